@@ -0,0 +1,530 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/mezzato/goconvert/imageconvert"
+	"github.com/mezzato/goconvert/logger"
+	"github.com/mezzato/goconvert/settings"
+	"github.com/mezzato/goconvert/webgui"
+)
+
+// command is a goconvert subcommand. run gets the arguments following the command name
+// and returns the exit code.
+type command struct {
+	name     string
+	usage    string // arguments, after the flags
+	short    string
+	settings bool // whether the command takes the settings flags
+	run      func(c *command, args []string) int
+}
+
+var commands []*command
+
+func init() {
+	// set here to break the initialization loop with runHelp
+	commands = []*command{
+		{"convert", "", "convert and archive the images of a folder, without uploading them", true, runConvert},
+		{"publish", "<collection folder>", "upload a converted collection folder to the FTP server", true, runPublish},
+		{"plan", "", "show what convert and publish would do, without changing anything", true, runPlan},
+		{"status", "", "show the collection of the source folder and the jobs of the web interface", true, runStatus},
+		{"config", "get <key> | set <key> <value> | show | sources | validate | schema | profiles | migrate <json|yaml|toml|ini> [file] | credentials set", "manage the configuration files and their profiles", true, runConfig},
+		{"collections", "list", "list the converted collections in the publish folder", true, runCollections},
+		{"serve", "", "start the web interface", true, runServe},
+		{"help", "[command]", "show the help of a command", false, runHelp},
+	}
+}
+
+func findCommand(name string) *command {
+	for _, c := range commands {
+		if c.name == name {
+			return c
+		}
+	}
+	return nil
+}
+
+// usage prints the list of commands, after the legacy flags.
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage:\n  goconvert <command> [flags] [arguments]\n  goconvert [flags]   (asks for the settings, converts and uploads)\n\nCommands:\n")
+	w := tabwriter.NewWriter(os.Stderr, 0, 8, 2, ' ', 0)
+	for _, c := range commands {
+		fmt.Fprintf(w, "  %s\t%s\n", c.name, c.short)
+	}
+	w.Flush()
+	fmt.Fprintf(os.Stderr, "\nUse \"goconvert help <command>\" for the flags of a command.\n\nFlags:\n")
+	flag.PrintDefaults()
+}
+
+// flagSet returns the flags of the command: -l and the settings flags if it takes them.
+func (c *command) flagSet() (fs *flag.FlagSet, logLevel *int) {
+	fs = flag.NewFlagSet("goconvert "+c.name, flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: goconvert %s [flags] %s\n\n%s.\n", c.name, c.usage, strings.ToUpper(c.short[:1])+c.short[1:])
+		fmt.Fprintf(os.Stderr, "\nFlags:\n")
+		fs.PrintDefaults()
+	}
+	logLevel = fs.Int("l", int(logger.DEBUG), "The log level")
+	if c.settings {
+		settings.RegisterFlags(fs)
+	}
+	return
+}
+
+// parse parses the command flags, which may follow the arguments, and sets up the logger.
+// The arguments after -- are never flags. ok is false if the command must exit with code.
+func (c *command) parse(fs *flag.FlagSet, logLevel *int, args []string) (positional []string, ok bool, code int) {
+	var rest []string
+	for i, a := range args {
+		if a == "--" {
+			args, rest = args[:i], args[i+1:]
+			break
+		}
+	}
+	for {
+		if err := fs.Parse(args); err != nil {
+			if err == flag.ErrHelp {
+				return nil, false, EXIT_SUCCESS
+			}
+			return nil, false, EXIT_FAILURE
+		}
+		if fs.NArg() == 0 {
+			break
+		}
+		positional = append(positional, fs.Arg(0))
+		args = fs.Args()[1:]
+	}
+	positional = append(positional, rest...)
+	lg = logger.NewConsoleSemanticLogger("goconvert", os.Stdout, logger.LogLevel(*logLevel))
+	return positional, true, EXIT_SUCCESS
+}
+
+// loadSettings reads the settings without asking anything and runs the checks.
+func loadSettings(fs *flag.FlagSet, checks ...func(*settings.Settings) error) (s *settings.Settings, err error) {
+	if s, err = settings.LoadSettings(settings.FlagValues(fs)); err != nil {
+		return
+	}
+	for _, check := range checks {
+		if err = check(s); err != nil {
+			return nil, err
+		}
+	}
+	s.Logger = lg
+	return
+}
+
+func runConvert(c *command, args []string) int {
+	fs, logLevel := c.flagSet()
+	args, ok, code := c.parse(fs, logLevel, args)
+	if !ok {
+		return code
+	}
+	s, err := loadSettings(fs, (*settings.Settings).CheckConversion, (*settings.Settings).Validate)
+	if err != nil {
+		lg.Error(err.Error())
+		return EXIT_FAILURE
+	}
+	return LaunchConversion(s, true)
+}
+
+func runPublish(c *command, args []string) int {
+	fs, logLevel := c.flagSet()
+	args, ok, code := c.parse(fs, logLevel, args)
+	if !ok {
+		return code
+	}
+	if len(args) != 1 {
+		fs.Usage()
+		return EXIT_FAILURE
+	}
+	s, err := loadSettings(fs, (*settings.Settings).CheckUpload)
+	if err != nil {
+		lg.Error(err.Error())
+		return EXIT_FAILURE
+	}
+	dir, err := collectionFolder(s, args[0])
+	if err != nil {
+		lg.Error(err.Error())
+		return EXIT_FAILURE
+	}
+	s.CollName = filepath.Base(dir)
+	return PublishCollection(s, dir)
+}
+
+// collectionFolder resolves the argument of publish: a folder path,
+// or the name of a collection in the publish folder.
+func collectionFolder(s *settings.Settings, arg string) (dir string, err error) {
+	dir = arg
+	if fi, e := os.Stat(dir); e != nil || !fi.IsDir() {
+		dir = filepath.Join(s.PublishDir, arg)
+		if fi, e = os.Stat(dir); e != nil || !fi.IsDir() {
+			return "", fmt.Errorf("The collection folder '%s' does not exist, neither in %s", arg, s.PublishDir)
+		}
+	}
+	return filepath.Abs(dir)
+}
+
+func runPlan(c *command, args []string) int {
+	fs, logLevel := c.flagSet()
+	args, ok, code := c.parse(fs, logLevel, args)
+	if !ok {
+		return code
+	}
+	s, err := loadSettings(fs, (*settings.Settings).CheckConversion, (*settings.Settings).Validate)
+	if err != nil {
+		lg.Error(err.Error())
+		return EXIT_FAILURE
+	}
+	// the remote changes are listed by a dry run of the upload
+	s.UploadSettings.DryRun = true
+	engine, err := imageconvert.New(s, engineOptions()...)
+	if err != nil {
+		lg.Error(err.Error())
+		return EXIT_FAILURE
+	}
+	plan, err := engine.Plan(context.Background())
+	if err != nil {
+		lg.Error(err.Error())
+		return EXIT_FAILURE
+	}
+	images := plan.Images
+	fmt.Printf("%d images to convert from %s:\n", len(images), s.SourceDir)
+	for _, img := range images {
+		fmt.Printf("  %s -> %s, %s, %s\n", img.Source, img.Renditions[settings.RENDITION_IMAGE],
+			img.Renditions[settings.RENDITION_THUMBNAIL], img.Renditions[settings.RENDITION_ORIGINAL])
+	}
+	if len(images) == 0 {
+		return EXIT_SUCCESS
+	}
+	fmt.Printf("Resized images folder:  %s\n", plan.PublishFolder)
+	fmt.Printf("Original images folder: %s\n", plan.ArchiveFolder)
+
+	if len(s.FtpSettings.Address) == 0 {
+		fmt.Println("No FTP address, the upload will be skipped.")
+		return EXIT_SUCCESS
+	}
+	fmt.Printf("Upload to %s in %s, policy %s\n", s.FtpSettings.Address, s.FtpSettings.RemoteDir, s.FtpSettings.Policy)
+	if _, err = os.Stat(plan.PublishFolder); err != nil {
+		fmt.Println("The collection folder does not exist yet, the remote changes will be listed once converted.")
+		return EXIT_SUCCESS
+	}
+	if err = s.CheckUpload(); err != nil {
+		lg.Error(err.Error())
+		return EXIT_FAILURE
+	}
+	if _, err = engine.Publish(context.Background(), plan.PublishFolder); err != nil {
+		lg.Error(err.Error())
+		return EXIT_FAILURE
+	}
+	return EXIT_SUCCESS
+}
+
+func runConfig(c *command, args []string) int {
+	fs, logLevel := c.flagSet()
+	args, ok, code := c.parse(fs, logLevel, args)
+	if !ok {
+		return code
+	}
+	if len(args) == 0 {
+		fs.Usage()
+		return EXIT_FAILURE
+	}
+
+	flagValues := settings.FlagValues(fs)
+	profile, sourceDir := settings.ConfigSelection(flagValues)
+
+	switch args[0] {
+	case "sources":
+		for _, src := range settings.ConfigSources(sourceDir) {
+			state := "missing"
+			if src.Exists {
+				state = "found"
+			}
+			fmt.Printf("%-8s %-8s %s\n", src.Name, state, src.Path)
+			for _, fn := range src.Ignored {
+				fmt.Printf("%-8s %-8s %s\n", src.Name, "ignored", fn)
+			}
+		}
+		fmt.Printf("Changes are written to %s\n", settings.ConfigFilePath())
+		return EXIT_SUCCESS
+	case "validate":
+		errs := settings.ValidateConfigFiles(sourceDir)
+		for _, e := range errs {
+			fmt.Fprintln(os.Stderr, e)
+		}
+		if len(errs) > 0 {
+			return EXIT_FAILURE
+		}
+		fmt.Println("The configuration files are valid")
+		return EXIT_SUCCESS
+	case "schema":
+		data, err := json.MarshalIndent(settings.JSONSchema(), "", "  ")
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return EXIT_FAILURE
+		}
+		fmt.Println(string(data))
+		return EXIT_SUCCESS
+	case "migrate":
+		if len(args) < 2 || len(args) > 3 {
+			fs.Usage()
+			return EXIT_FAILURE
+		}
+		fn := settings.ConfigFilePath()
+		if len(args) == 3 {
+			fn = args[2]
+		}
+		dst, err := settings.MigrateConfigFile(fn, args[1])
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return EXIT_FAILURE
+		}
+		fmt.Printf("%s written, the old file is kept as %s.bak\n", dst, fn)
+		if len(settings.ConfigFile) > 0 || len(os.Getenv(settings.ENV_CONFIG)) > 0 {
+			fmt.Printf("Use -config %s from now on\n", dst)
+		}
+		return EXIT_SUCCESS
+	case "profiles":
+		names, err := settings.ListProfiles(sourceDir)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return EXIT_FAILURE
+		}
+		for _, name := range names {
+			fmt.Println(name)
+		}
+		return EXIT_SUCCESS
+	}
+
+	switch {
+	case args[0] == "set" && len(args) == 3:
+		if configOption(args[1]) == nil {
+			return EXIT_FAILURE
+		}
+		if err := settings.SetConfigValue(profile, args[1], args[2]); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return EXIT_FAILURE
+		}
+		return EXIT_SUCCESS
+	case args[0] == "show" && len(args) == 1, args[0] == "get" && len(args) == 2, args[0] == "credentials" && len(args) == 2 && args[1] == "set":
+	default:
+		fs.Usage()
+		return EXIT_FAILURE
+	}
+
+	s, origins, err := settings.LoadSettingsWithOrigins(flagValues)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return EXIT_FAILURE
+	}
+	if args[0] == "credentials" {
+		// the password of the FTP address and username of the settings, in the keyfile
+		if err = s.StoreKeyfileCredential(); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return EXIT_FAILURE
+		}
+		fmt.Printf("The FTP password of %s@%s is saved in %s\n", s.FtpSettings.Username, s.FtpSettings.Address, s.CredentialSettings.Keyfile)
+		if !hasProvider(s, settings.PROVIDER_KEYFILE) {
+			fmt.Printf("Add %s to %s.%s to read it\n", settings.PROVIDER_KEYFILE, settings.SECTION_CREDENTIALS, settings.OPTION_CREDENTIALS_PROVIDERS)
+		}
+		return EXIT_SUCCESS
+	}
+	if args[0] == "get" {
+		o := configOption(args[1])
+		if o == nil {
+			return EXIT_FAILURE
+		}
+		fmt.Println(o.Param(s).String())
+		return EXIT_SUCCESS
+	}
+
+	// show: every effective value and where it comes from
+	if len(s.Profile) > 0 {
+		fmt.Printf("# profile %s\n", s.Profile)
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 1, ' ', 0)
+	for _, o := range settings.Options() {
+		if len(o.Section) > 0 {
+			fmt.Fprintf(w, "%s = %s\t# %s\n", o.Key(), o.Param(s).String(), origins[o.Key()])
+		}
+	}
+	w.Flush()
+	return EXIT_SUCCESS
+}
+
+func hasProvider(s *settings.Settings, name string) bool {
+	for _, p := range s.CredentialSettings.Providers {
+		if strings.TrimSpace(p) == name {
+			return true
+		}
+	}
+	return false
+}
+
+// configOption finds a saved option by key, printing the valid keys if there is none.
+func configOption(key string) *settings.Option {
+	o := settings.FindOption(key)
+	if o != nil && len(o.Section) > 0 {
+		return o
+	}
+	var keys []string
+	for _, o := range settings.Options() {
+		if len(o.Section) > 0 {
+			keys = append(keys, o.Key())
+		}
+	}
+	sort.Strings(keys)
+	fmt.Fprintf(os.Stderr, "Unknown configuration key %q, use one of:\n  %s\n", key, strings.Join(keys, "\n  "))
+	return nil
+}
+
+func runCollections(c *command, args []string) int {
+	fs, logLevel := c.flagSet()
+	args, ok, code := c.parse(fs, logLevel, args)
+	if !ok {
+		return code
+	}
+	if len(args) != 1 || args[0] != "list" {
+		fs.Usage()
+		return EXIT_FAILURE
+	}
+	s, err := loadSettings(fs)
+	if err != nil {
+		lg.Error(err.Error())
+		return EXIT_FAILURE
+	}
+	l, err := imageconvert.ListCollections(s.PublishDir, s.PiwigoGalleryHighDirName)
+	if err != nil {
+		lg.Error(err.Error())
+		return EXIT_FAILURE
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(w, "NAME\tIMAGES\tSIZE\tMODIFIED\n")
+	for _, coll := range l {
+		fmt.Fprintf(w, "%s\t%d\t%.1f MB\t%s\n", coll.Name, coll.Images, float64(coll.Size)/(1<<20), coll.Modified.Format("2006-01-02 15:04"))
+	}
+	w.Flush()
+	return EXIT_SUCCESS
+}
+
+func runStatus(c *command, args []string) int {
+	fs, logLevel := c.flagSet()
+	args, ok, code := c.parse(fs, logLevel, args)
+	if !ok {
+		return code
+	}
+	if len(args) != 0 {
+		fs.Usage()
+		return EXIT_FAILURE
+	}
+	s, err := loadSettings(fs)
+	if err != nil {
+		lg.Error(err.Error())
+		return EXIT_FAILURE
+	}
+	// the collection is only known with its name, the jobs are shown anyway
+	exitCode := EXIT_SUCCESS
+	if len(s.CollName) == 0 {
+		fmt.Println("No collection name, -c shows the collection converted from the source folder.")
+	} else if err = printCollectionStatus(s); err != nil {
+		lg.Error(err.Error())
+		exitCode = EXIT_FAILURE
+	}
+
+	jobs, err := webgui.SavedJobs(filepath.Join(settings.UserConfigDir(), webgui.JOBS_FILE_NAME))
+	if err != nil {
+		lg.Error(err.Error())
+		return EXIT_FAILURE
+	}
+	if len(jobs) == 0 {
+		fmt.Println("No jobs in the web interface.")
+		return exitCode
+	}
+	fmt.Println()
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(w, "JOB\tSTATE\tFOLDER\tCREATED\tENDED\tERROR\n")
+	for _, j := range jobs {
+		folder, ended := j.PublishFolder, ""
+		if len(folder) == 0 {
+			folder = j.Collection
+		}
+		if len(folder) == 0 && j.Settings != nil {
+			folder = j.Settings.SourceDir
+		}
+		if j.Ended != nil {
+			ended = j.Ended.Format("2006-01-02 15:04")
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", j.Id, j.State, folder, j.Created.Format("2006-01-02 15:04"), ended, j.Error)
+	}
+	w.Flush()
+	return exitCode
+}
+
+// printCollectionStatus prints the images left to convert from the source folder and the
+// collection converted from it so far.
+func printCollectionStatus(s *settings.Settings) error {
+	engine, err := imageconvert.New(s, imageconvert.WithLogger(lg))
+	if err != nil {
+		return err
+	}
+	plan, err := engine.Plan(context.Background())
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Source folder:     %s, %d images to convert\n", s.SourceDir, len(plan.Images))
+	fmt.Printf("Collection folder: %s\n", plan.PublishFolder)
+	name, err := filepath.Rel(s.PublishDir, plan.PublishFolder)
+	if err != nil {
+		return err
+	}
+	coll, err := imageconvert.ReadCollection(s.PublishDir, filepath.ToSlash(name), s.PiwigoGalleryHighDirName)
+	switch {
+	case err == imageconvert.ErrCollectionNotFound:
+		fmt.Println("Not converted yet.")
+	case err != nil:
+		return err
+	default:
+		fmt.Printf("Converted:         %d images, %.1f MB, modified %s\n", coll.Images, float64(coll.Size)/(1<<20), coll.Modified.Format("2006-01-02 15:04"))
+	}
+	return nil
+}
+
+func runServe(c *command, args []string) int {
+	fs, logLevel := c.flagSet()
+	args, ok, code := c.parse(fs, logLevel, args)
+	if !ok {
+		return code
+	}
+	s, err := loadSettings(fs)
+	if err == nil {
+		err = serveWebgui(s)
+	}
+	if err != nil {
+		lg.Error(fmt.Sprintf("The local web server could not be started: %v", err))
+		return EXIT_FAILURE
+	}
+	return EXIT_SUCCESS
+}
+
+func runHelp(c *command, args []string) int {
+	if len(args) == 0 {
+		usage()
+		return EXIT_SUCCESS
+	}
+	hc := findCommand(args[0])
+	if hc == nil || hc == c {
+		usage()
+		return EXIT_FAILURE
+	}
+	fs, _ := hc.flagSet()
+	fs.Usage()
+	return EXIT_SUCCESS
+}
@@ -3,11 +3,16 @@ module github.com/mezzato/goconvert
 go 1.23.3
 
 require (
+	github.com/BurntSushi/toml v1.6.0
 	github.com/dlintw/goconf v0.0.0-20120228082610-dcc070983490
 	github.com/mezzato/exif4go v0.0.0-20120304134106-495c41188073
 	github.com/mezzato/ftp4go v0.0.0-20151022100933-5f1b7135242c
 	github.com/revel/revel v1.1.0
+	golang.org/x/crypto v0.29.0
+	golang.org/x/image v0.24.0
 	golang.org/x/net v0.31.0
+	golang.org/x/term v0.26.0
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
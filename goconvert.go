@@ -1,18 +1,17 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"flag"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
-	"path/filepath"
+	"os/signal"
 	"strconv"
 	"strings"
-	"time"
 
-	ftp4go "github.com/mezzato/ftp4go"
 	"github.com/mezzato/goconvert/imageconvert"
 	"github.com/mezzato/goconvert/logger"
 	"github.com/mezzato/goconvert/settings"
@@ -25,24 +24,42 @@ func handler(w http.ResponseWriter, r *http.Request) {
 	fmt.Fprint(w, "Hi there!")
 }
 
-func ParseCommandLine() (usewebgui bool, sourcefolder string, collectionname string, logLevel logger.LogLevel) {
+// Exit codes of the command line conversion.
+const (
+	EXIT_SUCCESS = 0 // all images converted and uploaded
+	EXIT_FAILURE = 1 // wrong settings or no image converted
+	EXIT_PARTIAL = 2 // some images failed or the upload failed
+)
+
+func ParseCommandLine() (usewebgui bool, nonInteractive bool, flagValues map[string]string, logLevel logger.LogLevel) {
 
 	debug := flag.Bool("d", true, "debug mode")
 	webgui := flag.Bool("w", false, "whether to use a web browser instead of the command line")
-	srcfolder := flag.String("f", ".", "the image folder")
-	collname := flag.String("c", "collectionnamewithoutspaces", "the collection name")
+	noninteractive := flag.Bool("non-interactive", false, "never ask anything, read the settings from the flags, the environment and the configuration file")
 	LogLevelForRunFlag := flag.Int("l", int(logger.DEBUG), "The log level")
+	settings.RegisterFlags(flag.CommandLine)
 	flag.Parse()
 
 	settings.Debug = *debug
 
-	return *webgui, *srcfolder, *collname, logger.LogLevel(*LogLevelForRunFlag)
+	return *webgui, *noninteractive, settings.FlagValues(flag.CommandLine), logger.LogLevel(*LogLevelForRunFlag)
 }
 
-func GetSettings(srcfolder, collName string) (s *settings.Settings, err error) {
+func GetSettings(nonInteractive bool, flagValues map[string]string) (s *settings.Settings, err error) {
+
+	if nonInteractive {
+		settings.Interactive = false
+		if s, err = settings.LoadSettings(flagValues); err != nil {
+			return
+		}
+		printSettings(s)
+		return
+	}
 
-	if srcfolder == "." {
+	srcfolder, collName := flagValues["f"], flagValues["c"]
+	if len(srcfolder) == 0 {
 		lg.Info("No source folder specified, using the current: '.'")
+		srcfolder = "."
 	}
 
 	// check existence
@@ -52,18 +69,33 @@ func GetSettings(srcfolder, collName string) (s *settings.Settings, err error) {
 		//os.Exit(1)
 	}
 
-	if collName == "collectionnamewithoutspaces" {
+	if len(collName) == 0 {
 		lg.Info("No collection name was specified, this is required to store your images\n")
 		flag.Usage()
 		return nil, errors.New("No collection name was specified, this is required to store your images\n")
 		//os.Exit(1)
 	}
 
-	s, err = settings.AskForSettings(collName, srcfolder)
+	profile := os.Getenv(settings.ENV_PROFILE)
+	if v, ok := flagValues["profile"]; ok {
+		profile = v
+	}
+	s, err = settings.AskForSettings(collName, srcfolder, profile)
 	if err != nil {
 		log.Fatalf("A fatal error has occurred: %s", err)
 	}
 
+	// the flags win over the answers
+	if err = settings.ApplyValues(s, flagValues); err != nil {
+		return
+	}
+
+	printSettings(s)
+	return s, nil
+}
+
+func printSettings(s *settings.Settings) {
+
 	var pad int = 30
 	var padString string = strconv.Itoa(pad)
 
@@ -81,28 +113,43 @@ func GetSettings(srcfolder, collName string) (s *settings.Settings, err error) {
 	lg.Info(fmt.Sprintf(padS("Number of resize processes"), strconv.Itoa(s.ConversionSettings.NoSimultaneousResize)))
 	lg.Info(fmt.Sprintf(padS("ftp server"), s.FtpSettings.Address))
 	lg.Info(fmt.Sprintf(padS("ftp user"), s.FtpSettings.Username))
+	lg.Info(fmt.Sprintf(padS("ftp policy"), s.FtpSettings.Policy))
+	lg.Info(fmt.Sprintf(padS("Upload connections"), strconv.Itoa(s.UploadSettings.MaxConnections)))
+	lg.Info(fmt.Sprintf(padS("Upload bandwidth (KB/s)"), strconv.Itoa(s.UploadSettings.BandwidthKBps)))
 	lg.Info(fmt.Sprintf(strings.Repeat("-", pad*2) + "\n"))
-
-	return s, nil
-
 }
 
 func main() {
 
+	// subcommands, the flags alone run the whole flow
+	lg = logger.NewConsoleSemanticLogger("goconvert", os.Stdout, logger.DEBUG)
+	if len(os.Args) > 1 {
+		if c := findCommand(os.Args[1]); c != nil {
+			os.Exit(c.run(c, os.Args[2:]))
+		}
+		if !strings.HasPrefix(os.Args[1], "-") {
+			fmt.Fprintf(os.Stderr, "Unknown command %q\n\n", os.Args[1])
+			usage()
+			os.Exit(EXIT_FAILURE)
+		}
+	}
+
 	fmt.Print(`
 goconvert is a command line tool to convert, archive and upload images to an ftp server.
 
-Type -help for help with the command line arguments.
+Type -help for help with the command line arguments and the commands.
 Some examples:
 
 linux 	-> ./goconvert -f a/b/myImageFolder -c mycollectionname
 windows -> goconvert.exe -f "c:\myfolder with space\myimages" -c mycollectionname
+cron 	-> ./goconvert convert -f a/b/myImageFolder -c mycollectionname
 
 Have fun!
 
 `)
 
-	usewebgui, srcfolder, collectionname, logLevel := ParseCommandLine()
+	flag.Usage = usage
+	usewebgui, nonInteractive, flagValues, logLevel := ParseCommandLine()
 
 	// remove this once tested
 	// usewebgui = true
@@ -112,179 +159,132 @@ Have fun!
 	fmt.Println("Log level is:", logLevel)
 
 	if usewebgui {
-		browserCmd, server, err := webgui.StartWebgui()
+		s, err := settings.LoadSettings(flagValues)
+		if err == nil {
+			err = serveWebgui(s)
+		}
 		if err != nil {
 			fmt.Println("The local web server could not be started, using the console instead.")
 		} else {
-			if browserCmd != nil {
-				fmt.Println("Close the browser to shut down the process when you are finished.")
-				err = browserCmd.Wait()
-				<-server.Quit
-			} else {
-				fmt.Println("Open a browser manually and go the link specified. Press then Ctrl+C to shut down the process.")
-				<-server.Quit
-			}
 			return
 		}
 	}
 
-	s, err := GetSettings(srcfolder, collectionname)
-	s.Logger = lg
-
+	s, err := GetSettings(nonInteractive, flagValues)
+	if err == nil {
+		err = s.Validate()
+	}
 	if err != nil {
-		lg.Info(fmt.Sprintf("Error while collecting the settings:", err))
-		//return nil, os.NewError(fmt.Sprintf("The folder '%s' is not a valid directory.", srcfolder))
-		os.Exit(1)
+		lg.Error(fmt.Sprintf("Error while collecting the settings: %v", err))
+		os.Exit(EXIT_FAILURE)
 	}
-
-	// convert the images and collect the results
-	collPublishFolder := LaunchConversion(s)
-
-	//ftpAddress := "mezzsplace.dyndns.org" //, _ := askParameter("The name of the ftp server:[mezzsplace.dyndns.org]", "mezzsplace.dyndns.org")
-	//username := "enrico"                  //, _ := askParameter("The name of the user:[enrico]", "enrico")
-
-	// ftpAddress := "mezzsplace.dyndns.org" //, _ := askParameter("The name of the ftp server:[mezzsplace.dyndns.org]", "mezzsplace.dyndns.org")
-	// username := "enrico"                  //, _ := askParameter("The name of the user:[enrico]", "enrico")
-	// password, _ := askParameter(fmt.Sprintf("The password for username %s:", username), "")
+	s.Logger = lg
 
 	if len(s.FtpSettings.Address) == 0 {
 		lg.Info("The ftp address was not specified and the upload will be skipped.")
-		os.Exit(1)
 	}
 
-	ftpClient := ftp4go.NewFTP(0) // 1 for debugging
-	ftpClient.SetPassive(true)
-
-	/*
-		var (
-			resp *ftp4go.Response
-		)
-	*/
-
-	lg.Info(fmt.Sprintf("Connecting to host", s.FtpSettings.Address))
-	// connect
-	_, err = ftpClient.Connect(s.FtpSettings.Address, ftp4go.DefaultFtpPort, "")
-	if err != nil {
-		lg.Info(fmt.Sprintf("The FTP connection could not be established, error: %v", err))
-		os.Exit(1)
-	}
-
-	defer ftpClient.Quit()
+	// convert the images, then upload the collection
+	os.Exit(LaunchConversion(s, false))
+}
 
-	_, err = ftpClient.Login(s.FtpSettings.Username, s.FtpSettings.Password, "")
+// serveWebgui starts the web interface with the web settings of s and blocks until
+// the browser or the server is closed.
+func serveWebgui(s *settings.Settings) error {
+	browserCmd, server, err := webgui.StartWebgui(s)
 	if err != nil {
-		lg.Info(fmt.Sprintf("The FTP login was invalid, error: %v", err))
-		os.Exit(1)
+		return err
 	}
-
-	err = PublishCollToFtp(
-		ftpClient,
-		collPublishFolder,
-		"./piwigo/galleries",
-		EXCLUDED_DIRS)
-
-	if err != nil {
-		lg.Info(fmt.Sprintf("Error upload to FTP, error: %v", err))
-		return
+	if browserCmd != nil {
+		fmt.Println("Close the browser to shut down the process when you are finished.")
+		browserCmd.Wait()
 	} else {
-		lg.Info("Files successfully uploaded")
+		fmt.Println("Open a browser manually and go the link specified. Press then Ctrl+C to shut down the process.")
 	}
-
+	<-server.Quit
+	return nil
 }
 
-var EXCLUDED_DIRS []string = []string{"pwg_high"}
-
-func LaunchConversion(s *settings.Settings) (collPublishFolder string) {
-	startNanosecs := time.Now()
-	responseChannel, quitChannel, fileno, collPublishFolder, err := imageconvert.Convert(
-		s.CollName,
-		s.SourceDir,
-		s.PublishDir,
-		s.PiwigoGalleryHighDirName,
-		s.ConversionSettings)
-
+// LaunchConversion converts the images and uploads them unless noUpload is set,
+// logging the progress, and returns the exit code of the command.
+func LaunchConversion(s *settings.Settings, noUpload bool) (exitCode int) {
+	opts := engineOptions()
+	if noUpload {
+		opts = append(opts, imageconvert.WithoutUpload())
+	}
+	engine, err := imageconvert.New(s, opts...)
 	if err != nil {
-		panic(err)
+		lg.Error(fmt.Sprintf("The conversion could not be started: %v", err))
+		return EXIT_FAILURE
 	}
 
-	// collect responses
-	lg.Info(fmt.Sprintf("Collecting results"))
-
-	for i := 0; i < fileno; i++ {
-
-		r := <-responseChannel
-		fname := filepath.Base(r.ImgF.Path)
-		if r.Error == nil {
-			lg.Info(fmt.Sprintf("Success, file %s resized and archived\n", fname))
-		} else {
-			lg.Info(fmt.Sprintf("Error, file %s, the error was %s", fname, r.Error))
-		}
+	// Ctrl+C stops the conversion cleanly
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	r, err := engine.Run(ctx)
+	if r.Images == 0 {
+		lg.Error(fmt.Sprintf("The conversion could not be started: %v", err))
+		return EXIT_FAILURE
 	}
 
-	quitChannel <- true // stopping the server
-	lg.Info(fmt.Sprintf("The conversion took %.3f seconds", float32(time.Now().Sub(startNanosecs))/1e9))
-	lg.Info("Images successfully resized")
-
-	return collPublishFolder
-}
-
-func PublishCollToFtp(fc *ftp4go.FTP, localDir string, remoteRoorDir string, excludedDirs []string) (err error) {
-	lg.Info(fmt.Sprintf("Publishing to FTP root folder: %s, from local directory: %s.\nExcluded folders:%s", remoteRoorDir, localDir, excludedDirs))
-
-	collName := filepath.Base(localDir)
-	// careful!!!
-	if len(collName) > 0 {
-		/*
-			remoteDir := filepath.Join(remoteRoorDir, collName)
-			lg.Info("Removing old ftp folder tree if present at:", remoteDir)
-			err = fc.RemoveRemoteDirTree(remoteDir)
-		*/
-	} else {
-		return errors.New("The collection name can not be empty")
+	lg.Info(fmt.Sprintf("The conversion took %.3f seconds", r.Duration.Seconds()))
+
+	switch {
+	case r.Cancelled:
+		lg.Error("The conversion has been interrupted")
+		return EXIT_FAILURE
+	case r.Failed == r.Images:
+		lg.Error(fmt.Sprintf("All the %d images failed to convert", r.Images))
+		return EXIT_FAILURE
+	case r.Failed > 0:
+		lg.Error(fmt.Sprintf("%d of %d images failed to convert", r.Failed, r.Images))
+		exitCode = EXIT_PARTIAL
+	default:
+		lg.Info(fmt.Sprintf("%d images successfully converted", r.Images))
 	}
 
-	lg.Info(fmt.Sprintf("Uploading folder tree: %s", filepath.Base(localDir)))
-	maxSimultaneousConns := 4
-
-	stats, fileUploaded, quit := startStats()
-	// define the callback as an asychronous stats collector to pass information to the stats go routine
-	var collector = func(info *ftp4go.CallbackInfo) {
-		stats <- info // pipe in for stats
+	if err != nil {
+		lg.Error(err.Error())
+		return EXIT_PARTIAL
 	}
+	return
+}
 
-	var n int
-	n, err = fc.UploadDirTree(localDir, remoteRoorDir, maxSimultaneousConns, excludedDirs, collector)
-
-	// wait for all stats to finish
-	for k := 0; k < n; k++ {
-		<-fileUploaded
+// PublishCollection uploads the collection folder dir again, as the upload step of
+// LaunchConversion does, logging the progress, and returns the exit code of the command.
+func PublishCollection(s *settings.Settings, dir string) int {
+	engine, err := imageconvert.New(s, engineOptions()...)
+	if err != nil {
+		lg.Error(fmt.Sprintf("The upload could not be started: %v", err))
+		return EXIT_FAILURE
 	}
-	quit <- true
 
-	return
+	// Ctrl+C stops the upload cleanly
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	r, err := engine.Publish(ctx, dir)
+	switch {
+	case r.Cancelled:
+		lg.Error("The upload has been interrupted")
+		return EXIT_FAILURE
+	case err != nil:
+		lg.Error(fmt.Sprintf("Error uploading to FTP: %v", err))
+		return EXIT_FAILURE
+	}
+	return EXIT_SUCCESS
 }
 
-func startStats() (stats chan *ftp4go.CallbackInfo, fileUploaded chan bool, quit chan bool) {
-	stats = make(chan *ftp4go.CallbackInfo) // no buffer, this never blocks the go routine
-	quit = make(chan bool)
-	fileUploaded = make(chan bool, 50)
-
-	go func() {
-		for {
-			select {
-			case st := <-stats:
-				// do not wait here, the buffered request channel is the barrier
-				go func() {
-					if st.Eof {
-						lg.Info(fmt.Sprintf("Successfully uploaded file: %s\n", st.Resourcename))
-						fileUploaded <- true // done here
-					}
-				}()
-			case <-quit:
-				fmt.Println("Stopping collecting upload statistics")
-				return // get out
-			}
+// engineOptions are the options of the engines of the commands, which log the events
+// as they come in.
+func engineOptions() []imageconvert.Option {
+	return []imageconvert.Option{imageconvert.WithLogger(lg), imageconvert.WithEvents(func(ev imageconvert.Event) {
+		switch ev.Kind {
+		case imageconvert.EVENT_ERROR:
+			lg.Error(strings.TrimSpace(ev.Body))
+		case imageconvert.EVENT_UPLOAD:
+			lg.Debug(ev.Body)
+		default:
+			lg.Info(strings.TrimSpace(ev.Body))
 		}
-	}()
-	return
+	})}
 }
@@ -0,0 +1,374 @@
+package imageconvert
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"time"
+
+	"github.com/mezzato/goconvert/logger"
+	"github.com/mezzato/goconvert/settings"
+)
+
+// The kinds of the events of a conversion, the same as the Kind of the Messages
+// of the websocket.
+const (
+	EVENT_INFO   = "stdout"
+	EVENT_ERROR  = "stderr"
+	EVENT_UPLOAD = "upload"
+)
+
+// Event is the output of a running conversion.
+type Event struct {
+	Kind     string // one of the EVENT_ constants
+	Body     string
+	Progress *UploadProgress // set for EVENT_UPLOAD
+}
+
+// Option configures an Engine.
+type Option func(*Engine)
+
+// WithEvents sets the callback of the events of Run. It is called from a single
+// goroutine, the conversion waits for it to return.
+func WithEvents(f func(Event)) Option {
+	return func(e *Engine) { e.onEvent = f }
+}
+
+// WithoutUpload skips the FTP upload after the conversion.
+func WithoutUpload() Option {
+	return func(e *Engine) { e.noUpload = true }
+}
+
+// WithLogger sets the logger of the engine, by default the one of the settings.
+func WithLogger(l logger.SemanticLogger) Option {
+	return func(e *Engine) { e.logger = l }
+}
+
+// Engine converts, archives and uploads the images of a folder as the settings say.
+// It can be embedded in other programs, the command line and the web interface use it.
+type Engine struct {
+	id        string // of the Messages of the process
+	settings  *settings.Settings
+	noUpload  bool
+	onEvent   func(Event)
+	logger    logger.SemanticLogger
+	executors func(p *Process) func(*ConversionFileSystem) []*Executor
+}
+
+// New returns an engine for the settings, an error of type settings.ValidationErrors
+// if they are invalid.
+func New(s *settings.Settings, opts ...Option) (*Engine, error) {
+	if s == nil {
+		return nil, errors.New("The settings are missing.")
+	}
+	if err := s.Validate(); err != nil {
+		return nil, err
+	}
+	e := &Engine{
+		id:        "goconvert",
+		settings:  s,
+		logger:    s.Logger,
+		executors: func(p *Process) func(*ConversionFileSystem) []*Executor { return p.createExecutors },
+	}
+	for _, opt := range opts {
+		opt(e)
+	}
+	if e.logger == nil {
+		e.logger = logger.NewConsoleSemanticLogger("goconvert", os.Stdout, logger.INFO)
+	}
+	return e, nil
+}
+
+// Plan is what Run would do, without changing anything.
+type Plan struct {
+	Collection    string
+	PublishFolder string           // of the resized images
+	ArchiveFolder string           // of the original images
+	Images        []*ManifestEntry // the renditions of each source image
+}
+
+// Plan lists the images to convert and the files they would be converted to.
+func (e *Engine) Plan(ctx context.Context) (*Plan, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	cfs, err := extractConversionFileSystem(e.settings, e.logger)
+	if err != nil {
+		return nil, err
+	}
+	return &Plan{
+		Collection:    cfs.collName,
+		PublishFolder: cfs.CollectionPublishFolder,
+		ArchiveFolder: cfs.CollectionArchiveFolder,
+		Images:        cfs.Renditions(),
+	}, nil
+}
+
+// Report is the outcome of Run.
+type Report struct {
+	Collection    string
+	PublishFolder string
+	ArchiveFolder string
+	Images        int // the images found, 0 if the conversion did not start
+	Failed        int // the images which failed to convert
+	Uploaded      int // the files uploaded
+	Cancelled     bool
+	Duration      time.Duration
+}
+
+// Run converts the images, then writes the collection files and uploads the collection.
+// Cancelling ctx stops the conversion, Run then returns the error of ctx.
+// The images which failed to convert are counted in the report and are not an error.
+func (e *Engine) Run(ctx context.Context) (r Report, err error) {
+	if err = ctx.Err(); err != nil {
+		return
+	}
+	start := time.Now()
+	out := make(chan *Message)
+	done := make(chan struct{})
+	// the workers of a killed process may still send, out is never closed
+	go func() {
+		defer close(done)
+		for m := range out {
+			if m.Kind == "end" {
+				return
+			}
+			if e.onEvent != nil {
+				e.onEvent(Event{Kind: m.Kind, Body: m.Body, Progress: m.Progress})
+			}
+		}
+	}()
+	defer func() {
+		<-done
+		r.Duration = time.Since(start)
+	}()
+
+	p := newProcess(e.id, out, logger.DEBUG)
+	p.Logger = e.logger
+	p.noUpload = e.noUpload
+	cfs, err := p.tryStart("", e.settings, e.executors(p))
+	if err != nil {
+		p.end(err)
+		return
+	}
+	r.Collection, r.PublishFolder, r.ArchiveFolder = cfs.collName, cfs.CollectionPublishFolder, cfs.CollectionArchiveFolder
+	r.Images = cfs.ImageCount()
+
+	stop := context.AfterFunc(ctx, p.Kill)
+	err = p.Wait()
+	if !stop() {
+		// the process has been killed
+		r.Cancelled = true
+		if err == nil {
+			err = ctx.Err()
+		}
+	}
+	r.Failed, r.Uploaded = p.failed, p.uploaded
+	return
+}
+
+// emit sends an event to the callback of the engine, if any.
+func (e *Engine) emit(kind, body string) {
+	if e.onEvent != nil {
+		e.onEvent(Event{Kind: kind, Body: body})
+	}
+}
+
+// Publish uploads the collection folder dir again, as the upload step of Run does, or
+// only lists the remote changes in dry run mode.
+// Cancelling ctx stops the upload, Publish then returns the error of ctx.
+func (e *Engine) Publish(ctx context.Context, dir string) (r Report, err error) {
+	if err = ctx.Err(); err != nil {
+		return
+	}
+	start := time.Now()
+	r.Collection, r.PublishFolder = filepath.Base(dir), dir
+	r.ArchiveFolder = filepath.Join(dir, e.settings.PiwigoGalleryHighDirName)
+	defer func() { r.Duration = time.Since(start) }()
+	if e.noUpload {
+		return r, errors.New("The collection can not be published without upload.")
+	}
+
+	out := make(chan *Message)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for m := range out {
+			if e.onEvent != nil {
+				e.onEvent(Event{Kind: m.Kind, Body: m.Body, Progress: m.Progress})
+			}
+		}
+	}()
+	e.emit(EVENT_INFO, fmt.Sprintf("Uploading folder %s\n", r.Collection))
+	r.Uploaded, err = UploadCollection(e.id, e.settings, dir, out, ctx.Done())
+	close(out)
+	<-done
+	if ctx.Err() != nil {
+		r.Cancelled, err = true, ctx.Err()
+	} else if err == nil && (e.settings.UploadSettings == nil || !e.settings.UploadSettings.DryRun) {
+		e.emit(EVENT_INFO, fmt.Sprintf("%d files successfully uploaded\n", r.Uploaded))
+	}
+	return
+}
+
+// Regenerate resizes again the rendition, settings.RENDITION_IMAGE or RENDITION_THUMBNAIL,
+// of the images of the manifest of the collection folder dir from their originals, with
+// the conversion settings of the engine. The images which failed are counted in the report.
+// Cancelling ctx stops it, Regenerate then returns the error of ctx.
+func (e *Engine) Regenerate(ctx context.Context, dir, rendition string) (r Report, err error) {
+	if err = ctx.Err(); err != nil {
+		return
+	}
+	start := time.Now()
+	r.Collection, r.PublishFolder = filepath.Base(dir), dir
+	r.ArchiveFolder = filepath.Join(dir, e.settings.PiwigoGalleryHighDirName)
+	defer func() { r.Duration = time.Since(start) }()
+
+	var params *imgParams
+	for _, p := range resizeParams(e.settings.ConversionSettings) {
+		if p.rendition == rendition {
+			params = p
+		}
+	}
+	if params == nil {
+		return r, fmt.Errorf("The %q rendition can not be regenerated, only the %s and %s ones.", rendition, settings.RENDITION_IMAGE, settings.RENDITION_THUMBNAIL)
+	}
+	m, err := readManifest(r.ArchiveFolder)
+	if err != nil {
+		return r, fmt.Errorf("Invalid manifest in %s: %v", r.ArchiveFolder, err)
+	}
+	if len(m.Images) == 0 {
+		return r, fmt.Errorf("The collection %s has no manifest, the files of its renditions are unknown.", r.Collection)
+	}
+	if err = exec.Command("convert", "-version").Run(); err != nil {
+		return r, fmt.Errorf("Error running ImageMagick, check that it is correctly installed. Error: %s", err.Error())
+	}
+
+	r.Images = len(m.Images)
+	for _, entry := range m.Images {
+		if ctx.Err() != nil {
+			r.Cancelled = true
+			return r, ctx.Err()
+		}
+		if err := e.regenerate(ctx, dir, entry, params); err != nil {
+			r.Failed++
+			e.emit(EVENT_ERROR, fmt.Sprintf("regenerate %s for image %s failed to process due to error %v\n", rendition, entry.Source, err))
+			continue
+		}
+		e.emit(EVENT_INFO, fmt.Sprintf("regenerate %s for image %s correctly executed\n", rendition, entry.Source))
+	}
+	if ctx.Err() != nil {
+		r.Cancelled, err = true, ctx.Err()
+	}
+	return
+}
+
+// regenerate resizes the original of the manifest entry into its rendition of params.
+func (e *Engine) regenerate(ctx context.Context, dir string, entry *ManifestEntry, params *imgParams) error {
+	orig, target := entry.Renditions[settings.RENDITION_ORIGINAL], entry.Renditions[params.rendition]
+	if len(orig) == 0 || len(target) == 0 {
+		return errors.New("the manifest does not name its files")
+	}
+	src, dst := filepath.Join(dir, filepath.FromSlash(orig)), filepath.Join(dir, filepath.FromSlash(target))
+	if _, err := os.Stat(src); err != nil {
+		return fmt.Errorf("the original image is missing: %v", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(dst), 0777); err != nil {
+		return err
+	}
+	args := append(append([]string{src}, params.cmdArgs...), dst)
+	cmd := exec.CommandContext(ctx, "convert", args...)
+	cmd.Env = Environ()
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("%v %s", err, safeString(out))
+	}
+	return nil
+}
+
+// Job is a conversion running in the background.
+type Job struct {
+	cancel context.CancelFunc
+	done   chan struct{}
+	report Report
+	err    error
+}
+
+// Start runs the engine in the background, see Run.
+func (e *Engine) Start(ctx context.Context) *Job {
+	ctx, cancel := context.WithCancel(ctx)
+	j := &Job{cancel: cancel, done: make(chan struct{})}
+	go func() {
+		defer close(j.done)
+		defer cancel()
+		j.report, j.err = e.Run(ctx)
+	}()
+	return j
+}
+
+// Cancel stops the job and waits for it to end. It can be called on a nil job.
+func (j *Job) Cancel() {
+	if j == nil {
+		return
+	}
+	j.cancel()
+	<-j.done
+}
+
+// Done is closed when the job has ended.
+func (j *Job) Done() <-chan struct{} {
+	return j.done
+}
+
+// Wait waits for the job to end and returns the outcome of Run.
+func (j *Job) Wait() (Report, error) {
+	<-j.done
+	return j.report, j.err
+}
+
+// StartMessage starts the conversion of a "run" message of the websocket. The events are
+// sent to out as Messages with the id of m, followed by an "end" message with the error,
+// none if the job has been cancelled, and the invalid fields if the settings of m are invalid.
+func StartMessage(ctx context.Context, m *Message, out chan<- *Message) *Job {
+	var e *Engine
+	var err error
+	if m.Options == nil {
+		err = errors.New("The settings are missing.")
+	} else {
+		opts := []Option{WithEvents(func(ev Event) {
+			out <- &Message{Id: m.Id, Kind: ev.Kind, Body: ev.Body, Progress: ev.Progress}
+		})}
+		if m.Options.NoUpload {
+			opts = append(opts, WithoutUpload())
+		}
+		e, err = New(m.Options.Settings, opts...)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	j := &Job{cancel: cancel, done: make(chan struct{}), err: err}
+	go func() {
+		defer close(j.done)
+		defer cancel()
+		if e != nil {
+			e.id = m.Id
+			switch m.Options.Action {
+			case ACTION_CONVERT:
+				j.report, j.err = e.Run(ctx)
+			case ACTION_PUBLISH:
+				j.report, j.err = e.Publish(ctx, m.Options.Collection)
+			case ACTION_REGENERATE:
+				j.report, j.err = e.Regenerate(ctx, m.Options.Collection, m.Options.Rendition)
+			default:
+				j.err = fmt.Errorf("Unknown action %q", m.Options.Action)
+			}
+		}
+		if j.report.Cancelled {
+			out <- endMessage(m.Id, nil)
+		} else {
+			out <- endMessage(m.Id, j.err)
+		}
+	}()
+	return j
+}
@@ -0,0 +1,235 @@
+package imageconvert
+
+import (
+	"archive/zip"
+	"errors"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/mezzato/goconvert/settings"
+)
+
+// ErrCollectionNotFound is returned for a name which is not a collection of the publish folder.
+var ErrCollectionNotFound = errors.New("No such collection")
+
+// Collection is a converted collection folder in the publish folder.
+type Collection struct {
+	Name     string    `json:"name"`
+	Path     string    `json:"path"`
+	Images   int       `json:"images"` // resized images, the originals and thumbnails excluded
+	Size     int64     `json:"size"`   // bytes of the collection, the original images excluded
+	Modified time.Time `json:"modified"`
+
+	// the values of the collection template in the name, see Describe
+	Title  string     `json:"title,omitempty"`
+	First  *time.Time `json:"first,omitempty"`
+	Last   *time.Time `json:"last,omitempty"`
+	Count  int        `json:"count,omitempty"`
+	Camera string     `json:"camera,omitempty"`
+}
+
+// Describe sets the collection name, dates and camera the collection template of s has put
+// in the folder name. The folders the template has not named are left as they are.
+func (c *Collection) Describe(s *settings.Settings) {
+	info, ok := s.ParseCollectionFolder(c.Name)
+	if !ok {
+		return
+	}
+	c.Title, c.Count, c.Camera = info.Name, info.Count, info.Camera
+	if !info.First.IsZero() {
+		c.First = &info.First
+	}
+	if !info.Last.IsZero() {
+		c.Last = &info.Last
+	}
+}
+
+// ListCollections returns the collection folders in publishDir, sorted by name.
+// As the collection template may nest them, e.g. {year}/{collname}, a collection is
+// any folder holding images, named by its slash separated path in publishDir.
+// The highDirName subfolders holding the original images are not counted.
+func ListCollections(publishDir, highDirName string) (l []*Collection, err error) {
+	var walk func(dir, prefix string) error
+	walk = func(dir, prefix string) error {
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			return err
+		}
+		for _, e := range entries {
+			if !e.IsDir() || e.Name() == highDirName {
+				continue
+			}
+			p := filepath.Join(dir, e.Name())
+			c, err := readCollection(p, highDirName)
+			if err != nil {
+				return err
+			}
+			if c.Images > 0 {
+				c.Name = prefix + c.Name
+				l = append(l, c)
+				continue
+			}
+			if err = walk(p, prefix+e.Name()+"/"); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if err = walk(publishDir, ""); err != nil {
+		return nil, err
+	}
+	sort.Slice(l, func(i, j int) bool { return l[i].Name < l[j].Name })
+	return
+}
+
+// ReadCollection returns the collection of publishDir named as by ListCollections,
+// ErrCollectionNotFound if there is none. The folder, its symbolic links resolved, must be
+// strictly below publishDir: the name cannot be empty, "." or climb out of publishDir.
+func ReadCollection(publishDir, name, highDirName string) (*Collection, error) {
+	if len(name) == 0 || strings.Contains(name, `\`) || path.IsAbs(name) || path.Base(name) == highDirName {
+		return nil, ErrCollectionNotFound
+	}
+	for _, seg := range strings.Split(name, "/") {
+		if len(seg) == 0 || seg == "." || seg == ".." {
+			return nil, ErrCollectionNotFound
+		}
+	}
+	dir := filepath.Join(publishDir, filepath.FromSlash(name))
+	if !isBelow(publishDir, dir) {
+		return nil, ErrCollectionNotFound
+	}
+	c, err := readCollection(dir, highDirName)
+	if os.IsNotExist(err) || (err == nil && c.Images == 0) {
+		return nil, ErrCollectionNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	c.Name = name
+	return c, nil
+}
+
+// isBelow tells whether p, its symbolic links resolved, is a path strictly below root.
+func isBelow(root, p string) bool {
+	root, err := filepath.Abs(root)
+	if err != nil {
+		return false
+	}
+	if root, err = filepath.EvalSymlinks(root); err != nil {
+		return false
+	}
+	if p, err = filepath.EvalSymlinks(p); err != nil {
+		return false
+	}
+	if p, err = filepath.Abs(p); err != nil {
+		return false
+	}
+	rel, err := filepath.Rel(root, p)
+	return err == nil && rel != "." && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// Manifest returns the manifest of the renditions of the collection, an empty one if the
+// collection has been converted before the manifests.
+func (c *Collection) Manifest(highDirName string) (*Manifest, error) {
+	return readManifest(filepath.Join(c.Path, highDirName))
+}
+
+// DeleteCollection removes the collection folder, then its parent folders in publishDir
+// which are left empty, e.g. the year of a {year}/{collname} template.
+func DeleteCollection(publishDir string, c *Collection) error {
+	if err := os.RemoveAll(c.Path); err != nil {
+		return err
+	}
+	root := filepath.Clean(publishDir)
+	for dir := filepath.Dir(c.Path); dir != root && strings.HasPrefix(dir, root); dir = filepath.Dir(dir) {
+		// fails if the folder is not empty
+		if os.Remove(dir) != nil {
+			break
+		}
+	}
+	return nil
+}
+
+// WriteArchive writes the files of the collection to w as a zip archive, in a folder named
+// after the collection. The original images of the highDirName subfolder are only
+// included with originals.
+func WriteArchive(w io.Writer, c *Collection, highDirName string, originals bool) error {
+	var excluded []string
+	if !originals {
+		excluded = []string{highDirName}
+	}
+	files, _, err := collectUploadFiles(c.Path, excluded)
+	if err != nil {
+		return err
+	}
+	z := zip.NewWriter(w)
+	for _, f := range files {
+		if err = addToArchive(z, f.localPath, f.remotePath); err != nil {
+			return err
+		}
+	}
+	return z.Close()
+}
+
+func addToArchive(z *zip.Writer, fn, name string) error {
+	f, err := os.Open(fn)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	h, err := zip.FileInfoHeader(fi)
+	if err != nil {
+		return err
+	}
+	h.Name = name
+	// the images are compressed already
+	h.Method = zip.Store
+	if !isImageFile(fn) {
+		h.Method = zip.Deflate
+	}
+	zw, err := z.CreateHeader(h)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(zw, f)
+	return err
+}
+
+func readCollection(dir, highDirName string) (c *Collection, err error) {
+	fi, err := os.Stat(dir)
+	if err != nil {
+		return
+	}
+	files, _, err := collectUploadFiles(dir, []string{highDirName})
+	if err != nil {
+		return
+	}
+	c = &Collection{Name: fi.Name(), Path: dir, Modified: fi.ModTime()}
+	for _, f := range files {
+		// the thumbnails are in subfolders
+		if isImageFile(f.localPath) && filepath.Dir(f.localPath) == dir {
+			c.Images++
+		}
+		c.Size += f.size
+		if mt := modTime(f.localPath); mt.After(c.Modified) {
+			c.Modified = mt
+		}
+	}
+	return
+}
+
+func modTime(p string) (t time.Time) {
+	if fi, err := os.Stat(p); err == nil {
+		t = fi.ModTime()
+	}
+	return
+}
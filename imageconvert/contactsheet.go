@@ -0,0 +1,207 @@
+package imageconvert
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"os"
+	"path"
+	"path/filepath"
+
+	"github.com/mezzato/goconvert/settings"
+	"golang.org/x/image/draw"
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/basicfont"
+	"golang.org/x/image/math/fixed"
+)
+
+// CONTACT_SHEET_FOLDER is the subfolder of the collection folder of the contact sheets,
+// contactsheet-1.jpg, contactsheet-2.jpg... and contactsheet.pdf.
+const CONTACT_SHEET_FOLDER = "contactsheet"
+
+// sheetDPI is the resolution of the contact sheet pages.
+const sheetDPI = 150
+
+// sheetPages are the page formats in pixels at sheetDPI.
+var sheetPages = map[string]image.Point{
+	settings.PAGE_A4:               {1240, 1754},
+	settings.PAGE_A4_LANDSCAPE:     {1754, 1240},
+	settings.PAGE_LETTER:           {1275, 1650},
+	settings.PAGE_LETTER_LANDSCAPE: {1650, 1275},
+}
+
+// The layout of the contact sheets in pixels.
+const (
+	sheetMargin  = 60
+	sheetHeader  = 40 // the collection name and the page number
+	sheetPadding = 8
+	sheetLine    = 16 // the height of a caption line
+)
+
+// writeContactSheets composes the thumbnails of the images of the manifest into pages
+// with the file name and the date of each image, in the formats of the settings.
+// Only the thumbnail files are read, whatever produced them. It returns the files written.
+func writeContactSheets(cfs *ConversionFileSystem, sets *settings.Settings) (files []string, err error) {
+	size, ok := sheetPages[sets.ContactSheetPage]
+	if !ok {
+		return nil, fmt.Errorf("Unknown page format %s", sets.ContactSheetPage)
+	}
+	var entries []*ManifestEntry
+	for _, e := range cfs.manifest.Images {
+		if fi, err := os.Stat(filepath.Join(cfs.CollectionPublishFolder, filepath.FromSlash(e.Renditions[settings.RENDITION_THUMBNAIL]))); err == nil && !fi.IsDir() {
+			entries = append(entries, e)
+		}
+	}
+	perPage := sets.ContactSheetColumns * sets.ContactSheetRows
+	if perPage <= 0 || len(entries) == 0 {
+		return
+	}
+	count := (len(entries) + perPage - 1) / perPage
+
+	dir := filepath.Join(cfs.CollectionPublishFolder, CONTACT_SHEET_FOLDER)
+	if err = os.MkdirAll(dir, 0777); err != nil {
+		return
+	}
+	var pages [][]byte
+	for n := 1; n <= count; n++ {
+		l := entries[(n-1)*perPage:]
+		if len(l) > perPage {
+			l = l[:perPage]
+		}
+		sheet := composeSheet(cfs, l, size, sets.ContactSheetColumns, sets.ContactSheetRows, fmt.Sprintf("%s - %d/%d", cfs.collName, n, count))
+		var b bytes.Buffer
+		if err = jpeg.Encode(&b, sheet, &jpeg.Options{Quality: 90}); err != nil {
+			return
+		}
+		pages = append(pages, b.Bytes())
+	}
+
+	for _, format := range sets.ContactSheetFormats {
+		switch format {
+		case settings.SHEET_JPEG:
+			for i, page := range pages {
+				fn := filepath.Join(dir, fmt.Sprintf("contactsheet-%d.jpg", i+1))
+				if err = os.WriteFile(fn, page, 0666); err != nil {
+					return
+				}
+				files = append(files, fn)
+			}
+		case settings.SHEET_PDF:
+			fn := filepath.Join(dir, "contactsheet.pdf")
+			if err = writePDF(fn, pages, size); err != nil {
+				return
+			}
+			files = append(files, fn)
+		default:
+			return files, fmt.Errorf("Unknown contact sheet format %s", format)
+		}
+	}
+	return
+}
+
+// composeSheet draws a page of thumbnails on a grid with their captions.
+// The thumbnails which can not be decoded are left as grey boxes.
+func composeSheet(cfs *ConversionFileSystem, entries []*ManifestEntry, size image.Point, columns, rows int, title string) *image.RGBA {
+	sheet := image.NewRGBA(image.Rectangle{Max: size})
+	draw.Draw(sheet, sheet.Bounds(), image.White, image.Point{}, draw.Src)
+	grey := image.NewUniform(color.Gray{0xdd})
+
+	drawText(sheet, title, sheetMargin, sheetMargin+13, size.X-2*sheetMargin)
+
+	top := sheetMargin + sheetHeader
+	cellW := (size.X - 2*sheetMargin) / columns
+	cellH := (size.Y - top - sheetMargin) / rows
+	for i, e := range entries {
+		x := sheetMargin + (i%columns)*cellW
+		y := top + (i/columns)*cellH
+		box := image.Rect(x+sheetPadding, y+sheetPadding, x+cellW-sheetPadding, y+cellH-sheetPadding-2*sheetLine)
+
+		thumb, err := decodeImage(filepath.Join(cfs.CollectionPublishFolder, filepath.FromSlash(e.Renditions[settings.RENDITION_THUMBNAIL])))
+		if err != nil {
+			draw.Draw(sheet, box, grey, image.Point{}, draw.Src)
+		} else {
+			draw.CatmullRom.Scale(sheet, fitRect(thumb.Bounds().Size(), box), thumb, thumb.Bounds(), draw.Over, nil)
+		}
+
+		name := path.Base(e.Renditions[settings.RENDITION_IMAGE])
+		drawText(sheet, name, box.Min.X, box.Max.Y+sheetLine-3, box.Dx())
+		if !e.Date.IsZero() {
+			drawText(sheet, e.Date.Format("2006-01-02 15:04"), box.Min.X, box.Max.Y+2*sheetLine-3, box.Dx())
+		}
+	}
+	return sheet
+}
+
+func decodeImage(fn string) (image.Image, error) {
+	f, err := os.Open(fn)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	img, _, err := image.Decode(bufio.NewReader(f))
+	return img, err
+}
+
+// fitRect fits a rectangle of the proportions of size at the bottom of box, centred,
+// right above the caption.
+func fitRect(size image.Point, box image.Rectangle) image.Rectangle {
+	w, h := box.Dx(), box.Dy()
+	if size.X*h > size.Y*w {
+		h = size.Y * w / size.X
+	} else {
+		w = size.X * h / size.Y
+	}
+	min := box.Min.Add(image.Pt((box.Dx()-w)/2, box.Dy()-h))
+	return image.Rectangle{min, min.Add(image.Pt(w, h))}
+}
+
+// drawText writes s in black from the baseline at x, y, cut to width pixels.
+func drawText(dst draw.Image, s string, x, y, width int) {
+	d := &font.Drawer{Dst: dst, Src: image.Black, Face: basicfont.Face7x13, Dot: fixed.P(x, y)}
+	r := []rune(s)
+	if max := width / 7; len(r) > max && max > 3 {
+		r = append(r[:max-3], []rune("...")...)
+	}
+	d.DrawString(string(r))
+}
+
+// writePDF writes a PDF document of a JPEG image per page, the pages of size pixels
+// at sheetDPI.
+func writePDF(fn string, pages [][]byte, size image.Point) error {
+	var b bytes.Buffer
+	var offsets []int
+	obj := func(format string, a ...interface{}) {
+		offsets = append(offsets, b.Len())
+		fmt.Fprintf(&b, "%d 0 obj\n", len(offsets))
+		fmt.Fprintf(&b, format, a...)
+		b.WriteString("\nendobj\n")
+	}
+	w, h := float64(size.X)*72/sheetDPI, float64(size.Y)*72/sheetDPI
+
+	b.WriteString("%PDF-1.4\n")
+	obj("<< /Type /Catalog /Pages 2 0 R >>")
+	kids := ""
+	for i := range pages {
+		kids += fmt.Sprintf("%d 0 R ", 3+3*i)
+	}
+	obj("<< /Type /Pages /Kids [%s] /Count %d >>", kids, len(pages))
+	for i, page := range pages {
+		n := 3 + 3*i
+		obj("<< /Type /Page /Parent 2 0 R /MediaBox [0 0 %.2f %.2f] /Resources << /XObject << /Im0 %d 0 R >> >> /Contents %d 0 R >>", w, h, n+2, n+1)
+		content := fmt.Sprintf("q %.2f 0 0 %.2f 0 0 cm /Im0 Do Q", w, h)
+		obj("<< /Length %d >>\nstream\n%s\nendstream", len(content), content)
+		obj("<< /Type /XObject /Subtype /Image /Width %d /Height %d /ColorSpace /DeviceRGB /BitsPerComponent 8 /Filter /DCTDecode /Length %d >>\nstream\n%s\nendstream",
+			size.X, size.Y, len(page), page)
+	}
+
+	xref := b.Len()
+	fmt.Fprintf(&b, "xref\n0 %d\n0000000000 65535 f \n", len(offsets)+1)
+	for _, o := range offsets {
+		fmt.Fprintf(&b, "%010d 00000 n \n", o)
+	}
+	fmt.Fprintf(&b, "trailer\n<< /Size %d /Root 1 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(offsets)+1, xref)
+	return os.WriteFile(fn, b.Bytes(), 0666)
+}
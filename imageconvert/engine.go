@@ -12,6 +12,8 @@ import (
 	"strconv"
 	"strings"
 	"time"
+
+	"github.com/mezzato/goconvert/settings"
 )
 
 var ngoroutine = 4 * runtime.GOMAXPROCS(-1)
@@ -25,32 +27,48 @@ func (p *Process) createExecutors(c *ConversionFileSystem) (pipe []*Executor) {
 
 	convSettings := c.conversionSettings
 
+	ntasks := 2
+	pipe = make([]*Executor, ntasks)
+
+	pipe[0] = p.createResizeExecutor(c.CollectionPublishFolder, resizeParams(convSettings))
+	pipe[1] = p.createArchiveExecutor(c.CollectionPublishFolder, convSettings.MoveOriginal)
+
+	return
+
+}
+
+// resizeParams returns the ImageMagick arguments of the renditions resized from the originals.
+func resizeParams(convSettings *settings.ConversionSettings) []*imgParams {
 	smallPars := &imgParams{
 		[]string{"-resize", strconv.Itoa(convSettings.AreaInPixed()) + "@", "-font", "helvetica", "-fill", "black"},
-		"",
-		"",
+		settings.RENDITION_IMAGE,
 	}
 
 	thumbnailPars := &imgParams{
 		[]string{"-resize", "128x128", "-font", "helvetica"},
-		"thumbnail",
-		"TN-",
+		settings.RENDITION_THUMBNAIL,
 	}
 
-	convSets := []*imgParams{smallPars, thumbnailPars}
-
-	ntasks := 2
-	pipe = make([]*Executor, ntasks)
-
-	pipe[0] = p.createResizeExecutor(c.CollectionPublishFolder, convSets)
-	pipe[1] = p.createArchiveExecutor(c.CollectionArchiveFolder, convSettings.MoveOriginal)
-
-	return
-
+	return []*imgParams{smallPars, thumbnailPars}
 }
 
 func createWorker(timeoutMsec int, cmd *Executor, id string, outCh chan<- (*Message), killCh chan (struct{})) func(o chan *imgFile, i chan *imgFile) {
 	quit := killCh
+	// the sends give up once the process is killed, nobody receives any more
+	sendMessage := func(m *Message) bool {
+		select {
+		case outCh <- m:
+			return true
+		case <-killCh:
+			return false
+		}
+	}
+	send := func(out chan *imgFile, tr *imgFile) {
+		select {
+		case out <- tr:
+		case <-killCh:
+		}
+	}
 	return func(out chan *imgFile, in chan *imgFile) {
 		for {
 			select {
@@ -61,6 +79,12 @@ func createWorker(timeoutMsec int, cmd *Executor, id string, outCh chan<- (*Mess
 					break
 				}
 
+				// a failed image skips the next steps but is still passed on to be counted
+				if tr.failed {
+					send(out, tr)
+					break
+				}
+
 				//wp.activeRequests.Add(1)
 				err := executeWithTimeout(cmd, timeoutMsec, tr)
 
@@ -68,23 +92,23 @@ func createWorker(timeoutMsec int, cmd *Executor, id string, outCh chan<- (*Mess
 
 				if err != nil {
 					msg := fmt.Sprintf("%s for image %s failed to process due to error %v\n", cmd.StepName, fname, err)
-					outCh <- &Message{
-						Id: id, Kind: "stderr",
-						Body: msg,
+					if !sendMessage(&Message{Id: id, Kind: "stderr", Body: msg}) {
+						return
 					}
 					//wp.activeRequests.Done()
+					tr.failed = true
+					send(out, tr)
 					break // get out here
 				}
 
-				outCh <- &Message{
-					Id: id, Kind: "stdout",
-					Body: fmt.Sprintf("%s for image %s correctly executed\n", cmd.StepName, fname),
+				if !sendMessage(&Message{Id: id, Kind: "stdout", Body: fmt.Sprintf("%s for image %s correctly executed\n", cmd.StepName, fname)}) {
+					return
 				}
 
 				//fmt.Printf("worker %s processed without errors\n", cmd.Step)
 
 				//wp.activeRequests.Done()
-				out <- tr // pass on
+				send(out, tr) // pass on
 			case <-quit: // via broadcast
 				//fmt.Printf("worker %s quitting\n", cmd.Step)
 				quit = nil // HL
@@ -159,8 +183,8 @@ func (p *Process) createResizeExecutor(collPublishFolder string, convSets []*img
 				return errors.New("Command arguments must be specified")
 			}
 
-			newImgName := set.prefix + img.getNormalizedName(true)
-			subFolderPath := filepath.Join(collPublishFolder, set.subFolderRelPath)
+			newImgPath := filepath.Join(collPublishFolder, filepath.FromSlash(img.names[set.rendition]))
+			subFolderPath := filepath.Dir(newImgPath)
 			var fi os.FileInfo
 			if fi, err = os.Stat(subFolderPath); err != nil || !fi.IsDir() {
 				// create dirs
@@ -170,8 +194,6 @@ func (p *Process) createResizeExecutor(collPublishFolder string, convSets []*img
 				}
 			}
 
-			newImgPath := filepath.Join(subFolderPath, newImgName)
-
 			fullCmd := []string{"convert", img.Path}
 			fullCmd = append(fullCmd, set.cmdArgs...)
 			fullCmd = append(fullCmd, newImgPath)
@@ -189,18 +211,19 @@ func (p *Process) createResizeExecutor(collPublishFolder string, convSets []*img
 	return &Executor{StepName: "resize", Do: resizeHandler}
 }
 
-func (p *Process) createArchiveExecutor(collArchiveFolder string, moveOriginal bool) (executor *Executor) {
+func (p *Process) createArchiveExecutor(collPublishFolder string, moveOriginal bool) (executor *Executor) {
 	var archiveHandler = func(img *imgFile) (err error) {
+		movePath := filepath.Join(collPublishFolder, filepath.FromSlash(img.names[settings.RENDITION_ORIGINAL]))
+		collArchiveFolder := filepath.Dir(movePath)
 
 		var fi os.FileInfo
 		if fi, err = os.Stat(collArchiveFolder); err != nil || !fi.IsDir() {
 			// create dirs
-			p.Logger.Debug(fmt.Sprintf("Creating folder:", collArchiveFolder))
+			p.Logger.Debug(fmt.Sprintf("Creating folder:%s", collArchiveFolder))
 			if err = os.MkdirAll(collArchiveFolder, 0777); err != nil {
 				return err
 			}
 		}
-		movePath := filepath.Join(collArchiveFolder, img.getNormalizedName(false))
 
 		if moveOriginal {
 			p.Logger.Debug(fmt.Sprintf("Archiving original file to:%s", movePath))
@@ -37,27 +37,45 @@ var Environ func() []string = os.Environ
 // It is used for both sending output messages and receiving commands, as
 // distinguished by the Kind field.
 type Message struct {
-	Id      string // client-provided unique id for the process
-	Kind    string // in: "run", "kill" out: "stdout", "stderr", "end"
-	Body    string
-	Options *Options `json:",omitempty"`
+	Id       string // client-provided unique id for the process
+	Kind     string // in: "run", "kill" out: "stdout", "stderr", "upload", "end"
+	Body     string
+	Options  *Options                  `json:",omitempty"`
+	Progress *UploadProgress           `json:",omitempty"` // set for "upload" messages
+	Fields   settings.ValidationErrors `json:",omitempty"` // set for "end" messages when the settings are invalid
 }
 
+// The actions of a "run" message, the ones but ACTION_CONVERT work on a collection
+// already converted.
+const (
+	ACTION_CONVERT    = ""           // convert the source folder, see Engine.Run
+	ACTION_PUBLISH    = "publish"    // upload the collection again, see Engine.Publish
+	ACTION_REGENERATE = "regenerate" // resize a rendition again, see Engine.Regenerate
+)
+
 // Options specify additional message options.
 type Options struct {
-	Settings *settings.Settings `json:"settings"`
+	Settings   *settings.Settings `json:"settings"`
+	NoUpload   bool               `json:"noUpload,omitempty"`   // convert only, skip the FTP upload
+	Action     string             `json:"action,omitempty"`     // one of the ACTION_ constants
+	Collection string             `json:"collection,omitempty"` // the collection folder of the action
+	Rendition  string             `json:"rendition,omitempty"`  // of ACTION_REGENERATE
 }
 
 // process represents a running process.
 type Process struct {
-	id     string
-	out    chan<- *Message
-	done   chan struct{} // closed when wait completes
-	run    *exec.Cmd
-	killCh chan struct{}
-	waitCh chan error
-	Logger logger.SemanticLogger
-	once   sync.Once
+	id       string
+	settings *settings.Settings
+	noUpload bool
+	out      chan<- *Message
+	done     chan struct{} // closed when wait completes
+	run      *exec.Cmd
+	killCh   chan struct{}
+	waitCh   chan error
+	failed   int // number of images which failed to convert, set before waitCh is signalled
+	uploaded int // number of files uploaded, set before waitCh is signalled
+	Logger   logger.SemanticLogger
+	once     sync.Once
 }
 
 // startProcess builds and runs the given program, sending its output
@@ -75,17 +93,6 @@ func newProcess(id string, out chan<- *Message, logLevel logger.LogLevel) *Proce
 	return p
 }
 
-func CreateAndStartProcess(id, body string, out chan<- *Message, opt *Options) (p *Process, cfs *ConversionFileSystem, err error) {
-	p = newProcess(id, out, logger.DEBUG)
-
-	if cfs, err = p.tryStart(body, opt.Settings, p.createExecutors); err != nil {
-		p.end(err)
-		return
-	}
-	go p.Wait()
-	return
-}
-
 // start builds and starts the given program, sending its output to p.out,
 // and stores the running *exec.Cmd in the run field.
 func (p *Process) tryStart(body string, settings *settings.Settings, executorCreator func(*ConversionFileSystem) []*Executor) (cfs *ConversionFileSystem, err error) {
@@ -94,6 +101,7 @@ func (p *Process) tryStart(body string, settings *settings.Settings, executorCre
 	// (rather than the go tool process).
 	// This makes Kill work.
 
+	p.settings = settings
 	cfs, err = extractConversionFileSystem(settings, p.Logger)
 	if err != nil {
 		return
@@ -156,25 +164,122 @@ func (p *Process) tryStart(body string, settings *settings.Settings, executorCre
 	// start collecting in a go routine
 	go func() {
 		for _, f := range cfs.imgFiles {
-			inChan <- f
+			select {
+			case inChan <- f:
+			case <-p.killCh:
+				return
+			}
 		}
 	}()
 
-	// consume all images
+	// consume all images, finish the collection, then publish it
 	go func() {
+		var converted []*ManifestEntry
+	consume:
 		for j := 0; j < len(cfs.imgFiles); j++ {
 			select {
-			case <-outChan:
+			case f := <-outChan:
+				if f.failed {
+					p.failed++
+				} else {
+					converted = append(converted, f.manifestEntry())
+				}
 			case <-p.killCh:
-				break
+				break consume
 			}
 		}
-		p.waitCh <- nil
+		if err := p.finish(cfs, converted); err != nil {
+			p.waitCh <- err
+			return
+		}
+		p.waitCh <- p.upload(cfs)
 	}()
 
 	return cfs, nil
 }
 
+// finish records the images converted in the manifest, then writes the gallery, the
+// contact sheets and the index if the settings ask for them and the process has not been
+// killed, before the upload so that they are published with the collection.
+func (p *Process) finish(cfs *ConversionFileSystem, converted []*ManifestEntry) error {
+	if len(converted) == 0 {
+		return nil
+	}
+	cfs.manifest.Collection = cfs.collName
+	cfs.manifest.update(converted)
+	if err := cfs.manifest.write(cfs.CollectionArchiveFolder); err != nil {
+		return fmt.Errorf("The manifest of the collection could not be written: %v", err)
+	}
+
+	select {
+	case <-p.killCh:
+		return nil
+	default:
+	}
+	if p.settings.Gallery {
+		pages, err := writeGallery(cfs, p.settings)
+		if err != nil {
+			return fmt.Errorf("The gallery could not be written: %v", err)
+		}
+		p.out <- &Message{
+			Id: p.id, Kind: "stdout",
+			Body: fmt.Sprintf("Gallery of %d pages written to %s\n", len(pages), cfs.CollectionPublishFolder),
+		}
+	}
+	if p.settings.ContactSheet {
+		files, err := writeContactSheets(cfs, p.settings)
+		if err != nil {
+			return fmt.Errorf("The contact sheets could not be written: %v", err)
+		}
+		for _, fn := range files {
+			p.out <- &Message{Id: p.id, Kind: "stdout", Body: fmt.Sprintf("Contact sheet written to %s\n", fn)}
+		}
+	}
+	files, err := writeIndex(cfs, p.settings)
+	if err != nil {
+		return fmt.Errorf("The collection index could not be written: %v", err)
+	}
+	for _, fn := range files {
+		p.out <- &Message{Id: p.id, Kind: "stdout", Body: fmt.Sprintf("Index written to %s\n", fn)}
+	}
+	return nil
+}
+
+// upload is the last stage of the pipeline: it publishes the converted collection
+// to the FTP server if an address has been configured and the process has not been killed.
+func (p *Process) upload(cfs *ConversionFileSystem) error {
+	select {
+	case <-p.killCh:
+		return nil
+	default:
+	}
+
+	if p.noUpload || p.settings.FtpSettings == nil || len(p.settings.FtpSettings.Address) == 0 {
+		return nil
+	}
+
+	p.out <- &Message{
+		Id: p.id, Kind: "stdout",
+		Body: fmt.Sprintf("Uploading folder %s to %s\n", filepath.Base(cfs.CollectionPublishFolder), p.settings.FtpSettings.Address),
+	}
+	n, err := UploadCollection(p.id, p.settings, cfs.CollectionPublishFolder, p.out, p.killCh)
+	p.uploaded = n
+	if err != nil {
+		return fmt.Errorf("The collection could not be uploaded: %w", err)
+	}
+	p.out <- &Message{
+		Id: p.id, Kind: "stdout",
+		Body: fmt.Sprintf("%d files successfully uploaded\n", n),
+	}
+	return nil
+}
+
+// Failed returns the number of images which failed to convert.
+// It is only meaningful once Wait has returned.
+func (p *Process) Failed() int {
+	return p.failed
+}
+
 // wait waits for the running process to complete
 // and sends its error state to the client.
 func (p *Process) Wait() (err error) {
@@ -187,11 +292,16 @@ func (p *Process) Wait() (err error) {
 // end sends an "end" message to the client, containing the process id and the
 // given error value.
 func (p *Process) end(err error) {
-	m := &Message{Id: p.id, Kind: "end"}
+	p.out <- endMessage(p.id, err)
+}
+
+func endMessage(id string, err error) *Message {
+	m := &Message{Id: id, Kind: "end"}
 	if err != nil {
 		m.Body = err.Error()
+		m.Fields = settings.FieldErrors(err)
 	}
-	p.out <- m
+	return m
 }
 
 // Kill stops the process if it is running and waits for it to exit.
@@ -216,20 +326,24 @@ func (p *Process) cmd(dir string, args ...string) *exec.Cmd {
 	cmd := exec.Command(args[0], args[1:]...)
 	cmd.Dir = dir
 	cmd.Env = Environ()
-	cmd.Stdout = &messageWriter{p.id, "stdout", p.out}
-	cmd.Stderr = &messageWriter{p.id, "stderr", p.out}
+	cmd.Stdout = &messageWriter{p.id, "stdout", p.out, p.killCh}
+	cmd.Stderr = &messageWriter{p.id, "stderr", p.out, p.killCh}
 	return cmd
 }
 
 // messageWriter is an io.Writer that converts all writes to Message sends on
-// the out channel with the specified id and kind.
+// the out channel with the specified id and kind, until kill is closed.
 type messageWriter struct {
 	id, kind string
 	out      chan<- *Message
+	kill     <-chan struct{}
 }
 
 func (w *messageWriter) Write(b []byte) (n int, err error) {
-	w.out <- &Message{Id: w.id, Kind: w.kind, Body: safeString(b)}
+	select {
+	case w.out <- &Message{Id: w.id, Kind: w.kind, Body: safeString(b)}:
+	case <-w.kill:
+	}
 	return len(b), nil
 }
 
@@ -1,14 +1,27 @@
 package imageconvert
 
 import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	exif4go "github.com/mezzato/exif4go"
+	ftp4go "github.com/mezzato/ftp4go"
 	"github.com/mezzato/goconvert/logger"
 	"github.com/mezzato/goconvert/settings"
-	//"fmt"
+	"image/jpeg"
+	"net"
+	"net/textproto"
 	"os"
 	"path/filepath"
+	"regexp"
+	"runtime"
 	"sort"
-	//"strings"
+	"strings"
 	"testing"
+	"time"
 )
 
 func createTestExecutors(c *ConversionFileSystem) (pipe []*Executor) {
@@ -37,6 +50,8 @@ func TestEngine(t *testing.T) {
 	homeImgDir := "../test"
 
 	settings := settings.NewDefaultSettings("testcollection", homeImgDir)
+	settings.PublishDir = t.TempDir()
+	settings.IndexFormats = nil
 	opt.Settings = settings
 	outCh := make(chan *Message)
 	var p *Process
@@ -78,10 +93,6 @@ func TestEngine(t *testing.T) {
 }
 
 func TestConversion(t *testing.T) {
-	//id, body string, out chan<- *Message, opt *Options, executors []*Executor
-	var p *Process
-	var e error
-	var cfs *ConversionFileSystem
 	srcdir := "../test"
 
 	m, e := filepath.Glob(srcdir + "/*.jpg")
@@ -90,42 +101,38 @@ func TestConversion(t *testing.T) {
 
 	sets := settings.NewDefaultSettings("testcollection", srcdir)
 	sets.PublishDir = filepath.Join(os.TempDir(), "imageconverttest")
+	sets.IndexFormats = []string{settings.INDEX_JSON, settings.INDEX_CSV}
 
 	//os.RemoveAll(sets.PublishDir)
 
-	opt := &Options{Settings: sets}
-	outCh := make(chan *Message)
 	count := 0
-
-	go func() {
-		for m := range outCh {
-			t.Logf("messsage: kind %s, id: %s, message: %s", m.Kind, m.Id, m.Body)
-			if m.Kind != "end" {
-				count++
-			}
-
-		}
-	}()
-
-	t.Logf("process starting\n")
-	t.Logf("Testing to folder %s\n", sets.PublishDir)
-
-	p, cfs, e = CreateAndStartProcess("test", "body", outCh, opt)
-	t.Log("process started")
+	eng, e := New(sets, WithLogger(logger.NewConsoleSemanticLogger("test", os.Stdout, logger.ERROR)), WithEvents(func(ev Event) {
+		t.Logf("event: kind %s, message: %s", ev.Kind, ev.Body)
+		count++
+	}))
 	if e != nil {
-		t.Fatalf("error in process creation: %v", e)
+		t.Fatalf("error in engine creation: %v", e)
+	}
+	plan, e := eng.Plan(context.Background())
+	if e != nil {
+		t.Fatalf("error %q", e)
+	}
+	if len(plan.Images) != srccount || plan.Images[0].Renditions[settings.RENDITION_IMAGE] != "test_space.jpg" {
+		t.Fatalf("Unexpected plan %+v", plan)
 	}
 
-	t.Logf("Converting images into folder %s\n", cfs.CollectionPublishFolder)
-	defer os.RemoveAll(cfs.CollectionPublishFolder)
+	t.Logf("Converting images into folder %s\n", plan.PublishFolder)
+	defer os.RemoveAll(plan.PublishFolder)
 
-	e = p.Wait()
+	report, e := eng.Run(context.Background())
 	if e != nil {
 		t.Fatalf("error %q", e)
 	}
-
+	if report.Images != srccount || report.Failed != 0 || report.Cancelled || report.PublishFolder != plan.PublishFolder || count == 0 {
+		t.Fatalf("Unexpected report %+v after %d events", report, count)
+	}
 	// check that the _ is always present
-	m1, e := filepath.Glob(cfs.CollectionPublishFolder + "/*.jpg")
+	m1, e := filepath.Glob(report.PublishFolder + "/*.jpg")
 	//sort.Strings(m1)
 	destcount := len(m)
 
@@ -134,13 +141,607 @@ func TestConversion(t *testing.T) {
 	}
 
 	for _, n := range m {
-		cn := regexNormalize.ReplaceAllString(n, "_")
+		cn := regexp.MustCompile(`\s`).ReplaceAllString(n, "_")
 
 		if sort.SearchStrings(m1, cn) < 0 {
 			t.Fatalf("The output file name %s differs from the expected cleaned file name %s", n, cn)
 		}
 	}
 
-	//c.Wait()
+	data, e := os.ReadFile(filepath.Join(report.PublishFolder, "index.json"))
+	if e != nil {
+		t.Fatalf("error %q", e)
+	}
+	idx := new(Index)
+	if e = json.Unmarshal(data, idx); e != nil {
+		t.Fatalf("error %q", e)
+	}
+	if len(idx.Images) != srccount || idx.Collection != "testcollection" {
+		t.Fatalf("Unexpected index %+v", idx)
+	}
+	img := idx.Images[0]
+	if img.Source != "test space.jpg" || img.Camera != "Canon EOS 1000D" || img.Width == 0 || len(img.SHA1) != 40 || len(img.Renditions) != 3 {
+		t.Fatalf("Unexpected index image %+v", img)
+	}
+	if r := img.Renditions[1]; r.Path != "thumbnail/TN-test_space.jpg" || r.Size == 0 {
+		t.Fatalf("Unexpected thumbnail %+v", r)
+	}
+	if r := img.Renditions[2]; r.Rendition != settings.RENDITION_ORIGINAL || r.SHA1 != img.SHA1 {
+		t.Fatalf("Unexpected original %+v", r)
+	}
+	f, e := os.Open(filepath.Join(report.PublishFolder, "index.csv"))
+	if e != nil {
+		t.Fatalf("error %q", e)
+	}
+	defer f.Close()
+	if lines, e := csv.NewReader(f).ReadAll(); e != nil || len(lines) != srccount+1 || lines[1][9] != "test_space.jpg" {
+		t.Fatalf("Unexpected CSV index %v, %v", lines, e)
+	}
+}
+
+// stubConvert puts first in PATH a convert command which copies its input to its output,
+// for the tests which do not need ImageMagick to resize.
+func stubConvert(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the convert stub is a shell script")
+	}
+	dir := t.TempDir()
+	script := "#!/bin/sh\n[ \"$1\" = -version ] && exit 0\nfor a; do out=$a; done\nexec cp \"$1\" \"$out\"\n"
+	if err := os.WriteFile(filepath.Join(dir, "convert"), []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+}
+
+func TestMoveOriginal(t *testing.T) {
+	stubConvert(t)
+	srcdir := t.TempDir()
+	m, _ := filepath.Glob("../test/*.jpg")
+	for _, fn := range m {
+		data, err := os.ReadFile(fn)
+		if err == nil {
+			err = os.WriteFile(filepath.Join(srcdir, filepath.Base(fn)), data, 0666)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	sum, err := hashFile(filepath.Join(srcdir, "test space.jpg"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sets := settings.NewDefaultSettings("testcollection", srcdir)
+	sets.PublishDir = t.TempDir()
+	sets.ConversionSettings.MoveOriginal = true
+	sets.IndexFormats = []string{settings.INDEX_JSON}
+	eng, err := New(sets, WithLogger(logger.NewConsoleSemanticLogger("test", os.Stdout, logger.ERROR)), WithoutUpload())
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := eng.Run(context.Background())
+	if err != nil || r.Images != len(m) || r.Failed != 0 {
+		t.Fatalf("Unexpected report %+v, %v", r, err)
+	}
+	if left, _ := filepath.Glob(filepath.Join(srcdir, "*.jpg")); len(left) != 0 {
+		t.Fatalf("The originals %v have not been moved", left)
+	}
+
+	data, err := os.ReadFile(filepath.Join(r.PublishFolder, "index.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	idx := new(Index)
+	if err = json.Unmarshal(data, idx); err != nil {
+		t.Fatal(err)
+	}
+	img := idx.Images[0]
+	if len(idx.Images) != len(m) || img.Source != "test space.jpg" || img.SHA1 != sum || img.Width == 0 {
+		t.Fatalf("Unexpected index image %+v", img)
+	}
+	if o := img.Renditions[len(img.Renditions)-1]; o.Rendition != settings.RENDITION_ORIGINAL || o.SHA1 != sum {
+		t.Fatalf("Unexpected original %+v", o)
+	}
+}
+
+func TestCollectUploadFiles(t *testing.T) {
+	dir := filepath.Join(os.TempDir(), "imageconvertupload", "20120101_20120102_coll")
+	defer os.RemoveAll(filepath.Dir(dir))
+
+	for _, f := range []string{"a.jpg", "thumbnail/TN-a.jpg", "pwg_high/a.jpg"} {
+		fp := filepath.Join(dir, filepath.FromSlash(f))
+		os.MkdirAll(filepath.Dir(fp), 0777)
+		if e := os.WriteFile(fp, []byte("data"), 0666); e != nil {
+			t.Fatalf("error %q", e)
+		}
+	}
+
+	files, dirs, e := collectUploadFiles(dir, []string{"PWG_HIGH"})
+	if e != nil {
+		t.Fatalf("error %q", e)
+	}
+	if len(files) != 2 || len(dirs) != 2 {
+		t.Fatalf("Expected 2 files and 2 folders, got %d files and %d folders", len(files), len(dirs))
+	}
+	if dirs[0] != "20120101_20120102_coll" || files[1].remotePath != "20120101_20120102_coll/thumbnail/TN-a.jpg" {
+		t.Fatalf("Unexpected remote paths %v, %s", dirs, files[1].remotePath)
+	}
+
+	// a collection nested by the collection template
+	nested := filepath.Join(filepath.Dir(dir), "2012", "03", "coll2", "b.jpg")
+	os.MkdirAll(filepath.Dir(nested), 0777)
+	if e := os.WriteFile(nested, []byte("data"), 0666); e != nil {
+		t.Fatalf("error %q", e)
+	}
+
+	colls, e := ListCollections(filepath.Dir(dir), "pwg_high")
+	if e != nil {
+		t.Fatalf("error %q", e)
+	}
+	if len(colls) != 2 || colls[1].Name != "20120101_20120102_coll" || colls[1].Images != 1 || colls[1].Size != 8 {
+		t.Fatalf("Unexpected collections %+v", colls)
+	}
+	if colls[0].Name != "2012/03/coll2" || colls[0].Images != 1 {
+		t.Fatalf("Unexpected nested collection %+v", colls[0])
+	}
+}
+
+func TestCollectionArchive(t *testing.T) {
+	publish := t.TempDir()
+	dir := filepath.Join(publish, "2012", "20120101_20120102_coll")
+	for _, f := range []string{"a.jpg", "thumbnail/TN-a.jpg", "pwg_high/a.jpg"} {
+		fp := filepath.Join(dir, filepath.FromSlash(f))
+		os.MkdirAll(filepath.Dir(fp), 0777)
+		if e := os.WriteFile(fp, []byte("data"), 0666); e != nil {
+			t.Fatalf("error %q", e)
+		}
+	}
+	// images in publishDir itself or linked from outside of it are not a collection
+	outside := t.TempDir()
+	for _, fp := range []string{filepath.Join(publish, "loose.jpg"), filepath.Join(outside, "a.jpg")} {
+		if e := os.WriteFile(fp, []byte("data"), 0666); e != nil {
+			t.Fatalf("error %q", e)
+		}
+	}
+	if e := os.Symlink(outside, filepath.Join(publish, "linked")); e != nil {
+		t.Fatalf("error %q", e)
+	}
+	for _, name := range []string{"", ".", "./2012/20120101_20120102_coll", "2012//20120101_20120102_coll", "2012/20120101_20120102_coll/.",
+		"2012", "2012/../2012/20120101_20120102_coll", "../x", "2012/20120101_20120102_coll/pwg_high", "linked", publish} {
+		if _, e := ReadCollection(publish, name, "pwg_high"); e != ErrCollectionNotFound {
+			t.Errorf("%s: expected no collection, got %v", name, e)
+		}
+	}
+	c, e := ReadCollection(publish, "2012/20120101_20120102_coll", "pwg_high")
+	if e != nil {
+		t.Fatalf("error %q", e)
+	}
+
+	for originals, count := range map[bool]int{false: 2, true: 3} {
+		var buf bytes.Buffer
+		if e = WriteArchive(&buf, c, "pwg_high", originals); e != nil {
+			t.Fatalf("error %q", e)
+		}
+		z, e := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+		if e != nil {
+			t.Fatalf("error %q", e)
+		}
+		if len(z.File) != count || z.File[0].Name != "20120101_20120102_coll/a.jpg" {
+			t.Fatalf("Unexpected archive %v", z.File)
+		}
+	}
+
+	// nothing to regenerate without manifest
+	s := settings.NewDefaultSettings("coll", dir)
+	engine, e := New(s)
+	if e != nil {
+		t.Fatalf("error %q", e)
+	}
+	if _, e = engine.Regenerate(context.Background(), dir, settings.RENDITION_THUMBNAIL); e == nil || !strings.Contains(e.Error(), "no manifest") {
+		t.Fatalf("Expected a missing manifest error, got %v", e)
+	}
+	if _, e = engine.Regenerate(context.Background(), dir, settings.RENDITION_ORIGINAL); e == nil {
+		t.Fatalf("The originals can not be regenerated")
+	}
+
+	// the originals are uploaded when the gallery links them, the manifest never
+	os.WriteFile(filepath.Join(dir, "pwg_high", MANIFEST_FILE_NAME), []byte("{}"), 0666)
+	for downloads, count := range map[bool]int{false: 2, true: 3} {
+		s.Gallery, s.GalleryDownloads = true, downloads
+		files, _, _, e := collectionUploadFiles(s, dir)
+		if e != nil {
+			t.Fatalf("error %q", e)
+		}
+		if len(files) != count {
+			t.Fatalf("Expected %d files to upload, got %d", count, len(files))
+		}
+	}
+
+	if e = DeleteCollection(publish, c); e != nil {
+		t.Fatalf("error %q", e)
+	}
+	if _, e = os.Stat(filepath.Join(publish, "2012")); !os.IsNotExist(e) {
+		t.Fatalf("The empty parent folder should be removed, got %v", e)
+	}
+}
+
+func TestBandwidthLimiter(t *testing.T) {
+	sets := &settings.UploadSettings{BandwidthKBps: 100}
+	l := newBandwidthLimiter(sets)
+
+	start := time.Now()
+	l.wait(25*1024, nil, nil)
+	l.wait(25*1024, nil, nil)
+	if d := time.Since(start); d < 400*time.Millisecond {
+		t.Fatalf("50KB at 100KB/s took %v, expected about 500ms", d)
+	}
+
+	// lift the cap for the whole day
+	sets.UnlimitedFrom, sets.UnlimitedTo = "00:00", "00:00"
+	if !sets.IsUnlimitedAt(time.Date(2012, 1, 1, 21, 0, 0, 0, time.Local)) {
+		t.Fatalf("The bandwidth cap should be lifted")
+	}
+	sets.UnlimitedFrom, sets.UnlimitedTo = "20:00", "07:00"
+	if sets.IsUnlimitedAt(time.Date(2012, 1, 1, 12, 0, 0, 0, time.Local)) || !sets.IsUnlimitedAt(time.Date(2012, 1, 1, 6, 0, 0, 0, time.Local)) {
+		t.Fatalf("Wrong schedule for the window from %s to %s", sets.UnlimitedFrom, sets.UnlimitedTo)
+	}
+}
+
+func TestRemoteGuard(t *testing.T) {
+	if _, e := newRemoteGuard(".."); e == nil {
+		t.Fatalf("The collection folder .. must be rejected")
+	}
+	g, e := newRemoteGuard("20120101_20120102_coll")
+	if e != nil {
+		t.Fatalf("error %q", e)
+	}
+	for _, p := range []string{"20120101_20120102_coll", "20120101_20120102_coll/thumbnail/TN-a.jpg", "20120101_20120102_coll.uploading/a.jpg"} {
+		if e = g.check(p); e != nil {
+			t.Fatalf("error %q", e)
+		}
+	}
+	for _, p := range []string{"", ".", "other/a.jpg", "20120101_20120102_coll/../other", "/20120101_20120102_coll", "20120101_20120102_collection"} {
+		if e = g.check(p); e == nil {
+			t.Fatalf("The remote path %q must be rejected", p)
+		}
+	}
+
+	name, isDir, ok := parseListLine("drwxr-xr-x   2 owner group     4096 Jan 01 12:00 my folder")
+	if !ok || !isDir || name != "my folder" {
+		t.Fatalf("Wrong LIST parsing: %q, %v, %v", name, isDir, ok)
+	}
+	if !inExcludedDir("/pwg_high/a.jpg", []string{"PWG_HIGH"}) || inExcludedDir("/thumbnail/pwg_high", []string{"pwg_high"}) {
+		t.Fatalf("Wrong excluded folder detection")
+	}
+}
+
+// fakeFtp serves the LIST answers of listings, by path, on a local port. An answer
+// starting with a reply code is sent as an error.
+func fakeFtp(t *testing.T, listings map[string]string) int {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("error %q", err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		conn := textproto.NewConn(c)
+		conn.PrintfLine("220 ready")
+		var data net.Listener
+		for {
+			line, err := conn.ReadLine()
+			if err != nil {
+				return
+			}
+			cmd, arg, _ := strings.Cut(line, " ")
+			switch cmd {
+			case "PASV":
+				data, _ = net.Listen("tcp", "127.0.0.1:0")
+				port := data.Addr().(*net.TCPAddr).Port
+				conn.PrintfLine("227 Entering Passive Mode (127,0,0,1,%d,%d)", port>>8, port&0xff)
+			case "LIST":
+				answer, ok := listings[arg]
+				if !ok {
+					answer = "550 No such file or directory"
+				}
+				dc, _ := data.Accept()
+				data.Close()
+				if len(answer) > 3 && answer[0] >= '1' && answer[0] <= '5' && answer[3] == ' ' {
+					dc.Close()
+					conn.PrintfLine("%s", answer)
+					continue
+				}
+				conn.PrintfLine("150 listing")
+				dc.Write([]byte(answer))
+				dc.Close()
+				conn.PrintfLine("226 done")
+			default:
+				conn.PrintfLine("200 ok")
+			}
+		}
+	}()
+	return l.Addr().(*net.TCPAddr).Port
+}
+
+func TestListRemoteTree(t *testing.T) {
+	dir := func(name string) string { return "drwxr-xr-x 2 o g 4096 Jan 01 12:00 " + name + "\r\n" }
+	file := func(name string) string { return "-rw-r--r-- 1 o g 10 Jan 01 12:00 " + name + "\r\n" }
+	for _, c := range []struct {
+		name     string
+		listings map[string]string
+		exists   bool
+		files    int
+		err      bool
+	}{
+		{"missing", map[string]string{"": dir("other")}, false, 0, false},
+		{"tree", map[string]string{"": dir("coll"), "coll": file("a.jpg") + dir("thumbnail"), "coll/thumbnail": file("TN-a.jpg")}, true, 2, false},
+		{"root refused", map[string]string{"": "530 Not logged in"}, false, 0, true},
+		{"folder refused", map[string]string{"": dir("coll"), "coll": "550 Permission denied"}, false, 0, true},
+		{"subfolder refused", map[string]string{"": dir("coll"), "coll": dir("thumbnail"), "coll/thumbnail": "450 Busy"}, false, 0, true},
+	} {
+		fc := ftp4go.NewFTP(0)
+		fc.Port = fakeFtp(t, c.listings)
+		if _, e := fc.Connect("127.0.0.1", fc.Port, ""); e != nil {
+			t.Fatalf("error %q", e)
+		}
+		files, _, exists, e := listRemoteTree(fc, "coll")
+		if (e != nil) != c.err || exists != c.exists || len(files) != c.files {
+			t.Errorf("%s: unexpected files %v, exists %v, error %v", c.name, files, exists, e)
+		}
+		fc.Quit()
+	}
+}
+
+func TestInvalidSettings(t *testing.T) {
+	sets := settings.NewDefaultSettings("", t.TempDir())
+	sets.ConversionSettings.Width = 0
+	if _, e := New(sets); e == nil {
+		t.Fatalf("Invalid settings should not create an engine")
+	}
+	outCh := make(chan *Message, 1)
+	j := StartMessage(context.Background(), &Message{Id: "test", Kind: "run", Options: &Options{Settings: sets}}, outCh)
+	if _, e := j.Wait(); e == nil {
+		t.Fatalf("Invalid settings should not start a conversion")
+	}
+	m := <-outCh
+	if m.Kind != "end" || len(m.Fields) != 2 || m.Fields[0].Field != "collName" || m.Fields[1].Field != "conversionSettings.width" {
+		t.Fatalf("Expected an end message with the invalid fields, got %+v", m)
+	}
+}
+
+func TestCancel(t *testing.T) {
+	sets := settings.NewDefaultSettings("testcollection", "../test")
+	sets.PublishDir = t.TempDir()
+	ctx, cancel := context.WithCancel(context.Background())
+	eng, e := New(sets, WithLogger(logger.NewConsoleSemanticLogger("test", os.Stdout, logger.ERROR)), WithEvents(func(ev Event) {
+		cancel() // after the first image
+	}))
+	if e != nil {
+		t.Fatalf("error %q", e)
+	}
+	report, e := eng.Start(ctx).Wait()
+	if e != context.Canceled || !report.Cancelled {
+		t.Fatalf("Expected a cancelled conversion, got %+v, %v", report, e)
+	}
+	if _, e = os.Stat(filepath.Join(report.PublishFolder, "index.json")); e == nil {
+		t.Fatalf("A cancelled conversion should not write the index")
+	}
+}
+
+func TestRenditionNames(t *testing.T) {
+	src := t.TempDir()
+	data, e := os.ReadFile("../test/test_6365.jpg")
+	if e != nil {
+		t.Fatalf("error %q", e)
+	}
+	for _, n := range []string{"b.jpg", "c.jpg", "café 1.jpg"} {
+		if e = os.WriteFile(filepath.Join(src, n), data, 0666); e != nil {
+			t.Fatalf("error %q", e)
+		}
+	}
+
+	sets := settings.NewDefaultSettings("coll", src)
+	sets.PublishDir = t.TempDir()
+	sets.ConversionSettings.ImageName = "{collname}"
+	sets.ConversionSettings.Transliterate = true
+	cfs, e := PlanConversion(sets, logger.NewConsoleSemanticLogger("test", os.Stdout, logger.ERROR))
+	if e != nil {
+		t.Fatalf("error %q", e)
+	}
+
+	// another image of the collection is already named coll.jpg
+	m := &Manifest{Images: []*ManifestEntry{{Source: "old.jpg", Renditions: map[string]string{settings.RENDITION_IMAGE: "coll.jpg"}}}}
+	if e = m.write(cfs.CollectionArchiveFolder); e != nil {
+		t.Fatalf("error %q", e)
+	}
+	if cfs, e = PlanConversion(sets, logger.NewConsoleSemanticLogger("test", os.Stdout, logger.ERROR)); e != nil {
+		t.Fatalf("error %q", e)
+	}
+	want := []map[string]string{
+		{"image": "coll-2.jpg", "thumbnail": "thumbnail/TN-coll-2.jpg", "original": "pwg_high/b.jpg"},
+		{"image": "coll-3.jpg", "thumbnail": "thumbnail/TN-coll-3.jpg", "original": "pwg_high/c.jpg"},
+		{"image": "coll-4.jpg", "thumbnail": "thumbnail/TN-coll-4.jpg", "original": "pwg_high/cafe_1.jpg"},
+	}
+	for i, r := range cfs.Renditions() {
+		for rendition, name := range want[i] {
+			if r.Renditions[rendition] != name {
+				t.Errorf("%s: expected the %s %s, got %s", r.Source, rendition, name, r.Renditions[rendition])
+			}
+		}
+	}
+
+	m.update(cfs.Renditions())
+	if len(m.Images) != 4 || m.Images[3].Source != "old.jpg" {
+		t.Fatalf("Unexpected manifest %+v", m.Images)
+	}
+}
 
+func TestGPSCoordinate(t *testing.T) {
+	lat, ok := gpsCoordinate(&exif4go.IfdTag{Values: []string{"45", "30", "3600/100"}}, &exif4go.IfdTag{Values: []string{"S"}}, "S")
+	if !ok || lat < -45.51 || lat > -45.509 {
+		t.Fatalf("Expected -45.51, got %v", lat)
+	}
+	if _, ok = gpsCoordinate(&exif4go.IfdTag{Values: []string{"45", "x", "0"}}, nil, "S"); ok {
+		t.Fatalf("An invalid coordinate should be ignored")
+	}
+}
+
+func TestGallery(t *testing.T) {
+	src := t.TempDir()
+	data, e := os.ReadFile("../test/test_6365.jpg")
+	if e != nil {
+		t.Fatalf("error %q", e)
+	}
+	for _, n := range []string{"a.jpg", "b c.jpg", "d.jpg"} {
+		if e = os.WriteFile(filepath.Join(src, n), data, 0666); e != nil {
+			t.Fatalf("error %q", e)
+		}
+	}
+	sets := settings.NewDefaultSettings("coll", src)
+	sets.PublishDir = t.TempDir()
+	sets.GalleryPageSize = 2
+	sets.GalleryDownloads = true
+	cfs, e := PlanConversion(sets, logger.NewConsoleSemanticLogger("test", os.Stdout, logger.ERROR))
+	if e != nil {
+		t.Fatalf("error %q", e)
+	}
+	// d.jpg failed to convert
+	for _, r := range cfs.Renditions()[:2] {
+		for _, p := range r.Renditions {
+			fn := filepath.Join(cfs.CollectionPublishFolder, filepath.FromSlash(p))
+			os.MkdirAll(filepath.Dir(fn), 0777)
+			os.WriteFile(fn, data, 0666)
+		}
+	}
+	cfs.manifest.update(cfs.Renditions())
+
+	pages, e := writeGallery(cfs, sets)
+	if e != nil || len(pages) != 1 {
+		t.Fatalf("Expected a page, got %v, %v", pages, e)
+	}
+	html, _ := os.ReadFile(pages[0])
+	for _, s := range []string{`src="thumbnail/TN-b_c.jpg"`, `<a href="pwg_high/a.jpg" download>`, `href="#img-2"`, `href="gallery/style.css"`} {
+		if !strings.Contains(string(html), s) {
+			t.Errorf("The page should contain %s:\n%s", s, html)
+		}
+	}
+	if _, e = os.Stat(filepath.Join(cfs.CollectionPublishFolder, "gallery", "style.css")); e != nil {
+		t.Errorf("The style sheet should be copied, got %v", e)
+	}
+
+	theme := t.TempDir()
+	os.WriteFile(filepath.Join(theme, "page.html"), []byte(`{{range .Images}}{{.Image}} {{end}}{{.Next}}`), 0666)
+	os.Mkdir(filepath.Join(theme, "js"), 0777)
+	os.WriteFile(filepath.Join(theme, "js", "x.js"), nil, 0666)
+	sets.GalleryThemeDir = theme
+	sets.GalleryPageSize = 1
+	if pages, e = writeGallery(cfs, sets); e != nil || len(pages) != 2 {
+		t.Fatalf("Expected 2 pages, got %v, %v", pages, e)
+	}
+	if html, _ = os.ReadFile(pages[0]); string(html) != "a.jpg page-2.html" {
+		t.Fatalf("Unexpected page %q", html)
+	}
+	if _, e = os.Stat(filepath.Join(cfs.CollectionPublishFolder, "gallery", "js", "x.js")); e != nil {
+		t.Errorf("The theme files should be copied, got %v", e)
+	}
+}
+
+func TestContactSheets(t *testing.T) {
+	src := t.TempDir()
+	data, e := os.ReadFile("../test/test_6365.jpg")
+	if e != nil {
+		t.Fatalf("error %q", e)
+	}
+	for _, n := range []string{"a.jpg", "b.jpg", "c.jpg"} {
+		if e = os.WriteFile(filepath.Join(src, n), data, 0666); e != nil {
+			t.Fatalf("error %q", e)
+		}
+	}
+	sets := settings.NewDefaultSettings("coll", src)
+	sets.PublishDir = t.TempDir()
+	sets.ContactSheetColumns, sets.ContactSheetRows = 2, 1
+	sets.ContactSheetPage = settings.PAGE_A4_LANDSCAPE
+	sets.ContactSheetFormats = []string{settings.SHEET_JPEG, settings.SHEET_PDF}
+	cfs, e := PlanConversion(sets, logger.NewConsoleSemanticLogger("test", os.Stdout, logger.ERROR))
+	if e != nil {
+		t.Fatalf("error %q", e)
+	}
+	for i, r := range cfs.Renditions() {
+		fn := filepath.Join(cfs.CollectionPublishFolder, filepath.FromSlash(r.Renditions[settings.RENDITION_THUMBNAIL]))
+		os.MkdirAll(filepath.Dir(fn), 0777)
+		if i == 2 {
+			os.WriteFile(fn, []byte("not an image"), 0666)
+		} else {
+			os.WriteFile(fn, data, 0666)
+		}
+	}
+	cfs.manifest.update(cfs.Renditions())
+
+	files, e := writeContactSheets(cfs, sets)
+	if e != nil || len(files) != 3 {
+		t.Fatalf("Expected 2 pages and a PDF, got %v, %v", files, e)
+	}
+	f, e := os.Open(files[1])
+	if e != nil {
+		t.Fatalf("error %q", e)
+	}
+	defer f.Close()
+	if c, e := jpeg.DecodeConfig(f); e != nil || c.Width != 1754 || c.Height != 1240 {
+		t.Fatalf("Expected an A4 landscape page, got %+v, %v", c, e)
+	}
+	pdf, _ := os.ReadFile(files[2])
+	if !bytes.HasPrefix(pdf, []byte("%PDF-1.4")) || !bytes.Contains(pdf, []byte("/Count 2")) || !bytes.HasSuffix(pdf, []byte("%%EOF\n")) {
+		t.Fatalf("Unexpected PDF document %q", pdf[:100])
+	}
+}
+
+func TestOutbox(t *testing.T) {
+	o := NewOutbox(3, func(id string, n int) Delivery {
+		return &Message{Id: id, Kind: "stderr", Body: strings.Repeat("x", n)}
+	})
+	upload := func(file string, bytes int64) *Message {
+		return &Message{Id: "p", Kind: "upload", Progress: &UploadProgress{File: file, Bytes: bytes}}
+	}
+	// the progress of a file is coalesced while queued
+	o.Put(upload("a.jpg", 1))
+	o.Put(upload("a.jpg", 2))
+	o.Put(upload("b.jpg", 1))
+	o.Put(&Message{Id: "p", Kind: "stdout", Body: "1"})
+	// the oldest output is dropped once full, not the end
+	o.Put(&Message{Id: "p", Kind: "end"})
+	o.Put(&Message{Id: "q", Kind: "end"})
+
+	var got []string
+	for i := 0; i < 4; i++ {
+		d, ok := o.Get(nil)
+		if !ok {
+			t.Fatalf("Expected a message")
+		}
+		m := d.(*Message)
+		s := m.Kind + ":" + m.Body
+		if m.Progress != nil {
+			s = fmt.Sprintf("%s:%s:%d", m.Kind, m.Progress.File, m.Progress.Bytes)
+		}
+		got = append(got, s)
+	}
+	// the two progress messages dropped for p are reported first
+	want := []string{"stderr:xx", "stdout:1", "end:", "end:"}
+	if strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Fatalf("Expected %v, got %v", want, got)
+	}
+
+	done := make(chan struct{})
+	close(done)
+	if _, ok := o.Get(done); ok {
+		t.Fatalf("Expected no message")
+	}
+	o.Close()
+	o.Put(&Message{Id: "p", Kind: "end"})
+	if _, ok := o.Get(nil); ok {
+		t.Fatalf("Expected no message once closed")
+	}
 }
@@ -0,0 +1,116 @@
+package imageconvert
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"image"
+	_ "image/gif"
+	"image/jpeg"
+	_ "image/png"
+	"os"
+	"path/filepath"
+	"strings"
+
+	_ "golang.org/x/image/bmp"
+	"golang.org/x/image/draw"
+	_ "golang.org/x/image/tiff"
+)
+
+// MAX_PREVIEW_PIXELS is the size in pixels of the largest image Thumbnail decodes.
+const MAX_PREVIEW_PIXELS = 100 * 1000 * 1000
+
+// Folder is a folder which may hold images to convert.
+type Folder struct {
+	Name   string `json:"name"`
+	Path   string `json:"path"`
+	Images int    `json:"images"` // right in the folder, not in its subfolders
+}
+
+// ListFolder returns the subfolders of dir with the number of their images and the
+// names of the images of dir, sorted by name. The hidden files and folders are skipped.
+func ListFolder(dir string) (folders []*Folder, images []string, err error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, nil, err
+	}
+	folders, images = []*Folder{}, []string{}
+	for _, e := range entries {
+		if strings.HasPrefix(e.Name(), ".") {
+			continue
+		}
+		p := filepath.Join(dir, e.Name())
+		switch {
+		case e.IsDir():
+			folders = append(folders, &Folder{Name: e.Name(), Path: p, Images: CountImages(p)})
+		case isImageFile(e.Name()):
+			images = append(images, e.Name())
+		}
+	}
+	return folders, images, nil
+}
+
+// IsImageFile tells whether name has the extension of an image to convert.
+func IsImageFile(name string) bool {
+	return isImageFile(name)
+}
+
+// CountImages returns the number of images right in dir, 0 if it can not be read.
+func CountImages(dir string) (n int) {
+	entries, _ := os.ReadDir(dir)
+	for _, e := range entries {
+		if !e.IsDir() && isImageFile(e.Name()) {
+			n++
+		}
+	}
+	return
+}
+
+// Thumbnail returns a JPEG preview of the image fn fitting in a square of size pixels.
+// The raw images, e.g. NEF, and the ones larger than MAX_PREVIEW_PIXELS are not decoded.
+func Thumbnail(fn string, size int) ([]byte, error) {
+	cfg, err := decodeConfig(fn)
+	if err != nil {
+		return nil, err
+	}
+	if int64(cfg.Width)*int64(cfg.Height) > MAX_PREVIEW_PIXELS {
+		return nil, fmt.Errorf("The image of %dx%d pixels is too large to preview", cfg.Width, cfg.Height)
+	}
+	img, err := decodeImage(fn)
+	if err != nil {
+		return nil, err
+	}
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	if w > size || h > size {
+		if w > h {
+			w, h = size, h*size/w
+		} else {
+			w, h = w*size/h, size
+		}
+	}
+	if w < 1 {
+		w = 1
+	}
+	if h < 1 {
+		h = 1
+	}
+	thumb := image.NewRGBA(image.Rect(0, 0, w, h))
+	draw.ApproxBiLinear.Scale(thumb, thumb.Bounds(), img, b, draw.Src, nil)
+	var buf bytes.Buffer
+	if err = jpeg.Encode(&buf, thumb, &jpeg.Options{Quality: 80}); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// decodeConfig reads the size of the image fn, without decoding it.
+func decodeConfig(fn string) (image.Config, error) {
+	f, err := os.Open(fn)
+	if err != nil {
+		return image.Config{}, err
+	}
+	defer f.Close()
+	cfg, _, err := image.DecodeConfig(bufio.NewReader(f))
+	return cfg, err
+}
@@ -0,0 +1,169 @@
+package imageconvert
+
+import (
+	"fmt"
+	"html/template"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/mezzato/goconvert/settings"
+)
+
+// GALLERY_ASSETS_FOLDER is the subfolder of the collection folder where the files of the
+// gallery theme other than its page template are copied, e.g. the style sheets.
+const GALLERY_ASSETS_FOLDER = "gallery"
+
+// GalleryPage is the data of the page template of a gallery theme.
+// The pages are index.html then page-2.html, page-3.html... in the collection folder.
+type GalleryPage struct {
+	Collection string
+	Assets     string // the folder of the theme files, relative to the page
+	Number     int    // from 1
+	Prev, Next string // the previous and next pages, empty on the first and last page
+	Pages      []*GalleryLink
+	Images     []*GalleryImage
+	Downloads  bool // whether to link the original images
+}
+
+// GalleryLink links a page of the gallery.
+type GalleryLink struct {
+	Number  int
+	File    string
+	Current bool
+}
+
+// GalleryImage is an image of a gallery page, its renditions relative to the page.
+// Prev and Next are the ids of the neighbour images on the page, for the lightbox.
+type GalleryImage struct {
+	Id                         string
+	Name                       string
+	Image, Thumbnail, Original string
+	Prev, Next                 string
+}
+
+func galleryPageFile(n int) string {
+	if n == 1 {
+		return "index.html"
+	}
+	return fmt.Sprintf("page-%d.html", n)
+}
+
+// writeGallery writes the static HTML gallery of the images of the manifest
+// to the collection folder and returns the pages written.
+func writeGallery(cfs *ConversionFileSystem, sets *settings.Settings) (files []string, err error) {
+	theme := galleryTheme
+	if len(sets.GalleryThemeDir) > 0 {
+		if theme, err = readGalleryTheme(sets.GalleryThemeDir); err != nil {
+			return
+		}
+	}
+	t, err := template.New(settings.GALLERY_PAGE_TEMPLATE).Parse(theme[settings.GALLERY_PAGE_TEMPLATE])
+	if err != nil {
+		return nil, fmt.Errorf("Invalid gallery theme: %v", err)
+	}
+	for name, data := range theme {
+		if name == settings.GALLERY_PAGE_TEMPLATE {
+			continue
+		}
+		fn := filepath.Join(cfs.CollectionPublishFolder, GALLERY_ASSETS_FOLDER, filepath.FromSlash(name))
+		if err = os.MkdirAll(filepath.Dir(fn), 0777); err != nil {
+			return
+		}
+		if err = os.WriteFile(fn, []byte(data), 0666); err != nil {
+			return
+		}
+	}
+
+	var images []*GalleryImage
+	for _, e := range cfs.manifest.Images {
+		img := e.Renditions[settings.RENDITION_IMAGE]
+		if _, err := os.Stat(filepath.Join(cfs.CollectionPublishFolder, filepath.FromSlash(img))); err != nil {
+			continue // not converted
+		}
+		images = append(images, &GalleryImage{
+			Id:        fmt.Sprintf("img-%d", len(images)+1),
+			Name:      strings.TrimSuffix(e.Source, path.Ext(e.Source)),
+			Image:     img,
+			Thumbnail: e.Renditions[settings.RENDITION_THUMBNAIL],
+			Original:  e.Renditions[settings.RENDITION_ORIGINAL],
+		})
+	}
+
+	size := sets.GalleryPageSize
+	if size <= 0 {
+		size = len(images)
+	}
+	count := (len(images) + size - 1) / size
+	for n := 1; n <= count; n++ {
+		page := &GalleryPage{
+			Collection: cfs.collName,
+			Assets:     GALLERY_ASSETS_FOLDER,
+			Number:     n,
+			Downloads:  sets.GalleryDownloads,
+		}
+		if n > 1 {
+			page.Prev = galleryPageFile(n - 1)
+		}
+		if n < count {
+			page.Next = galleryPageFile(n + 1)
+		}
+		for i := 1; i <= count; i++ {
+			page.Pages = append(page.Pages, &GalleryLink{i, galleryPageFile(i), i == n})
+		}
+		page.Images = images[(n-1)*size:]
+		if len(page.Images) > size {
+			page.Images = page.Images[:size]
+		}
+		for i, img := range page.Images {
+			if i > 0 {
+				img.Prev = page.Images[i-1].Id
+			}
+			if i < len(page.Images)-1 {
+				img.Next = page.Images[i+1].Id
+			}
+		}
+
+		fn := filepath.Join(cfs.CollectionPublishFolder, galleryPageFile(n))
+		if err = writeGalleryPage(t, fn, page); err != nil {
+			return
+		}
+		files = append(files, fn)
+	}
+	return
+}
+
+func writeGalleryPage(t *template.Template, fn string, page *GalleryPage) error {
+	f, err := os.Create(fn)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err = t.Execute(f, page); err != nil {
+		return fmt.Errorf("Invalid gallery theme: %v", err)
+	}
+	return f.Close()
+}
+
+// readGalleryTheme returns the files of the theme folder by slash separated path.
+func readGalleryTheme(dir string) (map[string]string, error) {
+	theme := make(map[string]string)
+	err := filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		data, err := os.ReadFile(p)
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, p)
+		theme[filepath.ToSlash(rel)] = string(data)
+		return err
+	})
+	if _, ok := theme[settings.GALLERY_PAGE_TEMPLATE]; err == nil && !ok {
+		err = fmt.Errorf("The gallery theme folder %s has no %s template", dir, settings.GALLERY_PAGE_TEMPLATE)
+	}
+	return theme, err
+}
@@ -0,0 +1,61 @@
+package imageconvert
+
+// galleryTheme is the built-in theme of the static gallery: the page template, see
+// GalleryPage, and the files copied to GALLERY_ASSETS_FOLDER. The lightbox is the
+// :target of the image links and needs no script.
+var galleryTheme = map[string]string{
+	"page.html": `<!doctype html>
+<html>
+<head>
+<meta charset="UTF-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>{{.Collection}}{{if gt (len .Pages) 1}} - {{.Number}}{{end}}</title>
+<link rel="stylesheet" href="{{.Assets}}/style.css">
+</head>
+<body>
+	<h1>{{.Collection}}</h1>
+	<ul class="grid">
+	{{range .Images}}
+		<li><a href="#{{.Id}}" title="{{.Name}}"><img src="{{.Thumbnail}}" alt="{{.Name}}" loading="lazy"></a></li>
+	{{end}}
+	</ul>
+	{{if gt (len .Pages) 1}}
+	<nav class="pages">
+		{{if .Prev}}<a href="{{.Prev}}">&laquo;</a>{{end}}
+		{{range .Pages}}{{if .Current}}<span>{{.Number}}</span>{{else}}<a href="{{.File}}">{{.Number}}</a>{{end}} {{end}}
+		{{if .Next}}<a href="{{.Next}}">&raquo;</a>{{end}}
+	</nav>
+	{{end}}
+	{{range .Images}}
+	<div class="lightbox" id="{{.Id}}">
+		<a class="close" href="#" title="Close">&times;</a>
+		{{if .Prev}}<a class="prev" href="#{{.Prev}}">&lsaquo;</a>{{end}}
+		<figure>
+			<img src="{{.Image}}" alt="{{.Name}}" loading="lazy">
+			<figcaption>{{.Name}}{{if and $.Downloads .Original}} <a href="{{.Original}}" download>Download the original</a>{{end}}</figcaption>
+		</figure>
+		{{if .Next}}<a class="next" href="#{{.Next}}">&rsaquo;</a>{{end}}
+	</div>
+	{{end}}
+</body>
+</html>
+`,
+	"style.css": `body { margin: 0 auto; max-width: 1200px; padding: 1em; font-family: sans-serif; background: #fff; color: #222; }
+h1 { font-weight: normal; }
+.grid { display: flex; flex-wrap: wrap; gap: 8px; list-style: none; margin: 0; padding: 0; }
+.grid li { width: 128px; height: 128px; display: flex; align-items: center; justify-content: center; background: #eee; }
+.grid img { max-width: 128px; max-height: 128px; }
+.pages { margin: 1em 0; text-align: center; }
+.pages a, .pages span { padding: 0.2em 0.5em; }
+.pages span { font-weight: bold; }
+.lightbox { display: none; position: fixed; inset: 0; background: rgba(0, 0, 0, 0.9); align-items: center; justify-content: center; }
+.lightbox:target { display: flex; }
+.lightbox figure { margin: 0; text-align: center; color: #ddd; }
+.lightbox figure img { max-width: 90vw; max-height: 85vh; }
+.lightbox figcaption a { color: #9cf; margin-left: 1em; }
+.lightbox a.close, .lightbox a.prev, .lightbox a.next { position: absolute; color: #fff; text-decoration: none; font-size: 3em; padding: 0 0.3em; }
+.lightbox a.close { top: 0; right: 0; }
+.lightbox a.prev { left: 0; }
+.lightbox a.next { right: 0; }
+`,
+}
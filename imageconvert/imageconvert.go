@@ -1,11 +1,14 @@
 package imageconvert
 
 import (
+	"crypto/sha1"
+	"encoding/hex"
 	"errors"
 	"fmt"
+	"io"
 	"os"
+	"path"
 	"path/filepath"
-	"regexp"
 	"sort"
 	"strconv"
 	"strings"
@@ -17,39 +20,68 @@ import (
 )
 
 type imgParams struct {
-	cmdArgs          []string
-	subFolderRelPath string
-	prefix           string
+	cmdArgs   []string
+	rendition string // one of the settings.RENDITION_ constants
+}
+
+// thumbnailFolder is the subfolder of the thumbnails in the collection folder.
+const thumbnailFolder = "thumbnail"
+
+// exifInfo is what the EXIF tags of an image tell.
+type exifInfo struct {
+	date          time.Time
+	camera        string // the camera model, empty if unknown
+	width, height int    // 0 if unknown
+	location      *Location
+}
+
+// Location is where an image was taken, in decimal degrees.
+type Location struct {
+	Latitude  float64 `json:"latitude"`
+	Longitude float64 `json:"longitude"`
 }
 
 type imgFile struct {
-	timestamp       string
-	sortkey         string
+	timestamp string
+	sortkey   string
+	exifInfo
 	Path            string
 	targetExtension string
+	failed          bool              // set when a step fails, the next steps are skipped
+	names           map[string]string // the files of the renditions, see ManifestEntry
 }
 
-var regexNormalize = regexp.MustCompile(fmt.Sprintf("(?i)%s", `\s`))
-
-//includeFileRegexp.MatchString(info.Name())
+// hash returns the hexadecimal SHA-1 of the image file.
+func (img *imgFile) hash() (string, error) {
+	return hashFile(img.Path)
+}
 
-func (img *imgFile) getNormalizedName(useMappedExt bool) string {
-	if img == nil {
-		return ""
+// sourceFile returns the source image, or its archived copy in the collection folder
+// once the archive step has moved it there.
+func (img *imgFile) sourceFile(collPublishFolder string) string {
+	if _, err := os.Stat(img.Path); err == nil {
+		return img.Path
+	}
+	if p, ok := img.names[settings.RENDITION_ORIGINAL]; ok {
+		return filepath.Join(collPublishFolder, filepath.FromSlash(p))
 	}
-	bfn := filepath.Base(img.Path)
-	if len(bfn) == 0 {
-		return ""
+	return img.Path
+}
+
+func hashFile(fn string) (string, error) {
+	f, err := os.Open(fn)
+	if err != nil {
+		return "", err
 	}
-	n := regexNormalize.ReplaceAllString(bfn, "_")
-	if useMappedExt {
-		n = strings.TrimRight(n, filepath.Ext(n)) + img.targetExtension
+	defer f.Close()
+	h := sha1.New()
+	if _, err = io.Copy(h, f); err != nil {
+		return "", err
 	}
-	return n
-	//return strings.Join(strings.Fields(bfn), "_")
+	return hex.EncodeToString(h.Sum(nil)), nil
 }
 
-func getFileExifInfo(fp string) (timestamp string, sortkey string, err error) {
+func getFileExifInfo(fp string) (info exifInfo, err error) {
 	f, err := os.Open(fp)
 	if err != nil {
 		return
@@ -66,26 +98,64 @@ func getFileExifInfo(fp string) (timestamp string, sortkey string, err error) {
 		return
 	}
 
-	var t time.Time
 	if tag, ok := tags["Image DateTime"]; ok {
 		// t, err = time.Parse("%Y:%m:%d %H:%M:%S", tag.Values[0]) //[0:6]
-		t, err = time.Parse("2006:01:02 15:04:05", tag.Values[0])
+		info.date, err = time.Parse("2006:01:02 15:04:05", tag.Values[0])
 		if err != nil {
 			return
 		}
 	} else {
 		// Ensure date is present
-		t = time.Now()
+		info.date = time.Now()
+	}
+	if tag, ok := tags["Image Model"]; ok && len(tag.Values) > 0 {
+		info.camera = strings.TrimSpace(strings.Trim(tag.Values[0], "\x00"))
+	}
+	if tag, ok := tags["EXIF ExifImageWidth"]; ok && len(tag.Values) > 0 {
+		info.width, _ = strconv.Atoi(tag.Values[0])
+	}
+	if tag, ok := tags["EXIF ExifImageLength"]; ok && len(tag.Values) > 0 {
+		info.height, _ = strconv.Atoi(tag.Values[0])
+	}
+	lat, ok1 := gpsCoordinate(tags["GPS GPSLatitude"], tags["GPS GPSLatitudeRef"], "S")
+	lon, ok2 := gpsCoordinate(tags["GPS GPSLongitude"], tags["GPS GPSLongitudeRef"], "W")
+	if ok1 && ok2 {
+		info.location = &Location{lat, lon}
 	}
-
-	timestamp = strconv.FormatInt(t.Unix(), 10)
-	sortkey = t.Format("20060102")
 
 	return
 }
 
+// gpsCoordinate returns the decimal degrees of the degrees, minutes and seconds of
+// a GPS tag, negative if the reference tag is negativeRef.
+func gpsCoordinate(tag, ref *exif4go.IfdTag, negativeRef string) (float64, bool) {
+	if tag == nil || len(tag.Values) != 3 {
+		return 0, false
+	}
+	var v float64
+	for i, unit := range []float64{1, 60, 3600} {
+		num, den, ok := strings.Cut(tag.Values[i], "/")
+		n, err := strconv.ParseFloat(num, 64)
+		if err != nil {
+			return 0, false
+		}
+		if ok {
+			d, err := strconv.ParseFloat(den, 64)
+			if err != nil || d == 0 {
+				return 0, false
+			}
+			n /= d
+		}
+		v += n / unit
+	}
+	if ref != nil && len(ref.Values) > 0 && strings.HasPrefix(ref.Values[0], negativeRef) {
+		v = -v
+	}
+	return v, true
+}
+
 func newImgFile(fpath string, targetExtension string) (i *imgFile, err error) {
-	ts, sk, err1 := getFileExifInfo(fpath)
+	info, err1 := getFileExifInfo(fpath)
 
 	if err1 != nil {
 		//return
@@ -94,7 +164,18 @@ func newImgFile(fpath string, targetExtension string) (i *imgFile, err error) {
 	}
 
 	err = nil
-	return &imgFile{ts, sk, fpath, targetExtension}, err
+	ts := strconv.FormatInt(info.date.Unix(), 10)
+	sk := info.date.Format("20060102")
+	return &imgFile{ts, sk, info, fpath, targetExtension, false, nil}, err
+}
+
+// imageExtensions are the extensions of the files converted, sorted to look through them.
+var imageExtensions = []string{".bmp", ".gif", ".jpeg", ".jpg", ".nef", ".png", ".tif"}
+
+func isImageFile(name string) bool {
+	ext := strings.ToLower(filepath.Ext(name))
+	idx := sort.SearchStrings(imageExtensions, ext)
+	return idx < len(imageExtensions) && imageExtensions[idx] == ext
 }
 
 type ConversionFileSystem struct {
@@ -103,6 +184,7 @@ type ConversionFileSystem struct {
 	extensions              []string
 	remapping               map[string]string
 	imgFiles                []*imgFile
+	manifest                *Manifest
 	CollectionPublishFolder string
 	CollectionArchiveFolder string
 	timeoutMsec             int
@@ -119,13 +201,11 @@ func extractConversionFileSystem(sets *settings.Settings, logger logger.Semantic
 	f.timeoutMsec = sets.TimeoutMsec
 	f.collName = sets.CollName
 	f.sourceDir = sets.SourceDir
-	f.extensions = []string{".bmp", ".jpeg", ".jpg", ".gif", ".png", ".nef", ".tif"}
+	f.extensions = imageExtensions
 	f.remapping = map[string]string{
 		".nef": ".jpg",
 		".tif": ".jpg",
 	}
-	// NOTE: sort extensions to look through them
-	sort.Strings(f.extensions)
 
 	// find files
 	f.imgFiles, err = f.getImgFiles()
@@ -135,16 +215,133 @@ func extractConversionFileSystem(sets *settings.Settings, logger logger.Semantic
 
 	// resolve collection names
 	if len(f.imgFiles) > 0 {
-		ff := f.imgFiles[0]
-		lf := f.imgFiles[len(f.imgFiles)-1]
-		decoratedCollectionName := strings.Join([]string{ff.sortkey, lf.sortkey, sets.CollName}, "_")
-		f.CollectionPublishFolder = filepath.Join(sets.PublishDir, decoratedCollectionName)
+		var folder string
+		folder, err = sets.CollectionFolder(collectionInfo(sets.CollName, f.imgFiles))
+		if err != nil {
+			return
+		}
+		f.CollectionPublishFolder = filepath.Join(sets.PublishDir, folder)
 		f.CollectionArchiveFolder = filepath.Join(f.CollectionPublishFolder, sets.PiwigoGalleryHighDirName)
+
+		if f.manifest, err = readManifest(f.CollectionArchiveFolder); err != nil {
+			err = fmt.Errorf("Invalid manifest in %s: %v", f.CollectionArchiveFolder, err)
+			return
+		}
+		err = f.nameRenditions(sets)
 	}
 
 	return
 }
 
+// collectionInfo returns the values of the collection template for the images:
+// their date range, their number and the first camera model found.
+func collectionInfo(name string, imgFiles []*imgFile) *settings.CollectionInfo {
+	info := &settings.CollectionInfo{Name: name, Count: len(imgFiles)}
+	for i, img := range imgFiles {
+		if i == 0 || img.date.Before(info.First) {
+			info.First = img.date
+		}
+		if i == 0 || img.date.After(info.Last) {
+			info.Last = img.date
+		}
+		if len(info.Camera) == 0 {
+			info.Camera = img.camera
+		}
+	}
+	return info
+}
+
+// nameRenditions names the files of the renditions of the images from the templates of
+// the settings. A name already taken in the same folder, by another image or in the
+// manifest, gets a -2, -3... suffix.
+func (f *ConversionFileSystem) nameRenditions(sets *settings.Settings) error {
+	renditions := []struct{ rendition, folder string }{
+		{settings.RENDITION_IMAGE, ""},
+		{settings.RENDITION_THUMBNAIL, thumbnailFolder},
+		{settings.RENDITION_ORIGINAL, sets.PiwigoGalleryHighDirName},
+	}
+
+	// lowercase, for the case insensitive file systems
+	taken := make(map[string]bool)
+	sources := make(map[string]bool)
+	for _, img := range f.imgFiles {
+		sources[filepath.Base(img.Path)] = true
+	}
+	for _, e := range f.manifest.Images {
+		if !sources[e.Source] {
+			for _, p := range e.Renditions {
+				taken[strings.ToLower(p)] = true
+			}
+		}
+	}
+
+	for i, img := range f.imgFiles {
+		info := &settings.FileInfo{
+			Name:     filepath.Base(img.Path),
+			Seq:      i + 1,
+			Count:    len(f.imgFiles),
+			Date:     img.date,
+			Camera:   img.camera,
+			CollName: sets.CollName,
+			Hash:     img.hash,
+		}
+		img.names = make(map[string]string)
+		for _, r := range renditions {
+			name, err := sets.FileName(r.rendition, info)
+			if err != nil {
+				return err
+			}
+			ext := img.targetExtension
+			if r.rendition == settings.RENDITION_ORIGINAL {
+				ext = filepath.Ext(img.Path)
+			}
+			p := path.Join(r.folder, name)
+			for n := 2; taken[strings.ToLower(p+ext)]; n++ {
+				p = path.Join(r.folder, name+"-"+strconv.Itoa(n))
+			}
+			taken[strings.ToLower(p+ext)] = true
+			img.names[r.rendition] = p + ext
+			if r.rendition == settings.RENDITION_IMAGE {
+				info.Image = path.Base(p)
+			}
+		}
+	}
+	return nil
+}
+
+func (img *imgFile) manifestEntry() *ManifestEntry {
+	return &ManifestEntry{Source: filepath.Base(img.Path), Date: img.date, Renditions: img.names}
+}
+
+// Renditions returns the files of the renditions of the images, in conversion order.
+func (f *ConversionFileSystem) Renditions() []*ManifestEntry {
+	l := make([]*ManifestEntry, len(f.imgFiles))
+	for i, img := range f.imgFiles {
+		l[i] = img.manifestEntry()
+	}
+	return l
+}
+
+// PlanConversion lists the images to convert and resolves the collection folders
+// without changing anything on disk.
+func PlanConversion(sets *settings.Settings, logger logger.SemanticLogger) (*ConversionFileSystem, error) {
+	return extractConversionFileSystem(sets, logger)
+}
+
+// ImageCount returns the number of images found in the source folder.
+func (f *ConversionFileSystem) ImageCount() int {
+	return len(f.imgFiles)
+}
+
+// Images returns the paths of the images found in the source folder, in conversion order.
+func (f *ConversionFileSystem) Images() []string {
+	l := make([]string, len(f.imgFiles))
+	for i, img := range f.imgFiles {
+		l[i] = img.Path
+	}
+	return l
+}
+
 func (f *ConversionFileSystem) getImgFiles() (imgFiles []*imgFile, err error) {
 
 	var fi os.FileInfo
@@ -189,40 +386,3 @@ func (f *ConversionFileSystem) getImgFiles() (imgFiles []*imgFile, err error) {
 
 	return
 }
-
-// TODO: remove below
-
-type ConvertRequest struct {
-	imgF     *imgFile
-	response chan *ConvertResponse
-}
-
-type ConvertResponse struct {
-	ImgF  *imgFile
-	Error error
-}
-
-func Convert(collname string,
-	srcfolder string,
-	publishfolder string,
-	archivesubfoldername string,
-	convSettings *settings.ConversionSettings) (responseChannel chan *ConvertResponse, quitChannel chan bool, fileno int, collPublishFolder string, err error) {
-	//WriteInfo("Starting the image conversion")
-
-	//var imgFolder *imgFolder
-
-	if len(collname) == 0 {
-		err = errors.New("The collection name can not be empty.")
-		return
-	}
-
-	// imgFolder, err = newImgFolder(collname, srcfolder, publishfolder, archivesubfoldername)
-
-	if err != nil {
-		return
-	}
-
-	// REMOVE THIS METHOD
-	return
-
-}
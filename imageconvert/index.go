@@ -0,0 +1,203 @@
+package imageconvert
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/mezzato/goconvert/settings"
+)
+
+// INDEX_FILE_NAME is the collection index in the collection folder, with the extension
+// of each format, e.g. index.json.
+const INDEX_FILE_NAME = "index"
+
+// Index lists what a conversion produced in a collection folder, for the tools
+// downstream.
+type Index struct {
+	Collection string        `json:"collection"`
+	Folder     string        `json:"folder"`
+	Created    time.Time     `json:"created"`
+	Images     []*IndexImage `json:"images"`
+}
+
+// IndexImage describes a source image and its renditions.
+type IndexImage struct {
+	Source     string            `json:"source"`
+	Date       time.Time         `json:"date"`
+	Width      int               `json:"width,omitempty"`
+	Height     int               `json:"height,omitempty"`
+	Camera     string            `json:"camera,omitempty"`
+	Location   *Location         `json:"location,omitempty"` // only if the settings allow it
+	SHA1       string            `json:"sha1"`
+	Failed     bool              `json:"failed,omitempty"` // some renditions may be missing
+	Renditions []*IndexRendition `json:"renditions"`
+}
+
+// IndexRendition is a file produced from a source image.
+type IndexRendition struct {
+	Rendition string `json:"rendition"` // one of the settings.RENDITION_ constants
+	Path      string `json:"path"`      // slash separated, in the collection folder
+	Size      int64  `json:"size"`
+	Width     int    `json:"width,omitempty"`
+	Height    int    `json:"height,omitempty"`
+	SHA1      string `json:"sha1"`
+}
+
+// indexRenditions are the renditions in the index, in order.
+var indexRenditions = []string{settings.RENDITION_IMAGE, settings.RENDITION_THUMBNAIL, settings.RENDITION_ORIGINAL}
+
+// buildIndex describes the images of the conversion and the renditions found on disk.
+func buildIndex(cfs *ConversionFileSystem, sets *settings.Settings) (*Index, error) {
+	idx := &Index{Collection: cfs.collName, Folder: filepath.Base(cfs.CollectionPublishFolder), Created: time.Now()}
+	for _, img := range cfs.imgFiles {
+		src := img.sourceFile(cfs.CollectionPublishFolder)
+		sum, err := hashFile(src)
+		if err != nil {
+			return nil, err
+		}
+		e := &IndexImage{
+			Source: filepath.Base(img.Path),
+			Date:   img.date,
+			Width:  img.width,
+			Height: img.height,
+			Camera: img.camera,
+			SHA1:   sum,
+			Failed: img.failed,
+		}
+		if w, h, ok := imageSize(src); ok {
+			e.Width, e.Height = w, h
+		}
+		if sets.IndexGPS {
+			e.Location = img.location
+		}
+		for _, r := range indexRenditions {
+			p, ok := img.names[r]
+			if !ok {
+				continue
+			}
+			fn := filepath.Join(cfs.CollectionPublishFolder, filepath.FromSlash(p))
+			fi, err := os.Stat(fn)
+			if err != nil {
+				continue // not converted
+			}
+			ir := &IndexRendition{Rendition: r, Path: p, Size: fi.Size()}
+			ir.Width, ir.Height, _ = imageSize(fn)
+			if ir.SHA1, err = hashFile(fn); err != nil {
+				return nil, err
+			}
+			e.Renditions = append(e.Renditions, ir)
+		}
+		idx.Images = append(idx.Images, e)
+	}
+	return idx, nil
+}
+
+// imageSize returns the size in pixels of the JPEG, PNG and GIF images.
+func imageSize(fn string) (width, height int, ok bool) {
+	f, err := os.Open(fn)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	c, _, err := image.DecodeConfig(f)
+	if err != nil {
+		return
+	}
+	return c.Width, c.Height, true
+}
+
+// writeIndex writes the index of the conversion to the collection folder in the formats
+// of the settings and returns the files written.
+func writeIndex(cfs *ConversionFileSystem, sets *settings.Settings) (files []string, err error) {
+	if len(sets.IndexFormats) == 0 {
+		return
+	}
+	idx, err := buildIndex(cfs, sets)
+	if err != nil {
+		return
+	}
+	if err = os.MkdirAll(cfs.CollectionPublishFolder, 0777); err != nil {
+		return
+	}
+	for _, format := range sets.IndexFormats {
+		fn := filepath.Join(cfs.CollectionPublishFolder, INDEX_FILE_NAME+"."+format)
+		switch format {
+		case settings.INDEX_JSON:
+			err = idx.writeJSON(fn)
+		case settings.INDEX_CSV:
+			err = idx.writeCSV(fn)
+		default:
+			err = fmt.Errorf("Unknown index format %s", format)
+		}
+		if err != nil {
+			return
+		}
+		files = append(files, fn)
+	}
+	return
+}
+
+func (idx *Index) writeJSON(fn string) error {
+	data, err := json.MarshalIndent(idx, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(fn, data, 0666)
+}
+
+// writeCSV writes a line per image, with the columns of each rendition in indexRenditions,
+// e.g. image_path, image_size...
+func (idx *Index) writeCSV(fn string) error {
+	f, err := os.Create(fn)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	w := csv.NewWriter(f)
+
+	header := []string{"source", "date", "width", "height", "camera", "latitude", "longitude", "sha1", "failed"}
+	for _, r := range indexRenditions {
+		header = append(header, r+"_path", r+"_size", r+"_width", r+"_height", r+"_sha1")
+	}
+	w.Write(header)
+
+	itoa := func(i int) string {
+		if i == 0 {
+			return ""
+		}
+		return strconv.Itoa(i)
+	}
+	for _, img := range idx.Images {
+		var lat, lon string
+		if img.Location != nil {
+			lat = strconv.FormatFloat(img.Location.Latitude, 'f', -1, 64)
+			lon = strconv.FormatFloat(img.Location.Longitude, 'f', -1, 64)
+		}
+		line := []string{img.Source, img.Date.Format(time.RFC3339), itoa(img.Width), itoa(img.Height),
+			img.Camera, lat, lon, img.SHA1, strconv.FormatBool(img.Failed)}
+		for _, r := range indexRenditions {
+			cols := make([]string, 5)
+			for _, ir := range img.Renditions {
+				if ir.Rendition == r {
+					cols = []string{ir.Path, strconv.FormatInt(ir.Size, 10), itoa(ir.Width), itoa(ir.Height), ir.SHA1}
+				}
+			}
+			line = append(line, cols...)
+		}
+		w.Write(line)
+	}
+	w.Flush()
+	if err = w.Error(); err != nil {
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,76 @@
+package imageconvert
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// MANIFEST_FILE_NAME is the manifest of a collection, in its archive folder
+// so that it is not uploaded.
+const MANIFEST_FILE_NAME = "manifest.json"
+
+// Manifest maps the source images of a collection to the files of their renditions.
+// The conversions into an existing collection folder update its manifest.
+type Manifest struct {
+	Collection string           `json:"collection"`
+	Updated    time.Time        `json:"updated"`
+	Images     []*ManifestEntry `json:"images"`
+}
+
+// ManifestEntry lists the renditions of a source image by settings.RENDITION_ constant,
+// as slash separated paths in the collection folder, e.g. "thumbnail/TN-a.jpg".
+type ManifestEntry struct {
+	Source     string            `json:"source"` // the name of the source image
+	Date       time.Time         `json:"date"`   // when the image was taken
+	Renditions map[string]string `json:"renditions"`
+}
+
+// readManifest returns the manifest in the archive folder, an empty one if there is none.
+func readManifest(archiveFolder string) (*Manifest, error) {
+	m := new(Manifest)
+	data, err := os.ReadFile(filepath.Join(archiveFolder, MANIFEST_FILE_NAME))
+	if os.IsNotExist(err) {
+		return m, nil
+	}
+	if err == nil {
+		err = json.Unmarshal(data, m)
+	}
+	return m, err
+}
+
+// find returns the entry of the source image, nil if there is none.
+func (m *Manifest) find(source string) *ManifestEntry {
+	for _, e := range m.Images {
+		if e.Source == source {
+			return e
+		}
+	}
+	return nil
+}
+
+// update replaces the entries of the source images converted, sorted by source.
+func (m *Manifest) update(entries []*ManifestEntry) {
+	for _, e := range entries {
+		if old := m.find(e.Source); old != nil {
+			*old = *e
+		} else {
+			m.Images = append(m.Images, e)
+		}
+	}
+	sort.Slice(m.Images, func(i, j int) bool { return m.Images[i].Source < m.Images[j].Source })
+	m.Updated = time.Now()
+}
+
+func (m *Manifest) write(archiveFolder string) error {
+	if err := os.MkdirAll(archiveFolder, 0777); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(archiveFolder, MANIFEST_FILE_NAME), data, 0666)
+}
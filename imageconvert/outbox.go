@@ -0,0 +1,120 @@
+package imageconvert
+
+import (
+	"sync"
+)
+
+// Delivery is a message queued in an Outbox, a *Message or a type embedding a Message.
+type Delivery interface {
+	msg() *Message
+}
+
+func (m *Message) msg() *Message {
+	return m
+}
+
+// Outbox queues the messages sent to a client without ever blocking the processes
+// producing them, so that a slow client neither stalls nor stops a conversion.
+// While queued, the "upload" messages of a file are coalesced into the last one.
+// The queue is bounded: when it is full the oldest "stdout", "stderr" or "upload"
+// message is dropped, the "end" messages and the replies to the client are kept.
+type Outbox struct {
+	size    int
+	notice  func(id string, dropped int) Delivery
+	mu      sync.Mutex
+	queue   []Delivery
+	dropped map[string]int // by process id, since the last message delivered
+	closed  bool
+	ready   chan struct{}
+}
+
+// NewOutbox returns an Outbox queuing size messages. The messages dropped for a process
+// are reported by the message of notice, if not nil, before its next message.
+func NewOutbox(size int, notice func(id string, dropped int) Delivery) *Outbox {
+	if size < 1 {
+		size = 1
+	}
+	return &Outbox{size: size, notice: notice, dropped: make(map[string]int), ready: make(chan struct{}, 1)}
+}
+
+// Put queues d, it is discarded once the Outbox is closed.
+func (o *Outbox) Put(d Delivery) {
+	m := d.msg()
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.closed {
+		return
+	}
+	if m.Kind == "upload" && m.Progress != nil {
+		for i, q := range o.queue {
+			if p := q.msg(); p.Kind == "upload" && p.Id == m.Id && p.Progress != nil && p.Progress.File == m.Progress.File {
+				o.queue[i] = d
+				return
+			}
+		}
+	}
+	if len(o.queue) >= o.size {
+		o.drop()
+	}
+	o.queue = append(o.queue, d)
+	select {
+	case o.ready <- struct{}{}:
+	default:
+	}
+}
+
+// drop removes the oldest message which can be lost. It is called with mu held.
+func (o *Outbox) drop() {
+	for i, q := range o.queue {
+		switch p := q.msg(); p.Kind {
+		case "stdout", "stderr", "upload":
+			o.dropped[p.Id]++
+			o.queue = append(o.queue[:i], o.queue[i+1:]...)
+			return
+		}
+	}
+}
+
+// Get returns the oldest message, waiting for one until the Outbox is closed or done is.
+// ok is false if no message has been returned.
+func (o *Outbox) Get(done <-chan struct{}) (d Delivery, ok bool) {
+	for {
+		o.mu.Lock()
+		if len(o.queue) > 0 {
+			d = o.queue[0]
+			id := d.msg().Id
+			if n := o.dropped[id]; n > 0 {
+				delete(o.dropped, id)
+				if o.notice != nil {
+					o.mu.Unlock()
+					return o.notice(id, n), true
+				}
+			}
+			o.queue[0] = nil
+			o.queue = o.queue[1:]
+			o.mu.Unlock()
+			return d, true
+		}
+		closed := o.closed
+		o.mu.Unlock()
+		if closed {
+			return nil, false
+		}
+		select {
+		case <-o.ready:
+		case <-done:
+			return nil, false
+		}
+	}
+}
+
+// Close discards the messages queued and the ones put later, and wakes up Get.
+func (o *Outbox) Close() {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.closed, o.queue = true, nil
+	select {
+	case o.ready <- struct{}{}:
+	default:
+	}
+}
@@ -0,0 +1,339 @@
+package imageconvert
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+
+	ftp4go "github.com/mezzato/ftp4go"
+	"github.com/mezzato/goconvert/settings"
+)
+
+const (
+	stagingSuffix = ".uploading"
+	backupSuffix  = ".old"
+)
+
+// remoteAction is a change applied to the FTP server before or after the upload.
+type remoteAction struct {
+	kind string // "delete", "rmdir", "rename"
+	path string
+	to   string
+}
+
+func (a *remoteAction) String() string {
+	switch a.kind {
+	case "rename":
+		return fmt.Sprintf("rename remote folder %s to %s", a.path, a.to)
+	case "rmdir":
+		return fmt.Sprintf("remove remote folder %s", a.path)
+	}
+	return fmt.Sprintf("delete remote file %s", a.path)
+}
+
+// remoteGuard rejects any remote path outside the collection folder
+// and its staging and backup siblings.
+type remoteGuard struct {
+	roots []string
+}
+
+func newRemoteGuard(collName string) (g *remoteGuard, err error) {
+	if len(collName) == 0 || collName == "." || collName == ".." || strings.ContainsAny(collName, "/\\") {
+		return nil, fmt.Errorf("Invalid collection folder name: %q", collName)
+	}
+	return &remoteGuard{[]string{collName, collName + stagingSuffix, collName + backupSuffix}}, nil
+}
+
+func (g *remoteGuard) check(p string) error {
+	c := path.Clean(p)
+	if c != p || path.IsAbs(c) {
+		return fmt.Errorf("Refusing to touch remote path %q outside the collection folder", p)
+	}
+	for _, r := range g.roots {
+		if c == r || strings.HasPrefix(c, r+"/") {
+			return nil
+		}
+	}
+	return fmt.Errorf("Refusing to touch remote path %q outside the collection folder", p)
+}
+
+// uploadPlan lists what an upload does on the server for a given policy.
+type uploadPlan struct {
+	policy string
+	files  []*uploadFile // remote paths already mapped to the upload folder
+	dirs   []string
+	before []*remoteAction // applied before the upload
+	after  []*remoteAction // applied once all files have been uploaded
+	guard  *remoteGuard
+}
+
+// planUpload resolves the remote changes for the collection folder collName.
+// The remote tree is only listed, nothing is modified.
+func planUpload(fc *ftp4go.FTP, policy string, collName string, files []*uploadFile, dirs []string, excludedDirs []string) (plan *uploadPlan, err error) {
+	guard, err := newRemoteGuard(collName)
+	if err != nil {
+		return
+	}
+	if len(policy) == 0 {
+		policy = settings.POLICY_MERGE
+	}
+	plan = &uploadPlan{policy: policy, files: files, dirs: dirs, guard: guard}
+
+	switch policy {
+	case settings.POLICY_MERGE:
+	case settings.POLICY_REPLACE:
+		staging, backup := collName+stagingSuffix, collName+backupSuffix
+		// leftovers of a failed run
+		for _, root := range []string{staging, backup} {
+			var del []*remoteAction
+			if del, err = deleteTreeActions(fc, root, nil); err != nil {
+				return
+			}
+			plan.before = append(plan.before, del...)
+		}
+
+		plan.files = make([]*uploadFile, len(files))
+		for i, f := range files {
+			plan.files[i] = &uploadFile{f.localPath, staging + strings.TrimPrefix(f.remotePath, collName), f.size}
+		}
+		plan.dirs = make([]string, len(dirs))
+		for i, d := range dirs {
+			plan.dirs[i] = staging + strings.TrimPrefix(d, collName)
+		}
+
+		var exists bool
+		if _, _, exists, err = listRemoteTree(fc, collName); err != nil {
+			return
+		}
+		if exists {
+			plan.after = append(plan.after, &remoteAction{kind: "rename", path: collName, to: backup})
+		}
+		plan.after = append(plan.after, &remoteAction{kind: "rename", path: staging, to: collName})
+		if exists {
+			var del []*remoteAction
+			if del, err = deleteTreeActions(fc, collName, nil); err != nil {
+				return
+			}
+			// the old tree is deleted under its backup name
+			for _, a := range del {
+				a.path = backup + strings.TrimPrefix(a.path, collName)
+			}
+			plan.after = append(plan.after, del...)
+		}
+	case settings.POLICY_PRUNE:
+		keep := make(map[string]bool, len(files)+len(dirs))
+		for _, f := range files {
+			keep[f.remotePath] = true
+		}
+		for _, d := range dirs {
+			keep[d] = true
+		}
+		var del []*remoteAction
+		if del, err = deleteTreeActions(fc, collName, keep); err != nil {
+			return
+		}
+		// the excluded folders are not uploaded, so they are not pruned either
+		for _, a := range del {
+			if !inExcludedDir(strings.TrimPrefix(a.path, collName), excludedDirs) {
+				plan.after = append(plan.after, a)
+			}
+		}
+	default:
+		return nil, fmt.Errorf("Unknown upload policy %q, use one of %s, %s, %s", policy, settings.POLICY_MERGE, settings.POLICY_REPLACE, settings.POLICY_PRUNE)
+	}
+
+	for _, a := range append(plan.before, plan.after...) {
+		if err = guard.check(a.path); err != nil {
+			return
+		}
+		if a.kind == "rename" {
+			if err = guard.check(a.to); err != nil {
+				return
+			}
+		}
+	}
+	return
+}
+
+// deleteTreeActions lists the deletions needed to remove the remote tree root,
+// files first and then folders, deepest first. Paths in keep are spared along with their parents.
+func deleteTreeActions(fc *ftp4go.FTP, root string, keep map[string]bool) (actions []*remoteAction, err error) {
+	files, dirs, exists, err := listRemoteTree(fc, root)
+	if err != nil || !exists {
+		return
+	}
+	for _, f := range files {
+		if !keep[f] {
+			actions = append(actions, &remoteAction{kind: "delete", path: f})
+		}
+	}
+	// deepest folders first
+	sort.Sort(sort.Reverse(sort.StringSlice(dirs)))
+	for _, d := range dirs {
+		if keep != nil && (keep[d] || hasKeptChild(d, keep)) {
+			continue
+		}
+		actions = append(actions, &remoteAction{kind: "rmdir", path: d})
+	}
+	if keep == nil {
+		actions = append(actions, &remoteAction{kind: "rmdir", path: root})
+	}
+	return
+}
+
+// inExcludedDir tells whether one of the folders of the slash separated path p is excluded.
+func inExcludedDir(p string, excludedDirs []string) bool {
+	segs := strings.Split(p, "/")
+	for _, s := range segs[:len(segs)-1] {
+		for _, e := range excludedDirs {
+			if strings.EqualFold(s, e) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func hasKeptChild(dir string, keep map[string]bool) bool {
+	for k := range keep {
+		if strings.HasPrefix(k, dir+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// listRemoteTree returns the files and folders below the remote folder root, as
+// slash separated paths prefixed by root. exists is false if root is not in the listing
+// of its parent: ftp4go drops the reply codes, so a 550 to the listing of root can not be
+// told from the other errors, which are returned.
+func listRemoteTree(fc *ftp4go.FTP, root string) (files []string, dirs []string, exists bool, err error) {
+	var lines []string
+	if parent := path.Dir(root); parent == "." {
+		lines, err = fc.Dir()
+	} else {
+		lines, err = fc.Dir(parent)
+	}
+	if err != nil {
+		return nil, nil, false, fmt.Errorf("The remote folder %s could not be listed: %v", path.Dir(root), err)
+	}
+	for _, l := range lines {
+		if name, isDir, ok := parseListLine(l); ok && isDir && name == path.Base(root) {
+			exists = true
+			break
+		}
+	}
+	if !exists {
+		return
+	}
+	if files, dirs, err = listRemoteFolder(fc, root); err != nil {
+		return nil, nil, false, err
+	}
+	return
+}
+
+// listRemoteFolder lists the remote folder root, which exists, and its subfolders.
+func listRemoteFolder(fc *ftp4go.FTP, root string) (files []string, dirs []string, err error) {
+	lines, err := fc.Dir(root)
+	if err != nil {
+		return nil, nil, fmt.Errorf("The remote folder %s could not be listed: %v", root, err)
+	}
+	for _, l := range lines {
+		name, isDir, ok := parseListLine(l)
+		if !ok {
+			continue
+		}
+		p := path.Join(root, name)
+		if !isDir {
+			files = append(files, p)
+			continue
+		}
+		dirs = append(dirs, p)
+		sf, sd, err := listRemoteFolder(fc, p)
+		if err != nil {
+			return nil, nil, err
+		}
+		files = append(files, sf...)
+		dirs = append(dirs, sd...)
+	}
+	return
+}
+
+// parseListLine parses a line of a unix style LIST answer,
+// e.g. "-rw-r--r-- 1 owner group 1234 Jan 01 12:00 file name.jpg".
+func parseListLine(l string) (name string, isDir bool, ok bool) {
+	fields := strings.Fields(l)
+	if len(fields) < 2 || strings.EqualFold(fields[0], "total") {
+		return
+	}
+	if len(fields) >= 9 {
+		// names may contain spaces, keep everything after the time column
+		rest := l
+		for i := 0; i < 8; i++ {
+			rest = strings.TrimLeft(rest, " \t")
+			idx := strings.IndexAny(rest, " \t")
+			if idx < 0 {
+				return
+			}
+			rest = rest[idx:]
+		}
+		name = strings.TrimLeft(rest, " \t")
+	} else {
+		name = fields[len(fields)-1]
+	}
+	if name == "." || name == ".." || len(name) == 0 {
+		return
+	}
+	return name, fields[0][0] == 'd', true
+}
+
+// apply executes the remote actions, checking each path against the guard once more.
+func (plan *uploadPlan) apply(fc *ftp4go.FTP, actions []*remoteAction) (err error) {
+	for _, a := range actions {
+		if err = plan.guard.check(a.path); err != nil {
+			return
+		}
+		switch a.kind {
+		case "delete":
+			_, err = fc.Delete(a.path)
+		case "rmdir":
+			_, err = fc.Rmd(a.path)
+		case "rename":
+			if err = plan.guard.check(a.to); err != nil {
+				return
+			}
+			_, err = fc.Rename(a.path, a.to)
+		default:
+			err = errors.New("Unknown remote action: " + a.kind)
+		}
+		if err != nil {
+			return fmt.Errorf("Could not %s: %v", a, err)
+		}
+	}
+	return
+}
+
+// describe sends the plan as messages, one line per change.
+func (plan *uploadPlan) describe(id string, out chan<- *Message, dryRun bool) {
+	prefix := "Plan"
+	if dryRun {
+		prefix = "Dry run"
+	}
+	send := func(s string) {
+		out <- &Message{Id: id, Kind: "stdout", Body: fmt.Sprintf("%s: %s\n", prefix, s)}
+	}
+	send(fmt.Sprintf("policy %s, %d files to upload", plan.policy, len(plan.files)))
+	for _, a := range plan.before {
+		send(a.String())
+	}
+	if dryRun {
+		for _, f := range plan.files {
+			send("upload " + f.remotePath)
+		}
+	}
+	for _, a := range plan.after {
+		send(a.String())
+	}
+}
@@ -0,0 +1,94 @@
+package imageconvert
+
+import (
+	"io"
+	"sync"
+	"time"
+
+	"github.com/mezzato/goconvert/settings"
+)
+
+// bandwidthLimiter is a token bucket shared by all the connections of an upload.
+// A nil limiter does not throttle.
+type bandwidthLimiter struct {
+	sets   *settings.UploadSettings
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+func newBandwidthLimiter(sets *settings.UploadSettings) *bandwidthLimiter {
+	if sets == nil || sets.BandwidthKBps <= 0 {
+		return nil
+	}
+	return &bandwidthLimiter{sets: sets, last: time.Now()}
+}
+
+// wait reserves n bytes and blocks until they fit in the bandwidth cap.
+// It returns errUploadCancelled if the kill or abort channel is closed meanwhile.
+func (l *bandwidthLimiter) wait(n int, kill, abort <-chan struct{}) error {
+	if l == nil {
+		return nil
+	}
+
+	l.mu.Lock()
+	now := time.Now()
+	if l.sets.IsUnlimitedAt(now) {
+		l.tokens, l.last = 0, now
+		l.mu.Unlock()
+		return nil
+	}
+	rate := float64(l.sets.BandwidthKBps) * 1024
+	l.tokens += now.Sub(l.last).Seconds() * rate
+	if l.tokens > rate {
+		l.tokens = rate // allow a burst of one second at most
+	}
+	l.last = now
+	l.tokens -= float64(n)
+	var d time.Duration
+	if l.tokens < 0 {
+		d = time.Duration(-l.tokens / rate * float64(time.Second))
+	}
+	l.mu.Unlock()
+
+	if d == 0 {
+		return nil
+	}
+
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-kill:
+		return errUploadCancelled
+	case <-abort:
+		return errUploadCancelled
+	}
+}
+
+// uploadReader wraps the reader of a file being uploaded: it fails as soon as
+// the kill or abort channel is closed and throttles the transfer via the limiter.
+type uploadReader struct {
+	r       io.Reader
+	kill    <-chan struct{}
+	abort   <-chan struct{}
+	limiter *bandwidthLimiter
+}
+
+func (u *uploadReader) Read(b []byte) (n int, err error) {
+	select {
+	case <-u.kill:
+		return 0, errUploadCancelled
+	case <-u.abort:
+		return 0, errUploadCancelled
+	default:
+	}
+	n, err = u.r.Read(b)
+	if n > 0 {
+		if e := u.limiter.wait(n, u.kill, u.abort); e != nil {
+			return n, e
+		}
+	}
+	return
+}
@@ -0,0 +1,310 @@
+package imageconvert
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	ftp4go "github.com/mezzato/ftp4go"
+	"github.com/mezzato/goconvert/settings"
+)
+
+// progressInterval is the minimum time between two progress messages for the same file.
+const progressInterval = 500 * time.Millisecond
+
+var errUploadCancelled = errors.New("The upload has been cancelled.")
+
+// UploadProgress describes the state of a single file transfer.
+// It is attached to the "upload" messages sent during the upload stage.
+type UploadProgress struct {
+	File      string  `json:"file"`
+	FileIndex int     `json:"fileIndex"`
+	FileCount int     `json:"fileCount"`
+	Bytes     int64   `json:"bytes"`
+	Size      int64   `json:"size"`
+	Rate      float64 `json:"rate"`   // bytes per second
+	EtaSec    float64 `json:"etaSec"` // estimated seconds to complete the file
+}
+
+func (u *UploadProgress) String() string {
+	return fmt.Sprintf("Uploading %s (%d/%d): %s of %s at %s/s, %.0f seconds left\n",
+		u.File, u.FileIndex, u.FileCount, formatBytes(u.Bytes), formatBytes(u.Size), formatBytes(int64(u.Rate)), u.EtaSec)
+}
+
+func formatBytes(b int64) string {
+	const unit = 1024
+	if b < unit {
+		return fmt.Sprintf("%d B", b)
+	}
+	div, exp := int64(unit), 0
+	for n := b / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %cB", float64(b)/float64(div), "KMGTPE"[exp])
+}
+
+// uploadFile is a local file of the collection and its path on the FTP server,
+// relative to the remote root folder.
+type uploadFile struct {
+	localPath  string
+	remotePath string
+	size       int64
+}
+
+// collectUploadFiles walks the collection folder and returns the files to upload
+// and the remote folders to create, parents first. Folders whose name matches
+// one of excludedDirs, case insensitive, are skipped.
+func collectUploadFiles(localDir string, excludedDirs []string) (files []*uploadFile, dirs []string, err error) {
+	exDirs := make([]string, len(excludedDirs))
+	for i, d := range excludedDirs {
+		exDirs[i] = strings.ToLower(d)
+	}
+	sort.Strings(exDirs)
+
+	collName := filepath.Base(localDir)
+
+	err = filepath.Walk(localDir, func(p string, fi os.FileInfo, e error) error {
+		if e != nil {
+			return e
+		}
+		rel, e := filepath.Rel(localDir, p)
+		if e != nil {
+			return e
+		}
+		remotePath := path.Join(collName, filepath.ToSlash(rel))
+		if fi.IsDir() {
+			lname := strings.ToLower(fi.Name())
+			if idx := sort.SearchStrings(exDirs, lname); p != localDir && idx < len(exDirs) && exDirs[idx] == lname {
+				return filepath.SkipDir
+			}
+			dirs = append(dirs, remotePath)
+			return nil
+		}
+		files = append(files, &uploadFile{p, remotePath, fi.Size()})
+		return nil
+	})
+	return
+}
+
+// collectionUploadFiles returns the files and folders of the collection folder localDir to
+// upload, and the subfolders left out. The original images are only uploaded when the
+// gallery links them, the manifest is never.
+func collectionUploadFiles(sets *settings.Settings, localDir string) (files []*uploadFile, dirs, excludedDirs []string, err error) {
+	high := sets.PiwigoGalleryHighDirName
+	if !sets.Gallery || !sets.GalleryDownloads {
+		excludedDirs = []string{high}
+	}
+	if files, dirs, err = collectUploadFiles(localDir, excludedDirs); err != nil || len(excludedDirs) > 0 {
+		return
+	}
+	manifest := path.Join(filepath.Base(localDir), high, MANIFEST_FILE_NAME)
+	for i, f := range files {
+		if f.remotePath == manifest {
+			files = append(files[:i], files[i+1:]...)
+			break
+		}
+	}
+	return
+}
+
+// dialFtp opens a new connection to the FTP server and moves into the remote folder.
+func dialFtp(fs *settings.FtpSettings) (fc *ftp4go.FTP, err error) {
+	fc = ftp4go.NewFTP(0) // 1 for debugging
+	fc.SetPassive(true)
+
+	if _, err = fc.Connect(fs.Address, ftp4go.DefaultFtpPort, ""); err != nil {
+		return nil, fmt.Errorf("The FTP connection could not be established, error: %v", err)
+	}
+
+	if _, err = fc.Login(fs.Username, fs.Password, ""); err != nil {
+		fc.Quit()
+		return nil, fmt.Errorf("The FTP login was invalid, error: %v", err)
+	}
+
+	if len(fs.RemoteDir) > 0 {
+		if _, err = fc.Cwd(fs.RemoteDir); err != nil {
+			fc.Quit()
+			return nil, fmt.Errorf("The remote folder %s could not be opened, error: %v", fs.RemoteDir, err)
+		}
+	}
+	return
+}
+
+// UploadCollection uploads the collection folder localDir into the remote folder
+// of the FTP server specified in the settings. The high resolution archive folder is not uploaded.
+// Files are spread over UploadSettings.MaxConnections connections sharing the bandwidth cap.
+// A collection already on the server is handled according to FtpSettings.Policy; the planned
+// remote changes are always listed first and, in dry run mode, nothing else is done.
+// Progress is sent as "upload" messages on out with the given id; closing kill aborts the transfer.
+// Returns the number of files uploaded.
+func UploadCollection(id string, sets *settings.Settings, localDir string, out chan<- *Message, kill <-chan struct{}) (n int, err error) {
+	fs := sets.FtpSettings
+	if fs == nil || len(fs.Address) == 0 {
+		return 0, errors.New("The ftp address must be specified to upload the collection.")
+	}
+	if len(localDir) == 0 {
+		return 0, errors.New("The collection name can not be empty")
+	}
+
+	if _, err = sets.ResolvePassword(); err != nil {
+		return
+	}
+
+	files, dirs, excludedDirs, err := collectionUploadFiles(sets, localDir)
+	if err != nil {
+		return
+	}
+
+	conns := 1
+	if sets.UploadSettings != nil && sets.UploadSettings.MaxConnections > 1 {
+		conns = sets.UploadSettings.MaxConnections
+	}
+	if conns > len(files) {
+		conns = len(files)
+	}
+
+	// the first connection prepares the remote folders
+	fc, err := dialFtp(fs)
+	if err != nil {
+		return
+	}
+	pool := []*ftp4go.FTP{fc}
+	defer func() {
+		for _, c := range pool {
+			c.Quit()
+		}
+	}()
+
+	plan, err := planUpload(fc, fs.Policy, filepath.Base(localDir), files, dirs, excludedDirs)
+	if err != nil {
+		return
+	}
+	dryRun := sets.UploadSettings != nil && sets.UploadSettings.DryRun
+	plan.describe(id, out, dryRun)
+	if dryRun {
+		return
+	}
+	if err = plan.apply(fc, plan.before); err != nil {
+		return
+	}
+	files = plan.files
+
+	for _, d := range plan.dirs {
+		// the folder may already exist, a real failure shows up when storing the files
+		fc.Mkd(d)
+	}
+
+	for len(pool) < conns {
+		c, e := dialFtp(fs)
+		if e != nil {
+			// the server may limit the connections per user, go on with the ones open
+			out <- &Message{Id: id, Kind: "stderr", Body: fmt.Sprintf("Uploading with %d connections only: %v\n", len(pool), e)}
+			break
+		}
+		pool = append(pool, c)
+	}
+
+	limiter := newBandwidthLimiter(sets.UploadSettings)
+	queue := make(chan int)
+	abort := make(chan struct{})
+	var (
+		mu   sync.Mutex
+		once sync.Once
+		wg   sync.WaitGroup
+	)
+
+	for _, c := range pool {
+		wg.Add(1)
+		go func(c *ftp4go.FTP) {
+			defer wg.Done()
+			for i := range queue {
+				f := files[i]
+				e := uploadOne(c, f, i+1, len(files), id, out, &uploadReader{kill: kill, abort: abort, limiter: limiter})
+				mu.Lock()
+				if e == nil {
+					n++
+				} else if err == nil {
+					if e == errUploadCancelled {
+						err = e
+					} else {
+						err = fmt.Errorf("Error uploading file %s: %v", f.remotePath, e)
+					}
+				}
+				mu.Unlock()
+				if e != nil {
+					// stop the other connections too
+					once.Do(func() { close(abort) })
+				}
+			}
+		}(c)
+	}
+
+feed:
+	for i := range files {
+		select {
+		case queue <- i:
+		case <-abort:
+			break feed
+		case <-kill:
+			break feed
+		}
+	}
+	close(queue)
+	wg.Wait()
+
+	select {
+	case <-kill:
+		if err == nil && n < len(files) {
+			err = errUploadCancelled
+		}
+	default:
+	}
+	if err == nil {
+		err = plan.apply(fc, plan.after)
+	}
+	return
+}
+
+// uploadOne stores a single file through the reader r, reporting its progress at most every progressInterval.
+func uploadOne(fc *ftp4go.FTP, f *uploadFile, index, count int, id string, out chan<- *Message, r *uploadReader) (err error) {
+	lf, err := os.Open(f.localPath)
+	if err != nil {
+		return
+	}
+	defer lf.Close()
+	r.r = lf
+	start := time.Now()
+	var last time.Time
+
+	callback := func(info *ftp4go.CallbackInfo) {
+		now := time.Now()
+		if !info.Eof && now.Sub(last) < progressInterval {
+			return
+		}
+		last = now
+
+		pr := &UploadProgress{
+			File:      f.remotePath,
+			FileIndex: index,
+			FileCount: count,
+			Bytes:     info.BytesTransmitted,
+			Size:      f.size,
+		}
+		if elapsed := now.Sub(start).Seconds(); elapsed > 0 {
+			pr.Rate = float64(pr.Bytes) / elapsed
+		}
+		if pr.Rate > 0 {
+			pr.EtaSec = float64(pr.Size-pr.Bytes) / pr.Rate
+		}
+		out <- &Message{Id: id, Kind: "upload", Body: pr.String(), Progress: pr}
+	}
+
+	return fc.StoreBytes(ftp4go.STORE_FTP_CMD, r, ftp4go.BLOCK_SIZE, f.remotePath, f.localPath, callback)
+}
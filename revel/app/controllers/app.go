@@ -12,6 +12,8 @@ type Page struct {
 	Title          string
 	WebPort        int
 	SettingsAsJson string
+	Profiles       []string // the profiles of the configuration file
+	Profile        string   // the profile of SettingsAsJson
 }
 
 var (
@@ -23,14 +25,25 @@ type App struct {
 	*revel.Controller
 }
 
-func (c App) Index() revel.Result {
+// Index renders the conversion page with the settings of the given profile.
+func (c App) Index(profile string) revel.Result {
 
-	settingsAsJson, err := json.Marshal(defaultSettings)
+	sets, err := settings.LoadProfile(profile, homeImgDir)
+	if err != nil {
+		return c.RenderError(err)
+	}
+	sets.SourceDir = homeImgDir
+	profiles, err := settings.ListProfiles(homeImgDir)
+	if err != nil {
+		return c.RenderError(err)
+	}
+
+	settingsAsJson, err := json.Marshal(sets)
 	if err != nil {
 		return nil
 	}
 
-	p := &Page{WebPort: revel.HTTPPort, SettingsAsJson: string(settingsAsJson)}
+	p := &Page{WebPort: revel.HTTPPort, SettingsAsJson: string(settingsAsJson), Profiles: profiles, Profile: sets.Profile}
 
 	return c.Render(p)
 }
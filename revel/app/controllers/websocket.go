@@ -1,7 +1,9 @@
 package controllers
 
 import (
+	"context"
 	"encoding/json"
+	"fmt"
 	"io"
 	"log"
 
@@ -10,15 +12,20 @@ import (
 	"golang.org/x/net/websocket"
 )
 
-const msgLimit = 1000 // max number of messages to send per session
+const outboxSize = 1000 // max number of messages queued per client, see imageconvert.Outbox
 
 type WebSocket struct {
 	*revel.Controller
 }
 
 func (ws WebSocket) ConvertSocket(c *websocket.Conn) revel.Result {
-	in, out := make(chan *imageconvert.Message), make(chan *imageconvert.Message)
+	in := make(chan *imageconvert.Message)
 	errc := make(chan error, 1)
+	// the processes are never held up by a slow client, their output is queued
+	out := imageconvert.NewOutbox(outboxSize, func(id string, n int) imageconvert.Delivery {
+		return &imageconvert.Message{Id: id, Kind: "stderr", Body: fmt.Sprintf("%d messages have been dropped, the connection is too slow.\n", n)}
+	})
+	defer out.Close()
 
 	// Decode messages from client and send to the in channel.
 	go func() {
@@ -34,10 +41,14 @@ func (ws WebSocket) ConvertSocket(c *websocket.Conn) revel.Result {
 		}
 	}()
 
-	// Receive messages from the out channel and encode to the client.
+	// Receive messages from the outbox and encode to the client.
 	go func() {
 		enc := json.NewEncoder(c)
-		for m := range out {
+		for {
+			m, ok := out.Get(nil)
+			if !ok {
+				return
+			}
 			if err := enc.Encode(m); err != nil {
 				errc <- err
 				return
@@ -45,29 +56,20 @@ func (ws WebSocket) ConvertSocket(c *websocket.Conn) revel.Result {
 		}
 	}()
 
-	in, out = make(chan *imageconvert.Message), make(chan *imageconvert.Message)
-	errc = make(chan error, 1)
-
 	// Start and kill processes and handle errors.
-	proc := make(map[string]*imageconvert.Process)
+	proc := make(map[string]*imageconvert.Job)
 	for {
 		select {
 		case m := <-in:
 			switch m.Kind {
 			case "run":
 				log.Println("try to kill process with id: " + m.Id)
-				proc[m.Id].Kill()
+				proc[m.Id].Cancel()
 				log.Println("killed process with id: " + m.Id)
-				lOut := limiter(in, out)
-				p, _, e := imageconvert.CreateAndStartProcess(m.Id, m.Body, lOut, m.Options)
-				if e != nil {
-					log.Println(e)
-					break
-				}
+				proc[m.Id] = imageconvert.StartMessage(context.Background(), m, deliver(out))
 				log.Println("running process with id: " + m.Id)
-				proc[m.Id] = p
 			case "kill":
-				proc[m.Id].Kill()
+				proc[m.Id].Cancel()
 				log.Println("killed process with id: " + m.Id)
 			}
 		case err := <-errc:
@@ -77,8 +79,8 @@ func (ws WebSocket) ConvertSocket(c *websocket.Conn) revel.Result {
 			}
 			log.Println("shutting down")
 			// Shut down any running processes.
-			for _, p := range proc {
-				p.Kill()
+			for _, j := range proc {
+				j.Cancel()
 			}
 			// ! do not return
 			break
@@ -86,25 +88,15 @@ func (ws WebSocket) ConvertSocket(c *websocket.Conn) revel.Result {
 	}
 }
 
-// limiter returns a channel that wraps dest. Messages sent to the channel are
-// sent to dest. After msgLimit Messages have been passed on, a "kill" imageconvert.Message
-// is sent to the kill channel, and only "end" messages are passed.
-func limiter(kill chan<- *imageconvert.Message, dest chan<- *imageconvert.Message) chan<- *imageconvert.Message {
+// deliver returns a channel whose Messages are queued in out, until the "end" one.
+func deliver(out *imageconvert.Outbox) chan<- *imageconvert.Message {
 	ch := make(chan *imageconvert.Message)
 	go func() {
-		n := 0
 		for m := range ch {
-			switch {
-			case n < msgLimit || m.Kind == "end":
-				dest <- m
-				if m.Kind == "end" {
-					return
-				}
-			case n == msgLimit:
-				// process produced too much output. Kill it.
-				kill <- &imageconvert.Message{Id: m.Id, Kind: "kill"}
+			out.Put(m)
+			if m.Kind == "end" {
+				return
 			}
-			n++
 		}
 	}()
 	return ch
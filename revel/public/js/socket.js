@@ -24,7 +24,14 @@
     if (m.Kind === "stdout" || m.Kind === "stderr") {
       showMessage(o, m.Body, m.Kind);
     }
+    if (m.Kind === "upload") {
+      showProgress(o, m.Body, m.Progress);
+    }
     if (m.Kind === "end") {
+      if (m.Fields) {
+        // the settings were refused, let the page highlight them
+        o.dispatchEvent(new CustomEvent("fielderrors", {detail: m.Fields}));
+      }
       var s = "Program exited";
       if (m.Body !== "") {
         s += ": " + m.Body;
@@ -55,6 +62,23 @@
         o.scrollTop = o.scrollHeight - o.offsetHeight;
   }
 
+  // showProgress keeps a single line per uploaded file and rewrites it
+  // until the file has been transferred.
+  function showProgress(o, m, p) {
+    var span = o.uploadSpan;
+    if (!span) {
+      span = document.createElement("span");
+      span.className = "upload";
+      o.appendChild(span);
+      o.uploadSpan = span;
+    }
+    span.textContent = m;
+    if (!p || p.bytes >= p.size) {
+      o.uploadSpan = null;
+    }
+    o.scrollTop = o.scrollHeight - o.offsetHeight;
+  }
+
   function run(body, output, options) {
     var id = output.id;
     outputs[id] = output;
@@ -0,0 +1,357 @@
+package settings
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+// Sources of the settings, from the lowest to the highest priority.
+const (
+	SOURCE_DEFAULT = "default"
+	SOURCE_SYSTEM  = "system"  // in /etc/goconvert
+	SOURCE_BINARY  = "binary"  // next to the executable, where older versions saved it
+	SOURCE_USER    = "user"    // in $XDG_CONFIG_HOME/goconvert
+	SOURCE_PROJECT = "project" // in the image folder
+	SOURCE_CONFIG  = "config"  // given with -config or GOCONVERT_CONFIG
+	SOURCE_ENV     = "env"
+	SOURCE_FLAG    = "flag"
+)
+
+// ENV_CONFIG names an explicit configuration file, as the -config flag.
+const ENV_CONFIG = "GOCONVERT_CONFIG"
+
+// ConfigFile is the explicit configuration file, merged last and written instead of the user file.
+// GOCONVERT_CONFIG is used when empty.
+var ConfigFile string
+
+// systemConfigDir is a variable for the tests.
+var systemConfigDir = func() string {
+	if runtime.GOOS == "windows" {
+		return filepath.Join(os.Getenv("ProgramData"), "goconvert")
+	}
+	return "/etc/goconvert"
+}()
+
+// ConfigSource is a configuration file merged into the settings.
+type ConfigSource struct {
+	Name    string // one of the SOURCE_ constants
+	Path    string
+	Exists  bool
+	Ignored []string // the other configuration files of the folder, see configFileNames
+}
+
+func (src *ConfigSource) String() string {
+	return src.Name + " " + src.Path
+}
+
+func explicitConfigFile() string {
+	if len(ConfigFile) > 0 {
+		return ConfigFile
+	}
+	return os.Getenv(ENV_CONFIG)
+}
+
+// UserConfigFile returns the configuration file of the current user,
+// in $XDG_CONFIG_HOME/goconvert or the user configuration folder of the system.
+// It is goconvert.conf unless a file of another format is there, see configFileNames.
+func UserConfigFile() string {
+	fn, _ := findConfigFile(UserConfigDir())
+	return fn
+}
+
+// UserConfigDir returns the goconvert folder of the user configuration, see UserConfigFile.
+func UserConfigDir() string {
+	dir := os.Getenv("XDG_CONFIG_HOME")
+	if len(dir) == 0 {
+		if d, err := os.UserConfigDir(); err == nil {
+			dir = d
+		} else {
+			dir = filepath.Join(GetHomeDir(), ".config")
+		}
+	}
+	return filepath.Join(dir, "goconvert")
+}
+
+// ConfigSources returns the configuration files in merge order: system, binary, user,
+// project and explicit. The project file is looked up in sourceDir, skipped if empty.
+// In each folder the first of goconvert.conf, .toml, .yaml, .yml and .json is read.
+func ConfigSources(sourceDir string) (l []*ConfigSource) {
+	dirs := [][2]string{
+		{SOURCE_SYSTEM, systemConfigDir},
+		{SOURCE_BINARY, filepath.Dir(argv0)},
+		{SOURCE_USER, UserConfigDir()},
+	}
+	if len(sourceDir) > 0 {
+		dirs = append(dirs, [2]string{SOURCE_PROJECT, sourceDir})
+	}
+	var paths [][2]string
+	ignored := make(map[string][]string)
+	for _, d := range dirs {
+		fn, others := findConfigFile(d[1])
+		paths = append(paths, [2]string{d[0], fn})
+		ignored[fn] = others
+	}
+	if fn := explicitConfigFile(); len(fn) > 0 {
+		paths = append(paths, [2]string{SOURCE_CONFIG, fn})
+	}
+
+	seen := make(map[string]bool)
+	for _, p := range paths {
+		abs, err := filepath.Abs(p[1])
+		if err != nil {
+			abs = p[1]
+		}
+		// the same file is merged once, at its highest priority
+		if seen[abs] {
+			for i, src := range l {
+				if src.Path == abs {
+					l = append(l[:i], l[i+1:]...)
+					break
+				}
+			}
+		}
+		seen[abs] = true
+		fi, err := os.Stat(abs)
+		l = append(l, &ConfigSource{p[0], abs, err == nil && !fi.IsDir(), ignored[p[1]]})
+	}
+	return
+}
+
+// ConfigFilePath returns the file written by SaveSettingsToFile:
+// the explicit configuration file if any, else the user one.
+func ConfigFilePath() string {
+	if fn := explicitConfigFile(); len(fn) > 0 {
+		return fn
+	}
+	return UserConfigFile()
+}
+
+// Origins maps the option keys to where their effective value comes from,
+// e.g. "user /home/me/.config/goconvert/goconvert.conf" or "env GOCONVERT_WIDTH".
+type Origins map[string]string
+
+func (or Origins) set(o *Option, origin string) {
+	if or != nil {
+		or[o.Key()] = origin
+	}
+}
+
+type configLayer struct {
+	source *ConfigSource
+	doc    *configDoc
+}
+
+// readConfigLayers reads the existing configuration files, which must be valid.
+func readConfigLayers(sourceDir string) (layers []*configLayer, err error) {
+	for _, src := range ConfigSources(sourceDir) {
+		if !src.Exists {
+			continue
+		}
+		d, err := readConfigDoc(src.Path)
+		if err != nil {
+			return nil, err
+		}
+		if errs := d.validate(); len(errs) > 0 {
+			return nil, invalidConfigFile(src.Path, errs)
+		}
+		layers = append(layers, &configLayer{src, d})
+	}
+	return
+}
+
+// readConfigFile reads the file written by SaveSettingsToFile, empty if it does not exist.
+func readConfigFile() (d *configDoc, err error) {
+	fn := ConfigFilePath()
+	if _, e := os.Stat(fn); e != nil {
+		return newConfigDoc(FormatOf(fn) != FORMAT_INI), nil
+	}
+	return readConfigDoc(fn)
+}
+
+func writeConfigFile(d *configDoc) error {
+	return writeConfigDoc(ConfigFilePath(), d)
+}
+
+// applyConfigFile sets the options present in the base sections of the configuration file.
+func applyConfigFile(s *Settings, d *configDoc, origins Origins, origin string) error {
+	for _, o := range options {
+		if len(o.Section) == 0 {
+			continue
+		}
+		v, ok := d.sections[o.Section][o.Name]
+		if !ok {
+			continue
+		}
+		if err := o.setValue(s, v, d.typed); err != nil {
+			return fmt.Errorf("%s: %s: %v", origin, o.Key(), err)
+		}
+		origins.set(o, origin)
+	}
+	return nil
+}
+
+// applyProfile sets the options present in the profile of the configuration file.
+// found is false if the file has no such profile.
+func applyProfile(s *Settings, d *configDoc, name string, origins Origins, origin string) (found bool, err error) {
+	if !d.hasProfile(name) {
+		return
+	}
+	origin = fmt.Sprintf("%s [%s]", origin, profileSection(name))
+	p := d.profile(name)
+	for _, o := range options {
+		if len(o.Section) == 0 {
+			continue
+		}
+		v, ok := p[o.Key()]
+		if !ok {
+			continue
+		}
+		if err = o.setValue(s, v, d.typed); err != nil {
+			return true, fmt.Errorf("%s: %s: %v", origin, o.Key(), err)
+		}
+		origins.set(o, origin)
+	}
+	return true, nil
+}
+
+// loadConfig merges the base sections of all the configuration files over the defaults,
+// then the named profile of all the files: a profile inherits the merged base sections.
+func loadConfig(profile string, sourceDir string, origins Origins) (s *Settings, err error) {
+	s = NewDefaultSettings("", ".")
+	s.SaveConfig = false
+	for _, o := range options {
+		origins.set(o, SOURCE_DEFAULT)
+	}
+
+	layers, err := readConfigLayers(sourceDir)
+	if err != nil {
+		return nil, err
+	}
+	for _, l := range layers {
+		if err = applyConfigFile(s, l.doc, origins, l.source.String()); err != nil {
+			return nil, err
+		}
+	}
+	if len(profile) == 0 {
+		return
+	}
+
+	var found bool
+	for _, l := range layers {
+		f, err := applyProfile(s, l.doc, profile, origins, l.source.String())
+		if err != nil {
+			return nil, err
+		}
+		found = found || f
+	}
+	if !found {
+		return nil, fmt.Errorf("Unknown profile %q", profile)
+	}
+	s.Profile = strings.ToLower(strings.TrimSpace(profile))
+	return
+}
+
+// LoadProfile returns the settings of the configuration files, with the named profile applied.
+// An empty name loads the base sections only. The project file is looked up in sourceDir.
+func LoadProfile(name string, sourceDir string) (s *Settings, err error) {
+	return loadConfig(name, sourceDir, nil)
+}
+
+// ConfigSelection returns the profile and the image folder selecting the configuration,
+// from the flag values or else the environment. The image folder defaults to the current one.
+func ConfigSelection(flagValues map[string]string) (profile, sourceDir string) {
+	profile, sourceDir = os.Getenv(ENV_PROFILE), os.Getenv("GOCONVERT_SOURCEDIR")
+	if v, ok := flagValues["profile"]; ok {
+		profile = v
+	}
+	if v, ok := flagValues["f"]; ok {
+		sourceDir = v
+	}
+	if len(sourceDir) == 0 {
+		sourceDir = "."
+	}
+	return
+}
+
+// LoadSettings builds the settings without asking anything, see LoadSettingsWithOrigins.
+func LoadSettings(flagValues map[string]string) (s *Settings, err error) {
+	s, _, err = LoadSettingsWithOrigins(flagValues)
+	return
+}
+
+// LoadSettingsWithOrigins builds the settings without asking anything: the defaults are
+// overridden by the configuration files (see ConfigSources) and their profile selected by
+// -profile or GOCONVERT_PROFILE, then by the environment variables and last by the flag values.
+// The FTP password is then resolved through the credential providers if still missing.
+// Use CheckConversion and CheckUpload to make sure the mandatory settings are there.
+func LoadSettingsWithOrigins(flagValues map[string]string) (s *Settings, origins Origins, err error) {
+	profile, sourceDir := ConfigSelection(flagValues)
+	origins = make(Origins)
+	if s, err = loadConfig(profile, sourceDir, origins); err != nil {
+		return
+	}
+	if err = applyEnv(s, origins); err != nil {
+		return nil, nil, err
+	}
+	if err = applyValues(s, flagValues, origins); err != nil {
+		return nil, nil, err
+	}
+	if p, e := s.ResolvePassword(); e != nil {
+		return nil, nil, e
+	} else if len(p) > 0 {
+		origins.set(FindOption("ftp-password"), "credential provider "+p)
+	}
+	return
+}
+
+// SetConfigValue writes a single option to the configuration file written by SaveSettingsToFile,
+// in the section of the profile if not empty. The key is section.option or the flag name.
+func SetConfigValue(profile, key, value string) (err error) {
+	o := FindOption(key)
+	if o == nil || len(o.Section) == 0 {
+		return fmt.Errorf("Unknown configuration key %q", key)
+	}
+	s := newSettings()
+	if err = o.setValue(s, value, false); err != nil {
+		return fmt.Errorf("Invalid value for %s: %v", o.Key(), err)
+	}
+	d, err := readConfigFile()
+	if err != nil {
+		return
+	}
+	var v interface{} = value
+	if d.typed {
+		v = paramValue(o.param(s))
+	}
+	if len(profile) > 0 {
+		d.profile(profile)[o.Key()] = v
+	} else {
+		d.section(o.Section)[o.Name] = v
+	}
+	return writeConfigFile(d)
+}
+
+// ValidateConfigFiles checks the configuration files against the schema and returns one error
+// per unknown option or invalid value, prefixed with the file name.
+func ValidateConfigFiles(sourceDir string) (errs []error) {
+	for _, src := range ConfigSources(sourceDir) {
+		for _, fn := range src.Ignored {
+			errs = append(errs, fmt.Errorf("%s: ignored, %s is read instead", fn, filepath.Base(src.Path)))
+		}
+		if !src.Exists {
+			continue
+		}
+		d, err := readConfigDoc(src.Path)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		for _, e := range d.validate() {
+			errs = append(errs, fmt.Errorf("%s: %v", src.Path, e))
+		}
+	}
+	return
+}
@@ -0,0 +1,404 @@
+package settings
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/crypto/pbkdf2"
+	"golang.org/x/term"
+)
+
+const (
+	PROVIDER_ENV     = "env"
+	PROVIDER_NETRC   = "netrc"
+	PROVIDER_KEYFILE = "keyfile"
+	PROVIDER_COMMAND = "command"
+)
+
+// ENV_FTP_PASSWORD is the environment variable read by the env provider,
+// ENV_PASSPHRASE the one unlocking the keyfile.
+const ENV_FTP_PASSWORD = "GOCONVERT_FTP_PASSWORD"
+const ENV_PASSPHRASE = "GOCONVERT_PASSPHRASE"
+
+const keyfileIterations = 100000
+
+// CredentialProvider looks up the password of a user on a host.
+// found is false, with a nil error, when the provider has no entry for them.
+type CredentialProvider interface {
+	Name() string
+	Password(host, username string) (password string, found bool, err error)
+}
+
+// CredentialSettings select the providers tried, in order, to resolve the FTP password.
+type CredentialSettings struct {
+	Providers []string `json:"providers"`
+	NetrcFile string   `json:"netrcFile"`
+	Keyfile   string   `json:"keyfile"`
+	Command   string   `json:"command"`
+}
+
+func newCredentialSettings() *CredentialSettings {
+	return &CredentialSettings{
+		Providers: []string{PROVIDER_ENV, PROVIDER_NETRC},
+		NetrcFile: filepath.Join(GetHomeDir(), ".netrc"),
+	}
+}
+
+// CredentialProviders returns the configured providers in lookup order.
+// The keyfile and command providers are skipped if their file or command is not set.
+func (c *CredentialSettings) CredentialProviders() (l []CredentialProvider, err error) {
+	if c == nil {
+		c = newCredentialSettings()
+	}
+	for _, name := range c.Providers {
+		switch strings.TrimSpace(name) {
+		case PROVIDER_ENV:
+			l = append(l, &EnvCredentialProvider{ENV_FTP_PASSWORD})
+		case PROVIDER_NETRC:
+			l = append(l, &NetrcCredentialProvider{c.NetrcFile})
+		case PROVIDER_KEYFILE:
+			if len(c.Keyfile) > 0 {
+				l = append(l, &KeyfileCredentialProvider{c.Keyfile, envPassphrase})
+			}
+		case PROVIDER_COMMAND:
+			if len(c.Command) > 0 {
+				l = append(l, &CommandCredentialProvider{c.Command})
+			}
+		case "":
+		default:
+			return nil, fmt.Errorf("Unknown credential provider: %s", name)
+		}
+	}
+	return
+}
+
+// ResolvePassword fills in the FTP password from the credential providers if it is empty.
+// It returns the name of the provider used, empty if none had the password.
+func (s *Settings) ResolvePassword() (provider string, err error) {
+	fs := s.FtpSettings
+	if fs == nil || len(fs.Address) == 0 || len(fs.Password) > 0 {
+		return
+	}
+	providers, err := s.CredentialSettings.CredentialProviders()
+	if err != nil {
+		return
+	}
+	for _, p := range providers {
+		pwd, found, e := p.Password(fs.Address, fs.Username)
+		if e != nil {
+			return "", fmt.Errorf("Credential provider %s failed: %v", p.Name(), e)
+		}
+		if found {
+			fs.Password = pwd
+			return p.Name(), nil
+		}
+	}
+	return
+}
+
+// EnvCredentialProvider reads the password from an environment variable.
+type EnvCredentialProvider struct {
+	Variable string
+}
+
+func (p *EnvCredentialProvider) Name() string { return PROVIDER_ENV }
+
+func (p *EnvCredentialProvider) Password(host, username string) (string, bool, error) {
+	v, ok := os.LookupEnv(p.Variable)
+	return v, ok && len(v) > 0, nil
+}
+
+// NetrcCredentialProvider reads a netrc style file:
+//
+//	machine ftp.example.com login user password secret
+//	default login anonymous password guest
+type NetrcCredentialProvider struct {
+	Path string
+}
+
+func (p *NetrcCredentialProvider) Name() string { return PROVIDER_NETRC }
+
+func (p *NetrcCredentialProvider) Password(host, username string) (password string, found bool, err error) {
+	b, err := os.ReadFile(p.Path)
+	if os.IsNotExist(err) {
+		return "", false, nil
+	}
+	if err != nil {
+		return
+	}
+
+	var def *netrcEntry
+	for _, e := range parseNetrc(string(b)) {
+		if len(e.login) > 0 && len(username) > 0 && e.login != username {
+			continue
+		}
+		if e.isDefault {
+			if def == nil {
+				def = e
+			}
+			continue
+		}
+		if e.machine == host {
+			return e.password, true, nil
+		}
+	}
+	if def != nil {
+		return def.password, true, nil
+	}
+	return
+}
+
+type netrcEntry struct {
+	machine, login, password string
+	isDefault                bool
+}
+
+func parseNetrc(data string) (entries []*netrcEntry) {
+	var e *netrcEntry
+	tokens := strings.Fields(data)
+	next := func(i *int) string {
+		if *i+1 < len(tokens) {
+			*i++
+			return tokens[*i]
+		}
+		return ""
+	}
+	for i := 0; i < len(tokens); i++ {
+		switch tokens[i] {
+		case "machine":
+			e = &netrcEntry{machine: next(&i)}
+			entries = append(entries, e)
+		case "default":
+			e = &netrcEntry{isDefault: true}
+			entries = append(entries, e)
+		case "login":
+			if v := next(&i); e != nil {
+				e.login = v
+			}
+		case "password":
+			if v := next(&i); e != nil {
+				e.password = v
+			}
+		case "account", "macdef":
+			next(&i)
+		}
+	}
+	return
+}
+
+// CommandCredentialProvider runs an external helper and reads the password from the first
+// line of its output. The host and user are passed in the GOCONVERT_HOST and GOCONVERT_USER
+// environment variables; an empty output means no password.
+type CommandCredentialProvider struct {
+	Command string
+}
+
+func (p *CommandCredentialProvider) Name() string { return PROVIDER_COMMAND }
+
+func (p *CommandCredentialProvider) Password(host, username string) (password string, found bool, err error) {
+	args := strings.Fields(p.Command)
+	if len(args) == 0 {
+		return
+	}
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Env = append(os.Environ(), "GOCONVERT_HOST="+host, "GOCONVERT_USER="+username)
+	cmd.Stderr = os.Stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return
+	}
+	line, _ := bufio.NewReader(bytes.NewReader(out)).ReadString('\n')
+	password = strings.TrimRight(line, "\r\n")
+	return password, len(password) > 0, nil
+}
+
+// KeyfileCredentialProvider reads the passwords from a local file encrypted with AES-GCM,
+// whose key is derived from a passphrase. See SaveKeyfileCredential to add entries.
+type KeyfileCredentialProvider struct {
+	Path       string
+	Passphrase func() (string, error)
+}
+
+type keyfile struct {
+	Salt  string `json:"salt"`
+	Nonce string `json:"nonce"`
+	Data  string `json:"data"`
+}
+
+// envPassphrase reads the keyfile passphrase from the environment and
+// falls back to asking for it when running in a terminal.
+func envPassphrase() (string, error) {
+	if v := os.Getenv(ENV_PASSPHRASE); len(v) > 0 {
+		return v, nil
+	}
+	if fi, err := os.Stdin.Stat(); Interactive && err == nil && fi.Mode()&os.ModeCharDevice != 0 {
+		ans, err := askSecret("The passphrase to unlock the credentials keyfile: ")
+		return strings.TrimSpace(ans), err
+	}
+	return "", fmt.Errorf("The keyfile passphrase must be set in the %s environment variable", ENV_PASSPHRASE)
+}
+
+func credentialKey(host, username string) string {
+	return username + "@" + host
+}
+
+func (p *KeyfileCredentialProvider) Name() string { return PROVIDER_KEYFILE }
+
+func (p *KeyfileCredentialProvider) Password(host, username string) (password string, found bool, err error) {
+	if _, e := os.Stat(p.Path); os.IsNotExist(e) {
+		return "", false, nil
+	}
+	passphrase, err := p.Passphrase()
+	if err != nil {
+		return
+	}
+	entries, err := readKeyfile(p.Path, passphrase)
+	if err != nil {
+		return
+	}
+	password, found = entries[credentialKey(host, username)]
+	return
+}
+
+// SaveKeyfileCredential stores the password of username on host in the encrypted keyfile at path,
+// creating it if needed. The file is re-encrypted with a new salt on every save.
+func SaveKeyfileCredential(path, passphrase, host, username, password string) (err error) {
+	if len(passphrase) == 0 {
+		return errors.New("The keyfile passphrase can not be empty")
+	}
+	entries := make(map[string]string)
+	if _, e := os.Stat(path); e == nil {
+		if entries, err = readKeyfile(path, passphrase); err != nil {
+			return
+		}
+	}
+	entries[credentialKey(host, username)] = password
+
+	plain, err := json.Marshal(entries)
+	if err != nil {
+		return
+	}
+	salt := make([]byte, 16)
+	if _, err = io.ReadFull(rand.Reader, salt); err != nil {
+		return
+	}
+	gcm, err := newKeyfileCipher(passphrase, salt)
+	if err != nil {
+		return
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err = io.ReadFull(rand.Reader, nonce); err != nil {
+		return
+	}
+	kf := &keyfile{
+		Salt:  base64.StdEncoding.EncodeToString(salt),
+		Nonce: base64.StdEncoding.EncodeToString(nonce),
+		Data:  base64.StdEncoding.EncodeToString(gcm.Seal(nil, nonce, plain, nil)),
+	}
+	b, err := json.Marshal(kf)
+	if err != nil {
+		return
+	}
+	if err = os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return
+	}
+	return os.WriteFile(path, b, 0600)
+}
+
+// StoreKeyfileCredential asks for the FTP password of s and saves it in the keyfile of s.
+// The passphrase of the keyfile is read from the environment or asked, twice for a new file.
+func (s *Settings) StoreKeyfileCredential() (err error) {
+	c, fs := s.CredentialSettings, s.FtpSettings
+	if c == nil || len(c.Keyfile) == 0 {
+		return fmt.Errorf("No keyfile is set, set %s.%s first", SECTION_CREDENTIALS, OPTION_CREDENTIALS_KEYFILE)
+	}
+	if fs == nil || len(fs.Address) == 0 || len(fs.Username) == 0 {
+		return errors.New("The FTP address and username are needed to store their password")
+	}
+	passphrase := os.Getenv(ENV_PASSPHRASE)
+	if len(passphrase) == 0 {
+		if passphrase, err = askSecret("The passphrase of the credentials keyfile: "); err != nil {
+			return
+		}
+		// as read by envPassphrase
+		passphrase = strings.TrimSpace(passphrase)
+		if _, e := os.Stat(c.Keyfile); os.IsNotExist(e) {
+			again, err := askSecret("The passphrase again: ")
+			if err != nil {
+				return err
+			}
+			if strings.TrimSpace(again) != passphrase {
+				return errors.New("The passphrases do not match")
+			}
+		}
+	}
+	password, err := askSecret(fmt.Sprintf("The FTP password of %s: ", credentialKey(fs.Address, fs.Username)))
+	if err != nil {
+		return
+	}
+	return SaveKeyfileCredential(c.Keyfile, passphrase, fs.Address, fs.Username, password)
+}
+
+// askSecret asks as askParameter, without echoing the answer when the standard input
+// is a terminal.
+func askSecret(question string) (string, error) {
+	fd := int(os.Stdin.Fd())
+	if !Interactive || !term.IsTerminal(fd) {
+		return askParameter(question)
+	}
+	fmt.Print(question)
+	b, err := term.ReadPassword(fd)
+	fmt.Println()
+	return string(b), err
+}
+
+func readKeyfile(path, passphrase string) (entries map[string]string, err error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return
+	}
+	var kf keyfile
+	if err = json.Unmarshal(b, &kf); err != nil {
+		return nil, fmt.Errorf("The keyfile %s is corrupted: %v", path, err)
+	}
+	salt, err1 := base64.StdEncoding.DecodeString(kf.Salt)
+	nonce, err2 := base64.StdEncoding.DecodeString(kf.Nonce)
+	data, err3 := base64.StdEncoding.DecodeString(kf.Data)
+	if err1 != nil || err2 != nil || err3 != nil {
+		return nil, fmt.Errorf("The keyfile %s is corrupted", path)
+	}
+	gcm, err := newKeyfileCipher(passphrase, salt)
+	if err != nil {
+		return
+	}
+	if len(nonce) != gcm.NonceSize() {
+		return nil, fmt.Errorf("The keyfile %s is corrupted", path)
+	}
+	plain, err := gcm.Open(nil, nonce, data, nil)
+	if err != nil {
+		return nil, errors.New("The keyfile passphrase is wrong")
+	}
+	err = json.Unmarshal(plain, &entries)
+	return
+}
+
+func newKeyfileCipher(passphrase string, salt []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(pbkdf2.Key([]byte(passphrase), salt, keyfileIterations, 32, sha256.New))
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
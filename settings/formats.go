@@ -0,0 +1,439 @@
+package settings
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	conf "github.com/dlintw/goconf"
+	"gopkg.in/yaml.v3"
+)
+
+// Formats of the configuration files, chosen by the file extension.
+// Any extension other than .json, .yaml, .yml and .toml is read as INI.
+const (
+	FORMAT_INI  = "ini"
+	FORMAT_JSON = "json"
+	FORMAT_YAML = "yaml"
+	FORMAT_TOML = "toml"
+)
+
+// configFileNames are looked up in every configuration folder, the first one found is read.
+var configFileNames = []string{SETTINGS_FILE_NAME, "goconvert.toml", "goconvert.yaml", "goconvert.yml", "goconvert.json"}
+
+// KEY_PROFILES holds the profiles in the JSON, YAML and TOML files, e.g.
+//
+//	convert:
+//	  width: 1024
+//	profiles:
+//	  club:
+//	    convert:
+//	      width: 1600
+const KEY_PROFILES = "profiles"
+
+// FormatOf returns the format of the configuration file fn.
+func FormatOf(fn string) string {
+	switch strings.ToLower(filepath.Ext(fn)) {
+	case ".json":
+		return FORMAT_JSON
+	case ".yaml", ".yml":
+		return FORMAT_YAML
+	case ".toml":
+		return FORMAT_TOML
+	}
+	return FORMAT_INI
+}
+
+// findConfigFile returns the configuration file read in dir, the first of configFileNames
+// found or goconvert.conf if there is none, and the other ones found, which are ignored.
+func findConfigFile(dir string) (fn string, ignored []string) {
+	for _, name := range configFileNames {
+		p := filepath.Join(dir, name)
+		if fi, err := os.Stat(p); err != nil || fi.IsDir() {
+			continue
+		}
+		if len(fn) == 0 {
+			fn = p
+		} else {
+			ignored = append(ignored, p)
+		}
+	}
+	if len(fn) == 0 {
+		fn = filepath.Join(dir, SETTINGS_FILE_NAME)
+	}
+	return
+}
+
+// configDoc is the content of a configuration file, whatever its format.
+// The values are strings in the INI files and typed in the other formats.
+type configDoc struct {
+	typed    bool
+	sections map[string]map[string]interface{} // section -> option -> value
+	profiles map[string]map[string]interface{} // profile -> section.option -> value
+	problems []error                           // found while decoding, see validate
+}
+
+func newConfigDoc(typed bool) *configDoc {
+	return &configDoc{
+		typed:    typed,
+		sections: make(map[string]map[string]interface{}),
+		profiles: make(map[string]map[string]interface{}),
+	}
+}
+
+func (d *configDoc) section(name string) map[string]interface{} {
+	m, ok := d.sections[name]
+	if !ok {
+		m = make(map[string]interface{})
+		d.sections[name] = m
+	}
+	return m
+}
+
+func (d *configDoc) profile(name string) map[string]interface{} {
+	name = strings.ToLower(strings.TrimSpace(name))
+	m, ok := d.profiles[name]
+	if !ok {
+		m = make(map[string]interface{})
+		d.profiles[name] = m
+	}
+	return m
+}
+
+func (d *configDoc) hasProfile(name string) bool {
+	_, ok := d.profiles[strings.ToLower(strings.TrimSpace(name))]
+	return ok
+}
+
+// iniDoc reads a goconf file. The options of its default section are variables
+// listed in every section, they are skipped unless they name a known option.
+func iniDoc(c *conf.ConfigFile) *configDoc {
+	d := newConfigDoc(false)
+	vars := make(map[string]bool)
+	names, _ := c.GetOptions(conf.DefaultSection)
+	for _, name := range names {
+		vars[name] = true
+	}
+	for _, section := range c.GetSections() {
+		if section == conf.DefaultSection {
+			continue
+		}
+		profile := strings.TrimPrefix(section, SECTION_PROFILE_PREFIX)
+		isProfile := profile != section
+		var m map[string]interface{}
+		if isProfile {
+			m = d.profile(profile)
+		} else {
+			m = d.section(section)
+		}
+		names, _ := c.GetOptions(section)
+		for _, name := range names {
+			key := name
+			if !isProfile {
+				key = section + "." + name
+			}
+			if vars[name] && findKey(key) == nil {
+				continue
+			}
+			v, err := c.GetString(section, name)
+			if err != nil {
+				d.problems = append(d.problems, fmt.Errorf("[%s] %s: %v", section, name, err))
+				continue
+			}
+			m[name] = v
+		}
+	}
+	return d
+}
+
+// structuredDoc reads the sections and the profiles of a JSON, YAML or TOML document.
+func structuredDoc(m map[string]interface{}) *configDoc {
+	d := newConfigDoc(true)
+	for _, section := range sortedKeys(m) {
+		v := m[section]
+		if section == KEY_PROFILES {
+			profiles, ok := v.(map[string]interface{})
+			if !ok {
+				d.problems = append(d.problems, fmt.Errorf("%s: expected a table of profiles, got %s", section, describe(v)))
+				continue
+			}
+			for _, name := range sortedKeys(profiles) {
+				p := d.profile(name)
+				sections, ok := profiles[name].(map[string]interface{})
+				if !ok {
+					d.problems = append(d.problems, fmt.Errorf("profile %s: expected a table of sections, got %s", name, describe(profiles[name])))
+					continue
+				}
+				for _, s := range sortedKeys(sections) {
+					opts, ok := sections[s].(map[string]interface{})
+					if !ok {
+						d.problems = append(d.problems, fmt.Errorf("profile %s: %s: expected a table of options, got %s", name, s, describe(sections[s])))
+						continue
+					}
+					for option, v := range opts {
+						p[s+"."+option] = v
+					}
+				}
+			}
+			continue
+		}
+		opts, ok := v.(map[string]interface{})
+		if !ok {
+			d.problems = append(d.problems, fmt.Errorf("%s: expected a table of options, got %s", section, describe(v)))
+			continue
+		}
+		s := d.section(section)
+		for option, v := range opts {
+			s[option] = v
+		}
+	}
+	return d
+}
+
+func decodeConfig(data []byte, format string) (d *configDoc, err error) {
+	m := make(map[string]interface{})
+	switch format {
+	case FORMAT_INI:
+		c, err := conf.ReadConfigBytes(data)
+		if err != nil {
+			return nil, err
+		}
+		return iniDoc(c), nil
+	case FORMAT_JSON:
+		dec := json.NewDecoder(bytes.NewReader(data))
+		dec.UseNumber()
+		err = dec.Decode(&m)
+	case FORMAT_YAML:
+		err = yaml.Unmarshal(data, &m)
+	case FORMAT_TOML:
+		_, err = toml.Decode(string(data), &m)
+	default:
+		err = fmt.Errorf("Unknown configuration format %q", format)
+	}
+	if err != nil {
+		return
+	}
+	return structuredDoc(m), nil
+}
+
+func encodeConfig(d *configDoc, format string) (data []byte, err error) {
+	if format == FORMAT_INI {
+		c := conf.NewConfigFile()
+		for section, opts := range d.sections {
+			c.AddSection(section)
+			for name, v := range opts {
+				c.AddOption(section, name, iniValue(v))
+			}
+		}
+		for name, opts := range d.profiles {
+			c.AddSection(profileSection(name))
+			for key, v := range opts {
+				c.AddOption(profileSection(name), key, iniValue(v))
+			}
+		}
+		return c.WriteConfigBytes("goconvert configuration settings"), nil
+	}
+
+	m := make(map[string]interface{})
+	for section, opts := range d.sections {
+		m[section] = opts
+	}
+	if len(d.profiles) > 0 {
+		profiles := make(map[string]interface{})
+		for name, opts := range d.profiles {
+			sections := make(map[string]map[string]interface{})
+			for key, v := range opts {
+				section, option := splitKey(key)
+				if sections[section] == nil {
+					sections[section] = make(map[string]interface{})
+				}
+				sections[section][option] = v
+			}
+			profiles[name] = sections
+		}
+		m[KEY_PROFILES] = profiles
+	}
+
+	var buf bytes.Buffer
+	switch format {
+	case FORMAT_JSON:
+		enc := json.NewEncoder(&buf)
+		enc.SetIndent("", "  ")
+		err = enc.Encode(m)
+	case FORMAT_YAML:
+		enc := yaml.NewEncoder(&buf)
+		enc.SetIndent(2)
+		if err = enc.Encode(m); err == nil {
+			err = enc.Close()
+		}
+	case FORMAT_TOML:
+		err = toml.NewEncoder(&buf).Encode(m)
+	default:
+		err = fmt.Errorf("Unknown configuration format %q", format)
+	}
+	return buf.Bytes(), err
+}
+
+// iniValue formats a value for an INI file, the booleans as y and n.
+func iniValue(v interface{}) string {
+	if b, ok := v.(bool); ok {
+		return (*boolParam)(&b).String()
+	}
+	return formatValue(v)
+}
+
+// formatValue formats a scalar or a list, joined with commas.
+func formatValue(v interface{}) string {
+	switch t := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return t
+	case []string:
+		return strings.Join(t, ",")
+	case []interface{}:
+		l := make([]string, len(t))
+		for i, e := range t {
+			l[i] = formatValue(e)
+		}
+		return strings.Join(l, ",")
+	case float64:
+		return strconv.FormatFloat(t, 'f', -1, 64)
+	}
+	return fmt.Sprint(v)
+}
+
+// describe names a decoded value in the error messages.
+func describe(v interface{}) string {
+	switch t := v.(type) {
+	case nil:
+		return "nothing"
+	case string:
+		return fmt.Sprintf("the string %q", t)
+	case bool:
+		return fmt.Sprintf("the boolean %v", t)
+	case []interface{}, []string:
+		return "a list"
+	case map[string]interface{}:
+		return "a table"
+	}
+	return fmt.Sprintf("%v", v)
+}
+
+func splitKey(key string) (section, option string) {
+	if i := strings.Index(key, "."); i >= 0 {
+		return key[:i], key[i+1:]
+	}
+	return "", key
+}
+
+func sortedKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// readConfigDoc reads the configuration file fn in the format of its extension.
+func readConfigDoc(fn string) (d *configDoc, err error) {
+	data, err := os.ReadFile(fn)
+	if err != nil {
+		return
+	}
+	if d, err = decodeConfig(data, FormatOf(fn)); err != nil {
+		return nil, fmt.Errorf("Error reading the file %s: %v", fn, err)
+	}
+	return
+}
+
+// writeConfigDoc writes d to the configuration file fn, readable by its owner only as it
+// may hold the FTP password.
+func writeConfigDoc(fn string, d *configDoc) error {
+	data, err := encodeConfig(d, FormatOf(fn))
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(filepath.Dir(fn), 0755); err != nil {
+		return err
+	}
+	if err = os.WriteFile(fn, data, 0600); err != nil {
+		return err
+	}
+	// the files written before keep their mode
+	return os.Chmod(fn, 0600)
+}
+
+// typedDoc returns a copy of d with the values of the known options typed,
+// as written to the JSON, YAML and TOML files. d must be valid.
+func typedDoc(d *configDoc) (t *configDoc, err error) {
+	t = newConfigDoc(true)
+	convert := func(key string, v interface{}) (interface{}, error) {
+		o := findKey(key)
+		s := newSettings()
+		if err := o.setValue(s, v, d.typed); err != nil {
+			return nil, fmt.Errorf("%s: %v", key, err)
+		}
+		return paramValue(o.param(s)), nil
+	}
+	for section, opts := range d.sections {
+		m := t.section(section)
+		for name, v := range opts {
+			if m[name], err = convert(section+"."+name, v); err != nil {
+				return nil, err
+			}
+		}
+	}
+	for profile, opts := range d.profiles {
+		m := t.profile(profile)
+		for key, v := range opts {
+			if m[key], err = convert(key, v); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return
+}
+
+// MigrateConfigFile converts the configuration file fn, usually an INI goconvert.conf,
+// to a file of the given format in the same folder, and renames fn with a .bak suffix.
+// It returns the new file. fn must be valid and the new file must not exist.
+func MigrateConfigFile(fn string, format string) (dst string, err error) {
+	ext := "." + format
+	switch format {
+	case FORMAT_JSON, FORMAT_YAML, FORMAT_TOML:
+	case FORMAT_INI:
+		ext = ".conf"
+	default:
+		return "", fmt.Errorf("Unknown configuration format %q, use %s, %s, %s or %s", format, FORMAT_INI, FORMAT_JSON, FORMAT_YAML, FORMAT_TOML)
+	}
+	if FormatOf(fn) == format {
+		return "", fmt.Errorf("%s is already in the %s format", fn, format)
+	}
+	dst = strings.TrimSuffix(fn, filepath.Ext(fn)) + ext
+	if _, e := os.Stat(dst); e == nil {
+		return "", fmt.Errorf("%s already exists", dst)
+	}
+
+	d, err := readConfigDoc(fn)
+	if err != nil {
+		return
+	}
+	if errs := d.validate(); len(errs) > 0 {
+		return "", invalidConfigFile(fn, errs)
+	}
+	if d, err = typedDoc(d); err != nil {
+		return
+	}
+	if err = writeConfigDoc(dst, d); err != nil {
+		return
+	}
+	return dst, os.Rename(fn, fn+".bak")
+}
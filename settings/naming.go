@@ -0,0 +1,218 @@
+package settings
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// Renditions of an image, each named by its own template.
+const (
+	RENDITION_IMAGE     = "image"     // the resized image
+	RENDITION_THUMBNAIL = "thumbnail" // the thumbnail
+	RENDITION_ORIGINAL  = "original"  // the original image in the archive folder
+)
+
+// The default file names of the renditions, as expected by Piwigo.
+const (
+	DEFAULT_IMAGE_NAME     = "{name}"
+	DEFAULT_THUMBNAIL_NAME = "TN-{image}"
+	DEFAULT_ORIGINAL_NAME  = "{name}"
+)
+
+// The placeholders of the file name templates: the source name with the spaces replaced,
+// the sequence number with an optional width, e.g. {seq:4}, the capture date and time with
+// an optional Go time layout, the camera model, the rendition, a short hash of the source
+// with an optional length, the collection name and the resized image name.
+var filePlaceholders = []string{"name", "seq", "date", "time", "camera", "rendition", "hash", "collname", "image"}
+
+// FileInfo holds the values of the file name template placeholders for an image.
+type FileInfo struct {
+	Name     string // the source file name
+	Seq      int    // the position of the image in the collection, from 1
+	Count    int    // the number of images of the collection
+	Date     time.Time
+	Camera   string
+	CollName string
+	Image    string                 // the name of the resized image, set for the other renditions
+	Hash     func() (string, error) // the hexadecimal hash of the source file
+}
+
+var spaces = regexp.MustCompile(`\s`)
+
+// checkFileTemplate checks the syntax of a file name template, which can not contain folders.
+func checkFileTemplate(t string) error {
+	if strings.Contains(t, "/") {
+		return fmt.Errorf("%q can not contain folders", t)
+	}
+	return checkPathTemplate(t)
+}
+
+// fileTemplate returns the template of the rendition, the default one if not set.
+func (s *Settings) fileTemplate(rendition string) (t string) {
+	switch rendition {
+	case RENDITION_IMAGE:
+		t = s.ConversionSettings.ImageName
+		if len(t) == 0 {
+			t = DEFAULT_IMAGE_NAME
+		}
+	case RENDITION_THUMBNAIL:
+		t = s.ConversionSettings.ThumbnailName
+		if len(t) == 0 {
+			t = DEFAULT_THUMBNAIL_NAME
+		}
+	case RENDITION_ORIGINAL:
+		t = s.ConversionSettings.OriginalName
+		if len(t) == 0 {
+			t = DEFAULT_ORIGINAL_NAME
+		}
+	}
+	return
+}
+
+// checkFileTemplates returns the field errors of the placeholders of the file name templates.
+// The resized image name can not depend on itself.
+func (s *Settings) checkFileTemplates() (l ValidationErrors) {
+	vars := s.Vars()
+	fields := []struct{ rendition, field, flag string }{
+		{RENDITION_IMAGE, "conversionSettings.imageName", OPTION_CONVERT_IMAGENAME},
+		{RENDITION_THUMBNAIL, "conversionSettings.thumbnailName", OPTION_CONVERT_THUMBNAILNAME},
+		{RENDITION_ORIGINAL, "conversionSettings.originalName", OPTION_CONVERT_ORIGINALNAME},
+	}
+	for _, f := range fields {
+		t := s.fileTemplate(f.rendition)
+		if checkFileTemplate(t) != nil {
+			continue // reported against the schema
+		}
+		_, err := expandTemplate(t, func(name, arg string) (string, bool) {
+			_, ok := vars[name]
+			for _, p := range filePlaceholders {
+				ok = ok || (p == name && (p != "image" || f.rendition != RENDITION_IMAGE))
+			}
+			return "x", ok
+		})
+		if err != nil {
+			l = append(l, &FieldError{f.field, f.flag, err.Error()})
+		}
+	}
+	return
+}
+
+// FileName expands the template of the rendition with info and the user variables.
+// The name has no extension and is transliterated if the settings say so.
+func (s *Settings) FileName(rendition string, info *FileInfo) (string, error) {
+	vars := s.Vars()
+	var hashErr error
+	name, err := expandTemplate(s.fileTemplate(rendition), func(name, arg string) (string, bool) {
+		switch name {
+		case "name":
+			n := strings.TrimSuffix(info.Name, fileExt(info.Name))
+			return spaces.ReplaceAllString(n, "_"), true
+		case "seq":
+			width, err := strconv.Atoi(arg)
+			if err != nil {
+				width = len(strconv.Itoa(info.Count))
+			}
+			return fmt.Sprintf("%0*d", width, info.Seq), true
+		case "date":
+			if len(arg) == 0 {
+				arg = "20060102"
+			}
+			return info.Date.Format(arg), true
+		case "time":
+			if len(arg) == 0 {
+				arg = "150405"
+			}
+			return info.Date.Format(arg), true
+		case "camera":
+			if len(info.Camera) == 0 {
+				return "unknown", true
+			}
+			return info.Camera, true
+		case "rendition":
+			return rendition, true
+		case "hash":
+			n, err := strconv.Atoi(arg)
+			if err != nil || n <= 0 {
+				n = 8
+			}
+			var h string
+			if info.Hash != nil {
+				h, hashErr = info.Hash()
+			}
+			if n < len(h) {
+				h = h[:n]
+			}
+			return h, true
+		case "collname":
+			return info.CollName, true
+		case "image":
+			return info.Image, rendition != RENDITION_IMAGE
+		}
+		v, ok := vars[name]
+		return v, ok
+	})
+	if err == nil {
+		err = hashErr
+	}
+	if err == nil && s.ConversionSettings.Transliterate {
+		name = WebSafeName(name)
+	}
+	if err == nil && len(strings.Trim(name, ".")) == 0 {
+		err = fmt.Errorf("the name of %s is empty", info.Name)
+	}
+	if err != nil {
+		return "", fmt.Errorf("Invalid %s name template %q: %v", rendition, s.fileTemplate(rendition), err)
+	}
+	return name, nil
+}
+
+// fileExt is filepath.Ext for the names of any system.
+func fileExt(name string) string {
+	if i := strings.LastIndex(name, "."); i > 0 && !strings.ContainsAny(name[i:], `/\`) {
+		return name[i:]
+	}
+	return ""
+}
+
+// transliterations spell the letters of the latin alphabets in ASCII.
+var transliterations = map[rune]string{}
+
+func init() {
+	for ascii, letters := range map[string]string{
+		"A": "ÀÁÂÃÄÅĀĂĄ", "a": "àáâãäåāăą", "AE": "Æ", "ae": "æ",
+		"C": "ÇĆĈĊČ", "c": "çćĉċč", "D": "ĎĐÐ", "d": "ďđð",
+		"E": "ÈÉÊËĒĔĖĘĚ", "e": "èéêëēĕėęě", "G": "ĜĞĠĢ", "g": "ĝğġģ",
+		"H": "ĤĦ", "h": "ĥħ", "I": "ÌÍÎÏĨĪĬĮİ", "i": "ìíîïĩīĭįı",
+		"J": "Ĵ", "j": "ĵ", "K": "Ķ", "k": "ķ", "L": "ĹĻĽĿŁ", "l": "ĺļľŀł",
+		"N": "ÑŃŅŇ", "n": "ñńņň", "O": "ÒÓÔÕÖØŌŎŐ", "o": "òóôõöøōŏő", "OE": "Œ", "oe": "œ",
+		"R": "ŔŖŘ", "r": "ŕŗř", "S": "ŚŜŞŠ", "s": "śŝşš", "ss": "ß",
+		"T": "ŢŤŦ", "t": "ţťŧ", "TH": "Þ", "th": "þ",
+		"U": "ÙÚÛÜŨŪŬŮŰŲ", "u": "ùúûüũūŭůűų", "W": "Ŵ", "w": "ŵ",
+		"Y": "ÝŶŸ", "y": "ýÿŷ", "Z": "ŹŻŽ", "z": "źżž",
+	} {
+		for _, r := range letters {
+			transliterations[r] = ascii
+		}
+	}
+}
+
+// WebSafeName spells the accented letters of name in ASCII and replaces the characters
+// other than letters, digits, dots, dashes and underscores with an underscore.
+func WebSafeName(name string) string {
+	var b strings.Builder
+	for _, r := range name {
+		switch {
+		case transliterations[r] != "":
+			b.WriteString(transliterations[r])
+		case r < unicode.MaxASCII && (unicode.IsLetter(r) || unicode.IsDigit(r) || strings.ContainsRune("._-", r)):
+			b.WriteRune(r)
+		default:
+			b.WriteByte('_')
+		}
+	}
+	return b.String()
+}
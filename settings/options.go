@@ -0,0 +1,280 @@
+package settings
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Option binds a setting to its entry in the configuration file, its command line flag
+// and its environment variable. Settings with an empty Section are never saved to the file.
+type Option struct {
+	Flag    string
+	Env     string
+	Section string
+	Name    string
+	Usage   string
+	param   func(s *Settings) Param
+}
+
+// Param returns the setting of s bound to the option.
+func (o *Option) Param(s *Settings) Param {
+	return o.param(s)
+}
+
+func (o *Option) set(s *Settings, value string, source string) error {
+	if !o.param(s).Set(value) {
+		return fmt.Errorf("Invalid value %q for the setting %s from %s", value, o.Flag, source)
+	}
+	return nil
+}
+
+type listParam []string
+
+func (l *listParam) Set(s string) bool {
+	*l = nil
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); len(v) > 0 {
+			*l = append(*l, v)
+		}
+	}
+	return true
+}
+
+func (l *listParam) String() string {
+	return strings.Join(*l, ",")
+}
+
+// ENV_PROFILE selects the profile of the configuration file, as the -profile flag.
+const ENV_PROFILE = "GOCONVERT_PROFILE"
+
+// options lists every setting in the order they are saved to the configuration file.
+var options = []*Option{
+	{"c", "GOCONVERT_COLLNAME", "", "", "the collection name",
+		func(s *Settings) Param { return (*stringParam)(&s.CollName) }},
+	{"f", "GOCONVERT_SOURCEDIR", "", "", "the image folder",
+		func(s *Settings) Param { return (*stringParam)(&s.SourceDir) }},
+	{"saveconfig", "GOCONVERT_SAVECONFIG", "", "", "whether to save the settings to the configuration file",
+		func(s *Settings) Param { return (*boolParam)(&s.SaveConfig) }},
+	{"profile", ENV_PROFILE, "", "", "the profile of the configuration file to use, e.g. [profile club]",
+		func(s *Settings) Param { return (*stringParam)(&s.Profile) }},
+
+	{"publishdir", "GOCONVERT_PUBLISHDIR", SECTION_DEPLOY, OPTION_DEPLOY_PUBLISHDIR, "the picture folder where to back up the images",
+		func(s *Settings) Param { return (*stringParam)(&s.PublishDir) }},
+	{"homedir", "GOCONVERT_HOMEDIR", SECTION_DEPLOY, OPTION_DEPLOY_HOMEDIR, "the home folder for the current user",
+		func(s *Settings) Param { return (*stringParam)(&s.HomeDir) }},
+	{"piwigogallerydir", "GOCONVERT_PIWIGOGALLERYDIR", SECTION_DEPLOY, OPTION_DEPLOY_PIWIGOGALLERYDIR, "the folder where the Piwigo galleries are stored",
+		func(s *Settings) Param { return (*stringParam)(&s.PiwigoGalleryDir) }},
+	{"piwigogalleryhighdirname", "GOCONVERT_PIWIGOGALLERYHIGHDIRNAME", SECTION_DEPLOY, OPTION_DEPLOY_PIWIGOGALLERYHIGHDIRNAME, "the subfolder where to archive the original images",
+		func(s *Settings) Param { return (*stringParam)(&s.PiwigoGalleryHighDirName) }},
+	{"collectiontemplate", "GOCONVERT_COLLECTIONTEMPLATE", SECTION_DEPLOY, OPTION_DEPLOY_COLLECTIONTEMPLATE, "the collection folder in the publish folder, e.g. {year}/{first:2006-01-02}_{collname}, default " + DEFAULT_COLLECTION_TEMPLATE,
+		func(s *Settings) Param { return (*stringParam)(&s.CollectionTemplate) }},
+	{"templatevars", "GOCONVERT_TEMPLATEVARS", SECTION_DEPLOY, OPTION_DEPLOY_TEMPLATEVARS, "the comma separated name=value variables of the templates, e.g. club=alpine",
+		func(s *Settings) Param { return (*listParam)(&s.TemplateVars) }},
+	{"indexformats", "GOCONVERT_INDEXFORMATS", SECTION_DEPLOY, OPTION_DEPLOY_INDEXFORMATS, "the comma separated formats of the index written in the collection folder, json and csv, empty for none",
+		func(s *Settings) Param { return (*listParam)(&s.IndexFormats) }},
+	{"indexgps", "GOCONVERT_INDEXGPS", SECTION_DEPLOY, OPTION_DEPLOY_INDEXGPS, "whether the collection index tells where the images were taken",
+		func(s *Settings) Param { return (*boolParam)(&s.IndexGPS) }},
+
+	{"width", "GOCONVERT_WIDTH", SECTION_CONVERT, OPTION_CONVERT_WIDTH, "the width in pixel of the resized images",
+		func(s *Settings) Param { return (*intParam)(&s.ConversionSettings.Width) }},
+	{"height", "GOCONVERT_HEIGHT", SECTION_CONVERT, OPTION_CONVERT_HEIGHT, "the height in pixel of the resized images",
+		func(s *Settings) Param { return (*intParam)(&s.ConversionSettings.Height) }},
+	{"nosimultaneousresize", "GOCONVERT_NOSIMULTANEOUSRESIZE", SECTION_CONVERT, OPTION_CONVERT_NOSIMULTANEOUSRESIZE, "the number of simultaneous resize processes",
+		func(s *Settings) Param { return (*intParam)(&s.ConversionSettings.NoSimultaneousResize) }},
+	{"moveoriginal", "GOCONVERT_MOVEORIGINAL", SECTION_CONVERT, OPTION_CONVERT_MOVEORIGINAL, "whether to remove the images from the source folder after archiving",
+		func(s *Settings) Param { return (*boolParam)(&s.ConversionSettings.MoveOriginal) }},
+	{"timeout", "GOCONVERT_TIMEOUT", SECTION_CONVERT, OPTION_CONVERT_TIMEOUTMSEC, "the timeout in milliseconds of each processing step",
+		func(s *Settings) Param { return (*intParam)(&s.TimeoutMsec) }},
+	{"imagename", "GOCONVERT_IMAGENAME", SECTION_CONVERT, OPTION_CONVERT_IMAGENAME, "the name of the resized images without extension, e.g. {date}_{seq}_{name}, default " + DEFAULT_IMAGE_NAME,
+		func(s *Settings) Param { return (*stringParam)(&s.ConversionSettings.ImageName) }},
+	{"thumbnailname", "GOCONVERT_THUMBNAILNAME", SECTION_CONVERT, OPTION_CONVERT_THUMBNAILNAME, "the name of the thumbnails without extension, default " + DEFAULT_THUMBNAIL_NAME + " as expected by Piwigo",
+		func(s *Settings) Param { return (*stringParam)(&s.ConversionSettings.ThumbnailName) }},
+	{"originalname", "GOCONVERT_ORIGINALNAME", SECTION_CONVERT, OPTION_CONVERT_ORIGINALNAME, "the name of the archived originals without extension, default " + DEFAULT_ORIGINAL_NAME,
+		func(s *Settings) Param { return (*stringParam)(&s.ConversionSettings.OriginalName) }},
+	{"transliterate", "GOCONVERT_TRANSLITERATE", SECTION_CONVERT, OPTION_CONVERT_TRANSLITERATE, "whether to replace the accented letters and the characters unsafe in URLs in the file names",
+		func(s *Settings) Param { return (*boolParam)(&s.ConversionSettings.Transliterate) }},
+
+	{"gallery", "GOCONVERT_GALLERY", SECTION_GALLERY, OPTION_GALLERY_ENABLED, "whether to write a static HTML gallery in the collection folder",
+		func(s *Settings) Param { return (*boolParam)(&s.Gallery) }},
+	{"gallery-themedir", "GOCONVERT_GALLERY_THEMEDIR", SECTION_GALLERY, OPTION_GALLERY_THEMEDIR, "the folder of the gallery page.html template and its files, empty for the built-in theme",
+		func(s *Settings) Param { return (*stringParam)(&s.GalleryThemeDir) }},
+	{"gallery-pagesize", "GOCONVERT_GALLERY_PAGESIZE", SECTION_GALLERY, OPTION_GALLERY_PAGESIZE, "the number of thumbnails per gallery page",
+		func(s *Settings) Param { return (*intParam)(&s.GalleryPageSize) }},
+	{"gallery-downloads", "GOCONVERT_GALLERY_DOWNLOADS", SECTION_GALLERY, OPTION_GALLERY_DOWNLOADS, "whether the gallery links the original images, which are then uploaded with the collection",
+		func(s *Settings) Param { return (*boolParam)(&s.GalleryDownloads) }},
+
+	{"contactsheet", "GOCONVERT_CONTACTSHEET", SECTION_CONTACTSHEET, OPTION_CONTACTSHEET_ENABLED, "whether to compose the thumbnails of the collection into contact sheets",
+		func(s *Settings) Param { return (*boolParam)(&s.ContactSheet) }},
+	{"contactsheet-columns", "GOCONVERT_CONTACTSHEET_COLUMNS", SECTION_CONTACTSHEET, OPTION_CONTACTSHEET_COLUMNS, "the number of thumbnails per row of a contact sheet",
+		func(s *Settings) Param { return (*intParam)(&s.ContactSheetColumns) }},
+	{"contactsheet-rows", "GOCONVERT_CONTACTSHEET_ROWS", SECTION_CONTACTSHEET, OPTION_CONTACTSHEET_ROWS, "the number of rows of a contact sheet page",
+		func(s *Settings) Param { return (*intParam)(&s.ContactSheetRows) }},
+	{"contactsheet-page", "GOCONVERT_CONTACTSHEET_PAGE", SECTION_CONTACTSHEET, OPTION_CONTACTSHEET_PAGE, "the page format of the contact sheets, a4, a4-landscape, letter or letter-landscape",
+		func(s *Settings) Param { return (*stringParam)(&s.ContactSheetPage) }},
+	{"contactsheet-formats", "GOCONVERT_CONTACTSHEET_FORMATS", SECTION_CONTACTSHEET, OPTION_CONTACTSHEET_FORMATS, "the comma separated file formats of the contact sheets, jpeg and pdf",
+		func(s *Settings) Param { return (*listParam)(&s.ContactSheetFormats) }},
+
+	{"web-jobs", "GOCONVERT_WEB_JOBS", SECTION_WEB, OPTION_WEB_JOBS, "the number of conversion jobs the web interface runs at once, the others are queued",
+		func(s *Settings) Param { return (*intParam)(&s.WebJobs) }},
+	{"web-grace", "GOCONVERT_WEB_GRACE", SECTION_WEB, OPTION_WEB_GRACESEC, "the seconds the jobs of a closed websocket keep running waiting for a client to attach, 0 to cancel them at once",
+		func(s *Settings) Param { return (*intParam)(&s.WebGraceSec) }},
+	{"web-auth", "GOCONVERT_WEB_AUTH", SECTION_WEB, OPTION_WEB_AUTH, "the authentication of the web interface: none, token, basic, or launch for a one-time token in the URL opened in the browser",
+		func(s *Settings) Param { return (*stringParam)(&s.WebAuth) }},
+	{"web-token", "GOCONVERT_WEB_TOKEN", SECTION_WEB, OPTION_WEB_TOKEN, "the token of the token authentication, sent as bearer token or as the token parameter of the first page",
+		func(s *Settings) Param { return (*stringParam)(&s.WebToken) }},
+	{"web-users", "GOCONVERT_WEB_USERS", SECTION_WEB, OPTION_WEB_USERS, "the comma separated users of the basic authentication as name:bcrypt-hash, e.g. from htpasswd -nB",
+		func(s *Settings) Param { return (*listParam)(&s.WebUsers) }},
+	{"web-roots", "GOCONVERT_WEB_ROOTS", SECTION_WEB, OPTION_WEB_ROOTS, "the comma separated folders the web interface can browse for images, with their subfolders",
+		func(s *Settings) Param { return (*listParam)(&s.WebRoots) }},
+	{"web-stagingdir", "GOCONVERT_WEB_STAGINGDIR", SECTION_WEB, OPTION_WEB_STAGINGDIR, "the folder where the images uploaded by the browsers are staged until converted, empty for the user cache folder",
+		func(s *Settings) Param { return (*stringParam)(&s.WebStagingDir) }},
+	{"web-uploadmaxmb", "GOCONVERT_WEB_UPLOADMAXMB", SECTION_WEB, OPTION_WEB_UPLOADMAXMB, "the maximum size in MB of an image uploaded by a browser",
+		func(s *Settings) Param { return (*intParam)(&s.WebUploadMaxMB) }},
+	{"web-stagingmaxmb", "GOCONVERT_WEB_STAGINGMAXMB", SECTION_WEB, OPTION_WEB_STAGINGMAXMB, "the maximum size in MB of all the images of an upload by a browser",
+		func(s *Settings) Param { return (*intParam)(&s.WebStagingMaxMB) }},
+
+	{"ftp-address", "GOCONVERT_FTP_ADDRESS", SECTION_FTP, OPTION_FTP_ADDRESS, "the address of the FTP server, empty to skip the upload",
+		func(s *Settings) Param { return (*stringParam)(&s.FtpSettings.Address) }},
+	{"ftp-username", "GOCONVERT_FTP_USERNAME", SECTION_FTP, OPTION_FTP_USERNAME, "the username to log onto the FTP server",
+		func(s *Settings) Param { return (*stringParam)(&s.FtpSettings.Username) }},
+	{"ftp-password", ENV_FTP_PASSWORD, "", "", "the password to log onto the FTP server, prefer the environment or a credential provider",
+		func(s *Settings) Param { return (*stringParam)(&s.FtpSettings.Password) }},
+	{"ftp-remotedir", "GOCONVERT_FTP_REMOTEDIR", SECTION_FTP, OPTION_FTP_REMOTEDIR, "the folder on the FTP server where to upload the collection",
+		func(s *Settings) Param { return (*stringParam)(&s.FtpSettings.RemoteDir) }},
+	{"ftp-policy", "GOCONVERT_FTP_POLICY", SECTION_FTP, OPTION_FTP_POLICY, "merge, replace or prune a collection already on the server",
+		func(s *Settings) Param { return (*stringParam)(&s.FtpSettings.Policy) }},
+
+	{"upload-maxconnections", "GOCONVERT_UPLOAD_MAXCONNECTIONS", SECTION_UPLOAD, OPTION_UPLOAD_MAXCONNECTIONS, "the number of simultaneous upload connections",
+		func(s *Settings) Param { return (*intParam)(&s.UploadSettings.MaxConnections) }},
+	{"upload-bandwidthkbps", "GOCONVERT_UPLOAD_BANDWIDTHKBPS", SECTION_UPLOAD, OPTION_UPLOAD_BANDWIDTHKBPS, "the upload bandwidth in KB/s shared by all connections, 0 for unlimited",
+		func(s *Settings) Param { return (*intParam)(&s.UploadSettings.BandwidthKBps) }},
+	{"upload-unlimitedfrom", "GOCONVERT_UPLOAD_UNLIMITEDFROM", SECTION_UPLOAD, OPTION_UPLOAD_UNLIMITEDFROM, "the time of day (e.g. 20:00) from which the bandwidth limit is lifted",
+		func(s *Settings) Param { return (*stringParam)(&s.UploadSettings.UnlimitedFrom) }},
+	{"upload-unlimitedto", "GOCONVERT_UPLOAD_UNLIMITEDTO", SECTION_UPLOAD, OPTION_UPLOAD_UNLIMITEDTO, "the time of day (e.g. 07:00) at which the bandwidth limit applies again",
+		func(s *Settings) Param { return (*stringParam)(&s.UploadSettings.UnlimitedTo) }},
+	{"upload-dryrun", "GOCONVERT_UPLOAD_DRYRUN", SECTION_UPLOAD, OPTION_UPLOAD_DRYRUN, "whether to only list the remote changes without uploading",
+		func(s *Settings) Param { return (*boolParam)(&s.UploadSettings.DryRun) }},
+
+	{"credentials-providers", "GOCONVERT_CREDENTIALS_PROVIDERS", SECTION_CREDENTIALS, OPTION_CREDENTIALS_PROVIDERS, "the comma separated credential providers: env, netrc, keyfile, command",
+		func(s *Settings) Param { return (*listParam)(&s.CredentialSettings.Providers) }},
+	{"credentials-netrcfile", "GOCONVERT_CREDENTIALS_NETRCFILE", SECTION_CREDENTIALS, OPTION_CREDENTIALS_NETRCFILE, "the netrc file of the netrc credential provider",
+		func(s *Settings) Param { return (*stringParam)(&s.CredentialSettings.NetrcFile) }},
+	{"credentials-keyfile", "GOCONVERT_CREDENTIALS_KEYFILE", SECTION_CREDENTIALS, OPTION_CREDENTIALS_KEYFILE, "the encrypted file of the keyfile credential provider",
+		func(s *Settings) Param { return (*stringParam)(&s.CredentialSettings.Keyfile) }},
+	{"credentials-command", "GOCONVERT_CREDENTIALS_COMMAND", SECTION_CREDENTIALS, OPTION_CREDENTIALS_COMMAND, "the command printing the password for the command credential provider",
+		func(s *Settings) Param { return (*stringParam)(&s.CredentialSettings.Command) }},
+}
+
+// Options returns all the settings options.
+func Options() []*Option {
+	return options
+}
+
+// RegisterFlags defines a string flag for every option on the flag set, and -config.
+// Use FlagValues after parsing to get the flags set explicitly.
+func RegisterFlags(fs *flag.FlagSet) {
+	fs.StringVar(&ConfigFile, "config", "", fmt.Sprintf("an explicit configuration file, merged last and written instead of %s (env %s)", UserConfigFile(), ENV_CONFIG))
+	for _, o := range options {
+		fs.String(o.Flag, "", fmt.Sprintf("%s (env %s)", o.Usage, o.Env))
+	}
+}
+
+// FlagValues returns the values of the option flags set on the command line, by flag name.
+func FlagValues(fs *flag.FlagSet) map[string]string {
+	values := make(map[string]string)
+	fs.Visit(func(f *flag.Flag) {
+		for _, o := range options {
+			if o.Flag == f.Name {
+				values[f.Name] = f.Value.String()
+			}
+		}
+	})
+	return values
+}
+
+// applyEnv sets the options whose environment variable is defined.
+func applyEnv(s *Settings, origins Origins) error {
+	for _, o := range options {
+		if v, ok := os.LookupEnv(o.Env); ok {
+			if err := o.set(s, v, "the environment variable "+o.Env); err != nil {
+				return err
+			}
+			origins.set(o, SOURCE_ENV+" "+o.Env)
+		}
+	}
+	return nil
+}
+
+// ApplyValues sets the options from values keyed by flag name, as returned by FlagValues.
+func ApplyValues(s *Settings, values map[string]string) error {
+	return applyValues(s, values, nil)
+}
+
+func applyValues(s *Settings, values map[string]string, origins Origins) error {
+	for _, o := range options {
+		if v, ok := values[o.Flag]; ok {
+			if err := o.set(s, v, "the flag -"+o.Flag); err != nil {
+				return err
+			}
+			origins.set(o, SOURCE_FLAG+" -"+o.Flag)
+		}
+	}
+	return nil
+}
+
+// Key returns the name of the option in the configuration file, as section.name,
+// or its flag name for the options which are not saved.
+func (o *Option) Key() string {
+	if len(o.Section) == 0 {
+		return o.Flag
+	}
+	return o.Section + "." + o.Name
+}
+
+// Set parses value into the setting of s bound to the option.
+func (o *Option) Set(s *Settings, value string) error {
+	return o.set(s, value, "the value")
+}
+
+// FindOption returns the option with the given key or flag name, nil if there is none.
+func FindOption(key string) *Option {
+	for _, o := range options {
+		if o.Key() == key || o.Flag == key {
+			return o
+		}
+	}
+	return nil
+}
+
+func missingSettings(missing []string) error {
+	if len(missing) == 0 {
+		return nil
+	}
+	return errors.New("Missing mandatory settings:\n - " + strings.Join(missing, "\n - "))
+}
+
+// CheckConversion returns an error listing the settings missing to convert the images.
+func (s *Settings) CheckConversion() error {
+	var missing []string
+	if len(s.CollName) == 0 {
+		missing = append(missing, "the collection name (-c or GOCONVERT_COLLNAME)")
+	}
+	if fi, e := os.Stat(s.SourceDir); e != nil || !fi.IsDir() {
+		missing = append(missing, fmt.Sprintf("a valid image folder (-f or GOCONVERT_SOURCEDIR), '%s' is not a directory", s.SourceDir))
+	}
+	return missingSettings(missing)
+}
+
+// CheckUpload returns an error listing the settings missing to upload to the FTP server.
+func (s *Settings) CheckUpload() error {
+	var missing []string
+	if len(s.FtpSettings.Address) == 0 {
+		missing = append(missing, "the FTP address (-ftp-address or GOCONVERT_FTP_ADDRESS)")
+	} else if len(s.FtpSettings.Password) == 0 {
+		missing = append(missing, fmt.Sprintf("the FTP password of %s (-ftp-password, %s or a credential provider)", s.FtpSettings.Address, ENV_FTP_PASSWORD))
+	}
+	return missingSettings(missing)
+}
@@ -0,0 +1,52 @@
+package settings
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// SECTION_PROFILE_PREFIX starts the INI sections of the named profiles. A profile holds
+// section.option keys overriding the base sections, e.g.
+//
+//	[profile club]
+//	convert.width = 1600
+//	ftp.address = ftp.club.org
+const SECTION_PROFILE_PREFIX = "profile "
+
+func profileSection(name string) string {
+	return SECTION_PROFILE_PREFIX + strings.ToLower(strings.TrimSpace(name))
+}
+
+// ListProfiles returns the names of the profiles in the configuration files, sorted.
+// The project file is looked up in sourceDir.
+func ListProfiles(sourceDir string) (names []string, err error) {
+	layers, err := readConfigLayers(sourceDir)
+	if err != nil {
+		return
+	}
+	seen := make(map[string]bool)
+	for _, l := range layers {
+		for name := range l.doc.profiles {
+			if !seen[name] {
+				seen[name] = true
+				names = append(names, name)
+			}
+		}
+	}
+	sort.Strings(names)
+	return
+}
+
+// DeleteProfile removes the named profile from the configuration file written by SaveSettingsToFile.
+func DeleteProfile(name string) (err error) {
+	d, err := readConfigFile()
+	if err != nil {
+		return
+	}
+	if !d.hasProfile(name) {
+		return fmt.Errorf("Unknown profile %q", name)
+	}
+	delete(d.profiles, strings.ToLower(strings.TrimSpace(name)))
+	return writeConfigFile(d)
+}
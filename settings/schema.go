@@ -0,0 +1,338 @@
+package settings
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// constraint bounds the values of an option in the configuration files.
+type constraint struct {
+	min, max int                // bounds of an integer option, no upper bound if max is 0
+	values   []string           // the values allowed for a string or list option
+	layout   string             // the time layout of a string option, empty values allowed
+	valid    func(string) error // checks each non empty value of a string or list option
+}
+
+// schema constrains the options of the configuration files, by key.
+// The type of each option is the one of its setting, see Kind.
+var schema = map[string]*constraint{
+	SECTION_CONVERT + "." + OPTION_CONVERT_WIDTH:                {min: 1, max: 65535},
+	SECTION_CONVERT + "." + OPTION_CONVERT_HEIGHT:               {min: 1, max: 65535},
+	SECTION_CONVERT + "." + OPTION_CONVERT_NOSIMULTANEOUSRESIZE: {min: 1, max: 64},
+	SECTION_CONVERT + "." + OPTION_CONVERT_TIMEOUTMSEC:          {min: 1},
+	SECTION_CONVERT + "." + OPTION_CONVERT_IMAGENAME:            {valid: checkFileTemplate},
+	SECTION_CONVERT + "." + OPTION_CONVERT_THUMBNAILNAME:        {valid: checkFileTemplate},
+	SECTION_CONVERT + "." + OPTION_CONVERT_ORIGINALNAME:         {valid: checkFileTemplate},
+	SECTION_GALLERY + "." + OPTION_GALLERY_PAGESIZE:             {min: 1, max: 1000},
+	SECTION_CONTACTSHEET + "." + OPTION_CONTACTSHEET_COLUMNS:    {min: 1, max: 20},
+	SECTION_CONTACTSHEET + "." + OPTION_CONTACTSHEET_ROWS:       {min: 1, max: 30},
+	SECTION_CONTACTSHEET + "." + OPTION_CONTACTSHEET_PAGE:       {values: []string{PAGE_A4, PAGE_A4_LANDSCAPE, PAGE_LETTER, PAGE_LETTER_LANDSCAPE}},
+	SECTION_CONTACTSHEET + "." + OPTION_CONTACTSHEET_FORMATS:    {values: []string{SHEET_JPEG, SHEET_PDF}},
+	SECTION_WEB + "." + OPTION_WEB_JOBS:                         {min: 1, max: 16},
+	SECTION_WEB + "." + OPTION_WEB_GRACESEC:                     {min: 0},
+	SECTION_WEB + "." + OPTION_WEB_UPLOADMAXMB:                  {min: 1},
+	SECTION_WEB + "." + OPTION_WEB_STAGINGMAXMB:                 {min: 1},
+	SECTION_WEB + "." + OPTION_WEB_AUTH:                         {values: []string{AUTH_NONE, AUTH_TOKEN, AUTH_BASIC, AUTH_LAUNCH}},
+	SECTION_FTP + "." + OPTION_FTP_POLICY:                       {values: []string{POLICY_MERGE, POLICY_REPLACE, POLICY_PRUNE}},
+	SECTION_UPLOAD + "." + OPTION_UPLOAD_MAXCONNECTIONS:         {min: 1, max: 32},
+	SECTION_UPLOAD + "." + OPTION_UPLOAD_BANDWIDTHKBPS:          {min: 0},
+	SECTION_UPLOAD + "." + OPTION_UPLOAD_UNLIMITEDFROM:          {layout: "15:04"},
+	SECTION_UPLOAD + "." + OPTION_UPLOAD_UNLIMITEDTO:            {layout: "15:04"},
+	SECTION_CREDENTIALS + "." + OPTION_CREDENTIALS_PROVIDERS:    {values: []string{PROVIDER_ENV, PROVIDER_NETRC, PROVIDER_KEYFILE, PROVIDER_COMMAND}},
+	SECTION_DEPLOY + "." + OPTION_DEPLOY_COLLECTIONTEMPLATE:     {valid: checkPathTemplate},
+	SECTION_DEPLOY + "." + OPTION_DEPLOY_INDEXFORMATS:           {values: []string{INDEX_JSON, INDEX_CSV}},
+	SECTION_DEPLOY + "." + OPTION_DEPLOY_TEMPLATEVARS:           {valid: checkTemplateVar},
+}
+
+// Kinds of the option values.
+const (
+	KIND_STRING  = "string"
+	KIND_INTEGER = "integer"
+	KIND_BOOLEAN = "boolean"
+	KIND_LIST    = "list"
+)
+
+// Kind returns the type of the option value, one of the KIND_ constants.
+func (o *Option) Kind() string {
+	switch o.param(newSettings()).(type) {
+	case *intParam:
+		return KIND_INTEGER
+	case *boolParam:
+		return KIND_BOOLEAN
+	case *listParam:
+		return KIND_LIST
+	}
+	return KIND_STRING
+}
+
+// findKey returns the option saved under the section.option key, nil if there is none.
+func findKey(key string) *Option {
+	for _, o := range options {
+		if len(o.Section) > 0 && o.Key() == key {
+			return o
+		}
+	}
+	return nil
+}
+
+func article(kind string) string {
+	if kind == KIND_INTEGER {
+		return "an " + kind
+	}
+	return "a " + kind
+}
+
+// valueString returns the text of a value read from a configuration file, as parsed by
+// the setting. The typed values of the JSON, YAML and TOML files must match the option kind,
+// though a scalar is accepted for a string and a comma separated string for a list.
+func (o *Option) valueString(v interface{}, typed bool) (string, error) {
+	kind := o.Kind()
+	wrong := fmt.Errorf("expected %s, got %s", article(kind), describe(v))
+	switch t := v.(type) {
+	case map[string]interface{}:
+		return "", wrong
+	case []interface{}:
+		if kind != KIND_LIST {
+			return "", wrong
+		}
+		for _, e := range t {
+			if _, ok := e.(string); !ok {
+				return "", fmt.Errorf("expected a list of strings, got %s in the list", describe(e))
+			}
+		}
+	case string:
+		if typed && (kind == KIND_INTEGER || kind == KIND_BOOLEAN) {
+			return "", wrong
+		}
+	case bool:
+		if kind == KIND_INTEGER || kind == KIND_LIST {
+			return "", wrong
+		}
+		return strconv.FormatBool(t), nil
+	case float64:
+		if kind == KIND_INTEGER && (t != math.Trunc(t) || math.Abs(t) > math.MaxInt32) {
+			return "", fmt.Errorf("expected an integer, got %v", t)
+		}
+		if kind == KIND_BOOLEAN || kind == KIND_LIST {
+			return "", wrong
+		}
+	case json.Number:
+		if _, err := t.Int64(); err != nil && kind == KIND_INTEGER {
+			return "", fmt.Errorf("expected an integer, got %v", t)
+		}
+		if kind == KIND_BOOLEAN || kind == KIND_LIST {
+			return "", wrong
+		}
+	case nil:
+	default:
+		// the integers
+		if kind == KIND_BOOLEAN || kind == KIND_LIST {
+			return "", wrong
+		}
+	}
+	return formatValue(v), nil
+}
+
+// setValue sets the option from a value of a configuration file, checked against the schema.
+func (o *Option) setValue(s *Settings, v interface{}, typed bool) error {
+	str, err := o.valueString(v, typed)
+	if err != nil {
+		return err
+	}
+	p := o.param(s)
+	if !p.Set(str) {
+		return fmt.Errorf("expected %s, got %q", article(o.Kind()), str)
+	}
+	if c, ok := schema[o.Key()]; ok {
+		return c.check(p)
+	}
+	return nil
+}
+
+func (c *constraint) check(p Param) error {
+	switch v := p.(type) {
+	case *intParam:
+		if int(*v) < c.min {
+			return fmt.Errorf("must be at least %d, got %d", c.min, *v)
+		}
+		if c.max > 0 && int(*v) > c.max {
+			return fmt.Errorf("must be at most %d, got %d", c.max, *v)
+		}
+	case *stringParam:
+		if len(*v) == 0 {
+			return nil
+		}
+		if len(c.layout) > 0 {
+			if _, err := time.Parse(c.layout, string(*v)); err != nil {
+				return fmt.Errorf("must be a time of day as %s, got %q", c.layout, *v)
+			}
+		}
+		return c.checkValue(string(*v))
+	case *listParam:
+		for _, e := range *v {
+			if err := c.checkValue(e); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (c *constraint) checkValue(v string) error {
+	if c.valid != nil {
+		return c.valid(v)
+	}
+	if len(c.values) == 0 {
+		return nil
+	}
+	for _, a := range c.values {
+		if v == a {
+			return nil
+		}
+	}
+	return fmt.Errorf("must be one of %s, got %q", strings.Join(c.values, ", "), v)
+}
+
+// paramValue returns the typed value of a setting, as written to the JSON, YAML and TOML files.
+func paramValue(p Param) interface{} {
+	switch v := p.(type) {
+	case *intParam:
+		return int(*v)
+	case *boolParam:
+		return bool(*v)
+	case *listParam:
+		return append([]string{}, *v...)
+	}
+	return p.String()
+}
+
+// validate checks the document against the schema and returns one error per
+// unknown section, unknown option or invalid value.
+func (d *configDoc) validate() (errs []error) {
+	errs = append(errs, d.problems...)
+	sections := make(map[string]bool)
+	for _, o := range options {
+		sections[o.Section] = true
+	}
+	names := make([]string, 0, len(d.sections))
+	for name := range d.sections {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, section := range names {
+		if !sections[section] || len(section) == 0 {
+			errs = append(errs, fmt.Errorf("Unknown section [%s]", section))
+			continue
+		}
+		for _, name := range sortedKeys(d.sections[section]) {
+			errs = append(errs, d.validateValue(section+"."+name, d.sections[section][name], "")...)
+		}
+	}
+	names = names[:0]
+	for name := range d.profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, profile := range names {
+		for _, key := range sortedKeys(d.profiles[profile]) {
+			errs = append(errs, d.validateValue(key, d.profiles[profile][key], profile)...)
+		}
+	}
+	return
+}
+
+// validateValue checks the value of the section.option key, in the base sections if profile is empty.
+func (d *configDoc) validateValue(key string, v interface{}, profile string) []error {
+	o := findKey(key)
+	switch {
+	case o == nil && len(profile) > 0:
+		return []error{fmt.Errorf("Unknown option %s in [%s]", key, profileSection(profile))}
+	case o == nil:
+		section, name := splitKey(key)
+		return []error{fmt.Errorf("Unknown option %s in [%s]", name, section)}
+	}
+	if err := o.setValue(newSettings(), v, d.typed); err != nil {
+		if len(profile) > 0 {
+			return []error{fmt.Errorf("[%s] %s: %v", profileSection(profile), key, err)}
+		}
+		return []error{fmt.Errorf("%s: %v", key, err)}
+	}
+	return nil
+}
+
+func invalidConfigFile(fn string, errs []error) error {
+	l := make([]string, len(errs))
+	for i, e := range errs {
+		l[i] = e.Error()
+	}
+	return fmt.Errorf("Invalid configuration file %s:\n - %s", fn, strings.Join(l, "\n - "))
+}
+
+// JSONSchema returns the JSON schema of the JSON, YAML and TOML configuration files,
+// for the editors supporting it.
+func JSONSchema() map[string]interface{} {
+	sections := make(map[string]interface{})
+	for _, o := range options {
+		if len(o.Section) == 0 {
+			continue
+		}
+		p := map[string]interface{}{"description": o.Usage}
+		switch o.Kind() {
+		case KIND_LIST:
+			p["type"] = "array"
+			p["items"] = map[string]interface{}{"type": "string"}
+		default:
+			p["type"] = o.Kind()
+		}
+		if c, ok := schema[o.Key()]; ok {
+			switch {
+			case o.Kind() == KIND_INTEGER:
+				p["minimum"] = c.min
+				if c.max > 0 {
+					p["maximum"] = c.max
+				}
+			case len(c.values) > 0 && o.Kind() == KIND_LIST:
+				p["items"] = map[string]interface{}{"type": "string", "enum": c.values}
+			case len(c.values) > 0:
+				p["enum"] = c.values
+			case len(c.layout) > 0:
+				p["pattern"] = "^([01][0-9]|2[0-3]):[0-5][0-9]$"
+			}
+		}
+		s, ok := sections[o.Section].(map[string]interface{})
+		if !ok {
+			s = map[string]interface{}{
+				"type":                 "object",
+				"additionalProperties": false,
+				"properties":           make(map[string]interface{}),
+			}
+			sections[o.Section] = s
+		}
+		s["properties"].(map[string]interface{})[o.Name] = p
+	}
+
+	properties := make(map[string]interface{})
+	for k, v := range sections {
+		properties[k] = v
+	}
+	properties[KEY_PROFILES] = map[string]interface{}{
+		"type": "object",
+		"additionalProperties": map[string]interface{}{
+			"type":                 "object",
+			"additionalProperties": false,
+			"properties":           sections,
+		},
+	}
+	return map[string]interface{}{
+		"$schema":              "https://json-schema.org/draft/2020-12/schema",
+		"title":                "goconvert configuration",
+		"type":                 "object",
+		"additionalProperties": false,
+		"properties":           properties,
+	}
+}
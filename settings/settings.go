@@ -3,8 +3,9 @@ package settings
 import (
 	conf "github.com/dlintw/goconf"
 	logger "github.com/mezzato/goconvert/logger"
-	"errors"
+	"bufio"
 	"fmt"
+	"io"
 	"log"
 	"os"
 	"path/filepath"
@@ -12,6 +13,7 @@ import (
 	"sort"
 	"strconv"
 	"strings"
+	"time"
 )
 
 const SETTINGS_FILE_NAME = "goconvert.conf"
@@ -19,38 +21,168 @@ const SETTINGS_FILE_NAME = "goconvert.conf"
 const SECTION_DEPLOY = "deploy"
 const SECTION_FTP = "ftp"
 const SECTION_CONVERT = "convert"
+const SECTION_UPLOAD = "upload"
+const SECTION_CREDENTIALS = "credentials"
+const SECTION_GALLERY = "gallery"
+const SECTION_CONTACTSHEET = "contactsheet"
+const SECTION_WEB = "web"
 
 const OPTION_DEPLOY_PUBLISHDIR = "publishdir"
 const OPTION_DEPLOY_HOMEDIR = "homedir"
 const OPTION_DEPLOY_PIWIGOGALLERYDIR = "piwigogallerydir"
 const OPTION_DEPLOY_PIWIGOGALLERYHIGHDIRNAME = "piwigogalleryhighdirname"
+const OPTION_DEPLOY_COLLECTIONTEMPLATE = "collectiontemplate"
+const OPTION_DEPLOY_TEMPLATEVARS = "templatevars"
+const OPTION_DEPLOY_INDEXFORMATS = "indexformats"
+const OPTION_DEPLOY_INDEXGPS = "indexgps"
 
 const OPTION_CONVERT_WIDTH = "width"
 const OPTION_CONVERT_HEIGHT = "height"
 const OPTION_CONVERT_NOSIMULTANEOUSRESIZE = "nosimultaneousresize"
 const OPTION_CONVERT_MOVEORIGINAL = "moveoriginal"
+const OPTION_CONVERT_TIMEOUTMSEC = "timeoutmsec"
+const OPTION_CONVERT_IMAGENAME = "imagename"
+const OPTION_CONVERT_THUMBNAILNAME = "thumbnailname"
+const OPTION_CONVERT_ORIGINALNAME = "originalname"
+const OPTION_CONVERT_TRANSLITERATE = "transliterate"
 
 const OPTION_FTP_ADDRESS = "address"
 const OPTION_FTP_USERNAME = "username"
+const OPTION_FTP_REMOTEDIR = "targetdir" // goconf skips the lines starting with "rem" as comments
+const OPTION_FTP_POLICY = "policy"
+
+const OPTION_UPLOAD_MAXCONNECTIONS = "maxconnections"
+const OPTION_UPLOAD_BANDWIDTHKBPS = "bandwidthkbps"
+const OPTION_UPLOAD_UNLIMITEDFROM = "unlimitedfrom"
+const OPTION_UPLOAD_UNLIMITEDTO = "unlimitedto"
+const OPTION_UPLOAD_DRYRUN = "dryrun"
+
+const OPTION_GALLERY_ENABLED = "enabled"
+const OPTION_GALLERY_THEMEDIR = "themedir"
+const OPTION_GALLERY_PAGESIZE = "pagesize"
+const OPTION_GALLERY_DOWNLOADS = "downloads"
+
+// GALLERY_PAGE_TEMPLATE is the Go template of the gallery pages in a theme folder.
+const GALLERY_PAGE_TEMPLATE = "page.html"
+
+const OPTION_CONTACTSHEET_ENABLED = "enabled"
+const OPTION_CONTACTSHEET_COLUMNS = "columns"
+const OPTION_CONTACTSHEET_ROWS = "rows"
+const OPTION_CONTACTSHEET_PAGE = "page"
+const OPTION_CONTACTSHEET_FORMATS = "formats"
+
+const OPTION_WEB_JOBS = "jobs"
+const OPTION_WEB_GRACESEC = "gracesec"
+const OPTION_WEB_AUTH = "auth"
+const OPTION_WEB_TOKEN = "token"
+const OPTION_WEB_USERS = "users"
+const OPTION_WEB_ROOTS = "roots"
+const OPTION_WEB_STAGINGDIR = "stagingdir"
+const OPTION_WEB_UPLOADMAXMB = "uploadmaxmb"
+const OPTION_WEB_STAGINGMAXMB = "stagingmaxmb"
+
+// Page formats of the contact sheets.
+const (
+	PAGE_A4               = "a4"
+	PAGE_A4_LANDSCAPE     = "a4-landscape"
+	PAGE_LETTER           = "letter"
+	PAGE_LETTER_LANDSCAPE = "letter-landscape"
+)
+
+// File formats of the contact sheets: a JPEG image per page or a PDF document.
+const (
+	SHEET_JPEG = "jpeg"
+	SHEET_PDF  = "pdf"
+)
+
+// Authentication of the web interface.
+const (
+	AUTH_NONE   = "none"
+	AUTH_TOKEN  = "token"  // the static token WebToken, as bearer token or token parameter
+	AUTH_BASIC  = "basic"  // the users of WebUsers with their bcrypt password hashes
+	AUTH_LAUNCH = "launch" // a one-time token in the URL opened in the browser at start
+)
+
+const OPTION_CREDENTIALS_PROVIDERS = "providers"
+const OPTION_CREDENTIALS_NETRCFILE = "netrcfile"
+const OPTION_CREDENTIALS_KEYFILE = "keyfile"
+const OPTION_CREDENTIALS_COMMAND = "command"
+
+// Formats of the collection index.
+const (
+	INDEX_JSON = "json"
+	INDEX_CSV  = "csv"
+)
+
+// Policies for a collection already present on the remote server.
+const (
+	POLICY_MERGE   = "merge"   // upload over the remote folder, keep the other files
+	POLICY_REPLACE = "replace" // upload to a staging folder and rename it to the collection folder
+	POLICY_PRUNE   = "prune"   // merge and remove the remote files not present locally
+)
 
 var argv0 = os.Args[0]
 var Debug = false
 
+// Interactive is false when nothing may be asked on the standard input.
+var Interactive = true
+
 type missingSettingsFile string
 
 func (s missingSettingsFile) String() string { return string(s) }
 
+// ConversionSettings also name the files of each rendition of an image, see FileName.
 type ConversionSettings struct {
-	Width                int  `json:"width"`
-	Height               int  `json:"height"`
-	MoveOriginal         bool `json:"moveOriginal"`
-	NoSimultaneousResize int  `json:"noSimultaneousResize"`
+	Width                int    `json:"width"`
+	Height               int    `json:"height"`
+	MoveOriginal         bool   `json:"moveOriginal"`
+	NoSimultaneousResize int    `json:"noSimultaneousResize"`
+	ImageName            string `json:"imageName"`     // the template of the resized image names, without extension
+	ThumbnailName        string `json:"thumbnailName"` // the template of the thumbnail names
+	OriginalName         string `json:"originalName"`  // the template of the archived original names
+	Transliterate        bool   `json:"transliterate"` // make the names ASCII and safe in URLs
 }
 
 type FtpSettings struct {
-	Address  string `json:"address"`
-	Username string `json:"username"`
-	Password string `json:"password"`
+	Address   string `json:"address"`
+	Username  string `json:"username"`
+	Password  string `json:"password"`
+	RemoteDir string `json:"remoteDir"`
+	Policy    string `json:"policy"` // one of POLICY_MERGE, POLICY_REPLACE, POLICY_PRUNE
+}
+
+// UploadSettings apply to every publisher uploading a collection.
+// The bandwidth cap is shared by all connections; between UnlimitedFrom and
+// UnlimitedTo, both in the "15:04" format, the upload runs at full speed.
+type UploadSettings struct {
+	MaxConnections int    `json:"maxConnections"`
+	BandwidthKBps  int    `json:"bandwidthKBps"` // 0 means unlimited
+	UnlimitedFrom  string `json:"unlimitedFrom"`
+	UnlimitedTo    string `json:"unlimitedTo"`
+	DryRun         bool   `json:"dryRun"` // only list the remote changes
+}
+
+// IsUnlimitedAt tells whether the bandwidth cap is lifted at the given time.
+func (u *UploadSettings) IsUnlimitedAt(t time.Time) bool {
+	if u.BandwidthKBps <= 0 {
+		return true
+	}
+	from, err1 := time.Parse("15:04", u.UnlimitedFrom)
+	to, err2 := time.Parse("15:04", u.UnlimitedTo)
+	if err1 != nil || err2 != nil {
+		return false
+	}
+	m := t.Hour()*60 + t.Minute()
+	f := from.Hour()*60 + from.Minute()
+	e := to.Hour()*60 + to.Minute()
+	if f == e {
+		return true // a window of a whole day
+	}
+	if f < e {
+		return m >= f && m < e
+	}
+	// the window spans midnight, e.g. 20:00 to 07:00
+	return m >= f || m < e
 }
 
 func (sets *ConversionSettings) AreaInPixed() int {
@@ -60,14 +192,39 @@ func (sets *ConversionSettings) AreaInPixed() int {
 // settings
 type Settings struct {
 	SaveConfig               bool                  `json:"saveConfig"`
+	Profile                  string                `json:"profile"` // the profile of the configuration file, empty for the base sections
 	CollName                 string                `json:"collName"`
 	SourceDir                string                `json:"sourceDir"`
 	PublishDir               string                `json:"publishDir"`
 	HomeDir                  string                `json:"homeDir"`
 	PiwigoGalleryDir         string                `json:"piwigoGalleryDir"`
 	PiwigoGalleryHighDirName string                `json:"piwigoGalleryHighDirName"`
+	CollectionTemplate       string                `json:"collectionTemplate"` // the collection folder in PublishDir, see CollectionFolder
+	TemplateVars             []string              `json:"templateVars"`       // the user variables of the templates, as name=value
+	IndexFormats             []string              `json:"indexFormats"`       // the formats of the collection index, INDEX_JSON or INDEX_CSV
+	IndexGPS                 bool                  `json:"indexGps"`           // whether the index tells where the images were taken
+	Gallery                  bool                  `json:"gallery"`            // whether to write a static HTML gallery in the collection folder
+	GalleryThemeDir          string                `json:"galleryThemeDir"`    // the folder of the gallery templates, empty for the built-in theme
+	GalleryPageSize          int                   `json:"galleryPageSize"`    // the number of thumbnails per gallery page
+	GalleryDownloads         bool                  `json:"galleryDownloads"`   // whether the gallery links the original images, uploaded with the collection
+	ContactSheet             bool                  `json:"contactSheet"`       // whether to compose the thumbnails into contact sheets
+	ContactSheetColumns      int                   `json:"contactSheetColumns"`
+	ContactSheetRows         int                   `json:"contactSheetRows"`
+	ContactSheetPage         string                `json:"contactSheetPage"`    // one of the PAGE_ constants
+	ContactSheetFormats      []string              `json:"contactSheetFormats"` // SHEET_JPEG, SHEET_PDF or both
+	WebJobs                  int                   `json:"webJobs"`             // the number of jobs the web interface runs at once
+	WebGraceSec              int                   `json:"webGraceSec"`         // how long the jobs of a closed websocket wait for a client to attach
+	WebAuth                  string                `json:"webAuth"`             // one of the AUTH_ constants
+	WebToken                 string                `json:"webToken"`            // the token of AUTH_TOKEN
+	WebUsers                 []string              `json:"webUsers"`            // the users of AUTH_BASIC, as name:bcrypt-hash
+	WebRoots                 []string              `json:"webRoots"`            // the folders the web interface can browse for images
+	WebStagingDir            string                `json:"webStagingDir"`       // where the images uploaded by the browsers are staged, empty for the user cache
+	WebUploadMaxMB           int                   `json:"webUploadMaxMB"`      // the maximum size of an uploaded image
+	WebStagingMaxMB          int                   `json:"webStagingMaxMB"`     // the maximum size of the images of an upload
 	ConversionSettings       *ConversionSettings   `json:"conversionSettings"`
 	FtpSettings              *FtpSettings          `json:"ftpSettings"`
+	UploadSettings           *UploadSettings       `json:"uploadSettings"`
+	CredentialSettings       *CredentialSettings   `json:"credentialSettings"`
 	TimeoutMsec              int                   `json:"timeout_msec"`
 	Logger                   logger.SemanticLogger `json:"-"`
 }
@@ -75,7 +232,9 @@ type Settings struct {
 func newSettings() *Settings {
 	s := new(Settings)
 	s.ConversionSettings = new(ConversionSettings)
-	s.FtpSettings = new(FtpSettings)
+	s.FtpSettings = &FtpSettings{Policy: POLICY_MERGE}
+	s.UploadSettings = &UploadSettings{MaxConnections: 4}
+	s.CredentialSettings = newCredentialSettings()
 	s.SourceDir = "."
 	s.TimeoutMsec = 10000
 	s.Logger = logger.NewConsoleSemanticLogger("goconvert", os.Stdout, logger.INFO)
@@ -95,12 +254,25 @@ func NewDefaultSettings(collectionName string, sourceDir string) *Settings {
 	s.PublishDir = filepath.Join(homeDir, "Pictures")
 	s.PiwigoGalleryDir = filepath.Join(homeDir, "piwigo", "galleries")
 	s.PiwigoGalleryHighDirName = "pwg_high"
+	s.IndexFormats = []string{INDEX_JSON}
+	s.GalleryPageSize = 48
+	s.ContactSheetColumns = 5
+	s.ContactSheetRows = 6
+	s.ContactSheetPage = PAGE_A4
+	s.ContactSheetFormats = []string{SHEET_JPEG}
+	s.WebJobs = 1
+	s.WebGraceSec = 600
+	s.WebAuth = AUTH_NONE
+	s.WebRoots = []string{s.PublishDir}
+	s.WebUploadMaxMB = 200
+	s.WebStagingMaxMB = 4096
 	s.ConversionSettings.Width = 1024
 	s.ConversionSettings.Height = 768
 	s.ConversionSettings.NoSimultaneousResize = 1
 	s.ConversionSettings.MoveOriginal = false
 	s.FtpSettings.Address = ""
 	s.FtpSettings.Username = ""
+	s.FtpSettings.RemoteDir = "./piwigo/galleries"
 	s.SaveConfig = true
 
 	return s
@@ -114,13 +286,9 @@ type Param interface {
 type boolParam bool
 
 func (b *boolParam) Set(s string) bool {
-	//v, err := strconv.Atob(s)
-	var v bool
-	if s == "y" {
-		v = true
-	}
+	v, ok := conf.BoolStrings[strings.ToLower(s)]
 	*b = boolParam(v)
-	return true
+	return ok || len(s) == 0
 }
 
 func newBoolParam(val bool, b *bool) *boolParam {
@@ -176,48 +344,49 @@ type Question struct {
 
 func LoadSettingsFromFile(c *conf.ConfigFile) (s *Settings, err error) {
 	s = newSettings()
-
-	//s.CollName =
-	s.PublishDir, _ = c.GetString(SECTION_DEPLOY, OPTION_DEPLOY_PUBLISHDIR)
-	s.HomeDir, _ = c.GetString(SECTION_DEPLOY, OPTION_DEPLOY_HOMEDIR)
-	s.PiwigoGalleryDir, _ = c.GetString(SECTION_DEPLOY, OPTION_DEPLOY_PIWIGOGALLERYDIR)
-	s.PiwigoGalleryHighDirName, _ = c.GetString(SECTION_DEPLOY, OPTION_DEPLOY_PIWIGOGALLERYHIGHDIRNAME)
-
-	s.ConversionSettings.Height, _ = c.GetInt(SECTION_CONVERT, OPTION_CONVERT_HEIGHT)
-	s.ConversionSettings.Width, _ = c.GetInt(SECTION_CONVERT, OPTION_CONVERT_WIDTH)
-	s.ConversionSettings.NoSimultaneousResize, _ = c.GetInt(SECTION_CONVERT, OPTION_CONVERT_NOSIMULTANEOUSRESIZE)
-	s.ConversionSettings.MoveOriginal, _ = c.GetBool(SECTION_CONVERT, OPTION_CONVERT_MOVEORIGINAL)
-
-	s.FtpSettings.Address, _ = c.GetString(SECTION_FTP, OPTION_FTP_ADDRESS)
-	s.FtpSettings.Username, _ = c.GetString(SECTION_FTP, OPTION_FTP_USERNAME)
-
+	// the options missing in the file keep their defaults
+	err = applyConfigFile(s, iniDoc(c), nil, "the configuration file")
 	return
 }
 
+// SaveSettingsToFile writes the settings to the base sections of the configuration file
+// returned by ConfigFilePath, or to the section of their profile if set. A profile only keeps
+// the values which differ from the merged base sections, the other profiles are left untouched.
 func SaveSettingsToFile(s *Settings) (err error) {
 
-	d, _ := filepath.Split(argv0)
-	fn := filepath.Join(d, SETTINGS_FILE_NAME)
-
-	c := conf.NewConfigFile()
-
-	c.AddSection(SECTION_DEPLOY)
-	c.AddOption(SECTION_DEPLOY, OPTION_DEPLOY_PUBLISHDIR, s.PublishDir)
-	c.AddOption(SECTION_DEPLOY, OPTION_DEPLOY_HOMEDIR, s.HomeDir)
-	c.AddOption(SECTION_DEPLOY, OPTION_DEPLOY_PIWIGOGALLERYDIR, s.PiwigoGalleryDir)
-	c.AddOption(SECTION_DEPLOY, OPTION_DEPLOY_PIWIGOGALLERYHIGHDIRNAME, s.PiwigoGalleryHighDirName)
+	d, err := readConfigFile()
+	if err != nil {
+		return
+	}
 
-	c.AddSection(SECTION_CONVERT)
-	c.AddOption(SECTION_CONVERT, OPTION_CONVERT_WIDTH, strconv.Itoa(s.ConversionSettings.Width))
-	c.AddOption(SECTION_CONVERT, OPTION_CONVERT_HEIGHT, strconv.Itoa(s.ConversionSettings.Height))
-	c.AddOption(SECTION_CONVERT, OPTION_CONVERT_NOSIMULTANEOUSRESIZE, strconv.Itoa(s.ConversionSettings.NoSimultaneousResize))
-	c.AddOption(SECTION_CONVERT, OPTION_CONVERT_MOVEORIGINAL, strconv.FormatBool(s.ConversionSettings.MoveOriginal))
+	var base *Settings
+	if len(s.Profile) > 0 {
+		if base, err = LoadProfile("", s.SourceDir); err != nil {
+			return
+		}
+		d.profile(s.Profile)
+	}
 
-	c.AddSection(SECTION_FTP)
-	c.AddOption(SECTION_FTP, OPTION_FTP_ADDRESS, s.FtpSettings.Address)
-	c.AddOption(SECTION_FTP, OPTION_FTP_USERNAME, s.FtpSettings.Username)
+	// the password itself is never written here, see the credential providers
+	for _, o := range options {
+		if len(o.Section) == 0 {
+			continue
+		}
+		var v interface{} = o.Param(s).String()
+		if d.typed {
+			v = paramValue(o.Param(s))
+		}
+		switch {
+		case base == nil:
+			d.section(o.Section)[o.Name] = v
+		case o.Param(s).String() != o.Param(base).String():
+			d.profile(s.Profile)[o.Key()] = v
+		default:
+			delete(d.profile(s.Profile), o.Key())
+		}
+	}
 
-	err = c.WriteConfigFile(fn, 0666, "goconvert configuration settings")
+	err = writeConfigFile(d)
 	return
 }
 
@@ -233,6 +402,13 @@ var questionOrder = []string{
 	"address",
 	"username",
 	"password",
+	"remotedir",
+	"policy",
+	"maxconnections",
+	"bandwidthkbps",
+	"unlimitedfrom",
+	"unlimitedto",
+	"dryrun",
 	"saveconfig",
 }
 
@@ -252,6 +428,13 @@ func (s *Settings) GetConfigQuestions(mandatoryOnly bool) (l map[string]*Questio
 			"moveoriginal":             &Question{"Remove images after processing", newBoolParam(false, &s.ConversionSettings.MoveOriginal), "Whether to remove the images from the working folder after processing and archiving"},
 			"address":                  &Question{"FTP address", newStringParam("", &s.FtpSettings.Address), "The address of the FTP server, leave blank to skip the upload"},
 			"username":                 &Question{"FTP username", newStringParam("", &s.FtpSettings.Username), "The username to log onto the FTP server"},
+			"remotedir":                &Question{"FTP remote folder", newStringParam("./piwigo/galleries", &s.FtpSettings.RemoteDir), "The folder on the FTP server where to upload the collection"},
+			"policy":                   &Question{"FTP policy", newStringParam(POLICY_MERGE, &s.FtpSettings.Policy), "What to do with a collection already on the server: merge, replace or prune"},
+			"maxconnections":           &Question{"Upload: simultaneous connections", newIntParam(4, &s.UploadSettings.MaxConnections), "Number of simultaneous upload connections"},
+			"bandwidthkbps":            &Question{"Upload: bandwidth", newIntParam(0, &s.UploadSettings.BandwidthKBps), "The maximum upload bandwidth in KB/s shared by all connections, 0 for unlimited"},
+			"unlimitedfrom":            &Question{"Upload: full speed from", newStringParam("", &s.UploadSettings.UnlimitedFrom), "The time of day (e.g. 20:00) from which the bandwidth limit is lifted, leave blank to always apply it"},
+			"unlimitedto":              &Question{"Upload: full speed to", newStringParam("", &s.UploadSettings.UnlimitedTo), "The time of day (e.g. 07:00) at which the bandwidth limit applies again"},
+			"dryrun":                   &Question{"Upload: dry run", newBoolParam(false, &s.UploadSettings.DryRun), "Whether to only list the remote changes without uploading, y = yes, n = no"},
 			"saveconfig":               &Question{"Save the new settings to a file", newBoolParam(true, &s.SaveConfig), "Whether to save the settings for next time (passwords will not be saved!)"},
 		}
 		return o
@@ -270,19 +453,16 @@ func (s *Settings) GetConfigQuestions(mandatoryOnly bool) (l map[string]*Questio
 	return
 }
 
-func AskForSettings(collName string, srcfolder string) (s *Settings, err error) {
-
-	var newSettingsFile bool
-
-	var c *conf.ConfigFile
-	d, _ := filepath.Split(argv0)
-	fn := filepath.Join(d, SETTINGS_FILE_NAME)
-	fmt.Printf("Config file path:%s\n", fn)
+// AskForSettings asks for the settings on the standard input, proposing the ones of
+// the configuration file, with the named profile applied if not empty.
+func AskForSettings(collName string, srcfolder string, profile string) (s *Settings, err error) {
 
-	if _, err = os.Stat(fn); err != nil {
-		newSettingsFile = true
-	} else if c, err = conf.ReadConfigFile(fn); err != nil {
-		return nil, errors.New(fmt.Sprintf("Error reading the file %s", fn))
+	var newSettingsFile = true
+	for _, src := range ConfigSources(srcfolder) {
+		if src.Exists {
+			fmt.Printf("Config file path:%s\n", src.Path)
+			newSettingsFile = false
+		}
 	}
 
 	var useFile bool
@@ -307,18 +487,19 @@ func AskForSettings(collName string, srcfolder string) (s *Settings, err error)
 	}
 
 	if useFile {
-		s, err = LoadSettingsFromFile(c)
+		s, err = LoadProfile(profile, srcfolder)
 		if err != nil {
 			log.Fatalf("A fatal error has occurred: %s", err)
 		}
 	} else {
 		s = newSettings()
+		s.Profile = strings.ToLower(strings.TrimSpace(profile))
 	}
 
-	fmt.Printf("Use file is:%s\n", useFile)
+	fmt.Printf("Use file is:%v\n", useFile)
 	qs := s.GetConfigQuestions(useFile)
 
-	ftpkeys := []string{"address", "password", "username"} // sorted!
+	ftpkeys := []string{"address", "bandwidthkbps", "dryrun", "maxconnections", "password", "policy", "remotedir", "unlimitedfrom", "unlimitedto", "username"} // sorted!
 	sort.Strings(ftpkeys)
 
 	var skipFtp = useFile && len(s.FtpSettings.Address) == 0
@@ -331,6 +512,16 @@ func AskForSettings(collName string, srcfolder string) (s *Settings, err error)
 			continue // do not ask about ftp settings
 		}
 
+		if qkey == "password" {
+			// no need to ask if a credential provider knows the password
+			if p, e := s.ResolvePassword(); e != nil {
+				fmt.Println(e)
+			} else if len(p) > 0 {
+				fmt.Printf("Using the FTP password from the %s credential provider\n", p)
+				continue
+			}
+		}
+
 		q, ok := qs[qkey]
 		if ok {
 			askQuestion(q)
@@ -341,19 +532,19 @@ func AskForSettings(collName string, srcfolder string) (s *Settings, err error)
 
 	}
 
+	s.CollName = collName
+	s.SourceDir = srcfolder
+
 	if s.SaveConfig {
-		fmt.Printf("Saving configuration file\n")
+		fmt.Printf("Saving configuration file %s\n", ConfigFilePath())
 		err = SaveSettingsToFile(s)
 		if err != nil {
 			log.Fatalf("A fatal error has occurred: %s", err)
 		}
 	}
 
-	s.CollName = collName
-	s.SourceDir = srcfolder
-
 	if skipFtp {
-		fmt.Println("\nTHE FTP UPLOAD WILL BE SKIPPED! If you want to use it restart the conversion without using any saved settings.\n")
+		fmt.Print("\nTHE FTP UPLOAD WILL BE SKIPPED! If you want to use it restart the conversion without using any saved settings.\n\n")
 	}
 
 	return
@@ -373,22 +564,19 @@ func GetHomeDir() string {
 	return homeDir
 }
 
+var stdin = bufio.NewReader(os.Stdin)
+
+// askParameter prints the question and reads one line from the standard input,
+// the trailing newline excluded. It fails when not running interactively.
 func askParameter(question string) (inputValue string, err error) {
+	if !Interactive {
+		return "", fmt.Errorf("Can not ask in non-interactive mode: %s", question)
+	}
 	fmt.Print(question)
-	//originalStdout := os.Stdout
-	//os.Stdout, _ = os.OpenFile(os.DevNull, os.O_RDONLY, 0)
-	//defer func(){os.Stdout = originalStdout}()
-	const NBUF = 512
-	var buf [NBUF]byte
-	switch nr, er := os.Stdin.Read(buf[:]); true {
-	case nr < 0:
-		fmt.Print(os.Stderr, "Error reading parameter. Error: ", er)
-		os.Exit(1)
-	case nr == 0: //EOF
-		//os.NewError("Invalid parameter")
-	case nr > 0:
-		inputValue, err = string(buf[0:nr]), nil
+	inputValue, err = stdin.ReadString('\n')
+	if err == io.EOF && len(inputValue) > 0 {
+		err = nil
 	}
-	//fmt.Println("The input value is:", inputValue, " with length: ", len(inputValue))
+	inputValue = strings.TrimRight(inputValue, "\r\n")
 	return
 }
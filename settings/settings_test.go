@@ -0,0 +1,539 @@
+package settings
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNetrcCredentialProvider(t *testing.T) {
+	fp := filepath.Join(t.TempDir(), "netrc")
+	data := "machine ftp.example.com login enrico password secret\ndefault login anonymous password guest\n"
+	if e := os.WriteFile(fp, []byte(data), 0600); e != nil {
+		t.Fatalf("error %q", e)
+	}
+	p := &NetrcCredentialProvider{fp}
+
+	if pwd, found, e := p.Password("ftp.example.com", "enrico"); e != nil || !found || pwd != "secret" {
+		t.Fatalf("Wrong password %q, found %v, error %v", pwd, found, e)
+	}
+	if pwd, found, _ := p.Password("other.example.com", "anonymous"); !found || pwd != "guest" {
+		t.Fatalf("The default entry should match, got %q", pwd)
+	}
+	if _, found, _ := p.Password("other.example.com", "enrico"); found {
+		t.Fatalf("No entry should match")
+	}
+}
+
+func TestKeyfileCredentialProvider(t *testing.T) {
+	fp := filepath.Join(t.TempDir(), "keyfile")
+	if e := SaveKeyfileCredential(fp, "passphrase", "ftp.example.com", "enrico", "secret"); e != nil {
+		t.Fatalf("error %q", e)
+	}
+
+	p := &KeyfileCredentialProvider{fp, func() (string, error) { return "passphrase", nil }}
+	if pwd, found, e := p.Password("ftp.example.com", "enrico"); e != nil || !found || pwd != "secret" {
+		t.Fatalf("Wrong password %q, found %v, error %v", pwd, found, e)
+	}
+
+	p.Passphrase = func() (string, error) { return "wrong", nil }
+	if _, _, e := p.Password("ftp.example.com", "enrico"); e == nil {
+		t.Fatalf("A wrong passphrase must fail")
+	}
+
+	// config credentials set: the passphrase twice for a new keyfile, then the password
+	defer func(r *bufio.Reader) { stdin = r }(stdin)
+	s := NewDefaultSettings("", "")
+	s.FtpSettings.Address, s.FtpSettings.Username = "ftp.example.com", "anna"
+	s.CredentialSettings.Keyfile = filepath.Join(t.TempDir(), "keyfile")
+	stdin = bufio.NewReader(strings.NewReader("passphrase\nother\n"))
+	if e := s.StoreKeyfileCredential(); e == nil {
+		t.Fatalf("Different passphrases must fail")
+	}
+	stdin = bufio.NewReader(strings.NewReader("passphrase\npassphrase\nsecret2\n"))
+	if e := s.StoreKeyfileCredential(); e != nil {
+		t.Fatalf("error %q", e)
+	}
+	p.Path, p.Passphrase = s.CredentialSettings.Keyfile, func() (string, error) { return "passphrase", nil }
+	if pwd, found, e := p.Password("ftp.example.com", "anna"); e != nil || !found || pwd != "secret2" {
+		t.Fatalf("Wrong password %q, found %v, error %v", pwd, found, e)
+	}
+}
+
+func TestResolvePassword(t *testing.T) {
+	s := NewDefaultSettings("coll", ".")
+	s.FtpSettings.Address = "ftp.example.com"
+	s.CredentialSettings.Providers = []string{PROVIDER_ENV}
+	t.Setenv(ENV_FTP_PASSWORD, "fromenv")
+
+	p, e := s.ResolvePassword()
+	if e != nil || p != PROVIDER_ENV || s.FtpSettings.Password != "fromenv" {
+		t.Fatalf("Password not resolved: provider %q, error %v", p, e)
+	}
+}
+
+// isolateConfig points all the configuration files into a temporary folder.
+func isolateConfig(t *testing.T) (dir string) {
+	dir = t.TempDir()
+	defer func(a, s, c string) {
+		t.Cleanup(func() { argv0, systemConfigDir, ConfigFile = a, s, c })
+	}(argv0, systemConfigDir, ConfigFile)
+	argv0 = filepath.Join(dir, "bin", "goconvert")
+	systemConfigDir = filepath.Join(dir, "etc")
+	ConfigFile = ""
+	t.Setenv("XDG_CONFIG_HOME", filepath.Join(dir, "home"))
+	t.Setenv(ENV_CONFIG, "")
+	t.Setenv(ENV_PROFILE, "")
+	return
+}
+
+func writeFile(t *testing.T, fn, data string) {
+	if e := os.MkdirAll(filepath.Dir(fn), 0755); e != nil {
+		t.Fatalf("error %q", e)
+	}
+	if e := os.WriteFile(fn, []byte(data), 0600); e != nil {
+		t.Fatalf("error %q", e)
+	}
+}
+
+func TestLoadSettings(t *testing.T) {
+	dir := isolateConfig(t)
+
+	data := "[convert]\nwidth = 800\nheight = 600\n\n[ftp]\naddress = ftp.example.com\nusername = enrico\n"
+	writeFile(t, ConfigFilePath(), data)
+	t.Setenv("GOCONVERT_HEIGHT", "500")
+	t.Setenv("GOCONVERT_COLLNAME", "fromenv")
+	t.Setenv(ENV_FTP_PASSWORD, "")
+
+	// missing password and collection folder
+	s, e := LoadSettings(map[string]string{"f": filepath.Join(dir, "missing")})
+	if e != nil {
+		t.Fatalf("error %q", e)
+	}
+	if e = s.CheckConversion(); e == nil || !strings.Contains(e.Error(), "-f or GOCONVERT_SOURCEDIR") {
+		t.Fatalf("Expected the missing image folder, got %v", e)
+	}
+	if e = s.CheckUpload(); e == nil || !strings.Contains(e.Error(), "FTP password") {
+		t.Fatalf("Expected the missing password, got %v", e)
+	}
+
+	t.Setenv(ENV_FTP_PASSWORD, "secret")
+	s, e = LoadSettings(map[string]string{"f": dir, "c": "fromflag", "moveoriginal": "yes"})
+	if e != nil {
+		t.Fatalf("error %q", e)
+	}
+	if e = s.CheckConversion(); e != nil {
+		t.Fatalf("error %q", e)
+	}
+	if s.ConversionSettings.Width != 800 || s.ConversionSettings.Height != 500 {
+		t.Fatalf("Wrong size %dx%d, env should win over the file", s.ConversionSettings.Width, s.ConversionSettings.Height)
+	}
+	if s.CollName != "fromflag" || !s.ConversionSettings.MoveOriginal || s.FtpSettings.Password != "secret" {
+		t.Fatalf("Flags should win over env, got %+v", s)
+	}
+	if s.ConversionSettings.NoSimultaneousResize != 1 || s.SaveConfig {
+		t.Fatalf("Defaults expected, got %+v", s)
+	}
+
+	if _, e = LoadSettings(map[string]string{"f": dir, "width": "wide"}); e == nil {
+		t.Fatalf("An invalid width should fail")
+	}
+
+	data += "\n[upload]\nmaxconnections = many\nunknown = 1\n"
+	writeFile(t, ConfigFilePath(), data)
+	if errs := ValidateConfigFiles(""); len(errs) != 2 {
+		t.Fatalf("Expected 2 errors, got %v", errs)
+	}
+}
+
+func TestProfiles(t *testing.T) {
+	isolateConfig(t)
+
+	s := NewDefaultSettings("", ".")
+	s.FtpSettings.RemoteDir = "galleries"
+	if e := SaveSettingsToFile(s); e != nil {
+		t.Fatalf("error %q", e)
+	}
+	s.Profile = "Club"
+	s.ConversionSettings.Width = 1600
+	if e := SaveSettingsToFile(s); e != nil {
+		t.Fatalf("error %q", e)
+	}
+
+	if names, e := ListProfiles(""); e != nil || len(names) != 1 || names[0] != "club" {
+		t.Fatalf("Expected the club profile, got %v, error %v", names, e)
+	}
+	p, e := LoadProfile("club", "")
+	if e != nil {
+		t.Fatalf("error %q", e)
+	}
+	if p.ConversionSettings.Width != 1600 || p.FtpSettings.RemoteDir != "galleries" {
+		t.Fatalf("The profile should inherit from the base sections, got %+v", p.ConversionSettings)
+	}
+	if b, _ := LoadProfile("", ""); b.ConversionSettings.Width != 1024 {
+		t.Fatalf("The base sections should be unchanged, got width %d", b.ConversionSettings.Width)
+	}
+	if errs := ValidateConfigFiles(""); len(errs) > 0 {
+		t.Fatalf("Unexpected errors %v", errs)
+	}
+
+	if e = DeleteProfile("club"); e != nil {
+		t.Fatalf("error %q", e)
+	}
+	if _, e = LoadProfile("club", ""); e == nil {
+		t.Fatalf("The profile should be deleted")
+	}
+}
+
+func TestConfigLayers(t *testing.T) {
+	dir := isolateConfig(t)
+	project := filepath.Join(dir, "images")
+	writeFile(t, filepath.Join(systemConfigDir, SETTINGS_FILE_NAME), "[convert]\nwidth = 100\nheight = 100\n\n[ftp]\naddress = ftp.system.org\n")
+	writeFile(t, UserConfigFile(), "[convert]\nwidth = 200\n\n[profile club]\nftp.address = ftp.club.org\n")
+	writeFile(t, filepath.Join(project, SETTINGS_FILE_NAME), "[convert]\nwidth = 300\n")
+	explicit := filepath.Join(dir, "explicit.conf")
+	writeFile(t, explicit, "[upload]\nmaxconnections = 4\n")
+	t.Setenv(ENV_CONFIG, explicit)
+	t.Setenv("GOCONVERT_HEIGHT", "500")
+	t.Setenv(ENV_FTP_PASSWORD, "secret")
+
+	if l := ConfigSources(project); len(l) != 5 || l[4].Name != SOURCE_CONFIG || !l[4].Exists || l[1].Exists {
+		t.Fatalf("Unexpected sources %v", l)
+	}
+	if ConfigFilePath() != explicit {
+		t.Fatalf("The explicit file should be written, got %s", ConfigFilePath())
+	}
+
+	s, origins, e := LoadSettingsWithOrigins(map[string]string{"f": project, "profile": "club"})
+	if e != nil {
+		t.Fatalf("error %q", e)
+	}
+	if s.ConversionSettings.Width != 300 || s.ConversionSettings.Height != 500 || s.UploadSettings.MaxConnections != 4 {
+		t.Fatalf("Wrong merge, got %+v %+v", s.ConversionSettings, s.UploadSettings)
+	}
+	if s.FtpSettings.Address != "ftp.club.org" {
+		t.Fatalf("The profile should win over the system file, got %s", s.FtpSettings.Address)
+	}
+	for key, prefix := range map[string]string{
+		"convert.width":         SOURCE_PROJECT,
+		"convert.height":        SOURCE_ENV,
+		"upload.maxconnections": SOURCE_CONFIG,
+		"ftp.address":           SOURCE_USER,
+		"convert.timeoutmsec":   SOURCE_DEFAULT,
+	} {
+		if !strings.HasPrefix(origins[key], prefix) {
+			t.Errorf("%s should come from %s, got %q", key, prefix, origins[key])
+		}
+	}
+	if !strings.Contains(origins["ftp.address"], "[profile club]") {
+		t.Errorf("The origin should name the profile, got %q", origins["ftp.address"])
+	}
+
+	if names, _ := ListProfiles(project); len(names) != 1 {
+		t.Fatalf("Expected the club profile, got %v", names)
+	}
+	if e = SetConfigValue("", "convert.width", "wide"); e == nil {
+		t.Fatalf("An invalid width should not be written")
+	}
+	if e = SetConfigValue("", "convert.height", "700"); e != nil {
+		t.Fatalf("error %q", e)
+	}
+	os.Unsetenv("GOCONVERT_HEIGHT")
+	if s, e = LoadSettings(map[string]string{"f": project}); e != nil || s.ConversionSettings.Height != 700 {
+		t.Fatalf("The value should be saved in the explicit file, got %v, error %v", s, e)
+	}
+}
+
+func TestConfigFormats(t *testing.T) {
+	dir := isolateConfig(t)
+	project := filepath.Join(dir, "images")
+	writeFile(t, filepath.Join(systemConfigDir, "goconvert.toml"), "[convert]\nwidth = 100\n\n[profiles.club.ftp]\naddress = \"ftp.club.org\"\n")
+	writeFile(t, filepath.Join(dir, "home", "goconvert", "goconvert.yaml"), "convert:\n  height: 200\n  moveoriginal: true\ncredentials:\n  providers: [env, netrc]\n")
+	writeFile(t, filepath.Join(project, "goconvert.json"), `{"upload": {"maxconnections": 2, "unlimitedfrom": "20:00"}}`)
+
+	if fn := UserConfigFile(); FormatOf(fn) != FORMAT_YAML {
+		t.Fatalf("The YAML file should be the user file, got %s", fn)
+	}
+	s, e := LoadProfile("club", project)
+	if e != nil {
+		t.Fatalf("error %q", e)
+	}
+	if s.ConversionSettings.Width != 100 || s.ConversionSettings.Height != 200 || !s.ConversionSettings.MoveOriginal {
+		t.Fatalf("Wrong conversion settings %+v", s.ConversionSettings)
+	}
+	if s.UploadSettings.MaxConnections != 2 || s.UploadSettings.UnlimitedFrom != "20:00" || s.FtpSettings.Address != "ftp.club.org" {
+		t.Fatalf("Wrong settings %+v %+v", s.UploadSettings, s.FtpSettings)
+	}
+	if len(s.CredentialSettings.Providers) != 2 || s.CredentialSettings.Providers[1] != PROVIDER_NETRC {
+		t.Fatalf("Wrong providers %v", s.CredentialSettings.Providers)
+	}
+
+	// a profile saved to the YAML file keeps its types
+	s.Profile = "club"
+	s.ConversionSettings.Width = 1600
+	if e = SaveSettingsToFile(s); e != nil {
+		t.Fatalf("error %q", e)
+	}
+	if fi, e := os.Stat(UserConfigFile()); e != nil || (runtime.GOOS != "windows" && fi.Mode().Perm() != 0600) {
+		t.Fatalf("The configuration file should be readable by its owner only, got %v, error %v", fi, e)
+	}
+	data, _ := os.ReadFile(UserConfigFile())
+	if !strings.Contains(string(data), "convert.width: 1600") && !strings.Contains(string(data), "width: 1600") {
+		t.Fatalf("The width should be an integer, got\n%s", data)
+	}
+	if p, e := LoadProfile("club", project); e != nil || p.ConversionSettings.Width != 1600 {
+		t.Fatalf("The profile should be saved, got %v, error %v", p, e)
+	}
+
+	writeFile(t, filepath.Join(project, "goconvert.json"), `{"convert": {"width": "wide", "height": -5, "nosimultaneousresize": 100},
+		"upload": {"maxconnections": 2.5, "unlimitedto": "late", "speed": 1}, "extra": {}, "profiles": {"club": {"ftp": {"policy": "keep"}}}}`)
+	writeFile(t, filepath.Join(project, SETTINGS_FILE_NAME), "[convert]\nwidth = 300\n")
+	if p, e := LoadProfile("", project); e != nil || p.ConversionSettings.Width != 300 {
+		t.Fatalf("goconvert.conf should be read first, got %v, error %v", p, e)
+	}
+	if errs := ValidateConfigFiles(project); len(errs) != 1 || !strings.Contains(errs[0].Error(), "ignored") {
+		t.Fatalf("The JSON file should be reported as ignored, got %v", errs)
+	}
+	os.Remove(filepath.Join(project, SETTINGS_FILE_NAME))
+	if _, e = LoadProfile("", project); e == nil || !strings.Contains(e.Error(), "Invalid configuration file") {
+		t.Fatalf("An invalid file should fail, got %v", e)
+	}
+	errs := ValidateConfigFiles(project)
+	var msgs []string
+	for _, e := range errs {
+		msgs = append(msgs, e.Error())
+	}
+	all := strings.Join(msgs, "\n")
+	for _, want := range []string{
+		"Unknown section [extra]",
+		`convert.width: expected an integer, got the string "wide"`,
+		"convert.height: must be at least 1, got -5",
+		"convert.nosimultaneousresize: must be at most 64, got 100",
+		"upload.maxconnections: expected an integer, got 2.5",
+		`upload.unlimitedto: must be a time of day as 15:04, got "late"`,
+		"Unknown option speed in [upload]",
+		`[profile club] ftp.policy: must be one of merge, replace, prune, got "keep"`,
+	} {
+		if !strings.Contains(all, want) {
+			t.Errorf("Missing error %q in\n%s", want, all)
+		}
+	}
+	if len(errs) != 8 {
+		t.Errorf("Expected 8 errors, got\n%s", all)
+	}
+}
+
+func TestMigrateConfigFile(t *testing.T) {
+	dir := isolateConfig(t)
+	fn := filepath.Join(dir, SETTINGS_FILE_NAME)
+	writeFile(t, fn, "[convert]\nwidth = 800\nmoveoriginal = y\n\n[credentials]\nproviders = env,keyfile\n\n[profile club]\nupload.maxconnections = 8\n")
+
+	for _, format := range []string{FORMAT_JSON, FORMAT_YAML, FORMAT_TOML} {
+		dst, e := MigrateConfigFile(fn, format)
+		if e != nil {
+			t.Fatalf("error %q", e)
+		}
+		if _, e = os.Stat(fn + ".bak"); e != nil {
+			t.Fatalf("The INI file should be kept as .bak, error %v", e)
+		}
+		ConfigFile = dst
+		s, e := LoadProfile("club", "")
+		if e != nil {
+			t.Fatalf("%s: error %q", format, e)
+		}
+		if s.ConversionSettings.Width != 800 || !s.ConversionSettings.MoveOriginal || s.UploadSettings.MaxConnections != 8 ||
+			len(s.CredentialSettings.Providers) != 2 {
+			t.Fatalf("%s: wrong settings %+v %+v", format, s.ConversionSettings, s.UploadSettings)
+		}
+		if errs := ValidateConfigFiles(""); len(errs) > 0 {
+			t.Fatalf("%s: unexpected errors %v", format, errs)
+		}
+		ConfigFile = ""
+		os.Rename(fn+".bak", fn)
+	}
+
+	if _, e := MigrateConfigFile(fn, FORMAT_JSON); e == nil || !strings.Contains(e.Error(), "already exists") {
+		t.Fatalf("An existing file should not be overwritten, got %v", e)
+	}
+	writeFile(t, fn, "[convert]\nwidth = -1\n")
+	if _, e := MigrateConfigFile(fn, "xml"); e == nil {
+		t.Fatalf("An unknown format should fail")
+	}
+	os.Remove(filepath.Join(dir, "goconvert.yaml"))
+	if _, e := MigrateConfigFile(fn, FORMAT_YAML); e == nil || !strings.Contains(e.Error(), "must be at least 1") {
+		t.Fatalf("An invalid file should not be migrated, got %v", e)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	dir := t.TempDir()
+	s := NewDefaultSettings("holidays 2012", dir)
+	s.PublishDir = filepath.Join(dir, "published", "new")
+	if e := s.Validate(); e != nil {
+		t.Fatalf("Valid settings expected, got %v", e)
+	}
+
+	s.CollName = "a/b"
+	s.SourceDir = filepath.Join(dir, "missing")
+	s.ConversionSettings.Width = -10
+	s.ConversionSettings.NoSimultaneousResize = 0
+	s.TimeoutMsec = 0
+	s.FtpSettings.Policy = "keep"
+	e := s.Validate()
+	fields := FieldErrors(e)
+	want := map[string]string{
+		"collName":                 "can not contain",
+		"sourceDir":                "does not exist",
+		"conversionSettings.width": "must be at least 1",
+		"conversionSettings.noSimultaneousResize": "must be at least 1",
+		"timeout_msec":       "must be at least 1",
+		"ftpSettings.policy": "must be one of",
+	}
+	if len(fields) != len(want) {
+		t.Fatalf("Expected %d field errors, got %v", len(want), e)
+	}
+	for _, f := range fields {
+		if !strings.Contains(f.Message, want[f.Field]) || len(want[f.Field]) == 0 {
+			t.Errorf("Unexpected error %v", f)
+		}
+	}
+	if !strings.Contains(e.Error(), "conversionSettings.width (-width): must be at least 1") {
+		t.Errorf("The flag should be named, got %v", e)
+	}
+
+	s = NewDefaultSettings("coll", dir)
+	fn := filepath.Join(dir, "file")
+	writeFile(t, fn, "")
+	s.PublishDir = filepath.Join(fn, "sub")
+	s.FtpSettings = nil
+	fields = FieldErrors(s.Validate())
+	if len(fields) != 2 || fields[0].Field != "publishDir" || fields[1].Field != "ftpSettings" {
+		t.Fatalf("Expected the publish folder and FTP settings errors, got %v", fields)
+	}
+}
+
+func TestCollectionTemplate(t *testing.T) {
+	dir := t.TempDir()
+	s := NewDefaultSettings("holidays", dir)
+	info := &CollectionInfo{
+		Name:   "holidays",
+		First:  time.Date(2012, 3, 1, 10, 0, 0, 0, time.UTC),
+		Last:   time.Date(2012, 3, 4, 18, 0, 0, 0, time.UTC),
+		Count:  12,
+		Camera: "Canon EOS 1000D",
+	}
+	folder, e := s.CollectionFolder(info)
+	if e != nil || folder != "20120301_20120304_holidays" {
+		t.Fatalf("Unexpected default folder %q, %v", folder, e)
+	}
+
+	s.CollectionTemplate = "{year}/{month}/{first:2006-01-02}_{collname} ({count} by {club})"
+	s.TemplateVars = []string{"club=alpine"}
+	if e = s.Validate(); e != nil {
+		t.Fatalf("Valid template expected, got %v", e)
+	}
+	folder, e = s.CollectionFolder(info)
+	if e != nil || folder != filepath.FromSlash("2012/03/2012-03-01_holidays (12 by alpine)") {
+		t.Fatalf("Unexpected folder %q, %v", folder, e)
+	}
+
+	// the values can not add folders
+	s.CollectionTemplate = "{camera}/{collname}"
+	info.Camera, info.Name = "EOS/5D", "a:b"
+	if folder, e = s.CollectionFolder(info); e != nil || folder != filepath.FromSlash("EOS_5D/a_b") {
+		t.Fatalf("Unexpected folder %q, %v", folder, e)
+	}
+	info.Camera = ""
+	if folder, _ = s.CollectionFolder(info); folder != filepath.FromSlash("unknown/a_b") {
+		t.Fatalf("Unexpected folder without camera %q", folder)
+	}
+
+	invalid := map[string]string{
+		"/{collname}":          "relative",
+		"{year}/../{collname}": ". or ..",
+		"{year}//{collname}":   "empty folder",
+		"{collname":            "unclosed",
+		"{first}?{collname}":   "can not contain",
+		"{collname}_{place}":   "unknown placeholder {place}",
+	}
+	for tmpl, msg := range invalid {
+		s.CollectionTemplate = tmpl
+		fields := FieldErrors(s.Validate())
+		if len(fields) != 1 || fields[0].Field != "collectionTemplate" || !strings.Contains(fields[0].Message, msg) {
+			t.Errorf("Template %q: expected %q, got %v", tmpl, msg, fields)
+		}
+	}
+
+	s.CollectionTemplate = ""
+	s.TemplateVars = []string{"year=2000", "Club"}
+	if fields := FieldErrors(s.Validate()); len(fields) != 1 || fields[0].Field != "templateVars" {
+		t.Fatalf("Expected a template variable error, got %v", fields)
+	}
+}
+
+func TestParseCollectionFolder(t *testing.T) {
+	s := NewDefaultSettings("", t.TempDir())
+	info, ok := s.ParseCollectionFolder("20120301_20120304_summer_holidays")
+	if !ok || info.Name != "summer_holidays" || !info.First.Equal(time.Date(2012, 3, 1, 0, 0, 0, 0, time.UTC)) || info.Last.Day() != 4 {
+		t.Fatalf("Unexpected collection %+v, %v", info, ok)
+	}
+	for _, folder := range []string{"holidays", "2012_20120304_holidays", "2012/20120301_20120304_holidays"} {
+		if _, ok = s.ParseCollectionFolder(folder); ok {
+			t.Errorf("The folder %s should not match the template", folder)
+		}
+	}
+
+	s.CollectionTemplate = "{year}/{month}/{collname} ({count} by {club}, {camera})"
+	s.TemplateVars = []string{"club=alpine"}
+	info, ok = s.ParseCollectionFolder("2012/03/holidays (12 by alpine, EOS_5D)")
+	if !ok || info.Name != "holidays" || info.Count != 12 || info.Camera != "EOS_5D" || !info.First.Equal(time.Date(2012, 3, 1, 0, 0, 0, 0, time.UTC)) {
+		t.Fatalf("Unexpected collection %+v, %v", info, ok)
+	}
+	if _, ok = s.ParseCollectionFolder("2012/03/holidays (12 by others, EOS_5D)"); ok {
+		t.Errorf("The variables of the template should match their value")
+	}
+}
+
+func TestFileName(t *testing.T) {
+	s := NewDefaultSettings("holidays", t.TempDir())
+	info := &FileInfo{
+		Name:     "Łódź été.JPG",
+		Seq:      7,
+		Count:    120,
+		Date:     time.Date(2012, 3, 1, 10, 20, 30, 0, time.UTC),
+		CollName: "holidays",
+		Hash:     func() (string, error) { return "0123456789abcdef", nil },
+	}
+	names := map[string]string{}
+	for _, r := range []string{RENDITION_IMAGE, RENDITION_THUMBNAIL, RENDITION_ORIGINAL} {
+		n, e := s.FileName(r, info)
+		if e != nil {
+			t.Fatalf("error %q", e)
+		}
+		names[r] = n
+		info.Image = n
+	}
+	if names[RENDITION_IMAGE] != "Łódź_été" || names[RENDITION_THUMBNAIL] != "TN-Łódź_été" {
+		t.Fatalf("Unexpected default names %v", names)
+	}
+
+	s.ConversionSettings.ImageName = "{date}-{time:1504}_{seq}_{seq:5}_{hash:6}_{camera} & {rendition}_{name}"
+	s.ConversionSettings.Transliterate = true
+	if e := s.Validate(); e != nil {
+		t.Fatalf("Valid templates expected, got %v", e)
+	}
+	if n, _ := s.FileName(RENDITION_IMAGE, info); n != "20120301-1020_007_00007_012345_unknown___image_Lodz_ete" {
+		t.Fatalf("Unexpected name %q", n)
+	}
+
+	s.ConversionSettings.ImageName = "{image}"
+	s.ConversionSettings.OriginalName = "a/{name}"
+	fields := FieldErrors(s.Validate())
+	if len(fields) != 2 || fields[0].Field != "conversionSettings.imageName" || fields[1].Field != "conversionSettings.originalName" {
+		t.Fatalf("Expected the image and original name errors, got %v", fields)
+	}
+}
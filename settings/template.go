@@ -0,0 +1,314 @@
+package settings
+
+import (
+	"fmt"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// DEFAULT_COLLECTION_TEMPLATE names the collection folders after the date range of their
+// images, e.g. 20120301_20120304_holidays.
+const DEFAULT_COLLECTION_TEMPLATE = "{first}_{last}_{collname}"
+
+// The placeholders of the collection template. first and last take an optional Go time
+// layout, e.g. {first:2006-01-02}; year, month and day are the ones of the first image.
+var collectionPlaceholders = []string{"collname", "first", "last", "year", "month", "day", "count", "camera"}
+
+// CollectionInfo holds the values of the collection template placeholders.
+type CollectionInfo struct {
+	Name   string
+	First  time.Time // the date of the oldest image
+	Last   time.Time // the date of the most recent image
+	Count  int
+	Camera string // the camera model of the images, empty if unknown
+}
+
+// unsafeChars can not be part of a file or folder name on any system.
+const unsafeChars = `\:*?"<>|`
+
+var templateVarName = regexp.MustCompile(`^[a-z][a-z0-9_]*$`)
+
+// templatePart is either a literal or a placeholder of a template.
+type templatePart struct {
+	literal string
+	name    string
+	arg     string // after the colon, e.g. the time layout of {first:2006}
+}
+
+// parseTemplate splits a template into its literals and {name} or {name:arg} placeholders.
+func parseTemplate(t string) (parts []templatePart, err error) {
+	for len(t) > 0 {
+		i := strings.IndexAny(t, "{}")
+		if i < 0 {
+			parts = append(parts, templatePart{literal: t})
+			break
+		}
+		if t[i] == '}' {
+			return nil, fmt.Errorf("unexpected } at %q", t[i:])
+		}
+		if i > 0 {
+			parts = append(parts, templatePart{literal: t[:i]})
+		}
+		j := strings.IndexAny(t[i+1:], "{}")
+		if j < 0 || t[i+1+j] == '{' {
+			return nil, fmt.Errorf("unclosed { at %q", t[i:])
+		}
+		p := templatePart{name: t[i+1 : i+1+j]}
+		if k := strings.Index(p.name, ":"); k >= 0 {
+			p.name, p.arg = p.name[:k], p.name[k+1:]
+		}
+		if !templateVarName.MatchString(p.name) {
+			return nil, fmt.Errorf("invalid placeholder {%s}", t[i+1:i+1+j])
+		}
+		parts = append(parts, p)
+		t = t[i+j+2:]
+	}
+	return
+}
+
+// checkPathTemplate checks the syntax of a template of relative slash separated paths
+// and that its literals are safe in file names.
+func checkPathTemplate(t string) error {
+	parts, err := parseTemplate(t)
+	if err != nil {
+		return err
+	}
+	var literals []string
+	for _, p := range parts {
+		if len(p.name) > 0 {
+			literals = append(literals, "x") // any value
+		} else {
+			literals = append(literals, p.literal)
+		}
+		if strings.ContainsAny(p.literal, unsafeChars) || strings.IndexFunc(p.literal, unicode.IsControl) >= 0 {
+			return fmt.Errorf("%q can not contain any of %s", p.literal, unsafeChars)
+		}
+	}
+	return checkRelativePath(strings.Join(literals, ""))
+}
+
+func checkRelativePath(p string) error {
+	if len(p) == 0 {
+		return fmt.Errorf("the path is empty")
+	}
+	if strings.HasPrefix(p, "/") {
+		return fmt.Errorf("%q must be a relative path", p)
+	}
+	for _, segment := range strings.Split(p, "/") {
+		switch strings.TrimSpace(segment) {
+		case "":
+			return fmt.Errorf("%q has an empty folder name", p)
+		case ".", "..":
+			return fmt.Errorf("%q can not contain . or .. folders", p)
+		}
+	}
+	return nil
+}
+
+// sanitizeName replaces the characters of a placeholder value which are unsafe in a
+// folder name, the slash included, with an underscore.
+func sanitizeName(v string) string {
+	return strings.TrimSpace(strings.Map(func(r rune) rune {
+		if r == '/' || strings.ContainsRune(unsafeChars, r) || unicode.IsControl(r) {
+			return '_'
+		}
+		return r
+	}, v))
+}
+
+// expandTemplate replaces the placeholders of t with the sanitized values returned by lookup.
+func expandTemplate(t string, lookup func(name, arg string) (string, bool)) (string, error) {
+	parts, err := parseTemplate(t)
+	if err != nil {
+		return "", err
+	}
+	var b strings.Builder
+	for _, p := range parts {
+		if len(p.name) == 0 {
+			b.WriteString(p.literal)
+			continue
+		}
+		v, ok := lookup(p.name, p.arg)
+		if !ok {
+			return "", fmt.Errorf("unknown placeholder {%s}", p.name)
+		}
+		b.WriteString(sanitizeName(v))
+	}
+	return b.String(), nil
+}
+
+// checkTemplateVar checks a user variable of the templates, as name=value.
+func checkTemplateVar(v string) error {
+	name, _, ok := strings.Cut(v, "=")
+	if !ok || !templateVarName.MatchString(name) {
+		return fmt.Errorf("%q must be name=value, the name in lowercase letters, digits and _", v)
+	}
+	for _, p := range append(collectionPlaceholders, filePlaceholders...) {
+		if p == name {
+			return fmt.Errorf("the variable %s hides the placeholder {%s}", name, name)
+		}
+	}
+	return nil
+}
+
+// Vars returns the user variables of the templates by name, see TemplateVars.
+func (s *Settings) Vars() map[string]string {
+	vars := make(map[string]string)
+	for _, v := range s.TemplateVars {
+		if name, value, ok := strings.Cut(v, "="); ok {
+			vars[strings.TrimSpace(name)] = strings.TrimSpace(value)
+		}
+	}
+	return vars
+}
+
+// checkCollectionTemplate checks the placeholders of the collection template,
+// which may also be user variables.
+func (s *Settings) checkCollectionTemplate() error {
+	vars := s.Vars()
+	_, err := expandTemplate(s.collectionTemplate(), func(name, arg string) (string, bool) {
+		_, ok := vars[name]
+		for _, p := range collectionPlaceholders {
+			ok = ok || p == name
+		}
+		return "x", ok
+	})
+	return err
+}
+
+func (s *Settings) collectionTemplate() string {
+	if len(s.CollectionTemplate) == 0 {
+		return DEFAULT_COLLECTION_TEMPLATE
+	}
+	return s.CollectionTemplate
+}
+
+// CollectionFolder expands the collection template with info and the user variables.
+// The folder is relative to the publish folder, with the separators of the system.
+func (s *Settings) CollectionFolder(info *CollectionInfo) (string, error) {
+	vars := s.Vars()
+	layout := func(arg string) string {
+		if len(arg) == 0 {
+			return "20060102"
+		}
+		return arg
+	}
+	folder, err := expandTemplate(s.collectionTemplate(), func(name, arg string) (string, bool) {
+		switch name {
+		case "collname":
+			return info.Name, true
+		case "first":
+			return info.First.Format(layout(arg)), true
+		case "last":
+			return info.Last.Format(layout(arg)), true
+		case "year":
+			return info.First.Format("2006"), true
+		case "month":
+			return info.First.Format("01"), true
+		case "day":
+			return info.First.Format("02"), true
+		case "count":
+			return strconv.Itoa(info.Count), true
+		case "camera":
+			if len(info.Camera) == 0 {
+				return "unknown", true
+			}
+			return info.Camera, true
+		}
+		v, ok := vars[name]
+		return v, ok
+	})
+	if err == nil {
+		err = checkRelativePath(path.Clean(folder))
+	}
+	if err != nil {
+		return "", fmt.Errorf("Invalid collection template %q: %v", s.collectionTemplate(), err)
+	}
+	return filepath.FromSlash(folder), nil
+}
+
+// ParseCollectionFolder returns the values of the collection template found in a folder
+// it has named, slash separated and relative to the publish folder, e.g. the name, the
+// date range and the camera of 20120301_20120304_holidays. It returns false if the folder
+// does not match the template. Without {first}, First is the date of {year}, {month}
+// and {day}; the values not in the template are zero.
+func (s *Settings) ParseCollectionFolder(folder string) (*CollectionInfo, bool) {
+	parts, err := parseTemplate(s.collectionTemplate())
+	if err != nil {
+		return nil, false
+	}
+	vars := s.Vars()
+	var expr strings.Builder
+	var names []templatePart
+	expr.WriteString("^")
+	for _, p := range parts {
+		switch {
+		case len(p.name) == 0:
+			expr.WriteString(regexp.QuoteMeta(p.literal))
+			continue
+		case p.name == "year":
+			expr.WriteString(`(\d{4})`)
+		case p.name == "month", p.name == "day":
+			expr.WriteString(`(\d{2})`)
+		case p.name == "count":
+			expr.WriteString(`(\d+)`)
+		default:
+			if v, ok := vars[p.name]; ok {
+				expr.WriteString(regexp.QuoteMeta(sanitizeName(v)))
+				continue
+			}
+			expr.WriteString(`([^/]+?)`)
+		}
+		names = append(names, p)
+	}
+	expr.WriteString("$")
+	re, err := regexp.Compile(expr.String())
+	if err != nil {
+		return nil, false
+	}
+	m := re.FindStringSubmatch(folder)
+	if m == nil {
+		return nil, false
+	}
+	info := new(CollectionInfo)
+	date := map[string]int{"year": 1, "month": 1, "day": 1}
+	hasFirst := false
+	for i, p := range names {
+		v := m[i+1]
+		switch p.name {
+		case "collname":
+			info.Name = v
+		case "first", "last":
+			layout := p.arg
+			if len(layout) == 0 {
+				layout = "20060102"
+			}
+			t, err := time.Parse(layout, v)
+			if err != nil {
+				return nil, false
+			}
+			if p.name == "first" {
+				info.First, hasFirst = t, true
+			} else {
+				info.Last = t
+			}
+		case "year", "month", "day":
+			date[p.name], _ = strconv.Atoi(v)
+		case "count":
+			info.Count, _ = strconv.Atoi(v)
+		case "camera":
+			if v != "unknown" {
+				info.Camera = v
+			}
+		}
+	}
+	if !hasFirst && date["year"] > 1 {
+		info.First = time.Date(date["year"], time.Month(date["month"]), date["day"], 0, 0, 0, 0, time.UTC)
+	}
+	return info, true
+}
@@ -0,0 +1,194 @@
+package settings
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"unicode"
+)
+
+// FieldError is an invalid setting. Field is its JSON path in Settings,
+// e.g. "conversionSettings.width", so that the web pages can highlight it.
+type FieldError struct {
+	Field   string `json:"field"`
+	Flag    string `json:"flag,omitempty"` // the command line flag of the setting, if any
+	Message string `json:"message"`
+}
+
+func (e *FieldError) Error() string {
+	return e.Field + ": " + e.Message
+}
+
+// ValidationErrors lists the invalid settings found by Validate.
+type ValidationErrors []*FieldError
+
+func (l ValidationErrors) Error() string {
+	lines := make([]string, len(l))
+	for i, e := range l {
+		if len(e.Flag) > 0 {
+			lines[i] = fmt.Sprintf("%s (-%s): %s", e.Field, e.Flag, e.Message)
+		} else {
+			lines[i] = e.Error()
+		}
+	}
+	return "Invalid settings:\n - " + strings.Join(lines, "\n - ")
+}
+
+// FieldErrors returns the invalid settings of err if it is a ValidationErrors, else nil.
+func FieldErrors(err error) ValidationErrors {
+	var l ValidationErrors
+	if errors.As(err, &l) {
+		return l
+	}
+	return nil
+}
+
+// collNameChars can not be part of a collection name, which is a folder name
+// on the local disk and on the FTP server.
+const collNameChars = `/\:*?"<>|`
+
+// Validate checks the settings before a conversion starts: the collection name, the image
+// folder, the publish folder, which must be writable, the placeholders of the collection and
+// file name templates, and the values of the options against
+// the schema of the configuration files (image size, timeout, number of workers...).
+// It returns nil or the ValidationErrors.
+func (s *Settings) Validate() error {
+	var l ValidationErrors
+	add := func(field, flag, format string, a ...interface{}) {
+		l = append(l, &FieldError{field, flag, fmt.Sprintf(format, a...)})
+	}
+
+	switch name := s.CollName; {
+	case len(strings.TrimSpace(name)) == 0:
+		add("collName", "c", "the collection name can not be empty")
+	case name == "." || name == "..":
+		add("collName", "c", "the collection name can not be %q", name)
+	case strings.ContainsAny(name, collNameChars):
+		add("collName", "c", "the collection name can not contain any of %s", collNameChars)
+	case strings.IndexFunc(name, unicode.IsControl) >= 0:
+		add("collName", "c", "the collection name can not contain control characters")
+	case name != strings.TrimSpace(name):
+		add("collName", "c", "the collection name can not start or end with spaces")
+	case len(name) > 255:
+		add("collName", "c", "the collection name is longer than 255 bytes")
+	}
+
+	if fi, err := os.Stat(s.SourceDir); err != nil {
+		add("sourceDir", "f", "the image folder '%s' does not exist", s.SourceDir)
+	} else if !fi.IsDir() {
+		add("sourceDir", "f", "'%s' is not a folder", s.SourceDir)
+	}
+
+	if len(s.PublishDir) == 0 {
+		add("publishDir", "publishdir", "the publish folder can not be empty")
+	} else if err := checkWritable(s.PublishDir); err != nil {
+		add("publishDir", "publishdir", "%v", err)
+	}
+	if s.Gallery && len(s.GalleryThemeDir) > 0 {
+		if _, err := os.Stat(filepath.Join(s.GalleryThemeDir, GALLERY_PAGE_TEMPLATE)); err != nil {
+			add("galleryThemeDir", "gallery-themedir", "the gallery theme folder '%s' has no %s template", s.GalleryThemeDir, GALLERY_PAGE_TEMPLATE)
+		}
+	}
+	if name := s.PiwigoGalleryHighDirName; len(name) == 0 || strings.ContainsAny(name, `/\`) || name == "." || name == ".." {
+		add("piwigoGalleryHighDirName", "piwigogalleryhighdirname", "the archive subfolder must be a folder name, got %q", name)
+	}
+
+	// the JSON settings of the web pages may lack a section
+	sections := []struct {
+		field string
+		nil   bool
+	}{
+		{"conversionSettings", s.ConversionSettings == nil},
+		{"ftpSettings", s.FtpSettings == nil},
+		{"uploadSettings", s.UploadSettings == nil},
+		{"credentialSettings", s.CredentialSettings == nil},
+	}
+	missing := false
+	for _, section := range sections {
+		if section.nil {
+			add(section.field, "", "missing")
+			missing = true
+		}
+	}
+	if missing {
+		return l
+	}
+
+	if err := s.checkCollectionTemplate(); err != nil && checkPathTemplate(s.collectionTemplate()) == nil {
+		add("collectionTemplate", "collectiontemplate", "%v", err)
+	}
+	l = append(l, s.checkFileTemplates()...)
+
+	for _, o := range options {
+		c, ok := schema[o.Key()]
+		if !ok {
+			continue
+		}
+		p := o.param(s)
+		if err := c.check(p); err != nil {
+			add(fieldPath(s, p), o.Flag, "%v", err)
+		}
+	}
+
+	if len(l) == 0 {
+		return nil
+	}
+	return l
+}
+
+// checkWritable tells whether files can be created in dir, or in its closest
+// existing parent if it does not exist yet.
+func checkWritable(dir string) error {
+	d := dir
+	for {
+		fi, err := os.Stat(d)
+		if err == nil {
+			if !fi.IsDir() {
+				return fmt.Errorf("'%s' is not a folder", d)
+			}
+			break
+		}
+		parent := filepath.Dir(d)
+		if parent == d {
+			return fmt.Errorf("the folder '%s' can not be created", dir)
+		}
+		d = parent
+	}
+	f, err := os.CreateTemp(d, ".goconvert-*")
+	if err != nil {
+		return fmt.Errorf("the folder '%s' is not writable", d)
+	}
+	f.Close()
+	os.Remove(f.Name())
+	return nil
+}
+
+// fieldPath returns the JSON path of the field of s the setting p points to.
+func fieldPath(s *Settings, p Param) string {
+	addr := reflect.ValueOf(p).Pointer()
+	var find func(v reflect.Value, prefix string) string
+	find = func(v reflect.Value, prefix string) string {
+		t := v.Type()
+		for i := 0; i < t.NumField(); i++ {
+			f := v.Field(i)
+			name := strings.Split(t.Field(i).Tag.Get("json"), ",")[0]
+			if len(name) == 0 || name == "-" {
+				continue
+			}
+			if f.Kind() == reflect.Ptr && f.Elem().Kind() == reflect.Struct {
+				if path := find(f.Elem(), prefix+name+"."); len(path) > 0 {
+					return path
+				}
+				continue
+			}
+			if f.Addr().Pointer() == addr {
+				return prefix + name
+			}
+		}
+		return ""
+	}
+	return find(reflect.ValueOf(s).Elem(), "")
+}
@@ -0,0 +1,161 @@
+// The collection browser: it lists the collections of the publish folder of the profile,
+// shows the renditions of their manifest and runs their actions, see the
+// /api/v1/collections requests. The jobs of the actions are followed by their event stream.
+(function() {
+  "use strict";
+
+  var api = "/api/v1";
+  var maxPreviews = 24;
+
+  // profileQuery returns the query of the profile of the page with the params.
+  function profileQuery(params) {
+    var q = $.extend({}, params);
+    if ($("#profile").val()) {
+      q.profile = $("#profile").val();
+    }
+    return $.isEmptyObject(q) ? "" : "?" + $.param(q);
+  }
+
+  // collectionURL returns the URL of the collection, its name may hold slashes.
+  function collectionURL(name, suffix) {
+    return api + "/collections/" + encodeURIComponent(name) + (suffix || "");
+  }
+
+  function fileURL(name, file) {
+    return collectionURL(name, "/files/" + file.split("/").map(encodeURIComponent).join("/")) + profileQuery();
+  }
+
+  function formatDate(s) {
+    return s ? s.substring(0, 10) : "";
+  }
+
+  function formatSize(b) {
+    var units = ["B", "KB", "MB", "GB"], i = 0;
+    while (b >= 1024 && i < units.length - 1) {
+      b /= 1024;
+      i++;
+    }
+    return b.toFixed(i ? 1 : 0) + " " + units[i];
+  }
+
+  $(function() {
+    var table = $("#collectionlist"), detail = $("#collectiondetail"), error = $("#collectionerror"),
+        status = $("#collectionstatus");
+
+    function fail(xhr) {
+      error.text((xhr.responseJSON && xhr.responseJSON.error) || xhr.statusText);
+    }
+
+    // follow writes the events of the job of an action until it ends.
+    function follow(job, what) {
+      status.text(what + ": queued");
+      if (!window.EventSource) {
+        return;
+      }
+      var source = new EventSource(api + "/jobs/" + encodeURIComponent(job.id) + "/stream");
+      var last = function(e) {
+        var ev = JSON.parse(e.data);
+        if (ev.body) {
+          status.text(what + ": " + ev.body);
+        }
+      };
+      $.each(["stdout", "stderr", "upload"], function(i, kind) {
+        source.addEventListener(kind, last);
+      });
+      source.addEventListener("end", function(e) {
+        var ev = JSON.parse(e.data);
+        status.text(what + ": " + (ev.body ? "failed, " + ev.body : "done"));
+        source.close();
+        load();
+      });
+      source.onerror = function() {
+        source.close();
+      };
+    }
+
+    function action(c, path, params, what) {
+      error.empty();
+      $.post(collectionURL(c.name, path) + profileQuery(params), null, null, "json").done(function(job) {
+        follow(job, what + " " + c.name);
+      }).fail(fail);
+    }
+
+    function show(c) {
+      error.empty();
+      $.getJSON(collectionURL(c.name) + profileQuery()).done(function(d) {
+        detail.empty().show();
+        $("<h3></h3>").text(d.name).appendTo(detail);
+        var counts = $.map(d.renditions, function(n, r) {
+          return r + ": " + n;
+        });
+        $("<div></div>").text(d.manifest.images.length + " images in the manifest" + (counts.length ? ", " + counts.join(", ") : "")).appendTo(detail);
+        var previews = $("<div class=\"previews\"></div>").appendTo(detail);
+        $.each(d.manifest.images.slice(0, maxPreviews), function(i, e) {
+          var file = e.renditions.thumbnail || e.renditions.image;
+          if (file) {
+            $('<img loading="lazy">').attr({src: fileURL(d.name, file), alt: e.source, title: e.source}).appendTo(previews);
+          }
+        });
+        var files = $("<ul></ul>").appendTo(detail);
+        $.each(d.manifest.images, function(i, e) {
+          var li = $("<li></li>").text(e.source + ": ").appendTo(files);
+          $.each(e.renditions, function(r, file) {
+            $("<a></a>").attr({href: fileURL(d.name, file), target: "_blank"}).text(r).appendTo(li);
+            li.append(" ");
+          });
+        });
+        if (d.manifest.images.length === 0) {
+          $("<div></div>").text("No manifest, the renditions can not be regenerated.").appendTo(detail);
+        }
+      }).fail(fail);
+    }
+
+    function row(c) {
+      var tr = $("<tr></tr>");
+      $("<td></td>").append($('<a href="#"></a>').text(c.name).click(function(e) {
+        e.preventDefault();
+        show(c);
+      })).appendTo(tr);
+      $("<td></td>").text(formatDate(c.first) + (c.last && c.last !== c.first ? " - " + formatDate(c.last) : "")).appendTo(tr);
+      $("<td></td>").text(c.images).appendTo(tr);
+      $("<td></td>").text(formatSize(c.size)).appendTo(tr);
+      $("<td></td>").text(formatDate(c.modified)).appendTo(tr);
+      var actions = $("<td></td>").appendTo(tr);
+      $('<button type="button">Publish</button>').click(function() {
+        action(c, "/publish", null, "Publish");
+      }).appendTo(actions);
+      var rendition = $('<select><option value="thumbnail">thumbnails</option><option value="image">images</option></select>');
+      $('<button type="button">Regenerate</button>').click(function() {
+        action(c, "/regenerate", {rendition: rendition.val()}, "Regenerate " + rendition.val() + " of");
+      }).appendTo(actions);
+      actions.append(rendition);
+      $("<a></a>").attr("href", collectionURL(c.name, "/archive") + profileQuery()).text("Export").appendTo(actions);
+      $('<button type="button">Delete</button>').click(function() {
+        if (!window.confirm("Delete the collection " + c.name + " and its files?")) {
+          return;
+        }
+        error.empty();
+        $.ajax(collectionURL(c.name) + profileQuery(), {type: "DELETE"}).done(function() {
+          detail.hide();
+          load();
+        }).fail(fail);
+      }).appendTo(actions);
+      return tr;
+    }
+
+    function load() {
+      $.getJSON(api + "/collections" + profileQuery()).done(function(l) {
+        table.empty();
+        $.each(l, function(i, c) {
+          table.append(row(c));
+        });
+        if (l.length === 0) {
+          table.append($("<tr><td colspan=\"6\">No collection in the publish folder</td></tr>"));
+        }
+      }).fail(fail);
+    }
+
+    $("#collectionsrefresh").click(load);
+    load();
+  });
+})();
@@ -0,0 +1,102 @@
+// The folder picker of the image folder: it browses the folders the server allows,
+// see the /api/v1/folders and /api/v1/thumbnail requests, and previews their images.
+(function() {
+  "use strict";
+
+  var api = "/api/v1";
+  var maxPreviews = 24;
+
+  function thumbnailURL(path) {
+    return api + "/thumbnail?path=" + encodeURIComponent(path);
+  }
+
+  function joinPath(dir, name) {
+    var sep = dir.indexOf("\\") >= 0 ? "\\" : "/";
+    return dir.charAt(dir.length - 1) === sep ? dir + name : dir + sep + name;
+  }
+
+  function folderItem(f, onOpen) {
+    var li = $('<li class="folder"></li>');
+    $('<a href="#"></a>').text(f.name + " (" + f.images + ")").attr("title", f.path).click(function(e) {
+      e.preventDefault();
+      onOpen(f.path);
+    }).appendTo(li);
+    return li;
+  }
+
+  $(function() {
+    var picker = $("#folderpicker"), current = $("#folderpath"), list = $("#folderlist"),
+        previews = $("#folderpreviews"), choose = $("#folderchoose"), error = $("#foldererror");
+    var path = "";
+
+    function fail(xhr) {
+      var msg = (xhr.responseJSON && xhr.responseJSON.error) || xhr.statusText;
+      error.text(msg);
+    }
+
+    function showRoots() {
+      path = "";
+      current.text("Folders");
+      choose.prop("disabled", true);
+      previews.empty();
+      error.empty();
+      $.getJSON(api + "/folders").done(function(roots) {
+        list.empty();
+        $.each(roots, function(i, f) {
+          list.append(folderItem(f, open));
+        });
+        if (roots.length === 0) {
+          error.text("No folder can be browsed, see the web-roots setting.");
+        }
+      }).fail(fail);
+    }
+
+    function open(p) {
+      error.empty();
+      $.getJSON(api + "/folders", {path: p}).done(function(l) {
+        path = l.path;
+        current.text(l.path);
+        choose.prop("disabled", false);
+        list.empty();
+        $('<li class="parent"></li>').append($('<a href="#">..</a>').click(function(e) {
+          e.preventDefault();
+          if (l.parent) {
+            open(l.parent);
+          } else {
+            showRoots();
+          }
+        })).appendTo(list);
+        $.each(l.folders, function(i, f) {
+          list.append(folderItem(f, open));
+        });
+        previews.empty();
+        $.each(l.images.slice(0, maxPreviews), function(i, name) {
+          $('<img loading="lazy">').attr({src: thumbnailURL(joinPath(l.path, name)), alt: name, title: name}).appendTo(previews);
+        });
+        if (l.images.length > maxPreviews) {
+          $('<span></span>').text("and " + (l.images.length - maxPreviews) + " more images").appendTo(previews);
+        }
+      }).fail(fail);
+    }
+
+    $("#folderbrowse").click(function() {
+      picker.toggle();
+      if (picker.is(":visible")) {
+        var p = $("#folder").val();
+        if (p) {
+          $.getJSON(api + "/folders", {path: p}).done(function() {
+            open(p);
+          }).fail(showRoots);
+        } else {
+          showRoots();
+        }
+      }
+    });
+    choose.click(function() {
+      if (path) {
+        $("#folder").val(path).removeClass("invalid");
+        picker.hide();
+      }
+    });
+  });
+})();
@@ -34,12 +34,59 @@
     return s;
   }
 
+  // readFtpSettings copies the optional FTP fields of the page into the settings,
+  // an empty address skips the upload.
+  function readFtpSettings(sets) {
+    var ftp = sets.ftpSettings || {};
+    var fields = {address: 'ftpaddress', username: 'ftpusername', password: 'ftppassword', remoteDir: 'ftpremotedir'};
+    for (var k in fields) {
+      var node = document.getElementById(fields[k]);
+      if (node) {
+        ftp[k] = node.value;
+      }
+    }
+    sets.ftpSettings = ftp;
+  }
+
+  // the inputs of the page by JSON path of the settings, see settings.FieldError
+  var fieldInputs = {
+    sourceDir: 'folder',
+    collName: 'collection',
+    'ftpSettings.address': 'ftpaddress',
+    'ftpSettings.username': 'ftpusername',
+    'ftpSettings.password': 'ftppassword',
+    'ftpSettings.remoteDir': 'ftpremotedir'
+  };
+
+  // showFieldErrors marks the inputs of the invalid settings, with the error as tooltip.
+  function showFieldErrors(fields) {
+    clearFieldErrors();
+    for (var i = 0; i < fields.length; i++) {
+      var node = document.getElementById(fieldInputs[fields[i].field]);
+      if (node) {
+        node.classList.add('invalid');
+        node.title = fields[i].message;
+      }
+    }
+  }
+
+  function clearFieldErrors() {
+    var nodes = document.querySelectorAll('.invalid');
+    for (var i = 0; i < nodes.length; i++) {
+      nodes[i].classList.remove('invalid');
+      nodes[i].title = '';
+    }
+  }
+
   function init(code, folderNode, collectionNode) {
     var id = getId();
 
     var output = document.createElement('div');
     var outpre = document.createElement('pre');
     var stopFunc;
+    outpre.addEventListener("fielderrors", function(e) {
+      showFieldErrors(e.detail);
+    }, false);
 
     /*
     $(output).resizable({
@@ -62,9 +109,11 @@
       outpre.innerHTML = "";
       output.style.display = "block";
       run.style.display = "none";
+      clearFieldErrors();
       var sets = module.settings;
       sets.collName = collectionNode.value;
       sets.sourceDir = folderNode.value;
+      readFtpSettings(sets);
       var options = {settings: sets};
       stopFunc = runFunc("", outpre, options);
     }
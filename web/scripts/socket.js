@@ -5,12 +5,33 @@
 (function() {
   "use strict";
 
-  var websocket, outputs = {};
+  var websocket, addr, outputs = {};
+  // the job followed by each output and the number of its last event,
+  // to attach again to the jobs still running after a reconnection
+  var following = {};
 
   function onClose() {
+    for (var id in following) {
+      // the jobs outlive the connection for a while, reconnect and attach to them
+      setTimeout(connect, 2000);
+      return;
+    }
     window.alert('websocket connection closed');
   }
 
+  function onOpen() {
+    for (var id in following) {
+      sendMessage({Id: id, Kind: "attach", Body: following[id].job, Seq: following[id].seq});
+    }
+  }
+
+  function connect() {
+    websocket = new WebSocket(addr);
+    websocket.onopen = onOpen;
+    websocket.onmessage = onMessage;
+    websocket.onclose = onClose;
+  }
+
   function sendMessage(m) {
     websocket.send(JSON.stringify(m));
   }
@@ -18,13 +39,33 @@
   function onMessage(e) {
     var m = JSON.parse(e.data);
     var o = outputs[m.Id];
-    if (o === null) {
+    if (!o) {
       return;
     }
+    if (m.Kind === "job" && m.Job) {
+      if (!following[m.Id] || following[m.Id].job !== m.Job.id) {
+        following[m.Id] = {job: m.Job.id, seq: 0};
+      }
+    } else if (m.Kind === "job" && following[m.Id]) {
+      // the job is gone, e.g. after a restart of the server
+      delete following[m.Id];
+      showMessage(o, m.Body + "\n", "system");
+    }
+    if (m.Seq && following[m.Id]) {
+      following[m.Id].seq = m.Seq;
+    }
     if (m.Kind === "stdout" || m.Kind === "stderr") {
       showMessage(o, m.Body, m.Kind);
     }
+    if (m.Kind === "upload") {
+      showProgress(o, m.Body, m.Progress);
+    }
     if (m.Kind === "end") {
+      delete following[m.Id];
+      if (m.Fields) {
+        // the settings were refused, let the page highlight them
+        o.dispatchEvent(new CustomEvent("fielderrors", {detail: m.Fields}));
+      }
       var s = "Program exited";
       if (m.Body !== "") {
         s += ": " + m.Body;
@@ -55,6 +96,23 @@
         o.scrollTop = o.scrollHeight - o.offsetHeight;
   }
 
+  // showProgress keeps a single line per uploaded file and rewrites it
+  // until the file has been transferred.
+  function showProgress(o, m, p) {
+    var span = o.uploadSpan;
+    if (!span) {
+      span = document.createElement("span");
+      span.className = "upload";
+      o.appendChild(span);
+      o.uploadSpan = span;
+    }
+    span.textContent = m;
+    if (!p || p.bytes >= p.size) {
+      o.uploadSpan = null;
+    }
+    o.scrollTop = o.scrollHeight - o.offsetHeight;
+  }
+
   function run(body, output, options) {
     var id = output.id;
     outputs[id] = output;
@@ -66,10 +124,9 @@
     };
   }
 
-  window.connectPlayground = function(addr) {
-    websocket = new WebSocket(addr);
-    websocket.onmessage = onMessage;
-    websocket.onclose = onClose;
+  window.connectPlayground = function(a) {
+    addr = a;
+    connect();
     return run;
   };
 })();
@@ -0,0 +1,136 @@
+// The upload of images from the browser: the files chosen are sent in chunks to a staging
+// folder of the server, see the /api/v1/uploads requests, which becomes the image folder.
+// A chunk which fails is resumed from the bytes the server has received.
+(function() {
+  "use strict";
+
+  var api = "/api/v1";
+  var chunkSize = 1 << 20;
+  var retries = 5;
+
+  function errorText(xhr) {
+    return (xhr.responseJSON && xhr.responseJSON.error) || xhr.statusText || "connection lost";
+  }
+
+  // sendFile uploads file from offset into the upload id, calling progress with the bytes sent.
+  function sendFile(id, file, offset, progress) {
+    var d = $.Deferred(), failures = 0;
+    var url = api + "/uploads/" + encodeURIComponent(id) + "/files/" + encodeURIComponent(file.name);
+
+    function resume() {
+      // ask the server where the file stops, the chunk may have been partly received
+      $.getJSON(api + "/uploads/" + encodeURIComponent(id)).done(function(st) {
+        var at = 0;
+        $.each(st.files, function(i, f) {
+          if (f.name === file.name) {
+            at = f.received;
+          }
+        });
+        send(at);
+      }).fail(function(xhr) {
+        d.reject(errorText(xhr));
+      });
+    }
+
+    function send(start) {
+      progress(start);
+      if (start >= file.size && file.size > 0) {
+        d.resolve();
+        return;
+      }
+      var end = Math.min(start + chunkSize, file.size);
+      // an empty file has no range
+      var headers = end > start ? {"Content-Range": "bytes " + start + "-" + (end - 1) + "/" + file.size} : {};
+      $.ajax(url, {
+        type: "PUT",
+        data: file.slice(start, end),
+        processData: false,
+        contentType: "application/octet-stream",
+        headers: headers,
+        dataType: "json"
+      }).done(function(f) {
+        failures = 0;
+        if (f.complete) {
+          progress(file.size);
+          d.resolve();
+        } else {
+          send(f.received);
+        }
+      }).fail(function(xhr) {
+        if (xhr.status === 409 && xhr.responseJSON && xhr.responseJSON.file && !xhr.responseJSON.file.complete) {
+          send(xhr.responseJSON.file.received);
+        } else if (xhr.status === 0 && ++failures <= retries) {
+          setTimeout(resume, 1000 * failures);
+        } else {
+          d.reject(errorText(xhr));
+        }
+      });
+    }
+
+    send(offset);
+    return d.promise();
+  }
+
+  $(function() {
+    var input = $("#uploadfiles"), button = $("#uploadstart"), status = $("#uploadstatus"),
+        bar = $("#uploadprogress"), error = $("#uploaderror");
+    var upload = null; // the staging of the files chosen, kept to resume
+
+    input.change(function() {
+      upload = null;
+      error.empty();
+      status.empty();
+      bar.val(0);
+      button.prop("disabled", this.files.length === 0);
+    });
+
+    button.click(function() {
+      var files = $.makeArray(input[0].files);
+      if (files.length === 0) {
+        return;
+      }
+      var total = 0, done = 0;
+      $.each(files, function(i, f) {
+        total += f.size;
+      });
+      bar.attr("max", total || 1);
+      button.prop("disabled", true);
+      error.empty();
+
+      function next(i, received) {
+        if (i === files.length) {
+          status.text(files.length + " images uploaded");
+          $("#folder").val(upload.dir).removeClass("invalid");
+          button.prop("disabled", false).text("Upload");
+          return;
+        }
+        var f = files[i];
+        sendFile(upload.id, f, received[f.name] || 0, function(sent) {
+          status.text("Uploading " + f.name + " (" + (i + 1) + "/" + files.length + ")");
+          bar.val(done + sent);
+        }).done(function() {
+          done += f.size;
+          next(i + 1, received);
+        }).fail(function(msg) {
+          error.text(f.name + ": " + msg);
+          button.prop("disabled", false).text("Resume upload");
+        });
+      }
+
+      var started = upload ? $.getJSON(api + "/uploads/" + encodeURIComponent(upload.id)) : $.post(api + "/uploads", null, null, "json");
+      started.done(function(st) {
+        upload = st;
+        var received = {};
+        $.each(st.files, function(i, f) {
+          received[f.name] = f.received;
+        });
+        done = 0;
+        next(0, received);
+      }).fail(function(xhr) {
+        upload = null;
+        error.text(errorText(xhr));
+        button.prop("disabled", false);
+      });
+    });
+  });
+})();
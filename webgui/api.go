@@ -0,0 +1,217 @@
+package webgui
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/mezzato/goconvert/imageconvert"
+	settings "github.com/mezzato/goconvert/settings"
+)
+
+// API_PREFIX is the path of the REST API, see the OpenAPI document at API_PREFIX/openapi.json.
+const API_PREFIX = "/api/v1"
+
+// APIError is the body of the error responses of the API.
+type APIError struct {
+	Error  string                    `json:"error"`
+	Fields settings.ValidationErrors `json:"fields,omitempty"` // the invalid settings
+}
+
+// webSettings are the settings the web interface has been started with.
+var webSettings *settings.Settings
+
+// apiHandler routes the requests of the REST API.
+func apiHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET "+API_PREFIX+"/openapi.json", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, openAPIDocument)
+	})
+	mux.HandleFunc("GET "+API_PREFIX+"/jobs", func(w http.ResponseWriter, r *http.Request) {
+		writeAPI(w, http.StatusOK, jobs.List())
+	})
+	mux.HandleFunc("POST "+API_PREFIX+"/jobs", apiSubmitJob)
+	mux.HandleFunc("GET "+API_PREFIX+"/jobs/{id}", func(w http.ResponseWriter, r *http.Request) {
+		j, err := jobs.Get(r.PathValue("id"))
+		writeAPIResult(w, j, err)
+	})
+	mux.HandleFunc("POST "+API_PREFIX+"/jobs/{id}/cancel", func(w http.ResponseWriter, r *http.Request) {
+		id := r.PathValue("id")
+		if err := jobs.Cancel(id); err != nil {
+			writeAPIError(w, err)
+			return
+		}
+		j, err := jobs.Get(id)
+		writeAPIResult(w, j, err)
+	})
+	mux.HandleFunc("POST "+API_PREFIX+"/jobs/{id}/retry", func(w http.ResponseWriter, r *http.Request) {
+		j, err := jobs.Retry(r.PathValue("id"), nil)
+		writeAPIResult(w, j, err)
+	})
+	mux.HandleFunc("GET "+API_PREFIX+"/jobs/{id}/events", apiJobEvents)
+	mux.HandleFunc("GET "+API_PREFIX+"/jobs/{id}/stream", apiJobStream)
+	mux.HandleFunc("GET "+API_PREFIX+"/settings", func(w http.ResponseWriter, r *http.Request) {
+		s, err := profileSettings(r)
+		if err == nil {
+			s = publicSettings(s)
+		}
+		writeAPIResult(w, s, err)
+	})
+	mux.HandleFunc("POST "+API_PREFIX+"/settings/validate", func(w http.ResponseWriter, r *http.Request) {
+		s, ok := decodeSettings(w, r)
+		if !ok {
+			return
+		}
+		if err := s.Validate(); err != nil {
+			writeAPIError(w, err)
+			return
+		}
+		writeAPI(w, http.StatusOK, map[string]bool{"valid": true})
+	})
+	mux.HandleFunc("GET "+API_PREFIX+"/profiles", func(w http.ResponseWriter, r *http.Request) {
+		l, err := settings.ListProfiles(homeImgDir)
+		if l == nil {
+			l = []string{}
+		}
+		writeAPIResult(w, l, err)
+	})
+	mux.HandleFunc("GET "+API_PREFIX+"/collections", apiCollections)
+	mux.HandleFunc("GET "+API_PREFIX+"/collections/{name}", apiCollection)
+	mux.HandleFunc("DELETE "+API_PREFIX+"/collections/{name}", apiDeleteCollection)
+	mux.HandleFunc("GET "+API_PREFIX+"/collections/{name}/files/{file...}", apiCollectionFile)
+	mux.HandleFunc("GET "+API_PREFIX+"/collections/{name}/archive", apiCollectionArchive)
+	mux.HandleFunc("POST "+API_PREFIX+"/collections/{name}/publish", apiCollectionAction(imageconvert.ACTION_PUBLISH))
+	mux.HandleFunc("POST "+API_PREFIX+"/collections/{name}/regenerate", apiCollectionAction(imageconvert.ACTION_REGENERATE))
+	mux.HandleFunc("POST "+API_PREFIX+"/uploads", func(w http.ResponseWriter, r *http.Request) {
+		st, err := staging.Create(stagingDirs())
+		if err != nil {
+			writeAPIError(w, err)
+			return
+		}
+		w.Header().Set("Location", API_PREFIX+"/uploads/"+st.Id)
+		writeAPI(w, http.StatusCreated, st)
+	})
+	mux.HandleFunc("GET "+API_PREFIX+"/uploads/{id}", func(w http.ResponseWriter, r *http.Request) {
+		st, err := staging.Get(r.PathValue("id"))
+		writeAPIResult(w, st, err)
+	})
+	mux.HandleFunc("DELETE "+API_PREFIX+"/uploads/{id}", func(w http.ResponseWriter, r *http.Request) {
+		if err := staging.Remove(r.PathValue("id")); err != nil {
+			writeAPIError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+	mux.HandleFunc("PUT "+API_PREFIX+"/uploads/{id}/files/{name}", apiUploadChunk)
+	mux.HandleFunc("GET "+API_PREFIX+"/folders", apiFolders)
+	mux.HandleFunc("GET "+API_PREFIX+"/thumbnail", apiThumbnail)
+	mux.HandleFunc(API_PREFIX+"/", func(w http.ResponseWriter, r *http.Request) {
+		writeAPI(w, http.StatusNotFound, &APIError{Error: fmt.Sprintf("No such resource %s", r.URL.Path)})
+	})
+	return mux
+}
+
+// apiSubmitJob queues the settings of the body, without upload if the noUpload parameter is true.
+// The images of the upload parameter, uploaded by the browser, replace the source folder.
+func apiSubmitJob(w http.ResponseWriter, r *http.Request) {
+	s, ok := decodeSettings(w, r)
+	if !ok {
+		return
+	}
+	if id := r.URL.Query().Get("upload"); len(id) > 0 {
+		dir, err := stagedSource(id)
+		if err != nil {
+			writeAPIError(w, err)
+			return
+		}
+		s.SourceDir = dir
+	}
+	noUpload, _ := strconv.ParseBool(r.URL.Query().Get("noUpload"))
+	j, err := jobs.Submit(s, noUpload, nil)
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	w.Header().Set("Location", API_PREFIX+"/jobs/"+j.Id)
+	writeAPI(w, http.StatusCreated, j)
+}
+
+// apiJobEvents returns the events of a job after the one of the after parameter.
+func apiJobEvents(w http.ResponseWriter, r *http.Request) {
+	after := 0
+	if v := r.URL.Query().Get("after"); len(v) > 0 {
+		var err error
+		if after, err = strconv.Atoi(v); err != nil {
+			writeAPI(w, http.StatusBadRequest, &APIError{Error: fmt.Sprintf("Invalid event number %q", v)})
+			return
+		}
+	}
+	l, err := jobs.Events(r.PathValue("id"), after)
+	writeAPIResult(w, l, err)
+}
+
+// profileSettings returns the settings of the profile parameter, the ones of the web
+// interface if there is none.
+func profileSettings(r *http.Request) (*settings.Settings, error) {
+	profile := r.URL.Query().Get("profile")
+	if len(profile) == 0 && webSettings != nil {
+		return webSettings, nil
+	}
+	s, err := settings.LoadProfile(profile, homeImgDir)
+	if err != nil {
+		return nil, err
+	}
+	s.SourceDir = homeImgDir
+	return s, nil
+}
+
+func decodeSettings(w http.ResponseWriter, r *http.Request) (s *settings.Settings, ok bool) {
+	if err := json.NewDecoder(r.Body).Decode(&s); err != nil || s == nil {
+		writeAPI(w, http.StatusBadRequest, &APIError{Error: fmt.Sprintf("Invalid settings: %v", err)})
+		return nil, false
+	}
+	savedPassword(s)
+	return s, true
+}
+
+func writeAPIResult(w http.ResponseWriter, v interface{}, err error) {
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	writeAPI(w, http.StatusOK, v)
+}
+
+// writeAPIError writes the error with the status of its kind.
+func writeAPIError(w http.ResponseWriter, err error) {
+	status := http.StatusInternalServerError
+	var stateErr *JobStateError
+	var fieldErrs settings.ValidationErrors
+	var uploadErr *UploadError
+	switch {
+	case err == ErrJobNotFound, err == ErrStagingNotFound, err == imageconvert.ErrCollectionNotFound, errors.Is(err, fs.ErrNotExist):
+		status = http.StatusNotFound
+	case err == ErrOutsideRoots:
+		status = http.StatusForbidden
+	case errors.As(err, &stateErr), err == ErrCollectionBusy:
+		status = http.StatusConflict
+	case errors.As(err, &fieldErrs):
+		status = http.StatusUnprocessableEntity
+	case errors.As(err, &uploadErr):
+		status = uploadErr.Status
+	}
+	writeAPI(w, status, &APIError{Error: err.Error(), Fields: settings.FieldErrors(err)})
+}
+
+func writeAPI(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Println(err)
+	}
+}
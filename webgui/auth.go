@@ -0,0 +1,271 @@
+package webgui
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+
+	settings "github.com/mezzato/goconvert/settings"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/net/websocket"
+)
+
+// The cookies of the web interface: the session of a browser which has authenticated with
+// a token, and the CSRF token the pages send back in the CSRF_HEADER of their POSTs.
+const (
+	SESSION_COOKIE = "goconvert_session"
+	CSRF_COOKIE    = "goconvert_csrf"
+	CSRF_HEADER    = "X-CSRF-Token"
+)
+
+// authenticator guards the web interface with the authentication of the web settings.
+// The requests with a bearer token are not checked for CSRF, the browsers never send
+// one on their own.
+type authenticator struct {
+	mode   string
+	token  string
+	users  map[string][]byte // the bcrypt hashes by name
+	mu     sync.Mutex
+	launch string          // the one-time token, empty once used
+	keys   map[string]bool // the sessions
+}
+
+// newAuthenticator returns the authenticator of the web settings of s.
+func newAuthenticator(s *settings.Settings) (*authenticator, error) {
+	a := &authenticator{mode: s.WebAuth, keys: make(map[string]bool)}
+	switch a.mode {
+	case "", settings.AUTH_NONE:
+		a.mode = settings.AUTH_NONE
+	case settings.AUTH_TOKEN:
+		if len(s.WebToken) == 0 {
+			return nil, errors.New("The token authentication of the web interface requires a token.")
+		}
+		a.token = s.WebToken
+	case settings.AUTH_BASIC:
+		a.users = make(map[string][]byte)
+		for _, u := range s.WebUsers {
+			i := strings.Index(u, ":")
+			if i <= 0 {
+				return nil, fmt.Errorf("The web user %q is not name:bcrypt-hash.", u)
+			}
+			if _, err := bcrypt.Cost([]byte(u[i+1:])); err != nil {
+				return nil, fmt.Errorf("The password hash of the web user %s is not a bcrypt hash: %v", u[:i], err)
+			}
+			a.users[u[:i]] = []byte(u[i+1:])
+		}
+		if len(a.users) == 0 {
+			return nil, errors.New("The basic authentication of the web interface requires users.")
+		}
+	case settings.AUTH_LAUNCH:
+		a.launch = randomToken()
+	default:
+		return nil, fmt.Errorf("Unknown authentication %q of the web interface.", a.mode)
+	}
+	return a, nil
+}
+
+func randomToken() string {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+func equal(a, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
+
+// launchURL returns the URL of the web interface at addr to open in the browser,
+// with the one-time token of the launch authentication.
+func (a *authenticator) launchURL(addr string) string {
+	u := "http://" + addr + "/"
+	if a.mode == settings.AUTH_LAUNCH {
+		u += "?launch=" + a.launch
+	}
+	return u
+}
+
+// newSession starts a session, which the browser keeps in a cookie.
+func (a *authenticator) newSession(w http.ResponseWriter) {
+	key := randomToken()
+	a.mu.Lock()
+	a.keys[key] = true
+	a.mu.Unlock()
+	http.SetCookie(w, &http.Cookie{Name: SESSION_COOKIE, Value: key, Path: "/", HttpOnly: true, SameSite: http.SameSiteStrictMode})
+}
+
+func (a *authenticator) hasSession(r *http.Request) bool {
+	c, err := r.Cookie(SESSION_COOKIE)
+	if err != nil {
+		return false
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.keys[c.Value]
+}
+
+// authenticate tells whether r is authenticated and whether it carries a bearer token.
+// A token in the URL starts a session and redirects to the URL without it.
+func (a *authenticator) authenticate(w http.ResponseWriter, r *http.Request) (ok, bearer, redirected bool) {
+	if a.mode == settings.AUTH_NONE || a.hasSession(r) {
+		return true, false, false
+	}
+	switch a.mode {
+	case settings.AUTH_TOKEN:
+		if h := r.Header.Get("Authorization"); strings.HasPrefix(h, "Bearer ") {
+			return equal(h[len("Bearer "):], a.token), true, false
+		}
+		if t := r.URL.Query().Get("token"); len(t) > 0 && equal(t, a.token) {
+			a.newSession(w)
+			return true, false, redirectWithout(w, r, "token")
+		}
+	case settings.AUTH_BASIC:
+		if name, password, found := r.BasicAuth(); found {
+			hash, known := a.users[name]
+			return known && bcrypt.CompareHashAndPassword(hash, []byte(password)) == nil, false, false
+		}
+	case settings.AUTH_LAUNCH:
+		t := r.URL.Query().Get("launch")
+		a.mu.Lock()
+		used := len(t) > 0 && len(a.launch) > 0 && equal(t, a.launch)
+		if used {
+			a.launch = ""
+		}
+		a.mu.Unlock()
+		if used {
+			a.newSession(w)
+			return true, false, redirectWithout(w, r, "launch")
+		}
+	}
+	return false, false, false
+}
+
+// redirectWithout redirects a GET to its URL without the parameter, so that the token
+// does not stay in the address bar and the history. It tells whether it has redirected.
+func redirectWithout(w http.ResponseWriter, r *http.Request, param string) bool {
+	if r.Method != http.MethodGet {
+		return false
+	}
+	q := r.URL.Query()
+	q.Del(param)
+	u := *r.URL
+	u.RawQuery = q.Encode()
+	http.Redirect(w, r, u.RequestURI(), http.StatusSeeOther)
+	return true
+}
+
+// csrfToken returns the CSRF token of the browser, set in its cookie if it has none.
+func csrfToken(w http.ResponseWriter, r *http.Request) string {
+	if c, err := r.Cookie(CSRF_COOKIE); err == nil && len(c.Value) > 0 {
+		return c.Value
+	}
+	t := randomToken()
+	http.SetCookie(w, &http.Cookie{Name: CSRF_COOKIE, Value: t, Path: "/", SameSite: http.SameSiteStrictMode})
+	return t
+}
+
+// checkCSRF tells whether a request changing the state comes from a page of the web
+// interface: its CSRF_HEADER must match the CSRF cookie, which other sites can not read.
+// The clients which are not browsers, with neither Origin nor Referer, need no token:
+// the browsers send at least one of them with the POSTs of the pages of other sites.
+func checkCSRF(r *http.Request) bool {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return true
+	}
+	if len(r.Header.Get("Origin")) == 0 && len(r.Header.Get("Referer")) == 0 {
+		return true
+	}
+	c, err := r.Cookie(CSRF_COOKIE)
+	return err == nil && len(c.Value) > 0 && equal(r.Header.Get(CSRF_HEADER), c.Value)
+}
+
+// wrap requires the authentication for h, and the CSRF token for the POSTs of the browsers.
+func (a *authenticator) wrap(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ok, bearer, redirected := a.authenticate(w, r)
+		switch {
+		case redirected:
+			return
+		case !ok:
+			if a.mode == settings.AUTH_BASIC {
+				w.Header().Set("WWW-Authenticate", `Basic realm="goconvert"`)
+			}
+			denied(w, r, http.StatusUnauthorized, "Authentication required")
+			return
+		case !bearer && !checkCSRF(r):
+			denied(w, r, http.StatusForbidden, fmt.Sprintf("Missing or invalid %s header", CSRF_HEADER))
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// denied writes an error, as an APIError for the REST API.
+func denied(w http.ResponseWriter, r *http.Request, status int, msg string) {
+	if strings.HasPrefix(r.URL.Path, API_PREFIX+"/") {
+		writeAPI(w, status, &APIError{Error: msg})
+		return
+	}
+	http.Error(w, msg, status)
+}
+
+// checkOrigin refuses the websocket handshakes of the pages of other sites, which the
+// browsers would otherwise open with the cookies of the web interface.
+func checkOrigin(config *websocket.Config, r *http.Request) (err error) {
+	config.Origin, err = websocket.Origin(config, r)
+	if err != nil {
+		return err
+	}
+	if config.Origin == nil {
+		return errors.New("The websocket handshake has no origin.")
+	}
+	if !sameHost(config.Origin, r.Host) {
+		return fmt.Errorf("The websocket origin %s is not allowed.", config.Origin)
+	}
+	return nil
+}
+
+func sameHost(origin *url.URL, host string) bool {
+	return strings.EqualFold(origin.Host, host)
+}
+
+// publicSettings returns a copy of s without the credentials of the web interface and
+// the FTP password, to send to the clients.
+func publicSettings(s *settings.Settings) *settings.Settings {
+	c := *s
+	c.WebToken, c.WebUsers = "", nil
+	if s.FtpSettings != nil {
+		ftp := *s.FtpSettings
+		ftp.Password = ""
+		c.FtpSettings = &ftp
+	}
+	return &c
+}
+
+// savedPassword fills in the FTP password publicSettings has not sent to the clients,
+// left empty in the settings they send back for the same server and user.
+func savedPassword(s *settings.Settings) {
+	if s == nil || s.FtpSettings == nil || len(s.FtpSettings.Password) > 0 {
+		return
+	}
+	saved := webSettings
+	if len(s.Profile) > 0 {
+		if p, err := settings.LoadProfile(s.Profile, homeImgDir); err == nil {
+			saved = p
+		}
+	}
+	if saved == nil || saved.FtpSettings == nil {
+		return
+	}
+	if saved.FtpSettings.Address == s.FtpSettings.Address && saved.FtpSettings.Username == s.FtpSettings.Username {
+		s.FtpSettings.Password = saved.FtpSettings.Password
+	}
+}
@@ -0,0 +1,185 @@
+package webgui
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/mezzato/goconvert/imageconvert"
+	settings "github.com/mezzato/goconvert/settings"
+)
+
+// ErrCollectionBusy is returned when a job not ended works on the collection to delete.
+var ErrCollectionBusy = errors.New("A job is working on the collection")
+
+// CollectionDetail is a collection with the manifest of its renditions.
+type CollectionDetail struct {
+	*imageconvert.Collection
+	Manifest   *imageconvert.Manifest `json:"manifest"`
+	Renditions map[string]int         `json:"renditions"` // the files found by settings.RENDITION_ constant
+}
+
+// collectionOf returns the settings of the profile parameter and the collection of the
+// name path value in their publish folder.
+func collectionOf(r *http.Request) (*settings.Settings, *imageconvert.Collection, error) {
+	s, err := profileSettings(r)
+	if err != nil {
+		return nil, nil, err
+	}
+	c, err := imageconvert.ReadCollection(s.PublishDir, r.PathValue("name"), s.PiwigoGalleryHighDirName)
+	if err != nil {
+		return nil, nil, err
+	}
+	c.Describe(s)
+	return s, c, nil
+}
+
+// apiCollections lists the collections of the publish folder of the profile parameter.
+func apiCollections(w http.ResponseWriter, r *http.Request) {
+	s, err := profileSettings(r)
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	l, err := imageconvert.ListCollections(s.PublishDir, s.PiwigoGalleryHighDirName)
+	if l == nil {
+		l = []*imageconvert.Collection{}
+	}
+	for _, c := range l {
+		c.Describe(s)
+	}
+	writeAPIResult(w, l, err)
+}
+
+// apiCollection returns a collection with its manifest.
+func apiCollection(w http.ResponseWriter, r *http.Request) {
+	s, c, err := collectionOf(r)
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	m, err := c.Manifest(s.PiwigoGalleryHighDirName)
+	if err != nil {
+		writeAPIError(w, fmt.Errorf("Invalid manifest of %s: %v", c.Name, err))
+		return
+	}
+	d := &CollectionDetail{Collection: c, Manifest: m, Renditions: make(map[string]int)}
+	for _, e := range m.Images {
+		for rendition, p := range e.Renditions {
+			if _, err := os.Stat(filepath.Join(c.Path, filepath.FromSlash(p))); err == nil {
+				d.Renditions[rendition]++
+			}
+		}
+	}
+	writeAPI(w, http.StatusOK, d)
+}
+
+// apiCollectionFile serves a file of a collection, e.g. a rendition of its manifest.
+func apiCollectionFile(w http.ResponseWriter, r *http.Request) {
+	_, c, err := collectionOf(r)
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	p := r.PathValue("file")
+	if clean := path.Clean(p); clean != p || clean == ".." || strings.HasPrefix(clean, "../") || strings.HasPrefix(clean, "/") {
+		writeAPI(w, http.StatusBadRequest, &APIError{Error: fmt.Sprintf("Invalid file %q", p)})
+		return
+	}
+	f, err := os.Open(filepath.Join(c.Path, filepath.FromSlash(p)))
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil || fi.IsDir() {
+		writeAPI(w, http.StatusNotFound, &APIError{Error: fmt.Sprintf("No such file %s", p)})
+		return
+	}
+	w.Header().Set("Cache-Control", "private, max-age=300")
+	http.ServeContent(w, r, fi.Name(), fi.ModTime(), f)
+}
+
+// apiDeleteCollection removes a collection no job is working on.
+func apiDeleteCollection(w http.ResponseWriter, r *http.Request) {
+	s, c, err := collectionOf(r)
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	for _, j := range jobs.List() {
+		if !j.ended() && (within(j.PublishFolder, c.Path) || within(j.Collection, c.Path) || within(j.Settings.SourceDir, c.Path)) {
+			writeAPIError(w, ErrCollectionBusy)
+			return
+		}
+	}
+	if err = imageconvert.DeleteCollection(s.PublishDir, c); err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	slogger.Info(fmt.Sprintf("Deleted the collection %s", c.Path))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// within tells whether the folder p is dir or one of its subfolders.
+func within(p, dir string) bool {
+	if len(p) == 0 {
+		return false
+	}
+	a, err := filepath.Abs(p)
+	if err != nil {
+		return false
+	}
+	b, err := filepath.Abs(dir)
+	if err != nil {
+		return false
+	}
+	return a == b || strings.HasPrefix(a, b+string(filepath.Separator))
+}
+
+// apiCollectionAction queues the action of the collection, publish or regenerate the
+// rendition parameter.
+func apiCollectionAction(action string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		s, c, err := collectionOf(r)
+		if err != nil {
+			writeAPIError(w, err)
+			return
+		}
+		rendition := r.URL.Query().Get("rendition")
+		if action == imageconvert.ACTION_REGENERATE && rendition != settings.RENDITION_IMAGE && rendition != settings.RENDITION_THUMBNAIL {
+			writeAPI(w, http.StatusBadRequest, &APIError{Error: fmt.Sprintf("The rendition must be %s or %s, got %q", settings.RENDITION_IMAGE, settings.RENDITION_THUMBNAIL, rendition)})
+			return
+		}
+		j, err := jobs.SubmitAction(s, action, c.Path, rendition)
+		if err != nil {
+			writeAPIError(w, err)
+			return
+		}
+		w.Header().Set("Location", API_PREFIX+"/jobs/"+j.Id)
+		writeAPI(w, http.StatusCreated, j)
+	}
+}
+
+// apiCollectionArchive streams a zip archive of a collection, with its original images if
+// the originals parameter is true.
+func apiCollectionArchive(w http.ResponseWriter, r *http.Request) {
+	s, c, err := collectionOf(r)
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	originals, _ := strconv.ParseBool(r.URL.Query().Get("originals"))
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", path.Base(c.Name)+".zip"))
+	if err = imageconvert.WriteArchive(w, c, s.PiwigoGalleryHighDirName, originals); err != nil {
+		// the headers are gone, the truncated archive is invalid
+		slogger.Error(fmt.Sprintf("The archive of %s could not be written: %v", c.Name, err))
+	}
+}
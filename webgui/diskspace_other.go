@@ -0,0 +1,8 @@
+//go:build !(linux || darwin || freebsd)
+
+package webgui
+
+// freeSpace can not tell the free space on this system.
+func freeSpace(dir string) (int64, bool) {
+	return 0, false
+}
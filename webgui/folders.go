@@ -0,0 +1,150 @@
+package webgui
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/mezzato/goconvert/imageconvert"
+)
+
+// ErrOutsideRoots is returned for a path out of the folders the web interface can browse.
+var ErrOutsideRoots = errors.New("The path is outside of the folders which can be browsed")
+
+// The sizes in pixels of the thumbnails of the folder browser.
+const (
+	THUMBNAIL_SIZE     = 160
+	MAX_THUMBNAIL_SIZE = 512
+)
+
+// FolderListing is the content of a folder of the folder browser.
+type FolderListing struct {
+	Path    string                 `json:"path"`
+	Parent  string                 `json:"parent,omitempty"` // none for a root
+	Folders []*imageconvert.Folder `json:"folders"`
+	Images  []string               `json:"images"`
+}
+
+// browseRoots returns the folders the web interface can browse, with their symbolic links
+// resolved, skipping the ones which do not exist.
+func browseRoots() []string {
+	var l []string
+	if webSettings == nil {
+		return l
+	}
+	for _, r := range webSettings.WebRoots {
+		if abs, err := filepath.Abs(r); err == nil {
+			if real, err := filepath.EvalSymlinks(abs); err == nil {
+				l = append(l, real)
+			}
+		}
+	}
+	return l
+}
+
+// browsePath returns p with its symbolic links resolved, if it is in one of the roots,
+// and the root. A path which is not in a root as written is refused before looking at
+// the file system, so that the answer does not tell whether it exists.
+func browsePath(p string) (real, root string, err error) {
+	if !filepath.IsAbs(p) || !inRoots(filepath.Clean(p)) {
+		return "", "", ErrOutsideRoots
+	}
+	if real, err = filepath.EvalSymlinks(filepath.Clean(p)); err != nil {
+		return "", "", err
+	}
+	for _, root = range browseRoots() {
+		if isIn(root, real) {
+			return real, root, nil
+		}
+	}
+	return "", "", ErrOutsideRoots
+}
+
+// inRoots tells whether the path p is in one of the roots as configured or with their
+// symbolic links resolved, without resolving the ones of p.
+func inRoots(p string) bool {
+	if webSettings == nil {
+		return false
+	}
+	for _, r := range webSettings.WebRoots {
+		abs, err := filepath.Abs(r)
+		if err != nil {
+			continue
+		}
+		if isIn(abs, p) {
+			return true
+		}
+		if real, err := filepath.EvalSymlinks(abs); err == nil && isIn(real, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// isIn tells whether the path p is root or one of its subfolders.
+func isIn(root, p string) bool {
+	rel, err := filepath.Rel(root, p)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// apiFolders lists the roots, or the folder of the path parameter.
+func apiFolders(w http.ResponseWriter, r *http.Request) {
+	p := r.URL.Query().Get("path")
+	if len(p) == 0 {
+		l := []*imageconvert.Folder{}
+		for _, root := range browseRoots() {
+			l = append(l, &imageconvert.Folder{Name: filepath.Base(root), Path: root, Images: imageconvert.CountImages(root)})
+		}
+		writeAPI(w, http.StatusOK, l)
+		return
+	}
+	dir, root, err := browsePath(p)
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	folders, images, err := imageconvert.ListFolder(dir)
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	listing := &FolderListing{Path: dir, Folders: folders, Images: images}
+	if dir != root {
+		listing.Parent = filepath.Dir(dir)
+	}
+	writeAPI(w, http.StatusOK, listing)
+}
+
+// apiThumbnail returns a JPEG preview of the image of the path parameter, fitting in
+// the size parameter.
+func apiThumbnail(w http.ResponseWriter, r *http.Request) {
+	size := THUMBNAIL_SIZE
+	if v := r.URL.Query().Get("size"); len(v) > 0 {
+		var err error
+		if size, err = strconv.Atoi(v); err != nil || size < 1 || size > MAX_THUMBNAIL_SIZE {
+			writeAPI(w, http.StatusBadRequest, &APIError{Error: fmt.Sprintf("The size must be between 1 and %d, got %q", MAX_THUMBNAIL_SIZE, v)})
+			return
+		}
+	}
+	fn, _, err := browsePath(r.URL.Query().Get("path"))
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	if fi, err := os.Stat(fn); err != nil || fi.IsDir() {
+		writeAPI(w, http.StatusNotFound, &APIError{Error: fmt.Sprintf("No such image %s", fn)})
+		return
+	}
+	data, err := imageconvert.Thumbnail(fn, size)
+	if err != nil {
+		writeAPI(w, http.StatusUnsupportedMediaType, &APIError{Error: fmt.Sprintf("No preview of %s: %v", filepath.Base(fn), err)})
+		return
+	}
+	w.Header().Set("Content-Type", "image/jpeg")
+	w.Header().Set("Cache-Control", "private, max-age=300")
+	w.Write(data)
+}
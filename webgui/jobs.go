@@ -0,0 +1,549 @@
+package webgui
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/mezzato/goconvert/imageconvert"
+	lg "github.com/mezzato/goconvert/logger"
+	settings "github.com/mezzato/goconvert/settings"
+)
+
+// The states of a job.
+const (
+	JOB_QUEUED    = "queued"
+	JOB_RUNNING   = "running"
+	JOB_DONE      = "done"
+	JOB_FAILED    = "failed"
+	JOB_CANCELLED = "cancelled"
+)
+
+// JOBS_FILE_NAME keeps the jobs of the web interface across restarts,
+// in the user configuration folder.
+const JOBS_FILE_NAME = "jobs.json"
+
+// ErrJobNotFound is returned for an unknown job id.
+var ErrJobNotFound = errors.New("No such job")
+
+// JobStateError is returned when the state of a job does not allow an operation.
+type JobStateError struct {
+	Id, State string
+	Op        string // "cancel" or "retry"
+}
+
+func (e *JobStateError) Error() string {
+	if e.Op == "retry" {
+		return fmt.Sprintf("The job %s is %s, only the jobs failed or cancelled can be retried", e.Id, e.State)
+	}
+	return fmt.Sprintf("The job %s has already ended", e.Id)
+}
+
+// maxJobEvents bounds the output kept per job, the oldest events are dropped.
+const maxJobEvents = 10000
+
+// JobEvent is a message of the output of a job, numbered from 1 across its runs.
+type JobEvent struct {
+	Seq      int                          `json:"seq"`
+	Time     time.Time                    `json:"time"`
+	Kind     string                       `json:"kind"` // an imageconvert.EVENT_ constant or "end"
+	Body     string                       `json:"body,omitempty"`
+	Progress *imageconvert.UploadProgress `json:"progress,omitempty"`
+}
+
+// Job is a conversion submitted to the web interface.
+type Job struct {
+	Id       string               `json:"id"`
+	State    string               `json:"state"` // one of the JOB_ constants
+	Settings *settings.Settings   `json:"settings"`
+	NoUpload bool                 `json:"noUpload,omitempty"`
+	Created  time.Time            `json:"created"`
+	Started  *time.Time           `json:"started,omitempty"`
+	Ended    *time.Time           `json:"ended,omitempty"`
+	Error    string               `json:"error,omitempty"`
+	Report   *imageconvert.Report `json:"report,omitempty"`
+
+	// an action on a collection converted before, see SubmitAction
+	Action     string `json:"action,omitempty"`
+	Collection string `json:"collection,omitempty"`
+	Rendition  string `json:"rendition,omitempty"`
+
+	// the collection folder the job writes to, known once it has started
+	PublishFolder string `json:"publishFolder,omitempty"`
+
+	run     *imageconvert.Job
+	sink    func(*imageconvert.Message) // receives the output, may be nil
+	done    chan struct{}               // closed when the job ends
+	changed chan struct{}               // closed at the next event or change of state, if followed
+	clients int                         // attached to the job, see Attach
+	orphan  *time.Timer                 // cancels the job once the last client has detached
+	events  []*JobEvent
+	seq     int // of the last event
+}
+
+// snapshot returns a copy of the job to hand out of the lock, without the passwords.
+func (j *Job) snapshot() *Job {
+	c := *j
+	c.run, c.sink, c.done, c.changed, c.events, c.orphan = nil, nil, nil, nil, nil, nil
+	s := *c.Settings
+	ftp := *s.FtpSettings
+	ftp.Password = ""
+	s.FtpSettings = &ftp
+	s.WebToken, s.WebUsers = "", nil
+	c.Settings = &s
+	return &c
+}
+
+// record appends a message of the output to the events. It is called with mu held.
+func (j *Job) record(m *imageconvert.Message) {
+	j.seq++
+	j.events = append(j.events, &JobEvent{Seq: j.seq, Time: time.Now(), Kind: m.Kind, Body: m.Body, Progress: m.Progress})
+	if len(j.events) > maxJobEvents {
+		j.events = j.events[len(j.events)-maxJobEvents:]
+	}
+	j.notify()
+}
+
+// notify wakes up the followers of the job. It is called with mu held.
+func (j *Job) notify() {
+	if j.changed != nil {
+		close(j.changed)
+		j.changed = nil
+	}
+}
+
+// ended tells whether the job has ended, it may still be retried.
+func (j *Job) ended() bool {
+	return j.State == JOB_DONE || j.State == JOB_FAILED || j.State == JOB_CANCELLED
+}
+
+// eventsAfter returns the events numbered after seq. It is called with mu held.
+func (j *Job) eventsAfter(seq int) []*JobEvent {
+	l := []*JobEvent{}
+	for _, e := range j.events {
+		if e.Seq > seq {
+			l = append(l, e)
+		}
+	}
+	return l
+}
+
+// JobManager queues the jobs and runs a limited number at once.
+// The state of the jobs is saved to a file, the jobs queued are resumed by the
+// next manager and the jobs running are marked as failed.
+// The jobs the clients have attached to are cancelled once the last one has been
+// detached for the grace period.
+type JobManager struct {
+	mu          sync.Mutex
+	file        string // where the jobs are saved, none if empty
+	concurrency int
+	grace       time.Duration
+	running     int
+	jobs        []*Job // in submission order
+	onEnd       func(*Job)
+}
+
+// NewJobManager returns a manager running concurrency jobs at once, with the jobs of file,
+// which cancels the jobs left by their clients after grace.
+func NewJobManager(file string, concurrency int, grace time.Duration) (*JobManager, error) {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	m := &JobManager{file: file, concurrency: concurrency, grace: grace}
+	if err := m.load(); err != nil {
+		return nil, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.schedule()
+	return m, nil
+}
+
+func (m *JobManager) load() error {
+	if len(m.file) == 0 {
+		return nil
+	}
+	data, err := os.ReadFile(m.file)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err == nil {
+		err = json.Unmarshal(data, &m.jobs)
+	}
+	if err != nil {
+		return fmt.Errorf("The jobs file %s could not be read: %v", m.file, err)
+	}
+	now := time.Now()
+	for _, j := range m.jobs {
+		switch j.State {
+		case JOB_QUEUED:
+			j.done = make(chan struct{})
+		case JOB_RUNNING:
+			j.State, j.Error, j.Ended = JOB_FAILED, "Interrupted by a restart of the web interface", &now
+		}
+	}
+	return nil
+}
+
+// SavedJobs returns the jobs of file as the web interface last saved them, for a look
+// from outside of it: the running ones are left as they are.
+func SavedJobs(file string) ([]*Job, error) {
+	var l []*Job
+	data, err := os.ReadFile(file)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err == nil {
+		err = json.Unmarshal(data, &l)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("The jobs file %s could not be read: %v", file, err)
+	}
+	return l, nil
+}
+
+// save writes the jobs to the file without the FTP passwords, which the credential
+// providers give back when a job is resumed. It is called with mu held.
+func (m *JobManager) save() {
+	if len(m.file) == 0 {
+		return
+	}
+	l := make([]*Job, len(m.jobs))
+	for i, j := range m.jobs {
+		l[i] = j.snapshot()
+	}
+	data, err := json.MarshalIndent(l, "", "  ")
+	if err == nil {
+		err = os.MkdirAll(filepath.Dir(m.file), 0700)
+	}
+	if err == nil {
+		err = os.WriteFile(m.file, data, 0600)
+	}
+	if err != nil {
+		slogger.Error(fmt.Sprintf("The jobs could not be saved to %s: %v", m.file, err))
+	}
+}
+
+func (m *JobManager) find(id string) (*Job, error) {
+	for _, j := range m.jobs {
+		if j.Id == id {
+			return j, nil
+		}
+	}
+	return nil, ErrJobNotFound
+}
+
+// Submit queues the conversion of the settings, which must be valid. The output of the job,
+// "end" message included, is sent to sink with the job id, sink may be nil.
+func (m *JobManager) Submit(s *settings.Settings, noUpload bool, sink func(*imageconvert.Message)) (*Job, error) {
+	if s == nil {
+		return nil, errors.New("The settings are missing.")
+	}
+	if err := s.Validate(); err != nil {
+		return nil, err
+	}
+	return m.submit(&Job{Settings: s, NoUpload: noUpload, sink: sink})
+}
+
+// SubmitAction queues an action on the collection folder dir, imageconvert.ACTION_PUBLISH
+// or ACTION_REGENERATE of the rendition, with the settings s. The collection is the source
+// folder of the job and names it.
+func (m *JobManager) SubmitAction(s *settings.Settings, action, dir, rendition string) (*Job, error) {
+	if s == nil {
+		return nil, errors.New("The settings are missing.")
+	}
+	c := *s
+	c.SourceDir, c.CollName = dir, filepath.Base(dir)
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	return m.submit(&Job{Settings: &c, Action: action, Collection: dir, Rendition: rendition})
+}
+
+// submit queues the job, which has its settings and options.
+func (m *JobManager) submit(j *Job) (*Job, error) {
+	j.Id, j.State, j.Created, j.done = lg.UUID(), JOB_QUEUED, time.Now(), make(chan struct{})
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.jobs = append(m.jobs, j)
+	m.schedule()
+	m.save()
+	return j.snapshot(), nil
+}
+
+// schedule starts the jobs queued first while fewer than concurrency run.
+// It is called with mu held.
+func (m *JobManager) schedule() {
+	for _, j := range m.jobs {
+		if m.running >= m.concurrency {
+			return
+		}
+		if j.State == JOB_QUEUED {
+			m.start(j)
+		}
+	}
+}
+
+// start runs the job. It is called with mu held.
+func (m *JobManager) start(j *Job) {
+	now := time.Now()
+	j.State, j.Started = JOB_RUNNING, &now
+	j.notify()
+	m.running++
+
+	// the password of a resumed job comes from the credential providers
+	s := *j.Settings
+	ftp := *s.FtpSettings
+	s.FtpSettings = &ftp
+	if _, err := s.ResolvePassword(); err != nil {
+		go m.finish(j, imageconvert.Report{}, err)
+		return
+	}
+	j.PublishFolder = publishFolder(j, &s)
+
+	out := make(chan *imageconvert.Message)
+	j.run = imageconvert.StartMessage(context.Background(), &imageconvert.Message{
+		Id: j.Id, Kind: "run", Options: &imageconvert.Options{
+			Settings: &s, NoUpload: j.NoUpload, Action: j.Action, Collection: j.Collection, Rendition: j.Rendition,
+		},
+	}, out)
+	go func(run *imageconvert.Job, sink func(*imageconvert.Message)) {
+		for msg := range out {
+			m.mu.Lock()
+			j.record(msg)
+			m.mu.Unlock()
+			if sink != nil {
+				sink(msg)
+			}
+			if msg.Kind == "end" {
+				break
+			}
+		}
+		r, err := run.Wait()
+		m.finish(j, r, err)
+	}(j.run, j.sink)
+}
+
+// publishFolder returns the collection folder the job writes to, empty if it is not known
+// before the conversion.
+func publishFolder(j *Job, s *settings.Settings) string {
+	if len(j.Action) > 0 {
+		return j.Collection
+	}
+	e, err := imageconvert.New(s)
+	if err != nil {
+		return ""
+	}
+	p, err := e.Plan(context.Background())
+	if err != nil {
+		return ""
+	}
+	return p.PublishFolder
+}
+
+// finish records the outcome of a job and starts the next one.
+func (m *JobManager) finish(j *Job, r imageconvert.Report, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+	j.Ended, j.Report, j.run = &now, &r, nil
+	switch {
+	case r.Cancelled:
+		j.State = JOB_CANCELLED
+	case err != nil:
+		j.State, j.Error = JOB_FAILED, err.Error()
+	case r.Images > 0 && r.Failed == r.Images: // a publish converts no image
+		j.State, j.Error = JOB_FAILED, fmt.Sprintf("All the %d images failed to convert", r.Images)
+	default:
+		j.State = JOB_DONE
+	}
+	close(j.done)
+	j.notify()
+	if j.orphan != nil {
+		j.orphan.Stop()
+		j.orphan = nil
+	}
+	m.running--
+	m.schedule()
+	m.save()
+	if m.onEnd != nil {
+		go m.onEnd(j.snapshot())
+	}
+}
+
+// OnEnd sets the function called with each job which ends, out of the lock of the manager.
+func (m *JobManager) OnEnd(f func(*Job)) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.onEnd = f
+}
+
+// List returns the jobs in submission order.
+func (m *JobManager) List() []*Job {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	l := make([]*Job, len(m.jobs))
+	for i, j := range m.jobs {
+		l[i] = j.snapshot()
+	}
+	return l
+}
+
+// Get returns the job of the id.
+func (m *JobManager) Get(id string) (*Job, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	j, err := m.find(id)
+	if err != nil {
+		return nil, err
+	}
+	return j.snapshot(), nil
+}
+
+// Wait waits for the job to end and returns it.
+func (m *JobManager) Wait(id string) (*Job, error) {
+	m.mu.Lock()
+	j, err := m.find(id)
+	var done chan struct{}
+	if err == nil {
+		done = j.done
+	}
+	m.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	if done != nil {
+		<-done
+	}
+	return m.Get(id)
+}
+
+// Cancel removes a queued job from the queue, or stops a running job and waits for it to end.
+func (m *JobManager) Cancel(id string) error {
+	m.mu.Lock()
+	j, err := m.find(id)
+	switch {
+	case err != nil:
+	case j.State == JOB_QUEUED:
+		now := time.Now()
+		j.State, j.Ended = JOB_CANCELLED, &now
+		close(j.done)
+		j.notify()
+		m.save()
+	case j.State == JOB_RUNNING:
+		run, done := j.run, j.done
+		m.mu.Unlock()
+		run.Cancel()
+		<-done
+		return nil
+	default:
+		err = &JobStateError{Id: id, State: j.State, Op: "cancel"}
+	}
+	m.mu.Unlock()
+	return err
+}
+
+// Retry queues again a job which failed or has been cancelled, its output is sent to sink.
+func (m *JobManager) Retry(id string, sink func(*imageconvert.Message)) (*Job, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	j, err := m.find(id)
+	if err != nil {
+		return nil, err
+	}
+	if j.State != JOB_FAILED && j.State != JOB_CANCELLED {
+		return nil, &JobStateError{Id: id, State: j.State, Op: "retry"}
+	}
+	j.State, j.Error, j.Report, j.Started, j.Ended = JOB_QUEUED, "", nil, nil, nil
+	j.sink, j.done = sink, make(chan struct{})
+	j.notify()
+	m.schedule()
+	m.save()
+	return j.snapshot(), nil
+}
+
+// Events returns the events of the job numbered after seq, the oldest first.
+func (m *JobManager) Events(id string, after int) ([]*JobEvent, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	j, err := m.find(id)
+	if err != nil {
+		return nil, err
+	}
+	return j.eventsAfter(after), nil
+}
+
+// Follow returns the events of the job numbered after seq and whether the job has ended.
+// If there are no such events and the job has not ended, changed is closed at its next
+// event or change of state.
+func (m *JobManager) Follow(id string, after int) (l []*JobEvent, ended bool, changed <-chan struct{}, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	j, err := m.find(id)
+	if err != nil {
+		return nil, false, nil, err
+	}
+	l, ended = j.eventsAfter(after), j.ended()
+	if len(l) == 0 && !ended {
+		if j.changed == nil {
+			j.changed = make(chan struct{})
+		}
+		changed = j.changed
+	}
+	return l, ended, changed, nil
+}
+
+// Attach counts a client following the job, the job is no longer cancelled if the
+// last client had detached from it.
+func (m *JobManager) Attach(id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	j, err := m.find(id)
+	if err != nil {
+		return err
+	}
+	j.clients++
+	if j.orphan != nil {
+		j.orphan.Stop()
+		j.orphan = nil
+	}
+	return nil
+}
+
+// Detach uncounts a client of the job. When the last one leaves a job which has not ended,
+// the job is cancelled after the grace period unless a client attaches to it.
+func (m *JobManager) Detach(id string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	j, err := m.find(id)
+	if err != nil || j.clients == 0 {
+		return
+	}
+	j.clients--
+	if j.clients > 0 || j.ended() {
+		return
+	}
+	if m.grace <= 0 {
+		go m.Cancel(id)
+		return
+	}
+	var t *time.Timer
+	t = time.AfterFunc(m.grace, func() {
+		m.mu.Lock()
+		orphaned := j.orphan == t
+		if orphaned {
+			j.orphan = nil
+		}
+		m.mu.Unlock()
+		if orphaned {
+			slogger.Info(fmt.Sprintf("Cancelling the job %s, no client has attached to it", id))
+			m.Cancel(id)
+		}
+	})
+	j.orphan = t
+}
@@ -0,0 +1,327 @@
+package webgui
+
+// openAPIDocument describes the REST API served under API_PREFIX.
+const openAPIDocument = `{
+  "openapi": "3.0.3",
+  "info": {"title": "goconvert", "version": "1"},
+  "servers": [{"url": "/api/v1"}],
+  "paths": {
+    "/jobs": {
+      "get": {
+        "summary": "List the jobs in submission order",
+        "responses": {"200": {"description": "The jobs", "content": {"application/json": {"schema": {"type": "array", "items": {"$ref": "#/components/schemas/Job"}}}}}}
+      },
+      "post": {
+        "summary": "Queue a conversion",
+        "parameters": [
+          {"name": "noUpload", "in": "query", "schema": {"type": "boolean"}, "description": "Skip the upload step"},
+          {"name": "upload", "in": "query", "schema": {"type": "string"}, "description": "The id of a complete browser upload to convert instead of the source folder, removed once the job is done"}
+        ],
+        "requestBody": {"required": true, "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Settings"}}}},
+        "responses": {
+          "201": {"description": "The job queued", "headers": {"Location": {"schema": {"type": "string"}}}, "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Job"}}}},
+          "400": {"$ref": "#/components/responses/Error"},
+          "404": {"$ref": "#/components/responses/Error"},
+          "409": {"$ref": "#/components/responses/Error"},
+          "422": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/jobs/{id}": {
+      "parameters": [{"$ref": "#/components/parameters/JobId"}],
+      "get": {
+        "summary": "Get a job",
+        "responses": {"200": {"description": "The job", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Job"}}}}, "404": {"$ref": "#/components/responses/Error"}}
+      }
+    },
+    "/jobs/{id}/cancel": {
+      "parameters": [{"$ref": "#/components/parameters/JobId"}],
+      "post": {
+        "summary": "Remove a queued job from the queue or stop a running one",
+        "responses": {"200": {"description": "The job cancelled", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Job"}}}}, "404": {"$ref": "#/components/responses/Error"}, "409": {"$ref": "#/components/responses/Error"}}
+      }
+    },
+    "/jobs/{id}/retry": {
+      "parameters": [{"$ref": "#/components/parameters/JobId"}],
+      "post": {
+        "summary": "Queue again a failed or cancelled job",
+        "responses": {"200": {"description": "The job queued", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Job"}}}}, "404": {"$ref": "#/components/responses/Error"}, "409": {"$ref": "#/components/responses/Error"}}
+      }
+    },
+    "/jobs/{id}/events": {
+      "parameters": [{"$ref": "#/components/parameters/JobId"}],
+      "get": {
+        "summary": "Get the output of a job",
+        "parameters": [{"name": "after", "in": "query", "schema": {"type": "integer"}, "description": "Only the events numbered after this one"}],
+        "responses": {"200": {"description": "The events, the oldest first", "content": {"application/json": {"schema": {"type": "array", "items": {"$ref": "#/components/schemas/JobEvent"}}}}}, "400": {"$ref": "#/components/responses/Error"}, "404": {"$ref": "#/components/responses/Error"}}
+      }
+    },
+    "/jobs/{id}/stream": {
+      "parameters": [{"$ref": "#/components/parameters/JobId"}],
+      "get": {
+        "summary": "Stream the output of a job as Server-Sent Events, the event id is the seq of the event and the event type its kind",
+        "parameters": [
+          {"name": "Last-Event-ID", "in": "header", "schema": {"type": "integer"}, "description": "Replay the events numbered after this one"},
+          {"name": "after", "in": "query", "schema": {"type": "integer"}, "description": "Replay the events numbered after this one, if there is no Last-Event-ID"}
+        ],
+        "responses": {
+          "200": {"description": "The events until the job ends", "content": {"text/event-stream": {"schema": {"type": "string"}}}},
+          "204": {"description": "The job has ended and there are no more events"},
+          "400": {"$ref": "#/components/responses/Error"},
+          "404": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/settings": {
+      "get": {
+        "summary": "Get the settings of a profile, the ones of the web interface by default",
+        "parameters": [{"$ref": "#/components/parameters/Profile"}],
+        "responses": {"200": {"description": "The settings", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Settings"}}}}, "500": {"$ref": "#/components/responses/Error"}}
+      }
+    },
+    "/settings/validate": {
+      "post": {
+        "summary": "Validate settings",
+        "requestBody": {"required": true, "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Settings"}}}},
+        "responses": {"200": {"description": "The settings are valid"}, "400": {"$ref": "#/components/responses/Error"}, "422": {"$ref": "#/components/responses/Error"}}
+      }
+    },
+    "/folders": {
+      "get": {
+        "summary": "List the folders which can be browsed for images, or the content of one of them",
+        "parameters": [{"name": "path", "in": "query", "schema": {"type": "string"}, "description": "The absolute path of a folder in the browsable folders, none to list them"}],
+        "responses": {
+          "200": {"description": "The browsable folders as Folder array, or the FolderListing of the path", "content": {"application/json": {"schema": {"oneOf": [{"type": "array", "items": {"$ref": "#/components/schemas/Folder"}}, {"$ref": "#/components/schemas/FolderListing"}]}}}},
+          "403": {"$ref": "#/components/responses/Error"},
+          "404": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/thumbnail": {
+      "get": {
+        "summary": "Get a JPEG preview of an image of the browsable folders",
+        "parameters": [
+          {"name": "path", "in": "query", "required": true, "schema": {"type": "string"}},
+          {"name": "size", "in": "query", "schema": {"type": "integer", "minimum": 1, "maximum": 512, "default": 160}}
+        ],
+        "responses": {
+          "200": {"description": "The preview", "content": {"image/jpeg": {"schema": {"type": "string", "format": "binary"}}}},
+          "400": {"$ref": "#/components/responses/Error"},
+          "403": {"$ref": "#/components/responses/Error"},
+          "404": {"$ref": "#/components/responses/Error"},
+          "415": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/uploads": {
+      "post": {
+        "summary": "Start an upload of images from the browser into a staging folder",
+        "responses": {"201": {"description": "The empty upload", "headers": {"Location": {"schema": {"type": "string"}}}, "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Staging"}}}}, "500": {"$ref": "#/components/responses/Error"}}
+      }
+    },
+    "/uploads/{id}": {
+      "parameters": [{"$ref": "#/components/parameters/UploadId"}],
+      "get": {
+        "summary": "Get an upload with the bytes received of its files, to resume it",
+        "responses": {"200": {"description": "The upload", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Staging"}}}}, "404": {"$ref": "#/components/responses/Error"}}
+      },
+      "delete": {
+        "summary": "Remove an upload and its files",
+        "responses": {"204": {"description": "Removed"}, "404": {"$ref": "#/components/responses/Error"}}
+      }
+    },
+    "/uploads/{id}/files/{name}": {
+      "parameters": [{"$ref": "#/components/parameters/UploadId"}, {"name": "name", "in": "path", "required": true, "schema": {"type": "string"}}],
+      "put": {
+        "summary": "Upload a chunk of an image, which must start where the bytes received end",
+        "parameters": [{"name": "Content-Range", "in": "header", "schema": {"type": "string"}, "description": "bytes start-end/total, none for a whole file"}],
+        "requestBody": {"required": true, "content": {"application/octet-stream": {"schema": {"type": "string", "format": "binary"}}}},
+        "responses": {
+          "200": {"description": "The file with the bytes received", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/StagedFile"}}}},
+          "400": {"$ref": "#/components/responses/Error"},
+          "404": {"$ref": "#/components/responses/Error"},
+          "409": {"description": "The chunk does not start where the bytes received end, the file tells where to resume", "content": {"application/json": {"schema": {"allOf": [{"$ref": "#/components/schemas/Error"}, {"type": "object", "properties": {"file": {"$ref": "#/components/schemas/StagedFile"}}}]}}}},
+          "413": {"$ref": "#/components/responses/Error"},
+          "415": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/profiles": {
+      "get": {
+        "summary": "List the profiles of the configuration file",
+        "responses": {"200": {"description": "The profile names", "content": {"application/json": {"schema": {"type": "array", "items": {"type": "string"}}}}}}
+      }
+    },
+    "/collections": {
+      "get": {
+        "summary": "List the collections of the publish folder of a profile",
+        "parameters": [{"$ref": "#/components/parameters/Profile"}],
+        "responses": {"200": {"description": "The collections", "content": {"application/json": {"schema": {"type": "array", "items": {"$ref": "#/components/schemas/Collection"}}}}}, "500": {"$ref": "#/components/responses/Error"}}
+      }
+    },
+    "/collections/{name}": {
+      "parameters": [{"$ref": "#/components/parameters/CollectionName"}, {"$ref": "#/components/parameters/Profile"}],
+      "get": {
+        "summary": "Get a collection with the manifest of its renditions",
+        "responses": {"200": {"description": "The collection", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/CollectionDetail"}}}}, "404": {"$ref": "#/components/responses/Error"}}
+      },
+      "delete": {
+        "summary": "Delete a collection from the publish folder",
+        "responses": {"204": {"description": "Deleted"}, "404": {"$ref": "#/components/responses/Error"}, "409": {"$ref": "#/components/responses/Error"}}
+      }
+    },
+    "/collections/{name}/files/{file}": {
+      "parameters": [
+        {"$ref": "#/components/parameters/CollectionName"},
+        {"name": "file", "in": "path", "required": true, "schema": {"type": "string"}, "description": "The slash separated path of the file in the collection, e.g. a rendition of the manifest"},
+        {"$ref": "#/components/parameters/Profile"}
+      ],
+      "get": {
+        "summary": "Get a file of a collection",
+        "responses": {"200": {"description": "The file", "content": {"application/octet-stream": {"schema": {"type": "string", "format": "binary"}}}}, "400": {"$ref": "#/components/responses/Error"}, "404": {"$ref": "#/components/responses/Error"}}
+      }
+    },
+    "/collections/{name}/archive": {
+      "parameters": [{"$ref": "#/components/parameters/CollectionName"}, {"$ref": "#/components/parameters/Profile"}],
+      "get": {
+        "summary": "Export a collection as a zip archive",
+        "parameters": [{"name": "originals", "in": "query", "schema": {"type": "boolean"}, "description": "Include the original images"}],
+        "responses": {"200": {"description": "The archive", "content": {"application/zip": {"schema": {"type": "string", "format": "binary"}}}}, "404": {"$ref": "#/components/responses/Error"}}
+      }
+    },
+    "/collections/{name}/publish": {
+      "parameters": [{"$ref": "#/components/parameters/CollectionName"}, {"$ref": "#/components/parameters/Profile"}],
+      "post": {
+        "summary": "Queue a job uploading the collection again to the FTP server of the profile",
+        "responses": {
+          "201": {"description": "The job queued", "headers": {"Location": {"schema": {"type": "string"}}}, "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Job"}}}},
+          "404": {"$ref": "#/components/responses/Error"},
+          "422": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/collections/{name}/regenerate": {
+      "parameters": [{"$ref": "#/components/parameters/CollectionName"}, {"$ref": "#/components/parameters/Profile"}],
+      "post": {
+        "summary": "Queue a job resizing a rendition of the images of the manifest again from their originals",
+        "parameters": [{"name": "rendition", "in": "query", "required": true, "schema": {"type": "string", "enum": ["image", "thumbnail"]}}],
+        "responses": {
+          "201": {"description": "The job queued", "headers": {"Location": {"schema": {"type": "string"}}}, "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Job"}}}},
+          "400": {"$ref": "#/components/responses/Error"},
+          "404": {"$ref": "#/components/responses/Error"},
+          "422": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    }
+  },
+  "components": {
+    "parameters": {
+      "JobId": {"name": "id", "in": "path", "required": true, "schema": {"type": "string"}},
+      "Profile": {"name": "profile", "in": "query", "schema": {"type": "string"}},
+      "UploadId": {"name": "id", "in": "path", "required": true, "schema": {"type": "string"}},
+      "CollectionName": {"name": "name", "in": "path", "required": true, "schema": {"type": "string"}, "description": "The name of the collection as listed, its slashes escaped as %2F"}
+    },
+    "responses": {
+      "Error": {"description": "An error", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Error"}}}}
+    },
+    "schemas": {
+      "Error": {
+        "type": "object",
+        "required": ["error"],
+        "properties": {
+          "error": {"type": "string"},
+          "fields": {"type": "array", "items": {"type": "object", "properties": {"field": {"type": "string"}, "message": {"type": "string"}}}}
+        }
+      },
+      "Settings": {"type": "object", "description": "The settings of a conversion, as in the configuration file"},
+      "Job": {
+        "type": "object",
+        "properties": {
+          "id": {"type": "string"},
+          "state": {"type": "string", "enum": ["queued", "running", "done", "failed", "cancelled"]},
+          "settings": {"$ref": "#/components/schemas/Settings"},
+          "noUpload": {"type": "boolean"},
+          "created": {"type": "string", "format": "date-time"},
+          "started": {"type": "string", "format": "date-time"},
+          "ended": {"type": "string", "format": "date-time"},
+          "error": {"type": "string"},
+          "report": {"type": "object"},
+          "action": {"type": "string", "enum": ["publish", "regenerate"], "description": "The action on a collection, none for a conversion"},
+          "collection": {"type": "string"},
+          "rendition": {"type": "string"},
+          "publishFolder": {"type": "string", "description": "The collection folder the job writes to, once it has started"}
+        }
+      },
+      "Collection": {
+        "type": "object",
+        "properties": {
+          "name": {"type": "string"},
+          "path": {"type": "string"},
+          "images": {"type": "integer"},
+          "size": {"type": "integer"},
+          "modified": {"type": "string", "format": "date-time"},
+          "title": {"type": "string", "description": "The collection name in the folder name, as the collection template has put it"},
+          "first": {"type": "string", "format": "date-time"},
+          "last": {"type": "string", "format": "date-time"},
+          "count": {"type": "integer"},
+          "camera": {"type": "string"}
+        }
+      },
+      "CollectionDetail": {
+        "allOf": [
+          {"$ref": "#/components/schemas/Collection"},
+          {
+            "type": "object",
+            "properties": {
+              "manifest": {
+                "type": "object",
+                "properties": {
+                  "collection": {"type": "string"},
+                  "updated": {"type": "string", "format": "date-time"},
+                  "images": {"type": "array", "items": {"type": "object", "properties": {"source": {"type": "string"}, "date": {"type": "string", "format": "date-time"}, "renditions": {"type": "object", "additionalProperties": {"type": "string"}}}}}
+                }
+              },
+              "renditions": {"type": "object", "additionalProperties": {"type": "integer"}, "description": "The files found by rendition"}
+            }
+          }
+        ]
+      },
+      "Folder": {
+        "type": "object",
+        "properties": {"name": {"type": "string"}, "path": {"type": "string"}, "images": {"type": "integer"}}
+      },
+      "FolderListing": {
+        "type": "object",
+        "properties": {
+          "path": {"type": "string"},
+          "parent": {"type": "string"},
+          "folders": {"type": "array", "items": {"$ref": "#/components/schemas/Folder"}},
+          "images": {"type": "array", "items": {"type": "string"}}
+        }
+      },
+      "StagedFile": {
+        "type": "object",
+        "properties": {"name": {"type": "string"}, "received": {"type": "integer"}, "complete": {"type": "boolean"}}
+      },
+      "Staging": {
+        "type": "object",
+        "properties": {
+          "id": {"type": "string"},
+          "dir": {"type": "string"},
+          "files": {"type": "array", "items": {"$ref": "#/components/schemas/StagedFile"}}
+        }
+      },
+      "JobEvent": {
+        "type": "object",
+        "properties": {
+          "seq": {"type": "integer"},
+          "time": {"type": "string", "format": "date-time"},
+          "kind": {"type": "string"},
+          "body": {"type": "string"},
+          "progress": {"type": "object"}
+        }
+      }
+    }
+  }
+}
+`
@@ -0,0 +1,86 @@
+package webgui
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// sseHeartbeat is the interval of the comments keeping an idle stream open through proxies.
+const sseHeartbeat = 15 * time.Second
+
+// apiJobStream streams the events of a job as Server-Sent Events, the ones kept after the
+// Last-Event-ID header or the after parameter first, then the live ones until the job ends.
+// A job already ended with nothing more to send gets a 204, which stops the EventSource
+// reconnections.
+func apiJobStream(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	v := r.Header.Get("Last-Event-ID")
+	if len(v) == 0 {
+		v = r.URL.Query().Get("after")
+	}
+	after := 0
+	if len(v) > 0 {
+		var err error
+		if after, err = strconv.Atoi(v); err != nil {
+			writeAPI(w, http.StatusBadRequest, &APIError{Error: fmt.Sprintf("Invalid event number %q", v)})
+			return
+		}
+	}
+	l, ended, changed, err := jobs.Follow(id, after)
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	if len(l) == 0 && ended {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeAPI(w, http.StatusInternalServerError, &APIError{Error: "Streaming is not supported"})
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	heartbeat := time.NewTicker(sseHeartbeat)
+	defer heartbeat.Stop()
+	for {
+		for _, e := range l {
+			data, err := json.Marshal(e)
+			if err != nil {
+				slogger.Error(fmt.Sprintf("The event %d of the job %s could not be sent: %v", e.Seq, id, err))
+				continue
+			}
+			if _, err = fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", e.Seq, e.Kind, data); err != nil {
+				return
+			}
+			after = e.Seq
+		}
+		flusher.Flush()
+		if ended {
+			return
+		}
+		for changed != nil {
+			select {
+			case <-changed:
+				changed = nil
+			case <-heartbeat.C:
+				if _, err := fmt.Fprint(w, ": heartbeat\n\n"); err != nil {
+					return
+				}
+				flusher.Flush()
+			case <-r.Context().Done():
+				return
+			}
+		}
+		if l, ended, changed, err = jobs.Follow(id, after); err != nil {
+			return
+		}
+	}
+}
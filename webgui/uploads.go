@@ -0,0 +1,367 @@
+package webgui
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mezzato/goconvert/imageconvert"
+	lg "github.com/mezzato/goconvert/logger"
+	settings "github.com/mezzato/goconvert/settings"
+)
+
+// STAGING_TTL is how long the stagings not converted are kept.
+const STAGING_TTL = 48 * time.Hour
+
+// STAGING_MIN_FREE is the free space in bytes the uploads leave on the file system of
+// the staging area.
+const STAGING_MIN_FREE = 256 << 20
+
+// partSuffix marks the files being uploaded, which the conversion does not see.
+const partSuffix = ".part"
+
+// ErrStagingNotFound is returned for an unknown staging id.
+var ErrStagingNotFound = errors.New("No such upload")
+
+// UploadError is an image refused by the staging area, Status is the HTTP status to reply.
+type UploadError struct {
+	Status int
+	Msg    string
+}
+
+func (e *UploadError) Error() string {
+	return e.Msg
+}
+
+// StagedFile is an image of a staging, being uploaded or complete.
+type StagedFile struct {
+	Name     string `json:"name"`
+	Received int64  `json:"received"` // the bytes uploaded, the next chunk starts there
+	Complete bool   `json:"complete"`
+}
+
+// Staging is a folder of images uploaded by a browser, converted by a job with it as SourceDir.
+type Staging struct {
+	Id    string        `json:"id"`
+	Dir   string        `json:"dir"`
+	Files []*StagedFile `json:"files"`
+}
+
+// Complete tells whether all the files of the staging have been uploaded.
+func (s *Staging) Complete() bool {
+	for _, f := range s.Files {
+		if !f.Complete {
+			return false
+		}
+	}
+	return true
+}
+
+// StagingArea keeps the images uploaded by the browsers in a folder per staging.
+// The images are uploaded in chunks at increasing offsets, so that an upload broken off
+// resumes where it has stopped. The stagings are removed once converted, or after
+// STAGING_TTL.
+type StagingArea struct {
+	dir      string
+	maxSize  int64 // of an image
+	maxTotal int64 // of the images of a staging
+	mu       sync.Mutex
+	locks    map[string]*sync.Mutex // of the files being written
+}
+
+// NewStagingArea returns the staging area in dir, which accepts images up to maxSize bytes
+// and up to maxTotal bytes of images per staging.
+func NewStagingArea(dir string, maxSize, maxTotal int64) (*StagingArea, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("The staging folder %s could not be created: %v", dir, err)
+	}
+	a := &StagingArea{dir: dir, maxSize: maxSize, maxTotal: maxTotal, locks: make(map[string]*sync.Mutex)}
+	a.expire(nil)
+	return a, nil
+}
+
+// stagingRoot returns the staging folder of the web settings of s, in the user cache
+// if there is none.
+func stagingRoot(s *settings.Settings) string {
+	if len(s.WebStagingDir) > 0 {
+		return s.WebStagingDir
+	}
+	d, err := os.UserCacheDir()
+	if err != nil {
+		d = os.TempDir()
+	}
+	return filepath.Join(d, "goconvert", "staging")
+}
+
+// expire removes the stagings older than STAGING_TTL, but the ones of inUse.
+func (a *StagingArea) expire(inUse map[string]bool) {
+	entries, _ := os.ReadDir(a.dir)
+	for _, e := range entries {
+		p := filepath.Join(a.dir, e.Name())
+		if fi, err := e.Info(); err == nil && e.IsDir() && !inUse[p] && time.Since(fi.ModTime()) > STAGING_TTL {
+			slogger.Info(fmt.Sprintf("Removing the expired upload %s", p))
+			os.RemoveAll(p)
+		}
+	}
+}
+
+// Create starts a new staging.
+func (a *StagingArea) Create(inUse map[string]bool) (*Staging, error) {
+	a.expire(inUse)
+	id := lg.UUID()
+	dir := filepath.Join(a.dir, id)
+	if err := os.Mkdir(dir, 0700); err != nil {
+		return nil, err
+	}
+	return &Staging{Id: id, Dir: dir, Files: []*StagedFile{}}, nil
+}
+
+// path returns the folder of the staging id, checking that it exists.
+func (a *StagingArea) path(id string) (string, error) {
+	if len(id) == 0 || strings.ContainsAny(id, `/\`) || strings.HasPrefix(id, ".") {
+		return "", ErrStagingNotFound
+	}
+	dir := filepath.Join(a.dir, id)
+	if fi, err := os.Stat(dir); err != nil || !fi.IsDir() {
+		return "", ErrStagingNotFound
+	}
+	return dir, nil
+}
+
+// Get returns the staging of the id with its files.
+func (a *StagingArea) Get(id string) (*Staging, error) {
+	dir, err := a.path(id)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	s := &Staging{Id: id, Dir: dir, Files: []*StagedFile{}}
+	for _, e := range entries {
+		fi, err := e.Info()
+		if err != nil || e.IsDir() {
+			continue
+		}
+		name := strings.TrimSuffix(e.Name(), partSuffix)
+		s.Files = append(s.Files, &StagedFile{Name: name, Received: fi.Size(), Complete: name == e.Name()})
+	}
+	return s, nil
+}
+
+// Remove deletes the staging of the id.
+func (a *StagingArea) Remove(id string) error {
+	dir, err := a.path(id)
+	if err != nil {
+		return err
+	}
+	return os.RemoveAll(dir)
+}
+
+// Owns tells whether dir is a staging of the area.
+func (a *StagingArea) Owns(dir string) bool {
+	return len(dir) > 0 && filepath.Dir(filepath.Clean(dir)) == filepath.Clean(a.dir)
+}
+
+// lock serializes the writes to the file fn.
+func (a *StagingArea) lock(fn string) func() {
+	a.mu.Lock()
+	l, ok := a.locks[fn]
+	if !ok {
+		l = new(sync.Mutex)
+		a.locks[fn] = l
+	}
+	a.mu.Unlock()
+	l.Lock()
+	return l.Unlock
+}
+
+// checkName refuses the names which are not plain image file names.
+func checkName(name string) error {
+	if len(name) == 0 || strings.ContainsAny(name, `/\`) || strings.HasPrefix(name, ".") || strings.HasSuffix(name, partSuffix) {
+		return &UploadError{http.StatusBadRequest, fmt.Sprintf("Invalid file name %q", name)}
+	}
+	if !imageconvert.IsImageFile(name) {
+		return &UploadError{http.StatusUnsupportedMediaType, fmt.Sprintf("%s is not an image which can be converted", name)}
+	}
+	return nil
+}
+
+// Write appends the chunk of length bytes of the file name of the staging id starting at the
+// offset start, of a file of total bytes. The chunk must start where the file uploaded so far
+// ends, else a 409 UploadError is returned with the file, which tells where to resume.
+// A chunk shorter or longer than length is dropped with a 400 UploadError.
+func (a *StagingArea) Write(id, name string, start, length, total int64, chunk io.Reader) (*StagedFile, error) {
+	dir, err := a.path(id)
+	if err != nil {
+		return nil, err
+	}
+	if err = checkName(name); err != nil {
+		return nil, err
+	}
+	if total > a.maxSize {
+		return nil, &UploadError{http.StatusRequestEntityTooLarge, fmt.Sprintf("%s is larger than %d MB", name, a.maxSize>>20)}
+	}
+	fn := filepath.Join(dir, name)
+	defer a.lock(fn)()
+
+	if fi, err := os.Stat(fn); err == nil {
+		f := &StagedFile{Name: name, Received: fi.Size(), Complete: true}
+		if fi.Size() == total {
+			return f, nil
+		}
+		return f, &UploadError{http.StatusConflict, fmt.Sprintf("%s has already been uploaded with another size", name)}
+	}
+	part := fn + partSuffix
+	var received int64
+	if fi, err := os.Stat(part); err == nil {
+		received = fi.Size()
+	}
+	f := &StagedFile{Name: name, Received: received}
+	if start != received {
+		return f, &UploadError{http.StatusConflict, fmt.Sprintf("%s: expected the chunk at %d, got %d", name, received, start)}
+	}
+	if others := stagedSize(dir, name); others+total > a.maxTotal {
+		return f, &UploadError{http.StatusRequestEntityTooLarge, fmt.Sprintf("The upload is limited to %d MB, %s does not fit", a.maxTotal>>20, name)}
+	}
+	if free, ok := freeSpace(dir); ok && free-length < STAGING_MIN_FREE {
+		return f, &UploadError{http.StatusInsufficientStorage, fmt.Sprintf("Not enough free space for %s", name)}
+	}
+	w, err := os.OpenFile(part, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return f, err
+	}
+	// one byte more tells a chunk longer than announced
+	n, err := io.Copy(w, io.LimitReader(chunk, length+1))
+	if err == nil && n != length {
+		err = &UploadError{http.StatusBadRequest, fmt.Sprintf("%s: expected a chunk of %d bytes, got %d", name, length, n)}
+	}
+	if err != nil {
+		// the client sends the chunk again
+		w.Truncate(received)
+		w.Close()
+		return f, err
+	}
+	if err = w.Close(); err != nil {
+		return f, err
+	}
+	f.Received += n
+	if f.Received == total {
+		if err = os.Rename(part, fn); err != nil {
+			return f, err
+		}
+		f.Complete = true
+	}
+	return f, nil
+}
+
+// stagedSize returns the bytes uploaded to the staging folder dir, but the ones of the file name.
+func stagedSize(dir, name string) (n int64) {
+	entries, _ := os.ReadDir(dir)
+	for _, e := range entries {
+		if fi, err := e.Info(); err == nil && !e.IsDir() && strings.TrimSuffix(e.Name(), partSuffix) != name {
+			n += fi.Size()
+		}
+	}
+	return
+}
+
+// parseContentRange returns the start, the length and the total size of
+// "bytes start-end/total". A request without Content-Range holds a whole file of
+// ContentLength bytes.
+func parseContentRange(r *http.Request) (start, length, total int64, err error) {
+	h := r.Header.Get("Content-Range")
+	if len(h) == 0 {
+		if r.ContentLength < 0 {
+			return 0, 0, 0, errors.New("The Content-Length or Content-Range header is required")
+		}
+		return 0, r.ContentLength, r.ContentLength, nil
+	}
+	var end int64
+	if !strings.HasPrefix(h, "bytes ") {
+		return 0, 0, 0, fmt.Errorf("Invalid Content-Range %q", h)
+	}
+	rng, size, ok := strings.Cut(h[len("bytes "):], "/")
+	from, to, ok2 := strings.Cut(rng, "-")
+	if !ok || !ok2 {
+		return 0, 0, 0, fmt.Errorf("Invalid Content-Range %q", h)
+	}
+	if start, err = strconv.ParseInt(from, 10, 64); err == nil {
+		if end, err = strconv.ParseInt(to, 10, 64); err == nil {
+			total, err = strconv.ParseInt(size, 10, 64)
+		}
+	}
+	if err != nil || start < 0 || end < start || end >= total {
+		return 0, 0, 0, fmt.Errorf("Invalid Content-Range %q", h)
+	}
+	if r.ContentLength >= 0 && r.ContentLength != end-start+1 {
+		return 0, 0, 0, fmt.Errorf("The Content-Range %q does not match the Content-Length %d", h, r.ContentLength)
+	}
+	return start, end - start + 1, total, nil
+}
+
+// stagingDirs returns the staging folders of the jobs queued or running.
+func stagingDirs() map[string]bool {
+	inUse := make(map[string]bool)
+	for _, j := range jobs.List() {
+		if !j.ended() && j.Settings != nil {
+			inUse[filepath.Clean(j.Settings.SourceDir)] = true
+		}
+	}
+	return inUse
+}
+
+// cleanStaging removes the staging converted by a job done.
+func cleanStaging(j *Job) {
+	if j.State != JOB_DONE || j.Settings == nil || !staging.Owns(j.Settings.SourceDir) {
+		return
+	}
+	slogger.Info(fmt.Sprintf("Removing the upload %s converted by the job %s", j.Settings.SourceDir, j.Id))
+	if err := os.RemoveAll(j.Settings.SourceDir); err != nil {
+		slogger.Error(fmt.Sprintf("The upload %s could not be removed: %v", j.Settings.SourceDir, err))
+	}
+}
+
+// stagedSource returns the staging folder of the upload id to convert, which must be complete.
+func stagedSource(id string) (string, error) {
+	st, err := staging.Get(id)
+	if err != nil {
+		return "", err
+	}
+	if len(st.Files) == 0 {
+		return "", &UploadError{http.StatusConflict, fmt.Sprintf("The upload %s has no images", id)}
+	}
+	if !st.Complete() {
+		return "", &UploadError{http.StatusConflict, fmt.Sprintf("The upload %s is not complete", id)}
+	}
+	return st.Dir, nil
+}
+
+// apiUploadChunk writes the body of the request at the offset of its Content-Range.
+func apiUploadChunk(w http.ResponseWriter, r *http.Request) {
+	start, length, total, err := parseContentRange(r)
+	if err != nil {
+		writeAPI(w, http.StatusBadRequest, &APIError{Error: err.Error()})
+		return
+	}
+	body := http.MaxBytesReader(w, r.Body, staging.maxSize+1)
+	f, err := staging.Write(r.PathValue("id"), r.PathValue("name"), start, length, total, body)
+	var uploadErr *UploadError
+	if errors.As(err, &uploadErr) && f != nil {
+		// the client resumes at f.Received
+		writeAPI(w, uploadErr.Status, &struct {
+			APIError
+			File *StagedFile `json:"file"`
+		}{APIError{Error: err.Error()}, f})
+		return
+	}
+	writeAPIResult(w, f, err)
+}
@@ -9,7 +9,6 @@ import (
 	"html/template"
 	"io"
 
-	"github.com/mezzato/goconvert/imageconvert"
 	lg "github.com/mezzato/goconvert/logger"
 	settings "github.com/mezzato/goconvert/settings"
 	//"io/ioutil"
@@ -19,6 +18,7 @@ import (
 	"path/filepath"
 	"runtime"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -26,57 +26,31 @@ type Page struct {
 	Title          string
 	WebPort        int
 	SettingsAsJson string
-}
-
-type appendSliceWriter struct {
-	Buffer *[]string
-	Eof    bool
-}
-
-func (s *appendSliceWriter) Reset() error {
-
-	b := make([]string, 0, 100)
-	s.Buffer = &b
-	s.Eof = false
-
-	return nil
-}
-
-func (s *appendSliceWriter) Write(p []byte) (int, error) {
-	*s.Buffer = append(*s.Buffer, string(p))
-	//imageconvert.WriteInfof("The applendSliceWriter.Write slice length is: %d", len(w))
-	return len(p), nil
-}
-
-func (s *appendSliceWriter) ReadAll() (lines []string) {
-	n := len(*s.Buffer)
-	//imageconvert.WriteInfof("The applendSliceWriter.ReadAll() return slice length is: %d", n)
-	if n == 0 {
-		return *s.Buffer
-	}
-
-	r := (*s.Buffer)[0:n]
-	// trim the buffer
-	*s.Buffer = (*s.Buffer)[n:]
-	return r
+	Profiles       []string // the profiles of the configuration file
+	Profile        string   // the profile of SettingsAsJson
+	CSRFToken      string   // sent back by the POSTs of the page
 }
 
 type Response struct {
-	Messages []string `json:"messages"`
-	Errors   []string `json:"compile_errors"`
-	Eof      bool     `json:"eof"`
+	Messages []string                  `json:"messages"`
+	Errors   []string                  `json:"compile_errors"`
+	Fields   settings.ValidationErrors `json:"fields,omitempty"` // the invalid settings, to highlight
+	Eof      bool                      `json:"eof"`
+	Job      string                    `json:"job,omitempty"`  // the job of compressStatus
+	Last     int                       `json:"last,omitempty"` // the last event of the job read by compressStatus
 }
 
 type requestProcessor func(r *http.Request) (msgs []string, err error, eof bool)
 
 var (
-	templates       = make(map[string]*template.Template)
-	logger          *appendSliceWriter
+	templates                          = make(map[string]*template.Template)
 	slogger         lg.SemanticLogger  = lg.NewConsoleSemanticLogger("goconvert", os.Stdout, lg.DEBUG)
 	homeImgDir                         = filepath.Join(settings.GetHomeDir(), "Pictures", "ToResize")
 	defaultSettings *settings.Settings = settings.NewDefaultSettings("", homeImgDir)
-	compressing     bool
-	quitChannel     chan bool
+	jobs            *JobManager
+	staging         *StagingArea // of the images uploaded by the browsers
+	compressionMu   sync.Mutex
+	compression     string // the job launched last by compress, guarded by compressionMu
 )
 
 var webresources = make(map[string]string)
@@ -91,14 +65,27 @@ func echoServer(ws *websocket.Conn) {
 }
 */
 
-func StartWebgui() (browserCmd *exec.Cmd, server *Server, err error) {
+// StartWebgui serves the web interface with the web settings of s and opens a browser.
+func StartWebgui(s *settings.Settings) (browserCmd *exec.Cmd, server *Server, err error) {
 
 	setVariables()
+	webSettings = s
+	auth, err := newAuthenticator(s)
+	if err != nil {
+		return
+	}
+	if len(*serve) > 0 && auth.mode == settings.AUTH_NONE {
+		slogger.Warn(fmt.Sprintf("The web interface on %s has no authentication, anyone who reaches it can start jobs. Set web-auth.", *serve))
+	}
+	if jobs, err = NewJobManager(filepath.Join(settings.UserConfigDir(), JOBS_FILE_NAME), s.WebJobs, time.Duration(s.WebGraceSec)*time.Second); err != nil {
+		return
+	}
+	if staging, err = NewStagingArea(stagingRoot(s), int64(s.WebUploadMaxMB)<<20, int64(s.WebStagingMaxMB)<<20); err != nil {
+		return
+	}
+	jobs.OnEnd(cleanStaging)
 	// start up a local web server
 
-	b := make([]string, 0, 100)
-	logger = &appendSliceWriter{Buffer: &b}
-
 	slogger.Info(fmt.Sprintf("Starting up web server on port %d, click or copy this link to open up the page: %s", WEBLOG_PORT, hosturl))
 
 	// find and serve the goconvert files
@@ -148,35 +135,43 @@ func StartWebgui() (browserCmd *exec.Cmd, server *Server, err error) {
 					return
 				}
 
-				settingsAsJson, err := json.Marshal(defaultSettings)
+				p, err := newPage(r.URL.Query().Get("profile"))
 				if err != nil {
+					http.Error(w, err.Error(), http.StatusInternalServerError)
 					return
 				}
-
-				p := &Page{WebPort: WEBLOG_PORT, SettingsAsJson: string(settingsAsJson)}
+				p.CSRFToken = csrfToken(w, r)
 				renderTemplate(w, fkey, p)
 				return
 			}
-			http.Error(w, "not found", 404)
 		})
 		http.Handle("/"+webroot+"/", http.FileServer(http.Dir(webroot)))
 
 		// web socket
 		http.Handle("/socket", websocketHandler)
-		http.HandleFunc("/compress", wrapHandler(compress))
-		http.HandleFunc("/compress/status", wrapHandler(compressStatus))
-		http.HandleFunc("/cancel", wrapHandler(stopCompressing))
+		http.HandleFunc("/compress", postOnly(wrapHandler(compress)))
+		http.HandleFunc("/compress/status", compressStatus)
+		http.HandleFunc("/cancel", postOnly(wrapHandler(stopCompressing)))
+		http.HandleFunc("/jobs", listJobs)
+		http.HandleFunc("/jobs/get", getJob)
+		http.HandleFunc("/jobs/cancel", cancelJob)
+		http.HandleFunc("/jobs/retry", retryJob)
+		http.Handle(API_PREFIX+"/", apiHandler())
 
 		// websocket
 		//http.Handle("/echo", websocket.Handler(echoServer))
 		//http.Handle("/echo", websocket.Draft75Handler(echoServer))
-		server = NewServer(nil)
+		server = NewServer(auth.wrap(http.DefaultServeMux))
 		serverAddr := server.Listener.Addr().String()
 		slogger.Info(fmt.Sprintf("Test WebSocket server listening on %s", serverAddr))
 
 		slogger.Info(fmt.Sprintf("Serving at http://%s/", serverAddr))
 		// go http.ListenAndServe(*httpListen, nil)
-		browserCmd, _ = runBrowser(".", serverAddr)
+		launchURL := auth.launchURL(serverAddr)
+		if auth.mode == settings.AUTH_LAUNCH {
+			slogger.Info(fmt.Sprintf("Open %s to log in, the link works once", launchURL))
+		}
+		browserCmd, _ = runBrowser(".", launchURL)
 
 	}
 	// go http.ListenAndServe(":" + strconv.Itoa(WEBLOG_PORT), nil)
@@ -184,6 +179,24 @@ func StartWebgui() (browserCmd *exec.Cmd, server *Server, err error) {
 	return
 }
 
+// newPage returns the page data with the settings of the configuration files and the given profile.
+func newPage(profile string) (p *Page, err error) {
+	sets, err := settings.LoadProfile(profile, homeImgDir)
+	if err != nil {
+		return
+	}
+	sets.SourceDir = homeImgDir
+	profiles, err := settings.ListProfiles(homeImgDir)
+	if err != nil {
+		return
+	}
+	settingsAsJson, err := json.Marshal(publicSettings(sets))
+	if err != nil {
+		return
+	}
+	return &Page{WebPort: WEBLOG_PORT, SettingsAsJson: string(settingsAsJson), Profiles: profiles, Profile: sets.Profile}, nil
+}
+
 func createFileAndWriteText(fp string, text string) (err error) {
 	dir, _ := filepath.Split(fp)
 	_, e := os.Stat(dir)
@@ -280,60 +293,3 @@ func runBrowser(dir string, url string) (cmd *exec.Cmd, err error) {
 	}
 	return nil, errors.New("No known browser could be started. Do it manually!")
 }
-
-func launchConversionFromWeb(settings *settings.Settings, logger *appendSliceWriter, compressionStatus *bool) (responseChannel chan *imageconvert.ConvertResponse, quitChannel chan bool, err error) {
-	startNanosecs := time.Now()
-
-	quitChannel = make(chan bool)
-
-	io.WriteString(logger, "Analysing folder and starting up compression.")
-	responseChannel, quit, fileno, collPublishFolder, err := imageconvert.Convert(
-		settings.CollName,
-		settings.SourceDir,
-		settings.PublishDir,
-		settings.PiwigoGalleryHighDirName,
-		settings.ConversionSettings)
-
-	if err != nil {
-		return
-	}
-
-	go func() {
-
-		defer func() {
-			quit <- true // stopping the server
-			*compressionStatus = false
-			logger.Eof = true
-			io.WriteString(logger, fmt.Sprintf("The conversion took %.3f seconds", float32(time.Now().Sub(startNanosecs))/1e9))
-			io.WriteString(logger, "Images successfully resized to folder: "+collPublishFolder)
-		}()
-
-		*compressionStatus = true
-		// collect responses
-		slogger.Info(fmt.Sprintf("Collecting results. Number of images: %d", fileno))
-
-		for i := 0; i < fileno; i++ {
-
-			select {
-			case <-quitChannel:
-				io.WriteString(logger, "Compression cancelled by the user.")
-				io.WriteString(logger, fmt.Sprintf("The conversion took %.3f seconds", float32(time.Now().Sub(startNanosecs))/1e9))
-				return
-
-			case r := <-responseChannel:
-				fname := filepath.Base(r.ImgF.Path)
-				var msg string
-				if r.Error == nil {
-					msg = fmt.Sprintf("Success, file %s resized and archived", fname)
-				} else {
-					msg = fmt.Sprintf("Error, file %s, the error was %s", fname, r.Error)
-				}
-				slogger.Info(msg)
-				io.WriteString(logger, msg)
-			}
-		}
-
-	}()
-
-	return responseChannel, quitChannel, err
-}
@@ -1,12 +1,31 @@
 package webgui
 
 import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"hash/crc32"
+	"image"
+	"image/png"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"runtime"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/mezzato/goconvert/imageconvert"
+	settings "github.com/mezzato/goconvert/settings"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/net/websocket"
 )
 
 func TestRunBrowser(t *testing.T) {
@@ -46,3 +65,743 @@ func runB(dir string, url string) (cmd *exec.Cmd, err error) {
 	}
 	return nil, errors.New("No known browser could be started. Do it manually!")
 }
+
+func TestJobManager(t *testing.T) {
+	file := filepath.Join(t.TempDir(), JOBS_FILE_NAME)
+	m, e := NewJobManager(file, 1, 0)
+	if e != nil {
+		t.Fatalf("error %q", e)
+	}
+	if _, e = m.Submit(settings.NewDefaultSettings("", "../test"), true, nil); e == nil || len(settings.FieldErrors(e)) == 0 {
+		t.Fatalf("Invalid settings should be refused, got %v", e)
+	}
+
+	sets := settings.NewDefaultSettings("jobs", "../test")
+	sets.PublishDir = t.TempDir()
+	sets.FtpSettings.Password = "secret"
+	var ends int
+	first, e := m.Submit(sets, true, func(msg *imageconvert.Message) {
+		if msg.Kind == "end" {
+			ends++
+		}
+	})
+	if e != nil {
+		t.Fatalf("error %q", e)
+	}
+	second, e := m.Submit(sets, true, nil)
+	if e != nil {
+		t.Fatalf("error %q", e)
+	}
+	if second.State != JOB_QUEUED {
+		t.Fatalf("The second job should wait for the first, got %s", second.State)
+	}
+	if e = m.Cancel(second.Id); e != nil {
+		t.Fatalf("error %q", e)
+	}
+
+	j, e := m.Wait(first.Id)
+	if e != nil {
+		t.Fatalf("error %q", e)
+	}
+	if j.State != JOB_DONE || j.Report == nil || j.Report.Images == 0 || ends != 1 {
+		t.Fatalf("Unexpected job %+v, %d end messages", j, ends)
+	}
+	if j, _ = m.Get(second.Id); j.State != JOB_CANCELLED {
+		t.Fatalf("Expected a cancelled job, got %s", j.State)
+	}
+	if _, e = m.Retry(first.Id, nil); e == nil {
+		t.Fatalf("A job done should not be retried")
+	}
+	if _, e = m.Get("none"); e != ErrJobNotFound {
+		t.Fatalf("Expected %v, got %v", ErrJobNotFound, e)
+	}
+
+	// the jobs are there after a restart, without the password
+	if m, e = NewJobManager(file, 1, 0); e != nil {
+		t.Fatalf("error %q", e)
+	}
+	l := m.List()
+	if len(l) != 2 || l[0].Id != first.Id || l[0].State != JOB_DONE || l[1].State != JOB_CANCELLED {
+		t.Fatalf("Unexpected jobs %+v", l)
+	}
+	if l[0].Settings.FtpSettings.Password != "" {
+		t.Fatalf("The password should not be saved")
+	}
+	if _, e = m.Retry(second.Id, nil); e != nil {
+		t.Fatalf("error %q", e)
+	}
+	if j, e = m.Wait(second.Id); e != nil || j.State != JOB_DONE {
+		t.Fatalf("Unexpected retried job %+v, %v", j, e)
+	}
+}
+
+func TestAPI(t *testing.T) {
+	var e error
+	if jobs, e = NewJobManager("", 1, 0); e != nil {
+		t.Fatalf("error %q", e)
+	}
+	srv := httptest.NewServer(apiHandler())
+	defer srv.Close()
+	call := func(method, path, body string, status int, v interface{}) {
+		req, _ := http.NewRequest(method, srv.URL+API_PREFIX+path, strings.NewReader(body))
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("error %q", err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != status {
+			t.Fatalf("%s %s: expected status %d, got %d", method, path, status, resp.StatusCode)
+		}
+		if v != nil {
+			if err = json.NewDecoder(resp.Body).Decode(v); err != nil {
+				t.Fatalf("error %q", err)
+			}
+		}
+	}
+
+	var doc map[string]interface{}
+	call("GET", "/openapi.json", "", http.StatusOK, &doc)
+	if doc["openapi"] == nil {
+		t.Fatalf("Unexpected OpenAPI document %v", doc)
+	}
+
+	var apiErr APIError
+	call("POST", "/jobs", "{", http.StatusBadRequest, &apiErr)
+	data, _ := json.Marshal(settings.NewDefaultSettings("", "../test"))
+	call("POST", "/jobs", string(data), http.StatusUnprocessableEntity, &apiErr)
+	if len(apiErr.Fields) == 0 {
+		t.Fatalf("The invalid settings should be listed, got %+v", apiErr)
+	}
+	call("GET", "/jobs/none", "", http.StatusNotFound, &apiErr)
+	call("GET", "/none", "", http.StatusNotFound, &apiErr)
+
+	sets := settings.NewDefaultSettings("api", "../test")
+	sets.PublishDir = t.TempDir()
+	data, _ = json.Marshal(sets)
+	var j Job
+	call("POST", "/jobs?noUpload=true", string(data), http.StatusCreated, &j)
+	if _, e = jobs.Wait(j.Id); e != nil {
+		t.Fatalf("error %q", e)
+	}
+	call("GET", "/jobs/"+j.Id, "", http.StatusOK, &j)
+	if j.State == JOB_QUEUED || j.State == JOB_RUNNING {
+		t.Fatalf("Expected a job ended, got %+v", j)
+	}
+	call("POST", "/jobs/"+j.Id+"/cancel", "", http.StatusConflict, &apiErr)
+
+	var events []*JobEvent
+	call("GET", "/jobs/"+j.Id+"/events", "", http.StatusOK, &events)
+	if len(events) == 0 || events[len(events)-1].Kind != "end" {
+		t.Fatalf("Unexpected events %+v", events)
+	}
+	last := events[len(events)-1].Seq
+	call("GET", fmt.Sprintf("/jobs/%s/events?after=%d", j.Id, last-1), "", http.StatusOK, &events)
+	if len(events) != 1 || events[0].Seq != last {
+		t.Fatalf("Expected the last event only, got %+v", events)
+	}
+	call("GET", "/jobs/"+j.Id+"/events?after=x", "", http.StatusBadRequest, &apiErr)
+
+	// the FTP password is not sent to the clients, the one they send back empty is restored
+	webSettings = settings.NewDefaultSettings("api", "../test")
+	webSettings.FtpSettings.Address, webSettings.FtpSettings.Username, webSettings.FtpSettings.Password = "ftp.example.com", "user", "secret"
+	resp, e := http.Get(srv.URL + API_PREFIX + "/settings")
+	if e != nil {
+		t.Fatalf("error %q", e)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || strings.Contains(string(body), "secret") || !strings.Contains(string(body), "ftp.example.com") {
+		t.Fatalf("Unexpected settings %d %s", resp.StatusCode, body)
+	}
+	if webSettings.FtpSettings.Password != "secret" {
+		t.Fatalf("The settings of the web interface should be left alone")
+	}
+	var sent *settings.Settings
+	json.Unmarshal(body, &sent)
+	savedPassword(sent)
+	if sent.FtpSettings.Password != "secret" {
+		t.Fatalf("Expected the saved password, got %q", sent.FtpSettings.Password)
+	}
+	sent.FtpSettings.Password, sent.FtpSettings.Username = "", "other"
+	savedPassword(sent)
+	if len(sent.FtpSettings.Password) > 0 {
+		t.Fatalf("The password of another user should not be filled in")
+	}
+	webSettings = nil
+}
+
+func TestJobStream(t *testing.T) {
+	var e error
+	if jobs, e = NewJobManager("", 1, 0); e != nil {
+		t.Fatalf("error %q", e)
+	}
+	srv := httptest.NewServer(apiHandler())
+	defer srv.Close()
+	sets := settings.NewDefaultSettings("stream", "../test")
+	sets.PublishDir = t.TempDir()
+	j, e := jobs.Submit(sets, true, nil)
+	if e != nil {
+		t.Fatalf("error %q", e)
+	}
+
+	// stream reads the events sent after lastId until the stream ends
+	stream := func(lastId string) (status int, ids []string, kinds []string) {
+		req, _ := http.NewRequest("GET", srv.URL+API_PREFIX+"/jobs/"+j.Id+"/stream", nil)
+		if len(lastId) > 0 {
+			req.Header.Set("Last-Event-ID", lastId)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("error %q", err)
+		}
+		defer resp.Body.Close()
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			line := scanner.Text()
+			switch {
+			case strings.HasPrefix(line, "id: "):
+				ids = append(ids, line[4:])
+			case strings.HasPrefix(line, "event: "):
+				kinds = append(kinds, line[7:])
+			}
+		}
+		return resp.StatusCode, ids, kinds
+	}
+
+	status, ids, kinds := stream("")
+	if status != http.StatusOK || len(ids) == 0 || len(ids) != len(kinds) || kinds[len(kinds)-1] != "end" {
+		t.Fatalf("Unexpected stream %d, ids %v, kinds %v", status, ids, kinds)
+	}
+	if len(ids) > 1 {
+		status, replayed, _ := stream(ids[len(ids)-2])
+		if status != http.StatusOK || len(replayed) != 1 || replayed[0] != ids[len(ids)-1] {
+			t.Fatalf("Expected the last event only, got %d %v", status, replayed)
+		}
+	}
+	if _, e = jobs.Wait(j.Id); e != nil {
+		t.Fatalf("error %q", e)
+	}
+	if status, _, _ = stream(ids[len(ids)-1]); status != http.StatusNoContent {
+		t.Fatalf("Expected no content after the end, got %d", status)
+	}
+}
+
+func TestJobGrace(t *testing.T) {
+	m, e := NewJobManager("", 1, 50*time.Millisecond)
+	if e != nil {
+		t.Fatalf("error %q", e)
+	}
+	m.running = m.concurrency // keep the jobs queued
+	sets := settings.NewDefaultSettings("grace", "../test")
+	sets.PublishDir = t.TempDir()
+	j, e := m.Submit(sets, true, nil)
+	if e != nil {
+		t.Fatalf("error %q", e)
+	}
+	// a job nobody attached to is left alone
+	time.Sleep(100 * time.Millisecond)
+	if j, _ = m.Get(j.Id); j.State != JOB_QUEUED {
+		t.Fatalf("Expected a queued job, got %s", j.State)
+	}
+	// attaching within the grace period keeps the job
+	if e = m.Attach(j.Id); e != nil {
+		t.Fatalf("error %q", e)
+	}
+	m.Detach(j.Id)
+	if e = m.Attach(j.Id); e != nil {
+		t.Fatalf("error %q", e)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if j, _ = m.Get(j.Id); j.State != JOB_QUEUED {
+		t.Fatalf("Expected a queued job, got %s", j.State)
+	}
+	// the job is cancelled once left for the grace period
+	m.Detach(j.Id)
+	if j, e = m.Wait(j.Id); e != nil || j.State != JOB_CANCELLED {
+		t.Fatalf("Expected a cancelled job, got %+v, %v", j, e)
+	}
+	if e = m.Attach("none"); e != ErrJobNotFound {
+		t.Fatalf("Expected %v, got %v", ErrJobNotFound, e)
+	}
+}
+
+func TestJobOutcome(t *testing.T) {
+	m, e := NewJobManager("", 1, 0)
+	if e != nil {
+		t.Fatalf("error %q", e)
+	}
+	m.running = m.concurrency // keep the jobs queued
+	sets := settings.NewDefaultSettings("", "../test")
+	sets.PublishDir = t.TempDir()
+	coll := filepath.Join(sets.PublishDir, "coll")
+	os.Mkdir(coll, 0755)
+	for _, c := range []struct {
+		action string
+		r      imageconvert.Report
+		state  string
+	}{
+		{imageconvert.ACTION_PUBLISH, imageconvert.Report{Uploaded: 3}, JOB_DONE},
+		{imageconvert.ACTION_REGENERATE, imageconvert.Report{Images: 2, Failed: 1}, JOB_DONE},
+		{imageconvert.ACTION_REGENERATE, imageconvert.Report{Images: 2, Failed: 2}, JOB_FAILED},
+	} {
+		j, e := m.SubmitAction(sets, c.action, coll, settings.RENDITION_THUMBNAIL)
+		if e != nil {
+			t.Fatalf("error %q", e)
+		}
+		m.mu.Lock()
+		job, _ := m.find(j.Id)
+		m.running++ // as start does
+		m.mu.Unlock()
+		m.finish(job, c.r, nil)
+		if j, _ = m.Get(j.Id); j.State != c.state {
+			t.Fatalf("%s with %+v: expected %s, got %s %q", c.action, c.r, c.state, j.State, j.Error)
+		}
+	}
+}
+
+func TestSocketAttach(t *testing.T) {
+	var e error
+	if jobs, e = NewJobManager("", 1, time.Minute); e != nil {
+		t.Fatalf("error %q", e)
+	}
+	sets := settings.NewDefaultSettings("attach", "../test")
+	sets.PublishDir = t.TempDir()
+	j, e := jobs.Submit(sets, true, nil)
+	if e != nil {
+		t.Fatalf("error %q", e)
+	}
+	if _, e = jobs.Wait(j.Id); e != nil {
+		t.Fatalf("error %q", e)
+	}
+
+	srv := httptest.NewServer(websocketHandler)
+	defer srv.Close()
+	ws, e := websocket.Dial("ws"+srv.URL[4:], "", srv.URL)
+	if e != nil {
+		t.Fatalf("error %q", e)
+	}
+	defer ws.Close()
+	enc, dec := json.NewEncoder(ws), json.NewDecoder(ws)
+
+	// a client reattaching gets the job and the events it has missed
+	if e = enc.Encode(&socketMessage{Message: imageconvert.Message{Id: "p1", Kind: "attach", Body: j.Id}}); e != nil {
+		t.Fatalf("error %q", e)
+	}
+	var kinds []string
+	for len(kinds) == 0 || kinds[len(kinds)-1] != "end" {
+		var m socketMessage
+		if e = dec.Decode(&m); e != nil {
+			t.Fatalf("error %q", e)
+		}
+		if m.Id != "p1" {
+			t.Fatalf("Unexpected message %+v", m)
+		}
+		if m.Kind == "job" && (m.Job == nil || m.Job.Id != j.Id) {
+			t.Fatalf("Unexpected job reply %+v", m)
+		}
+		kinds = append(kinds, m.Kind)
+	}
+	if kinds[0] != "job" || len(kinds) < 2 {
+		t.Fatalf("Unexpected messages %v", kinds)
+	}
+
+	// the job has ended, it is not listed
+	if e = enc.Encode(&socketMessage{Message: imageconvert.Message{Id: "l", Kind: "list"}}); e != nil {
+		t.Fatalf("error %q", e)
+	}
+	var m socketMessage
+	if e = dec.Decode(&m); e != nil || m.Kind != "list" || len(m.Jobs) != 0 {
+		t.Fatalf("Unexpected list %+v, %v", m, e)
+	}
+}
+
+func TestAuth(t *testing.T) {
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	serve := func(a *authenticator, r *http.Request) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		a.wrap(ok).ServeHTTP(w, r)
+		return w
+	}
+	sets := settings.NewDefaultSettings("", "../test")
+
+	// token
+	sets.WebAuth = settings.AUTH_TOKEN
+	if _, e := newAuthenticator(sets); e == nil {
+		t.Fatalf("A token should be required")
+	}
+	sets.WebToken = "secret"
+	a, e := newAuthenticator(sets)
+	if e != nil {
+		t.Fatalf("error %q", e)
+	}
+	if w := serve(a, httptest.NewRequest("GET", "/", nil)); w.Code != http.StatusUnauthorized {
+		t.Fatalf("Expected %d, got %d", http.StatusUnauthorized, w.Code)
+	}
+	r := httptest.NewRequest("POST", API_PREFIX+"/jobs", nil)
+	r.Header.Set("Authorization", "Bearer secret")
+	r.Header.Set("Origin", "http://example.com")
+	if w := serve(a, r); w.Code != http.StatusOK {
+		t.Fatalf("The bearer token should be enough, got %d", w.Code)
+	}
+	w := serve(a, httptest.NewRequest("GET", "/index.html?token=secret&profile=p", nil))
+	if w.Code != http.StatusSeeOther || w.Header().Get("Location") != "/index.html?profile=p" {
+		t.Fatalf("Expected a redirect without the token, got %d %s", w.Code, w.Header().Get("Location"))
+	}
+	session := w.Result().Cookies()[0]
+	r = httptest.NewRequest("GET", "/index.html", nil)
+	r.AddCookie(session)
+	if w = serve(a, r); w.Code != http.StatusOK {
+		t.Fatalf("The session should be enough, got %d", w.Code)
+	}
+
+	// the POSTs of the browsers need the CSRF token
+	csrf := &http.Cookie{Name: CSRF_COOKIE, Value: "c"}
+	post := func(origin, header string) int {
+		r := httptest.NewRequest("POST", "/jobs/cancel", nil)
+		r.AddCookie(session)
+		r.AddCookie(csrf)
+		if len(origin) > 0 {
+			r.Header.Set("Origin", origin)
+		}
+		if len(header) > 0 {
+			r.Header.Set(CSRF_HEADER, header)
+		}
+		return serve(a, r).Code
+	}
+	if code := post("http://example.com", ""); code != http.StatusForbidden {
+		t.Fatalf("Expected %d, got %d", http.StatusForbidden, code)
+	}
+	if code := post("http://example.com", "x"); code != http.StatusForbidden {
+		t.Fatalf("Expected %d, got %d", http.StatusForbidden, code)
+	}
+	if code := post("http://example.com", "c"); code != http.StatusOK {
+		t.Fatalf("Expected %d, got %d", http.StatusOK, code)
+	}
+	if code := post("", ""); code != http.StatusOK {
+		t.Fatalf("Expected %d without origin, got %d", http.StatusOK, code)
+	}
+	// so the legacy handlers changing the state refuse the GETs
+	w = httptest.NewRecorder()
+	postOnly(wrapHandler(stopCompressing)).ServeHTTP(w, httptest.NewRequest("GET", "/cancel", nil))
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Fatalf("Expected %d, got %d", http.StatusMethodNotAllowed, w.Code)
+	}
+	w = httptest.NewRecorder()
+	postOnly(wrapHandler(stopCompressing)).ServeHTTP(w, httptest.NewRequest("POST", "/cancel", nil))
+	var resp Response
+	if json.NewDecoder(w.Body).Decode(&resp) != nil || len(resp.Errors) == 0 {
+		t.Fatalf("Nothing should be cancelled without a compression running, got %s", w.Body)
+	}
+
+	// basic
+	hash, _ := bcrypt.GenerateFromPassword([]byte("pw"), bcrypt.MinCost)
+	sets.WebAuth, sets.WebUsers = settings.AUTH_BASIC, []string{"anna:" + string(hash)}
+	if a, e = newAuthenticator(sets); e != nil {
+		t.Fatalf("error %q", e)
+	}
+	r = httptest.NewRequest("GET", "/", nil)
+	r.SetBasicAuth("anna", "wrong")
+	if w = serve(a, r); w.Code != http.StatusUnauthorized || len(w.Header().Get("WWW-Authenticate")) == 0 {
+		t.Fatalf("Expected a challenge, got %d", w.Code)
+	}
+	r.SetBasicAuth("anna", "pw")
+	if w = serve(a, r); w.Code != http.StatusOK {
+		t.Fatalf("Expected %d, got %d", http.StatusOK, w.Code)
+	}
+
+	// the launch token works once
+	sets.WebAuth = settings.AUTH_LAUNCH
+	if a, e = newAuthenticator(sets); e != nil {
+		t.Fatalf("error %q", e)
+	}
+	u, _ := url.Parse(a.launchURL("127.0.0.1:1234"))
+	if w = serve(a, httptest.NewRequest("GET", u.RequestURI(), nil)); w.Code != http.StatusSeeOther {
+		t.Fatalf("Expected a redirect, got %d", w.Code)
+	}
+	if w = serve(a, httptest.NewRequest("GET", u.RequestURI(), nil)); w.Code != http.StatusUnauthorized {
+		t.Fatalf("The launch token should work once, got %d", w.Code)
+	}
+
+	// the websocket refuses the other sites
+	srv := httptest.NewServer(websocketHandler)
+	defer srv.Close()
+	if _, e = websocket.Dial("ws"+srv.URL[4:], "", "http://example.com"); e == nil {
+		t.Fatalf("The websocket of another origin should be refused")
+	}
+}
+
+func TestFolders(t *testing.T) {
+	root, outside := t.TempDir(), t.TempDir()
+	shoot := filepath.Join(root, "shoot")
+	if e := os.Mkdir(shoot, 0755); e != nil {
+		t.Fatalf("error %q", e)
+	}
+	f, e := os.Create(filepath.Join(shoot, "a.png"))
+	if e != nil {
+		t.Fatalf("error %q", e)
+	}
+	png.Encode(f, image.NewRGBA(image.Rect(0, 0, 400, 200)))
+	f.Close()
+	os.WriteFile(filepath.Join(shoot, "b.nef"), []byte("raw"), 0644)
+	os.Symlink(outside, filepath.Join(root, "link"))
+	webSettings = settings.NewDefaultSettings("", root)
+	webSettings.WebRoots = []string{root}
+
+	srv := httptest.NewServer(apiHandler())
+	defer srv.Close()
+	get := func(path string, status int, v interface{}) *http.Response {
+		resp, err := http.Get(srv.URL + API_PREFIX + path)
+		if err != nil {
+			t.Fatalf("error %q", err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != status {
+			t.Fatalf("GET %s: expected status %d, got %d", path, status, resp.StatusCode)
+		}
+		if v != nil {
+			if err = json.NewDecoder(resp.Body).Decode(v); err != nil {
+				t.Fatalf("error %q", err)
+			}
+		}
+		return resp
+	}
+
+	var roots []*imageconvert.Folder
+	get("/folders", http.StatusOK, &roots)
+	if len(roots) != 1 {
+		t.Fatalf("Unexpected roots %+v", roots)
+	}
+	var l FolderListing
+	get("/folders?path="+url.QueryEscape(roots[0].Path), http.StatusOK, &l)
+	if len(l.Folders) != 1 || l.Folders[0].Name != "shoot" || l.Folders[0].Images != 2 || l.Parent != "" {
+		t.Fatalf("Unexpected listing %+v", l)
+	}
+	get("/folders?path="+url.QueryEscape(l.Folders[0].Path), http.StatusOK, &l)
+	if len(l.Images) != 2 || l.Parent != roots[0].Path {
+		t.Fatalf("Unexpected listing %+v", l)
+	}
+
+	// never outside of the roots, the symbolic links are not followed out of them
+	var apiErr APIError
+	for _, p := range []string{outside, filepath.Join(root, ".."), filepath.Join(root, "link"), "shoot"} {
+		get("/folders?path="+url.QueryEscape(p), http.StatusForbidden, &apiErr)
+	}
+	get("/folders?path="+url.QueryEscape(filepath.Join(root, "none")), http.StatusNotFound, &apiErr)
+	// out of the roots, whether the path exists is not told
+	get("/folders?path="+url.QueryEscape(filepath.Join(outside, "none")), http.StatusForbidden, &apiErr)
+
+	resp := get("/thumbnail?size=100&path="+url.QueryEscape(filepath.Join(shoot, "a.png")), http.StatusOK, nil)
+	if resp.Header.Get("Content-Type") != "image/jpeg" {
+		t.Fatalf("Unexpected thumbnail %s", resp.Header.Get("Content-Type"))
+	}
+	get("/thumbnail?path="+url.QueryEscape(filepath.Join(shoot, "b.nef")), http.StatusUnsupportedMediaType, &apiErr)
+	// the size of a huge image is read, the image is not decoded
+	var buf bytes.Buffer
+	png.Encode(&buf, image.NewGray(image.Rect(0, 0, 1, 1)))
+	huge := buf.Bytes()
+	binary.BigEndian.PutUint32(huge[16:], 40000)
+	binary.BigEndian.PutUint32(huge[20:], 40000)
+	binary.BigEndian.PutUint32(huge[29:], crc32.ChecksumIEEE(huge[12:29]))
+	os.WriteFile(filepath.Join(shoot, "huge.png"), huge, 0644)
+	get("/thumbnail?path="+url.QueryEscape(filepath.Join(shoot, "huge.png")), http.StatusUnsupportedMediaType, &apiErr)
+	if !strings.Contains(apiErr.Error, "too large") {
+		t.Fatalf("Unexpected error %q", apiErr.Error)
+	}
+	get("/thumbnail?size=0&path="+url.QueryEscape(filepath.Join(shoot, "a.png")), http.StatusBadRequest, &apiErr)
+	get("/thumbnail?path="+url.QueryEscape(filepath.Join(root, "link", "x.png")), http.StatusNotFound, &apiErr)
+}
+
+func TestUploads(t *testing.T) {
+	var e error
+	if jobs, e = NewJobManager("", 1, 0); e != nil {
+		t.Fatalf("error %q", e)
+	}
+	if staging, e = NewStagingArea(t.TempDir(), 10, 16); e != nil {
+		t.Fatalf("error %q", e)
+	}
+	srv := httptest.NewServer(apiHandler())
+	defer srv.Close()
+	call := func(method, path, body, contentRange string, status int, v interface{}) {
+		req, _ := http.NewRequest(method, srv.URL+API_PREFIX+path, strings.NewReader(body))
+		if len(contentRange) > 0 {
+			req.Header.Set("Content-Range", contentRange)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("error %q", err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != status {
+			t.Fatalf("%s %s: expected status %d, got %d", method, path, status, resp.StatusCode)
+		}
+		if v != nil {
+			if err = json.NewDecoder(resp.Body).Decode(v); err != nil {
+				t.Fatalf("error %q", err)
+			}
+		}
+	}
+
+	var st Staging
+	call("POST", "/uploads", "", "", http.StatusCreated, &st)
+	files := "/uploads/" + st.Id + "/files/"
+	var f StagedFile
+	call("PUT", files+"a.jpg", "0123", "bytes 0-3/8", http.StatusOK, &f)
+	if f.Received != 4 || f.Complete {
+		t.Fatalf("Unexpected file %+v", f)
+	}
+
+	// a chunk out of place tells where to resume
+	var conflict struct {
+		APIError
+		File *StagedFile `json:"file"`
+	}
+	call("PUT", files+"a.jpg", "0123", "bytes 0-3/8", http.StatusConflict, &conflict)
+	if conflict.File == nil || conflict.File.Received != 4 {
+		t.Fatalf("Unexpected conflict %+v", conflict)
+	}
+	var apiErr APIError
+	sets := settings.NewDefaultSettings("upload", "../test")
+	data, _ := json.Marshal(sets)
+	call("POST", "/jobs?upload="+st.Id, string(data), "", http.StatusConflict, &apiErr)
+
+	// a chunk of another length than its range is dropped
+	call("PUT", files+"a.jpg", "45", "bytes 4-7/8", http.StatusBadRequest, &apiErr)
+	for _, chunk := range []string{"45", "456789"} {
+		var uploadErr *UploadError
+		if _, e = staging.Write(st.Id, "a.jpg", 4, 4, 8, strings.NewReader(chunk)); !errors.As(e, &uploadErr) || uploadErr.Status != http.StatusBadRequest {
+			t.Fatalf("The chunk %q should be refused, got %v", chunk, e)
+		}
+	}
+
+	call("PUT", files+"a.jpg", "4567", "bytes 4-7/8", http.StatusOK, &f)
+	if f.Received != 8 || !f.Complete {
+		t.Fatalf("Unexpected file %+v", f)
+	}
+	// the images of an upload are limited as a whole
+	call("PUT", files+"e.jpg", "0123", "bytes 0-3/9", http.StatusRequestEntityTooLarge, &apiErr)
+	call("PUT", files+"b.txt", "text", "", http.StatusUnsupportedMediaType, &apiErr)
+	call("PUT", files+"c.jpg", "0123", "bytes 0-3/11", http.StatusRequestEntityTooLarge, &apiErr)
+	call("PUT", files+".hidden.jpg", "0123", "", http.StatusBadRequest, &apiErr)
+	call("PUT", files+"d.jpg", "0123", "bytes 3-1/4", http.StatusBadRequest, &apiErr)
+	call("PUT", "/uploads/none/files/a.jpg", "0123", "", http.StatusNotFound, &apiErr)
+	call("GET", "/uploads/"+st.Id, "", "", http.StatusOK, &st)
+	if len(st.Files) != 1 || !st.Complete() {
+		t.Fatalf("Unexpected upload %+v", st)
+	}
+
+	var j Job
+	call("POST", "/jobs?noUpload=true&upload="+st.Id, string(data), "", http.StatusCreated, &j)
+	if j.Settings.SourceDir != st.Dir {
+		t.Fatalf("Expected the job to convert %s, got %s", st.Dir, j.Settings.SourceDir)
+	}
+	jobs.Wait(j.Id)
+
+	// a job done removes its upload, not the folders out of the staging area
+	cleanStaging(&Job{State: JOB_FAILED, Settings: &settings.Settings{SourceDir: st.Dir}})
+	call("GET", "/uploads/"+st.Id, "", "", http.StatusOK, nil)
+	cleanStaging(&Job{State: JOB_DONE, Settings: &settings.Settings{SourceDir: "../test"}})
+	cleanStaging(&Job{State: JOB_DONE, Settings: &settings.Settings{SourceDir: st.Dir}})
+	call("GET", "/uploads/"+st.Id, "", "", http.StatusNotFound, &apiErr)
+
+	call("POST", "/uploads", "", "", http.StatusCreated, &st)
+	call("DELETE", "/uploads/"+st.Id, "", "", http.StatusNoContent, nil)
+	call("DELETE", "/uploads/"+st.Id, "", "", http.StatusNotFound, &apiErr)
+}
+
+func TestCollections(t *testing.T) {
+	var e error
+	if jobs, e = NewJobManager("", 1, 0); e != nil {
+		t.Fatalf("error %q", e)
+	}
+	publish := t.TempDir()
+	webSettings = settings.NewDefaultSettings("", "../test")
+	webSettings.PublishDir = publish
+	webSettings.CollectionTemplate = "{year}/{first}_{last}_{collname}"
+	high := webSettings.PiwigoGalleryHighDirName
+	coll := filepath.Join(publish, "2012", "20120301_20120304_holidays")
+	for _, fn := range []string{"a.jpg", "thumbnail/TN-a.jpg", high + "/a.jpg"} {
+		os.MkdirAll(filepath.Dir(filepath.Join(coll, fn)), 0755)
+		os.WriteFile(filepath.Join(coll, fn), []byte(fn), 0644)
+	}
+	manifest := `{"collection": "holidays", "images": [{"source": "a.jpg", "renditions": {"image": "a.jpg", "thumbnail": "thumbnail/TN-a.jpg", "original": "` + high + `/a.jpg"}}]}`
+	os.WriteFile(filepath.Join(coll, high, imageconvert.MANIFEST_FILE_NAME), []byte(manifest), 0644)
+
+	srv := httptest.NewServer(apiHandler())
+	defer srv.Close()
+	call := func(method, path string, status int, v interface{}) *http.Response {
+		req, _ := http.NewRequest(method, srv.URL+API_PREFIX+path, nil)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("error %q", err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != status {
+			t.Fatalf("%s %s: expected status %d, got %d", method, path, status, resp.StatusCode)
+		}
+		if v != nil {
+			if err = json.NewDecoder(resp.Body).Decode(v); err != nil {
+				t.Fatalf("error %q", err)
+			}
+		}
+		return resp
+	}
+
+	var l []*imageconvert.Collection
+	call("GET", "/collections", http.StatusOK, &l)
+	if len(l) != 1 || l[0].Name != "2012/20120301_20120304_holidays" || l[0].Title != "holidays" || l[0].First == nil || l[0].First.Day() != 1 || l[0].Last.Day() != 4 {
+		t.Fatalf("Unexpected collections %+v", l)
+	}
+	name := "/collections/" + url.PathEscape(l[0].Name)
+	var d CollectionDetail
+	call("GET", name, http.StatusOK, &d)
+	if len(d.Manifest.Images) != 1 || d.Renditions[settings.RENDITION_THUMBNAIL] != 1 || d.Renditions[settings.RENDITION_ORIGINAL] != 1 {
+		t.Fatalf("Unexpected collection %+v", d)
+	}
+	var apiErr APIError
+	call("GET", "/collections/"+url.PathEscape("2012/../2012/20120301_20120304_holidays"), http.StatusNotFound, &apiErr)
+	call("GET", "/collections/2012", http.StatusNotFound, &apiErr)
+	// the publish folder itself is never a collection, even holding images
+	os.WriteFile(filepath.Join(publish, "loose.jpg"), []byte("loose"), 0644)
+	for _, p := range []string{"/collections/%2E", "/collections/%2E%2F2012"} {
+		call("DELETE", p, http.StatusNotFound, &apiErr)
+	}
+	if _, e = os.Stat(filepath.Join(publish, "loose.jpg")); e != nil {
+		t.Fatalf("The publish folder should be left alone, got %v", e)
+	}
+	call("GET", name+"/files/thumbnail/TN-a.jpg", http.StatusOK, nil)
+	call("GET", name+"/files/"+url.PathEscape("../a.jpg"), http.StatusBadRequest, &apiErr)
+	call("GET", name+"/files/none.jpg", http.StatusNotFound, &apiErr)
+
+	resp := call("GET", name+"/archive", http.StatusOK, nil)
+	if resp.Header.Get("Content-Type") != "application/zip" || !strings.Contains(resp.Header.Get("Content-Disposition"), "20120301_20120304_holidays.zip") {
+		t.Fatalf("Unexpected archive %v", resp.Header)
+	}
+
+	call("POST", name+"/regenerate?rendition=original", http.StatusBadRequest, &apiErr)
+	var j Job
+	call("POST", name+"/regenerate?rendition=thumbnail", http.StatusCreated, &j)
+	if j.Action != imageconvert.ACTION_REGENERATE || j.Collection != coll || j.Rendition != settings.RENDITION_THUMBNAIL {
+		t.Fatalf("Unexpected job %+v", j)
+	}
+	jobs.Wait(j.Id)
+
+	// a running job writing to or reading from the collection keeps it
+	busy := &Job{Id: "busy", State: JOB_RUNNING, Settings: settings.NewDefaultSettings("busy", t.TempDir()), PublishFolder: coll}
+	jobs.mu.Lock()
+	jobs.jobs = append(jobs.jobs, busy)
+	jobs.mu.Unlock()
+	call("DELETE", name, http.StatusConflict, &apiErr)
+	jobs.mu.Lock()
+	busy.PublishFolder, busy.Settings.SourceDir = "", filepath.Join(coll, "thumbnail")
+	jobs.mu.Unlock()
+	call("DELETE", name, http.StatusConflict, &apiErr)
+	jobs.mu.Lock()
+	busy.State = JOB_DONE
+	jobs.mu.Unlock()
+
+	call("DELETE", name, http.StatusNoContent, nil)
+	call("DELETE", name, http.StatusNotFound, &apiErr)
+	if _, e = os.Stat(filepath.Join(publish, "2012")); !os.IsNotExist(e) {
+		t.Fatalf("The empty year folder should be removed, got %v", e)
+	}
+}
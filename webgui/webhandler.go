@@ -9,6 +9,8 @@ import (
 	"io/ioutil"
 	"log"
 	"net/http"
+	"strconv"
+	"strings"
 )
 
 func wrapHandler(processor requestProcessor) func(w http.ResponseWriter, r *http.Request) {
@@ -18,6 +20,7 @@ func wrapHandler(processor requestProcessor) func(w http.ResponseWriter, r *http
 		resp.Eof = eof
 		if err != nil {
 			resp.Errors = []string{err.Error()}
+			resp.Fields = settings.FieldErrors(err)
 		} else {
 			resp.Messages = out
 		}
@@ -36,39 +39,162 @@ func compress(r *http.Request) (msg []string, err error, eof bool) {
 		return
 	}
 	var jsonSettings *settings.Settings
-	fmt.Println("request body: " + string(b))
 	err = json.Unmarshal(b, &jsonSettings)
 	if err != nil {
 		fmt.Println(err)
 		eof = true
 		return
 	}
-	if compressing {
-		return nil, errors.New("Still Compressing\n another folder.\nPlese wait until it has finished."), !compressing
+	if jsonSettings == nil {
+		return nil, errors.New("The settings are missing."), true
 	}
+	savedPassword(jsonSettings)
 
-	compressing = true
-	// launch asynchronously to avoid delays
-	go func() {
-		_, quitChannel, err = launchConversionFromWeb(jsonSettings, logger, &compressing)
-	}()
+	// the job is queued behind the running ones
+	j, err := jobs.Submit(jsonSettings, false, nil)
+	if err != nil {
+		return nil, err, true
+	}
+	compressionMu.Lock()
+	compression = j.Id
+	compressionMu.Unlock()
 
-	return []string{fmt.Sprintf("Compressing\nfolder: %s\nCollection name: %s", jsonSettings.SourceDir, jsonSettings.CollName)}, err, !compressing
+	return []string{fmt.Sprintf("Compressing\nfolder: %s\nCollection name: %s", jsonSettings.SourceDir, jsonSettings.CollName)}, nil, false
+}
+
+// lastCompression returns the job launched last by compress, nil if there is none.
+func lastCompression() *Job {
+	compressionMu.Lock()
+	id := compression
+	compressionMu.Unlock()
+	if len(id) == 0 {
+		return nil
+	}
+	j, err := jobs.Get(id)
+	if err != nil {
+		return nil
+	}
+	return j
 }
 
-func compressStatus(r *http.Request) (msgs []string, err error, eof bool) {
-	newLines := logger.ReadAll()
-	if len(newLines) > 0 {
-		msgs = newLines
+// compressStatus returns the output of the job of the id parameter, the last one launched by
+// compress by default, numbered after the after parameter. The log of the job is not drained,
+// each page keeps the number of the last event it has read.
+func compressStatus(w http.ResponseWriter, r *http.Request) {
+	id := r.FormValue("id")
+	if j := lastCompression(); len(id) == 0 && j != nil {
+		id = j.Id
+	}
+	after, _ := strconv.Atoi(r.FormValue("after"))
+	resp := &Response{Job: id, Last: after}
+	l, ended, _, err := jobs.Follow(id, after)
+	if err != nil {
+		resp.Errors, resp.Eof = []string{err.Error()}, true
+	} else {
+		resp.Eof = ended
+		for _, e := range l {
+			resp.Last = e.Seq
+			switch e.Kind {
+			case "upload":
+			case "end":
+				if len(e.Body) > 0 {
+					resp.Messages = append(resp.Messages, "Error, the conversion failed: "+e.Body)
+				} else {
+					resp.Messages = append(resp.Messages, "The conversion has ended.")
+				}
+			default:
+				resp.Messages = append(resp.Messages, strings.TrimSpace(e.Body))
+			}
+		}
+	}
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		log.Println(err)
 	}
-	return msgs, nil, !compressing
 }
 
 func stopCompressing(r *http.Request) (msgs []string, err error, eof bool) {
-	if !compressing || quitChannel == nil {
-		return nil, errors.New("No compression has been launched yet."), false
+	j := lastCompression()
+	if j == nil || j.ended() {
+		return nil, errors.New("No compression is running."), false
+	}
+
+	go jobs.Cancel(j.Id)
+	return []string{"Stopping the compression"}, nil, false
+}
+
+// postOnly serves the POSTs with h, as the requests changing the state must be checked
+// for CSRF, see checkCSRF.
+func postOnly(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "POST only", http.StatusMethodNotAllowed)
+			return
+		}
+		h(w, r)
+	}
+}
+
+// writeJSON writes v, or the error with the invalid settings if err is not nil.
+func writeJSON(w http.ResponseWriter, v interface{}, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	if err != nil {
+		status := http.StatusBadRequest
+		if err == ErrJobNotFound {
+			status = http.StatusNotFound
+		}
+		w.WriteHeader(status)
+		v = &Response{Errors: []string{err.Error()}, Fields: settings.FieldErrors(err), Eof: true}
+	}
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Println(err)
+	}
+}
+
+// listJobs lists the jobs, or on POST submits the settings of the body as a job,
+// without upload if the noupload parameter is true.
+func listJobs(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSON(w, jobs.List(), nil)
+		return
+	}
+	var s *settings.Settings
+	if err := json.NewDecoder(r.Body).Decode(&s); err != nil {
+		writeJSON(w, nil, fmt.Errorf("Invalid settings: %v", err))
+		return
+	}
+	savedPassword(s)
+	noUpload, _ := strconv.ParseBool(r.FormValue("noupload"))
+	j, err := jobs.Submit(s, noUpload, nil)
+	writeJSON(w, j, err)
+}
+
+// getJob returns the job of the id parameter.
+func getJob(w http.ResponseWriter, r *http.Request) {
+	j, err := jobs.Get(r.FormValue("id"))
+	writeJSON(w, j, err)
+}
+
+// cancelJob cancels the job of the id parameter and returns it.
+func cancelJob(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "POST only", http.StatusMethodNotAllowed)
+		return
 	}
+	id := r.FormValue("id")
+	if err := jobs.Cancel(id); err != nil {
+		writeJSON(w, nil, err)
+		return
+	}
+	j, err := jobs.Get(id)
+	writeJSON(w, j, err)
+}
 
-	quitChannel <- true
-	return []string{"Stopping the compression"}, nil, !compressing
+// retryJob queues again the job of the id parameter and returns it.
+func retryJob(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "POST only", http.StatusMethodNotAllowed)
+		return
+	}
+	j, err := jobs.Retry(r.FormValue("id"), nil)
+	writeJSON(w, j, err)
 }
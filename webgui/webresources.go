@@ -10,6 +10,12 @@ func setVariables() {webresources["index.html"] = `
 <head>
 <meta charset="UTF-8">
 <title>goconvert web</title>
+<style>
+	input.invalid { border: 2px solid maroon; background-color: #fdd; }
+	#folderpicker { border: 1px solid #ccc; padding: 0.5em; margin: 0.5em 0; }
+	#folderlist { list-style: none; padding: 0; max-height: 15em; overflow-y: auto; }
+	#folderpreviews img { width: 80px; height: 80px; object-fit: cover; margin: 2px; }
+</style>
 </head>
 <body>
 	<h1>Viewing index</h1>
@@ -17,14 +23,56 @@ func setVariables() {webresources["index.html"] = `
 	<div>Testing page, port {{.WebPort |html}}</div>
 
 	<h1>Image conversion and upload tool</h1>
+	<section id="profilesection">
+		<label for="profile">Profile</label> <select id="profile" name="profile">
+			<option value="">default</option>
+			{{range .Profiles}}<option value="{{.}}"{{if eq . $.Profile}} selected{{end}}>{{.}}</option>{{end}}
+		</select>
+	</section>
 	<section id="imagefolder">
 		<label for="folder">Image folder</label> <input id="folder"
 			name="folder" type="text" value="" />
+		<button id="folderbrowse" type="button">Browse...</button>
+		<div id="folderpicker" style="display: none">
+			<div id="folderpath"></div>
+			<ul id="folderlist"></ul>
+			<div id="folderpreviews"></div>
+			<div id="foldererror" style="color:maroon"></div>
+			<button id="folderchoose" type="button" disabled>Choose this folder</button>
+		</div>
+		<div id="uploadsection">
+			<label for="uploadfiles">or upload images</label> <input id="uploadfiles"
+				name="uploadfiles" type="file" multiple accept="image/*,.nef,.cr2,.arw,.dng" />
+			<button id="uploadstart" type="button" disabled>Upload</button>
+			<progress id="uploadprogress" value="0" max="1"></progress>
+			<span id="uploadstatus"></span>
+			<div id="uploaderror" style="color:maroon"></div>
+		</div>
 	</section>
 	<section id="collectionname">
 		<label for="collection">Collection name</label> <input id="collection"
 			name="collection" type="text" value="" />
 	</section>
+	<section id="ftpsection">
+		<label for="ftpaddress">FTP address</label> <input id="ftpaddress"
+			name="ftpaddress" type="text" value="" />
+		<label for="ftpusername">FTP user</label> <input id="ftpusername"
+			name="ftpusername" type="text" value="" />
+		<label for="ftppassword">FTP password</label> <input id="ftppassword"
+			name="ftppassword" type="password" value="" />
+		<label for="ftpremotedir">FTP folder</label> <input id="ftpremotedir"
+			name="ftpremotedir" type="text" value="" />
+	</section>
+	<section id="collectionsection">
+		<span>Collections</span> <button id="collectionsrefresh" type="button">Refresh</button>
+		<table id="collections">
+			<thead><tr><th>Collection</th><th>Dates</th><th>Images</th><th>Size</th><th>Modified</th><th></th></tr></thead>
+			<tbody id="collectionlist"></tbody>
+		</table>
+		<div id="collectionstatus"></div>
+		<div id="collectionerror" style="color:maroon"></div>
+		<div id="collectiondetail" style="display: none"></div>
+	</section>
 	<section id="logsection">
 		<span>Output log</span>
 		<div id="outputlog"></div>
@@ -43,12 +91,25 @@ func setVariables() {webresources["index.html"] = `
 			mod.settings =  JSON.parse('{{.SettingsAsJson}}');
 			return mod
 		})(convertModule || {});
+		// the POSTs of the page prove they come from it, see webgui.CSRF_HEADER
+		$.ajaxSetup({headers: {'X-CSRF-Token': '{{.CSRFToken}}'}});
 	
 		$(function(){
 			$('#folder').val(convertModule.settings && convertModule.settings.homeDir);
+			var ftp = (convertModule.settings && convertModule.settings.ftpSettings) || {};
+			$('#ftpaddress').val(ftp.address);
+			$('#ftpusername').val(ftp.username);
+			$('#ftpremotedir').val(ftp.remoteDir);
+			// reload the page with the settings of the selected profile
+			$('#profile').change(function() {
+				window.location.search = this.value ? '?profile=' + encodeURIComponent(this.value) : '';
+			});
 		});
 	</script>
 	
+	<script type="text/javascript" src="scripts/folders.js"></script>
+	<script type="text/javascript" src="scripts/uploads.js"></script>
+	<script type="text/javascript" src="scripts/collections.js"></script>
 	<script type="text/javascript" src="scripts/socket.js"></script>
 	<script type="text/javascript" src="scripts/play.js"></script>
 	
@@ -9507,12 +9568,59 @@ webresources["scripts/play.js"] = `// Copyright 2012 The Go Authors. All rights
     return s;
   }
 
+  // readFtpSettings copies the optional FTP fields of the page into the settings,
+  // an empty address skips the upload.
+  function readFtpSettings(sets) {
+    var ftp = sets.ftpSettings || {};
+    var fields = {address: 'ftpaddress', username: 'ftpusername', password: 'ftppassword', remoteDir: 'ftpremotedir'};
+    for (var k in fields) {
+      var node = document.getElementById(fields[k]);
+      if (node) {
+        ftp[k] = node.value;
+      }
+    }
+    sets.ftpSettings = ftp;
+  }
+
+  // the inputs of the page by JSON path of the settings, see settings.FieldError
+  var fieldInputs = {
+    sourceDir: 'folder',
+    collName: 'collection',
+    'ftpSettings.address': 'ftpaddress',
+    'ftpSettings.username': 'ftpusername',
+    'ftpSettings.password': 'ftppassword',
+    'ftpSettings.remoteDir': 'ftpremotedir'
+  };
+
+  // showFieldErrors marks the inputs of the invalid settings, with the error as tooltip.
+  function showFieldErrors(fields) {
+    clearFieldErrors();
+    for (var i = 0; i < fields.length; i++) {
+      var node = document.getElementById(fieldInputs[fields[i].field]);
+      if (node) {
+        node.classList.add('invalid');
+        node.title = fields[i].message;
+      }
+    }
+  }
+
+  function clearFieldErrors() {
+    var nodes = document.querySelectorAll('.invalid');
+    for (var i = 0; i < nodes.length; i++) {
+      nodes[i].classList.remove('invalid');
+      nodes[i].title = '';
+    }
+  }
+
   function init(code, folderNode, collectionNode) {
     var id = getId();
 
     var output = document.createElement('div');
     var outpre = document.createElement('pre');
     var stopFunc;
+    outpre.addEventListener("fielderrors", function(e) {
+      showFieldErrors(e.detail);
+    }, false);
 
     /*
     $(output).resizable({
@@ -9535,9 +9643,11 @@ webresources["scripts/play.js"] = `// Copyright 2012 The Go Authors. All rights
       outpre.innerHTML = "";
       output.style.display = "block";
       run.style.display = "none";
+      clearFieldErrors();
       var sets = module.settings;
       sets.collName = collectionNode.value;
       sets.sourceDir = folderNode.value;
+      readFtpSettings(sets);
       var options = {settings: sets};
       stopFunc = runFunc("", outpre, options);
     }
@@ -9609,12 +9719,33 @@ webresources["scripts/socket.js"] = `// Copyright 2012 The Go Authors. All right
 (function() {
   "use strict";
 
-  var websocket, outputs = {};
+  var websocket, addr, outputs = {};
+  // the job followed by each output and the number of its last event,
+  // to attach again to the jobs still running after a reconnection
+  var following = {};
 
   function onClose() {
+    for (var id in following) {
+      // the jobs outlive the connection for a while, reconnect and attach to them
+      setTimeout(connect, 2000);
+      return;
+    }
     window.alert('websocket connection closed');
   }
 
+  function onOpen() {
+    for (var id in following) {
+      sendMessage({Id: id, Kind: "attach", Body: following[id].job, Seq: following[id].seq});
+    }
+  }
+
+  function connect() {
+    websocket = new WebSocket(addr);
+    websocket.onopen = onOpen;
+    websocket.onmessage = onMessage;
+    websocket.onclose = onClose;
+  }
+
   function sendMessage(m) {
     websocket.send(JSON.stringify(m));
   }
@@ -9622,13 +9753,33 @@ webresources["scripts/socket.js"] = `// Copyright 2012 The Go Authors. All right
   function onMessage(e) {
     var m = JSON.parse(e.data);
     var o = outputs[m.Id];
-    if (o === null) {
+    if (!o) {
       return;
     }
+    if (m.Kind === "job" && m.Job) {
+      if (!following[m.Id] || following[m.Id].job !== m.Job.id) {
+        following[m.Id] = {job: m.Job.id, seq: 0};
+      }
+    } else if (m.Kind === "job" && following[m.Id]) {
+      // the job is gone, e.g. after a restart of the server
+      delete following[m.Id];
+      showMessage(o, m.Body + "\n", "system");
+    }
+    if (m.Seq && following[m.Id]) {
+      following[m.Id].seq = m.Seq;
+    }
     if (m.Kind === "stdout" || m.Kind === "stderr") {
       showMessage(o, m.Body, m.Kind);
     }
+    if (m.Kind === "upload") {
+      showProgress(o, m.Body, m.Progress);
+    }
     if (m.Kind === "end") {
+      delete following[m.Id];
+      if (m.Fields) {
+        // the settings were refused, let the page highlight them
+        o.dispatchEvent(new CustomEvent("fielderrors", {detail: m.Fields}));
+      }
       var s = "Program exited";
       if (m.Body !== "") {
         s += ": " + m.Body;
@@ -9659,6 +9810,23 @@ webresources["scripts/socket.js"] = `// Copyright 2012 The Go Authors. All right
         o.scrollTop = o.scrollHeight - o.offsetHeight;
   }
 
+  // showProgress keeps a single line per uploaded file and rewrites it
+  // until the file has been transferred.
+  function showProgress(o, m, p) {
+    var span = o.uploadSpan;
+    if (!span) {
+      span = document.createElement("span");
+      span.className = "upload";
+      o.appendChild(span);
+      o.uploadSpan = span;
+    }
+    span.textContent = m;
+    if (!p || p.bytes >= p.size) {
+      o.uploadSpan = null;
+    }
+    o.scrollTop = o.scrollHeight - o.offsetHeight;
+  }
+
   function run(body, output, options) {
     var id = output.id;
     outputs[id] = output;
@@ -9670,13 +9838,414 @@ webresources["scripts/socket.js"] = `// Copyright 2012 The Go Authors. All right
     };
   }
 
-  window.connectPlayground = function(addr) {
-    websocket = new WebSocket(addr);
-    websocket.onmessage = onMessage;
-    websocket.onclose = onClose;
+  window.connectPlayground = function(a) {
+    addr = a;
+    connect();
     return run;
   };
 })();
 `
+webresources["scripts/folders.js"] = `// The folder picker of the image folder: it browses the folders the server allows,
+// see the /api/v1/folders and /api/v1/thumbnail requests, and previews their images.
+(function() {
+  "use strict";
+
+  var api = "/api/v1";
+  var maxPreviews = 24;
+
+  function thumbnailURL(path) {
+    return api + "/thumbnail?path=" + encodeURIComponent(path);
+  }
+
+  function joinPath(dir, name) {
+    var sep = dir.indexOf("\\") >= 0 ? "\\" : "/";
+    return dir.charAt(dir.length - 1) === sep ? dir + name : dir + sep + name;
+  }
+
+  function folderItem(f, onOpen) {
+    var li = $('<li class="folder"></li>');
+    $('<a href="#"></a>').text(f.name + " (" + f.images + ")").attr("title", f.path).click(function(e) {
+      e.preventDefault();
+      onOpen(f.path);
+    }).appendTo(li);
+    return li;
+  }
+
+  $(function() {
+    var picker = $("#folderpicker"), current = $("#folderpath"), list = $("#folderlist"),
+        previews = $("#folderpreviews"), choose = $("#folderchoose"), error = $("#foldererror");
+    var path = "";
+
+    function fail(xhr) {
+      var msg = (xhr.responseJSON && xhr.responseJSON.error) || xhr.statusText;
+      error.text(msg);
+    }
+
+    function showRoots() {
+      path = "";
+      current.text("Folders");
+      choose.prop("disabled", true);
+      previews.empty();
+      error.empty();
+      $.getJSON(api + "/folders").done(function(roots) {
+        list.empty();
+        $.each(roots, function(i, f) {
+          list.append(folderItem(f, open));
+        });
+        if (roots.length === 0) {
+          error.text("No folder can be browsed, see the web-roots setting.");
+        }
+      }).fail(fail);
+    }
+
+    function open(p) {
+      error.empty();
+      $.getJSON(api + "/folders", {path: p}).done(function(l) {
+        path = l.path;
+        current.text(l.path);
+        choose.prop("disabled", false);
+        list.empty();
+        $('<li class="parent"></li>').append($('<a href="#">..</a>').click(function(e) {
+          e.preventDefault();
+          if (l.parent) {
+            open(l.parent);
+          } else {
+            showRoots();
+          }
+        })).appendTo(list);
+        $.each(l.folders, function(i, f) {
+          list.append(folderItem(f, open));
+        });
+        previews.empty();
+        $.each(l.images.slice(0, maxPreviews), function(i, name) {
+          $('<img loading="lazy">').attr({src: thumbnailURL(joinPath(l.path, name)), alt: name, title: name}).appendTo(previews);
+        });
+        if (l.images.length > maxPreviews) {
+          $('<span></span>').text("and " + (l.images.length - maxPreviews) + " more images").appendTo(previews);
+        }
+      }).fail(fail);
+    }
+
+    $("#folderbrowse").click(function() {
+      picker.toggle();
+      if (picker.is(":visible")) {
+        var p = $("#folder").val();
+        if (p) {
+          $.getJSON(api + "/folders", {path: p}).done(function() {
+            open(p);
+          }).fail(showRoots);
+        } else {
+          showRoots();
+        }
+      }
+    });
+    choose.click(function() {
+      if (path) {
+        $("#folder").val(path).removeClass("invalid");
+        picker.hide();
+      }
+    });
+  });
+})();
+`
+webresources["scripts/uploads.js"] = `// The upload of images from the browser: the files chosen are sent in chunks to a staging
+// folder of the server, see the /api/v1/uploads requests, which becomes the image folder.
+// A chunk which fails is resumed from the bytes the server has received.
+(function() {
+  "use strict";
+
+  var api = "/api/v1";
+  var chunkSize = 1 << 20;
+  var retries = 5;
+
+  function errorText(xhr) {
+    return (xhr.responseJSON && xhr.responseJSON.error) || xhr.statusText || "connection lost";
+  }
+
+  // sendFile uploads file from offset into the upload id, calling progress with the bytes sent.
+  function sendFile(id, file, offset, progress) {
+    var d = $.Deferred(), failures = 0;
+    var url = api + "/uploads/" + encodeURIComponent(id) + "/files/" + encodeURIComponent(file.name);
+
+    function resume() {
+      // ask the server where the file stops, the chunk may have been partly received
+      $.getJSON(api + "/uploads/" + encodeURIComponent(id)).done(function(st) {
+        var at = 0;
+        $.each(st.files, function(i, f) {
+          if (f.name === file.name) {
+            at = f.received;
+          }
+        });
+        send(at);
+      }).fail(function(xhr) {
+        d.reject(errorText(xhr));
+      });
+    }
+
+    function send(start) {
+      progress(start);
+      if (start >= file.size && file.size > 0) {
+        d.resolve();
+        return;
+      }
+      var end = Math.min(start + chunkSize, file.size);
+      // an empty file has no range
+      var headers = end > start ? {"Content-Range": "bytes " + start + "-" + (end - 1) + "/" + file.size} : {};
+      $.ajax(url, {
+        type: "PUT",
+        data: file.slice(start, end),
+        processData: false,
+        contentType: "application/octet-stream",
+        headers: headers,
+        dataType: "json"
+      }).done(function(f) {
+        failures = 0;
+        if (f.complete) {
+          progress(file.size);
+          d.resolve();
+        } else {
+          send(f.received);
+        }
+      }).fail(function(xhr) {
+        if (xhr.status === 409 && xhr.responseJSON && xhr.responseJSON.file && !xhr.responseJSON.file.complete) {
+          send(xhr.responseJSON.file.received);
+        } else if (xhr.status === 0 && ++failures <= retries) {
+          setTimeout(resume, 1000 * failures);
+        } else {
+          d.reject(errorText(xhr));
+        }
+      });
+    }
+
+    send(offset);
+    return d.promise();
+  }
+
+  $(function() {
+    var input = $("#uploadfiles"), button = $("#uploadstart"), status = $("#uploadstatus"),
+        bar = $("#uploadprogress"), error = $("#uploaderror");
+    var upload = null; // the staging of the files chosen, kept to resume
+
+    input.change(function() {
+      upload = null;
+      error.empty();
+      status.empty();
+      bar.val(0);
+      button.prop("disabled", this.files.length === 0);
+    });
+
+    button.click(function() {
+      var files = $.makeArray(input[0].files);
+      if (files.length === 0) {
+        return;
+      }
+      var total = 0, done = 0;
+      $.each(files, function(i, f) {
+        total += f.size;
+      });
+      bar.attr("max", total || 1);
+      button.prop("disabled", true);
+      error.empty();
+
+      function next(i, received) {
+        if (i === files.length) {
+          status.text(files.length + " images uploaded");
+          $("#folder").val(upload.dir).removeClass("invalid");
+          button.prop("disabled", false).text("Upload");
+          return;
+        }
+        var f = files[i];
+        sendFile(upload.id, f, received[f.name] || 0, function(sent) {
+          status.text("Uploading " + f.name + " (" + (i + 1) + "/" + files.length + ")");
+          bar.val(done + sent);
+        }).done(function() {
+          done += f.size;
+          next(i + 1, received);
+        }).fail(function(msg) {
+          error.text(f.name + ": " + msg);
+          button.prop("disabled", false).text("Resume upload");
+        });
+      }
+
+      var started = upload ? $.getJSON(api + "/uploads/" + encodeURIComponent(upload.id)) : $.post(api + "/uploads", null, null, "json");
+      started.done(function(st) {
+        upload = st;
+        var received = {};
+        $.each(st.files, function(i, f) {
+          received[f.name] = f.received;
+        });
+        done = 0;
+        next(0, received);
+      }).fail(function(xhr) {
+        upload = null;
+        error.text(errorText(xhr));
+        button.prop("disabled", false);
+      });
+    });
+  });
+})();
+`
+webresources["scripts/collections.js"] = `// The collection browser: it lists the collections of the publish folder of the profile,
+// shows the renditions of their manifest and runs their actions, see the
+// /api/v1/collections requests. The jobs of the actions are followed by their event stream.
+(function() {
+  "use strict";
+
+  var api = "/api/v1";
+  var maxPreviews = 24;
+
+  // profileQuery returns the query of the profile of the page with the params.
+  function profileQuery(params) {
+    var q = $.extend({}, params);
+    if ($("#profile").val()) {
+      q.profile = $("#profile").val();
+    }
+    return $.isEmptyObject(q) ? "" : "?" + $.param(q);
+  }
+
+  // collectionURL returns the URL of the collection, its name may hold slashes.
+  function collectionURL(name, suffix) {
+    return api + "/collections/" + encodeURIComponent(name) + (suffix || "");
+  }
+
+  function fileURL(name, file) {
+    return collectionURL(name, "/files/" + file.split("/").map(encodeURIComponent).join("/")) + profileQuery();
+  }
+
+  function formatDate(s) {
+    return s ? s.substring(0, 10) : "";
+  }
+
+  function formatSize(b) {
+    var units = ["B", "KB", "MB", "GB"], i = 0;
+    while (b >= 1024 && i < units.length - 1) {
+      b /= 1024;
+      i++;
+    }
+    return b.toFixed(i ? 1 : 0) + " " + units[i];
+  }
+
+  $(function() {
+    var table = $("#collectionlist"), detail = $("#collectiondetail"), error = $("#collectionerror"),
+        status = $("#collectionstatus");
+
+    function fail(xhr) {
+      error.text((xhr.responseJSON && xhr.responseJSON.error) || xhr.statusText);
+    }
+
+    // follow writes the events of the job of an action until it ends.
+    function follow(job, what) {
+      status.text(what + ": queued");
+      if (!window.EventSource) {
+        return;
+      }
+      var source = new EventSource(api + "/jobs/" + encodeURIComponent(job.id) + "/stream");
+      var last = function(e) {
+        var ev = JSON.parse(e.data);
+        if (ev.body) {
+          status.text(what + ": " + ev.body);
+        }
+      };
+      $.each(["stdout", "stderr", "upload"], function(i, kind) {
+        source.addEventListener(kind, last);
+      });
+      source.addEventListener("end", function(e) {
+        var ev = JSON.parse(e.data);
+        status.text(what + ": " + (ev.body ? "failed, " + ev.body : "done"));
+        source.close();
+        load();
+      });
+      source.onerror = function() {
+        source.close();
+      };
+    }
+
+    function action(c, path, params, what) {
+      error.empty();
+      $.post(collectionURL(c.name, path) + profileQuery(params), null, null, "json").done(function(job) {
+        follow(job, what + " " + c.name);
+      }).fail(fail);
+    }
+
+    function show(c) {
+      error.empty();
+      $.getJSON(collectionURL(c.name) + profileQuery()).done(function(d) {
+        detail.empty().show();
+        $("<h3></h3>").text(d.name).appendTo(detail);
+        var counts = $.map(d.renditions, function(n, r) {
+          return r + ": " + n;
+        });
+        $("<div></div>").text(d.manifest.images.length + " images in the manifest" + (counts.length ? ", " + counts.join(", ") : "")).appendTo(detail);
+        var previews = $("<div class=\"previews\"></div>").appendTo(detail);
+        $.each(d.manifest.images.slice(0, maxPreviews), function(i, e) {
+          var file = e.renditions.thumbnail || e.renditions.image;
+          if (file) {
+            $('<img loading="lazy">').attr({src: fileURL(d.name, file), alt: e.source, title: e.source}).appendTo(previews);
+          }
+        });
+        var files = $("<ul></ul>").appendTo(detail);
+        $.each(d.manifest.images, function(i, e) {
+          var li = $("<li></li>").text(e.source + ": ").appendTo(files);
+          $.each(e.renditions, function(r, file) {
+            $("<a></a>").attr({href: fileURL(d.name, file), target: "_blank"}).text(r).appendTo(li);
+            li.append(" ");
+          });
+        });
+        if (d.manifest.images.length === 0) {
+          $("<div></div>").text("No manifest, the renditions can not be regenerated.").appendTo(detail);
+        }
+      }).fail(fail);
+    }
+
+    function row(c) {
+      var tr = $("<tr></tr>");
+      $("<td></td>").append($('<a href="#"></a>').text(c.name).click(function(e) {
+        e.preventDefault();
+        show(c);
+      })).appendTo(tr);
+      $("<td></td>").text(formatDate(c.first) + (c.last && c.last !== c.first ? " - " + formatDate(c.last) : "")).appendTo(tr);
+      $("<td></td>").text(c.images).appendTo(tr);
+      $("<td></td>").text(formatSize(c.size)).appendTo(tr);
+      $("<td></td>").text(formatDate(c.modified)).appendTo(tr);
+      var actions = $("<td></td>").appendTo(tr);
+      $('<button type="button">Publish</button>').click(function() {
+        action(c, "/publish", null, "Publish");
+      }).appendTo(actions);
+      var rendition = $('<select><option value="thumbnail">thumbnails</option><option value="image">images</option></select>');
+      $('<button type="button">Regenerate</button>').click(function() {
+        action(c, "/regenerate", {rendition: rendition.val()}, "Regenerate " + rendition.val() + " of");
+      }).appendTo(actions);
+      actions.append(rendition);
+      $("<a></a>").attr("href", collectionURL(c.name, "/archive") + profileQuery()).text("Export").appendTo(actions);
+      $('<button type="button">Delete</button>').click(function() {
+        if (!window.confirm("Delete the collection " + c.name + " and its files?")) {
+          return;
+        }
+        error.empty();
+        $.ajax(collectionURL(c.name) + profileQuery(), {type: "DELETE"}).done(function() {
+          detail.hide();
+          load();
+        }).fail(fail);
+      }).appendTo(actions);
+      return tr;
+    }
+
+    function load() {
+      $.getJSON(api + "/collections" + profileQuery()).done(function(l) {
+        table.empty();
+        $.each(l, function(i, c) {
+          table.append(row(c));
+        });
+        if (l.length === 0) {
+          table.append($("<tr><td colspan=\"6\">No collection in the publish folder</td></tr>"));
+        }
+      }).fail(fail);
+    }
+
+    $("#collectionsrefresh").click(load);
+    load();
+  });
+})();
+`
 
 return }
@@ -89,7 +89,7 @@ func NewServer(handler http.Handler) *Server {
 	server := &http.Server{Handler: handler}
 	go server.Serve(ts.Listener)
 	if *serve != "" {
-		fmt.Println(os.Stderr, "httptest: serving on", ts.URL)
+		fmt.Fprintln(os.Stderr, "httptest: serving on", ts.URL)
 		select {}
 	}
 	return ts
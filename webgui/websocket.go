@@ -16,33 +16,66 @@ package webgui
 import (
 	"golang.org/x/net/websocket"
 	"github.com/mezzato/goconvert/imageconvert"
+	settings "github.com/mezzato/goconvert/settings"
 	"encoding/json"
+	"fmt"
 	"io"
 	"log"
 	"os"
 )
 
-const msgLimit = 1000 // max number of messages to send per session
+const outboxSize = 1000 // max number of messages queued per client, see imageconvert.Outbox
 
-// Handler implements a WebSocket handler for a client connection.
-var websocketHandler = websocket.Handler(socketHandler)
+// Handler implements a WebSocket handler for a client connection, opened by the pages
+// of the web interface only.
+var websocketHandler = websocket.Server{Handler: socketHandler, Handshake: checkOrigin}
 
 // Environ provides an environment when a binary, such as the go tool, is
 // invoked.
 var Environ func() []string = os.Environ
 
+// socketMessage is the wire format of the websocket of the web interface: a Message,
+// with the jobs for the "job", "jobs" and "list" replies.
+//
+// Besides "run" and "kill" the clients send "jobs" to list the jobs, "list" to list the
+// jobs queued or running, and "job", "cancel" and "retry" with the job id as Body.
+// The output of a job run or retried by a client is sent with the Id of the message which
+// started it, after a "job" reply, and with the number of the event as Seq.
+// The jobs outlive the connection for the grace period of the web settings: a client
+// reconnecting sends "attach" with the job id as Body and the last Seq it has received,
+// the output it has missed is then sent with the Id of the "attach" message.
+type socketMessage struct {
+	imageconvert.Message
+	Seq  int    `json:",omitempty"`
+	Job  *Job   `json:",omitempty"`
+	Jobs []*Job `json:",omitempty"`
+}
+
+// process is a job followed by a connection.
+type process struct {
+	job  string
+	stop chan struct{} // stops following the job
+}
+
 // socketHandler handles the websocket connection for a given present session.
-// It handles transcoding Messages to and from JSON format, and starting
-// and killing processes.
+// It handles transcoding Messages to and from JSON format, and submitting,
+// following and cancelling jobs.
 func socketHandler(c *websocket.Conn) {
-	in, out := make(chan *imageconvert.Message), make(chan *imageconvert.Message)
+	in := make(chan *socketMessage)
 	errc := make(chan error, 1)
+	closed := make(chan struct{}) // the output of the jobs is dropped once closed
+	defer close(closed)
+	// the jobs are never held up by a slow client, their output is queued
+	out := imageconvert.NewOutbox(outboxSize, func(id string, n int) imageconvert.Delivery {
+		return &socketMessage{Message: imageconvert.Message{Id: id, Kind: "stderr", Body: fmt.Sprintf("%d messages have been dropped, the connection is too slow.\n", n)}}
+	})
+	defer out.Close()
 
 	// Decode messages from client and send to the in channel.
 	go func() {
 		dec := json.NewDecoder(c)
 		for {
-			var m imageconvert.Message
+			var m socketMessage
 			if err := dec.Decode(&m); err != nil {
 				errc <- err
 				return
@@ -51,10 +84,14 @@ func socketHandler(c *websocket.Conn) {
 		}
 	}()
 
-	// Receive messages from the out channel and encode to the client.
+	// Receive messages from the outbox and encode to the client.
 	go func() {
 		enc := json.NewEncoder(c)
-		for m := range out {
+		for {
+			m, ok := out.Get(closed)
+			if !ok {
+				return
+			}
 			if err := enc.Encode(m); err != nil {
 				errc <- err
 				return
@@ -62,63 +99,143 @@ func socketHandler(c *websocket.Conn) {
 		}
 	}()
 
-	in, out = make(chan *imageconvert.Message), make(chan *imageconvert.Message)
-	errc = make(chan error, 1)
+	send := func(r *socketMessage) {
+		out.Put(r)
+	}
+	reply := func(m *socketMessage, j *Job, err error) {
+		r := &socketMessage{Message: imageconvert.Message{Id: m.Id, Kind: "job"}, Job: j}
+		if err != nil {
+			r.Body, r.Fields = err.Error(), settings.FieldErrors(err)
+		}
+		send(r)
+	}
+
+	// follow attaches the connection to a job and sends its events numbered after seq
+	// with the message id until the job ends.
+	proc := make(map[string]*process) // the job of each message id
+	unfollow := func(id string) {
+		if p, ok := proc[id]; ok {
+			close(p.stop)
+			jobs.Detach(p.job)
+			delete(proc, id)
+		}
+	}
+	follow := func(id, job string, seq int) error {
+		if err := jobs.Attach(job); err != nil {
+			return err
+		}
+		unfollow(id)
+		p := &process{job: job, stop: make(chan struct{})}
+		proc[id] = p
+		go func() {
+			var last string // the kind of the last event sent, or received before an attach
+			if l, _ := jobs.Events(job, seq-1); len(l) > 0 && l[0].Seq == seq {
+				last = l[0].Kind
+			}
+			for {
+				l, ended, changed, err := jobs.Follow(job, seq)
+				if err != nil {
+					return
+				}
+				for _, e := range l {
+					select {
+					case <-p.stop:
+						return
+					default:
+					}
+					send(&socketMessage{Message: imageconvert.Message{Id: id, Kind: e.Kind, Body: e.Body, Progress: e.Progress}, Seq: e.Seq})
+					seq, last = e.Seq, e.Kind
+				}
+				if ended {
+					// a job cancelled in the queue or interrupted by a restart has no "end" event
+					if j, err := jobs.Get(job); err == nil && last != "end" {
+						send(&socketMessage{Message: imageconvert.Message{Id: id, Kind: "end", Body: j.Error}})
+					}
+					return
+				}
+				if changed != nil {
+					select {
+					case <-changed:
+					case <-p.stop:
+						return
+					case <-closed:
+						return
+					}
+				}
+			}
+		}()
+		return nil
+	}
 
-	// Start and kill processes and handle errors.
-	proc := make(map[string]*imageconvert.Process)
+	// Submit, follow and cancel the jobs and handle errors.
 	for {
 		select {
 		case m := <-in:
 			switch m.Kind {
 			case "run":
-				proc[m.Id].Kill()
-				lOut := limiter(in, out)
-				p, _, e := imageconvert.CreateAndStartProcess(m.Id, m.Body, lOut, m.Options)
-				if e != nil {
+				if p, ok := proc[m.Id]; ok {
+					go jobs.Cancel(p.job)
+				}
+				var s *settings.Settings
+				var noUpload bool
+				if m.Options != nil {
+					s, noUpload = m.Options.Settings, m.Options.NoUpload
+				}
+				j, err := jobs.Submit(s, noUpload, nil)
+				if err != nil {
+					// the client highlights the invalid fields
+					send(&socketMessage{Message: imageconvert.Message{Id: m.Id, Kind: "end", Body: err.Error(), Fields: settings.FieldErrors(err)}})
 					break
 				}
-				proc[m.Id] = p
-
-				go p.Wait()
-
+				reply(m, j, nil)
+				follow(m.Id, j.Id, 0)
 			case "kill":
-				proc[m.Id].Kill()
+				if p, ok := proc[m.Id]; ok {
+					go jobs.Cancel(p.job)
+				}
+			case "attach":
+				j, err := jobs.Get(m.Body)
+				reply(m, j, err)
+				if err == nil {
+					follow(m.Id, j.Id, m.Seq)
+				}
+			case "list":
+				l := []*Job{}
+				for _, j := range jobs.List() {
+					if !j.ended() {
+						l = append(l, j)
+					}
+				}
+				send(&socketMessage{Message: imageconvert.Message{Id: m.Id, Kind: "list"}, Jobs: l})
+			case "jobs":
+				send(&socketMessage{Message: imageconvert.Message{Id: m.Id, Kind: "jobs"}, Jobs: jobs.List()})
+			case "job":
+				j, err := jobs.Get(m.Body)
+				reply(m, j, err)
+			case "cancel":
+				go func(m *socketMessage) {
+					err := jobs.Cancel(m.Body)
+					j, _ := jobs.Get(m.Body)
+					reply(m, j, err)
+				}(m)
+			case "retry":
+				j, err := jobs.Retry(m.Body, nil)
+				reply(m, j, err)
+				if err == nil {
+					follow(m.Id, j.Id, j.seq)
+				}
 			}
 		case err := <-errc:
 			if err != io.EOF {
 				// A encode or decode has failed; bail.
 				log.Println(err)
 			}
-			// Shut down any running processes.
-			for _, p := range proc {
-				p.Kill()
+			// Leave the jobs of the connection, they are cancelled if no client
+			// attaches to them within the grace period.
+			for id := range proc {
+				unfollow(id)
 			}
 			return
 		}
 	}
 }
-
-// limiter returns a channel that wraps dest. Messages sent to the channel are
-// sent to dest. After msgLimit Messages have been passed on, a "kill" imageconvert.Message
-// is sent to the kill channel, and only "end" messages are passed.
-func limiter(kill chan<- *imageconvert.Message, dest chan<- *imageconvert.Message) chan<- *imageconvert.Message {
-	ch := make(chan *imageconvert.Message)
-	go func() {
-		n := 0
-		for m := range ch {
-			switch {
-			case n < msgLimit || m.Kind == "end":
-				dest <- m
-				if m.Kind == "end" {
-					return
-				}
-			case n == msgLimit:
-				// process produced too much output. Kill it.
-				kill <- &imageconvert.Message{Id: m.Id, Kind: "kill"}
-			}
-			n++
-		}
-	}()
-	return ch
-}